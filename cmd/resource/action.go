@@ -1,63 +1,125 @@
 package resource
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"os"
 	"time"
 
 	"github.com/aws-cloudformation/cloudformation-cli-go-plugin/cfn/handler"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/lambda"
 	"helm.sh/helm/v3/pkg/release"
 )
 
 type Stage string
 
 const (
-	InitStage        Stage = "Init"
-	ReleaseStabilize Stage = "ReleaseStabilize"
-	UninstallRelease Stage = "UninstallRelease"
-	LambdaStabilize  Stage = "LambdaStabilize"
-	CompleteStage    Stage = "Complete"
-	NoStage          Stage = "NoStage"
+	InitStage          Stage = "Init"
+	ReleaseStabilize   Stage = "ReleaseStabilize"
+	UninstallRelease   Stage = "UninstallRelease"
+	LambdaStabilize    Stage = "LambdaStabilize"
+	CompleteStage      Stage = "Complete"
+	NoStage            Stage = "NoStage"
+	UninstallStabilize Stage = "UninstallStabilize"
 )
 
 const (
 	retryCount = 3
+	// warmUpAttempts bounds the pings of a new connector within one invocation.
+	warmUpAttempts = 10
+	// warmUpWindow is how long after a create or update the connector is pinged before it's used.
+	warmUpWindow = 15 * time.Minute
 )
 
-func initialize(session *session.Session, currentModel *Model, action Action) handler.ProgressEvent {
+func initialize(session *session.Session, currentModel *Model, action Action, logicalID string, stackID string) handler.ProgressEvent {
 	vpc := false
 	var err error
-	client, err := NewClients(currentModel.ClusterID, currentModel.KubeConfig, currentModel.Namespace, session, currentModel.RoleArn, nil, currentModel.VPCConfiguration)
+	ctx, closeTrace := beginTrace(string(action))
+	defer closeTrace(nil)
+	ctx, cancel := withDeadline(ctx, currentModel.TimeOut)
+	defer cancel()
+	e := &Event{}
+	e.Inputs = new(Inputs)
+	e.Inputs.Config = new(Config)
+	e.Action = action
+	e.Model = currentModel
+	e.Inputs.ChartDetails, err = getChartDetails(currentModel)
 	if err != nil {
 		return makeEvent(currentModel, NoStage, err)
 	}
+	e.Inputs.Config.Name = getReleaseName(currentModel.Name, e.Inputs.ChartDetails.ChartName, stackID, logicalID)
+	currentModel.Name = e.Inputs.Config.Name
+	e.Inputs.Config.Namespace = getReleaseNameSpace(currentModel.Namespace)
+	e.Inputs.Config.KubeVersion = currentModel.KubeVersion
+	e.Inputs.Config.APIVersions = currentModel.ApiVersions
+	e.Inputs.Config.ValueFiles = currentModel.ValueFiles
+	e.Inputs.Config.MaxHistory = currentModel.MaxHistory
+	e.Inputs.Config.DisableOpenAPIValidation = aws.BoolValue(currentModel.DisableOpenAPIValidation)
+	e.Inputs.Config.DisableHooks = aws.BoolValue(currentModel.DisableHooks)
+	e.Inputs.Config.KeepHistory = aws.BoolValue(currentModel.KeepHistory)
+	e.Inputs.Config.UninstallTimeOut = currentModel.UninstallTimeOut
+	e.Inputs.Config.UninstallWait = aws.BoolValue(currentModel.UninstallWait)
+	e.Inputs.Config.UninstallDescription = currentModel.UninstallDescription
+	e.Inputs.Config.TakeOwnership = aws.BoolValue(currentModel.TakeOwnership)
+	e.Inputs.Config.DeleteNamespaceOnUninstall = aws.BoolValue(currentModel.DeleteNamespaceOnUninstall)
+	e.Inputs.Config.ValueFromConfigMap = currentModel.ValueFromConfigMap
+	e.Inputs.Config.ValueFromSecret = currentModel.ValueFromSecret
+	e.Inputs.Config.ReleaseLabels = currentModel.ReleaseLabels
+	e.Inputs.Config.DeletePreInstallManifests = aws.BoolValue(currentModel.DeletePreInstallManifests)
+	e.Inputs.Config.Repositories = currentModel.Repositories
+	e.Inputs.Config.CommonLabels = currentModel.CommonLabels
+	e.Inputs.Config.CommonAnnotations = commonAnnotations(currentModel.CommonAnnotations, stackID, logicalID)
+	e.Inputs.Config.ChartCache = aws.StringValue(currentModel.ChartCache)
+	e.Inputs.Config.ChartCacheTTL = aws.IntValue(currentModel.ChartCacheTTL)
+	if action == InstallReleaseAction {
+		if err := validateReleaseName(*e.Inputs.Config.Name); err != nil {
+			return makeEvent(currentModel, NoStage, err)
+		}
+	}
+	var client *Clients
+	err = trace(ctx, "KubeConfig", func() (err error) {
+		client, err = NewClients(currentModel.ClusterID, currentModel.KubeConfig, currentModel.Namespace, session, clusterRegion(currentModel), currentModel.RoleArn, nil, currentModel.VPCConfiguration, currentModel.KubeContext, aws.BoolValue(currentModel.InsecureSkipTLSVerify))
+		if err != nil {
+			return err
+		}
+		return client.UseStorageNamespace(currentModel.StorageNamespace)
+	})
+	if err != nil {
+		return makeEvent(currentModel, NoStage, err)
+	}
+	client.ctx = ctx
+	vpcDetected := false
 	if IsZero(currentModel.VPCConfiguration) && currentModel.ClusterID != nil {
-		currentModel.VPCConfiguration, err = getVpcConfig(client.AWSClients.EKSClient(nil, nil), client.AWSClients.EC2Client(nil, nil), currentModel)
+		err = trace(ctx, "VPCDetection", func() (err error) {
+			currentModel.VPCConfiguration, err = client.vpcConfig(currentModel)
+			return err
+		})
 		if err != nil {
 			return makeEvent(currentModel, NoStage, err)
 		}
 		// generate lambda resource when auto detected vpc configs
 		if !IsZero(currentModel.VPCConfiguration) {
+			vpcDetected = true
 			client.LambdaResource = newLambdaResource(client.AWSClients.STSClient(nil, nil), currentModel.ClusterID, currentModel.KubeConfig, currentModel.VPCConfiguration)
 		}
 	}
-	e := &Event{}
-	e.Inputs = new(Inputs)
-	e.Inputs.Config = new(Config)
-	e.Action = action
-	e.Model = currentModel
-	e.Inputs.ChartDetails, err = getChartDetails(currentModel)
-	if err != nil {
-		return makeEvent(currentModel, NoStage, err)
+	// Clusters behind a VPC are checked by the connector.
+	if IsZero(currentModel.VPCConfiguration) {
+		if err := trace(ctx, "ClusterAccess", client.CheckClusterAccess); err != nil {
+			return makeEvent(currentModel, NoStage, err)
+		}
 	}
-	e.Inputs.Config.Name = getReleaseName(currentModel.Name, e.Inputs.ChartDetails.ChartName)
-	currentModel.Name = e.Inputs.Config.Name
-	e.Inputs.Config.Namespace = getReleaseNameSpace(currentModel.Namespace)
 	if currentModel.ID == nil {
-		currentModel.ID, err = generateID(currentModel, *e.Inputs.Config.Name, aws.StringValue(session.Config.Region), *e.Inputs.Config.Namespace)
+		region := aws.StringValue(session.Config.Region)
+		if currentModel.ClusterRegion != nil {
+			region = *currentModel.ClusterRegion
+		}
+		currentModel.ID, err = generateID(currentModel, *e.Inputs.Config.Name, region, *e.Inputs.Config.Namespace, vpcDetected)
 		if err != nil {
 			return makeEvent(currentModel, NoStage, err)
 		}
@@ -65,11 +127,21 @@ func initialize(session *session.Session, currentModel *Model, action Action) ha
 	}
 	if !IsZero(currentModel.VPCConfiguration) {
 		vpc = true
+		client.LambdaResource.useConnector(currentModel.ConnectorFunctionArn)
+		client.LambdaResource.useRole(currentModel.ConnectorRoleArn)
+		setConnectorOutputs(currentModel, client.LambdaResource)
 		e.Kubeconfig, err = getLocalKubeConfig()
 		if err != nil {
 			return makeEvent(currentModel, NoStage, err)
 		}
-		u, err := client.initializeLambda(client.LambdaResource)
+		client.LambdaResource.tags = connectorTags(currentModel, stackID)
+		client.LambdaResource.environment = connectorEnvironment(currentModel)
+		client.LambdaResource.kmsKeyArn = currentModel.ConnectorKMSKeyArn
+		var u bool
+		err = trace(ctx, "LambdaInit", func() (err error) {
+			u, err = client.initializeLambda(client.LambdaResource)
+			return err
+		})
 		if err != nil {
 			return makeEvent(currentModel, NoStage, err)
 		}
@@ -83,14 +155,35 @@ func initialize(session *session.Session, currentModel *Model, action Action) ha
 		if err != nil {
 			return makeEvent(currentModel, NoStage, err)
 		}
+		e.Inputs.Config.PullSecretName, e.Inputs.Config.PullSecretConfig, err = client.pullSecretConfig(currentModel.PullSecret)
+		if err != nil {
+			return makeEvent(currentModel, NoStage, err)
+		}
+		e.Inputs.Config.PreInstallManifests, err = client.readManifests("PreInstallManifests", currentModel.PreInstallManifests)
+		if err != nil {
+			return makeEvent(currentModel, NoStage, err)
+		}
+		e.Inputs.Config.NamespaceManifests, err = client.readManifests("NamespaceManifests", namespaceManifests(currentModel))
+		if err != nil {
+			return makeEvent(currentModel, NoStage, err)
+		}
 		data, err := DecodeID(currentModel.ID)
 		if err != nil {
 			return makeEvent(currentModel, NoStage, err)
 		}
 		currentModel.Name = data.Name
 		e.Model = currentModel
-		err = client.helmInstallWrapper(e, client.LambdaResource.functionName, vpc)
-		if err != nil {
+		if ev, ok := checkOperationBudget(ctx, currentModel); !ok {
+			return ev
+		}
+		err = trace(ctx, "HelmInstall", func() error {
+			return client.helmInstallWrapper(e, client.LambdaResource.functionName, vpc)
+		})
+		if ev, ok := namespaceTerminating(currentModel, err); ok {
+			return ev
+		}
+		// An install still running is left to the release status check, which waits on pending releases.
+		if err != nil && !isInFlight(err) {
 			return makeEvent(currentModel, NoStage, err)
 		}
 		return makeEvent(currentModel, ReleaseStabilize, nil)
@@ -99,14 +192,42 @@ func initialize(session *session.Session, currentModel *Model, action Action) ha
 		if err != nil {
 			return makeEvent(currentModel, NoStage, err)
 		}
-		data, err := DecodeID(currentModel.ID)
+		e.Inputs.Config.PullSecretName, e.Inputs.Config.PullSecretConfig, err = client.pullSecretConfig(currentModel.PullSecret)
 		if err != nil {
 			return makeEvent(currentModel, NoStage, err)
 		}
-		err = client.helmUpgradeWrapper(data.Name, e, client.LambdaResource.functionName, vpc)
+		e.Inputs.Config.PreInstallManifests, err = client.readManifests("PreInstallManifests", currentModel.PreInstallManifests)
 		if err != nil {
 			return makeEvent(currentModel, NoStage, err)
 		}
+		e.Inputs.Config.NamespaceManifests, err = client.readManifests("NamespaceManifests", namespaceManifests(currentModel))
+		if err != nil {
+			return makeEvent(currentModel, NoStage, err)
+		}
+		data, err := DecodeID(currentModel.ID)
+		if err != nil {
+			return makeEvent(currentModel, NoStage, err)
+		}
+		if ev, ok := checkOperationBudget(ctx, currentModel); !ok {
+			return ev
+		}
+		err = trace(ctx, "HelmUpgrade", func() error {
+			return client.helmUpgradeWrapper(data.Name, e, client.LambdaResource.functionName, vpc)
+		})
+		if isReleaseNotFound(err) && aws.BoolValue(currentModel.InstallIfMissing) {
+			log.Printf("Release %s not found, installing it", *data.Name)
+			e.Action = InstallReleaseAction
+			e.Inputs.Config.Name = data.Name
+			err = trace(ctx, "HelmInstall", func() error {
+				return client.helmInstallWrapper(e, client.LambdaResource.functionName, vpc)
+			})
+		}
+		if ev, ok := namespaceTerminating(currentModel, err); ok {
+			return ev
+		}
+		if err != nil && !isInFlight(err) {
+			return makeEvent(currentModel, NoStage, err)
+		}
 		currentModel.Name = data.Name
 		return makeEvent(currentModel, ReleaseStabilize, nil)
 	case UninstallReleaseAction:
@@ -114,7 +235,23 @@ func initialize(session *session.Session, currentModel *Model, action Action) ha
 		if err != nil {
 			return makeEvent(currentModel, NoStage, err)
 		}
-		err = client.helmDeleteWrapper(data.Name, e, client.LambdaResource.functionName, vpc)
+		if e.Inputs.Config.DeletePreInstallManifests {
+			e.Inputs.Config.PreInstallManifests, err = client.readManifests("PreInstallManifests", currentModel.PreInstallManifests)
+			if err != nil {
+				return makeEvent(currentModel, NoStage, err)
+			}
+		}
+		// Pre-delete hooks cut off part way would leave the release half uninstalled.
+		if invocationShort(ctx) {
+			log.Printf("Too little time left in this invocation, uninstalling in the next one")
+			return makeEvent(currentModel, UninstallRelease, nil)
+		}
+		if e.Inputs.Config.UninstallWait {
+			return client.uninstallWithWait(ctx, currentModel, data.Name, e, vpc)
+		}
+		err = trace(ctx, "HelmUninstall", func() error {
+			return client.helmDeleteWrapper(data.Name, e, client.LambdaResource.functionName, vpc)
+		})
 		if err != nil {
 			return makeEvent(currentModel, NoStage, err)
 		}
@@ -123,15 +260,55 @@ func initialize(session *session.Session, currentModel *Model, action Action) ha
 	return makeEvent(currentModel, NoStage, fmt.Errorf("unhandled stage %s", action))
 }
 
+// checkOperationBudget returns the event to end the invocation with when there's too little time left to start an
+// install or upgrade.
+func checkOperationBudget(ctx context.Context, currentModel *Model) (handler.ProgressEvent, bool) {
+	retry, err := operationBudget(ctx, os.Getenv("StartTime"), currentModel.TimeOut)
+	if err != nil {
+		return makeEvent(currentModel, NoStage, err), false
+	}
+	if retry {
+		log.Printf("Too little time left in this invocation, starting the operation in the next one")
+		return makeEvent(currentModel, InitStage, nil), false
+	}
+	return handler.ProgressEvent{}, true
+}
+
+// namespaceTerminating reports an install held up by its namespace still terminating, returning the event to try it
+// again on the next callback. makeEvent fails it once the TimeOut is up.
+func namespaceTerminating(currentModel *Model, err error) (handler.ProgressEvent, bool) {
+	if errorReason(err) != NamespaceTerminating {
+		return handler.ProgressEvent{}, false
+	}
+	log.Printf("%s, installing on the next callback", err.Error())
+	pushLastKnownError(err.Error())
+	return makeEvent(currentModel, InitStage, nil), true
+}
+
 func checkReleaseStatus(session *session.Session, currentModel *Model, successStage Stage) handler.ProgressEvent {
 	vpc := false
 	var err error
-	client, err := NewClients(currentModel.ClusterID, currentModel.KubeConfig, currentModel.Namespace, session, currentModel.RoleArn, nil, currentModel.VPCConfiguration)
+	ctx, closeTrace := beginTrace(string(CheckReleaseAction))
+	defer closeTrace(nil)
+	ctx, cancel := withDeadline(ctx, currentModel.TimeOut)
+	defer cancel()
+	var client *Clients
+	err = trace(ctx, "KubeConfig", func() (err error) {
+		client, err = NewClients(currentModel.ClusterID, currentModel.KubeConfig, currentModel.Namespace, session, clusterRegion(currentModel), currentModel.RoleArn, nil, currentModel.VPCConfiguration, currentModel.KubeContext, aws.BoolValue(currentModel.InsecureSkipTLSVerify))
+		if err != nil {
+			return err
+		}
+		return client.UseStorageNamespace(currentModel.StorageNamespace)
+	})
 	if err != nil {
 		return makeEvent(currentModel, NoStage, err)
 	}
+	client.ctx = ctx
 	if IsZero(currentModel.VPCConfiguration) && currentModel.ClusterID != nil {
-		currentModel.VPCConfiguration, err = getVpcConfig(client.AWSClients.EKSClient(nil, nil), client.AWSClients.EC2Client(nil, nil), currentModel)
+		err = trace(ctx, "VPCDetection", func() (err error) {
+			currentModel.VPCConfiguration, err = client.vpcConfig(currentModel)
+			return err
+		})
 		if err != nil {
 			return makeEvent(currentModel, NoStage, err)
 		}
@@ -140,11 +317,18 @@ func checkReleaseStatus(session *session.Session, currentModel *Model, successSt
 	e.Model = currentModel
 	if !IsZero(currentModel.VPCConfiguration) {
 		vpc = true
+		client.LambdaResource.useConnector(currentModel.ConnectorFunctionArn)
+		client.LambdaResource.useRole(currentModel.ConnectorRoleArn)
+		setConnectorOutputs(currentModel, client.LambdaResource)
 		e.Kubeconfig, err = getLocalKubeConfig()
 		if err != nil {
 			return makeEvent(currentModel, NoStage, err)
 		}
-		u, err := client.initializeLambda(client.LambdaResource)
+		var u bool
+		err = trace(ctx, "LambdaInit", func() (err error) {
+			u, err = client.initializeLambda(client.LambdaResource)
+			return err
+		})
 		if err != nil {
 			return makeEvent(currentModel, NoStage, err)
 		}
@@ -153,45 +337,149 @@ func checkReleaseStatus(session *session.Session, currentModel *Model, successSt
 		}
 	}
 	e.Action = CheckReleaseAction
-	s, err := client.helmStatusWrapper(currentModel.Name, e, client.LambdaResource.functionName, vpc)
+	var s *HelmStatusData
+	err = trace(ctx, "HelmStatus", func() (err error) {
+		s, err = client.helmStatusWrapper(currentModel.Name, e, client.LambdaResource.functionName, vpc)
+		return err
+	})
 	if err != nil {
 		return makeEvent(currentModel, NoStage, err)
 	}
 	switch s.Status {
 	case release.StatusDeployed:
 		e.ReleaseData = &ReleaseData{
-			Name:      *currentModel.Name,
-			Namespace: s.Namespace,
-			Chart:     s.Chart,
-			Manifest:  s.Manifest,
+			Name:                *currentModel.Name,
+			Namespace:           s.Namespace,
+			Chart:               s.Chart,
+			Manifest:            s.Manifest,
+			FailFast:            aws.BoolValue(currentModel.FailFast),
+			ReadinessProbe:      aws.StringValue(currentModel.ReadinessProbe),
+			StartTime:           os.Getenv("StartTime"),
+			ReadinessTimeOuts:   currentModel.ReadinessTimeOuts,
+			ReadinessConditions: currentModel.ReadinessConditions,
 		}
 		e.Action = GetPendingAction
-		pending, err := client.kubePendingWrapper(e, client.LambdaResource.functionName, vpc)
+		var pending bool
+		err = trace(ctx, "PendingCheck", func() (err error) {
+			pending, err = client.kubePendingWrapper(e, client.LambdaResource.functionName, vpc)
+			return err
+		})
 		if err != nil {
-			return makeEvent(currentModel, NoStage, err)
+			return makeEvent(currentModel, NoStage, client.withDiagnostics(e, *currentModel.Name, s, vpc, err))
 		}
 		if pending {
 			log.Printf("Release %s have pending resources", e.ReleaseData.Name)
 			return makeEvent(currentModel, ReleaseStabilize, nil)
 		}
 		log.Printf("Release %s have no pending resources.", e.ReleaseData.Name)
+		currentModel.ChartChecksum = aws.String(s.ChartChecksum)
+		// Record the version helm resolved, the latest one when Version wasn't set.
+		if s.ChartVersion != "" {
+			currentModel.Version = aws.String(s.ChartVersion)
+		}
+		err = setClusterOutputs(client.AWSClients.EKSClient(client.region, nil), currentModel)
+		if err != nil {
+			return makeEvent(currentModel, NoStage, err)
+		}
 		return makeEvent(currentModel, successStage, nil)
 	case release.StatusPendingInstall, release.StatusPendingUpgrade:
+		if pendingTooLong(s.LastDeployed) {
+			e.Action = UnlockReleaseAction
+			err = trace(ctx, "HelmUnlock", func() error {
+				return client.helmUnlockWrapper(currentModel.Name, e, client.LambdaResource.functionName, vpc)
+			})
+			// A release locked by an operation of the provider is still being worked on.
+			if errorReason(err) == Conflict {
+				pushLastKnownError(err.Error())
+				return makeEvent(currentModel, ReleaseStabilize, nil)
+			}
+			if err != nil {
+				return makeEvent(currentModel, NoStage, err)
+			}
+			return makeEvent(currentModel, NoStage, fmt.Errorf("release %s/%s was in %s state for over %v with no helm operation running, it's been marked failed so the operation can be retried", s.Namespace, *currentModel.Name, s.Status, pendingReleaseTimeOut))
+		}
 		pushLastKnownError(fmt.Sprintf("Release %s/%s in %s state", s.Namespace, *currentModel.Name, s.Status))
 		return makeEvent(currentModel, ReleaseStabilize, nil)
 	default:
 		pushLastKnownError(fmt.Sprintf("Release %s/%s in %s state", s.Namespace, *currentModel.Name, s.Status))
-		return makeEvent(currentModel, NoStage, errors.New("release failed"))
+		return makeEvent(currentModel, NoStage, client.withDiagnostics(e, *currentModel.Name, s, vpc, withReason(ReleaseFailed, errors.New("release failed"))))
 
 	}
 }
 
+// uninstallWithWait spreads UninstallWait over invocations: the first uninstalls keeping the release record, later ones
+// check the resources in its manifest are gone, then the record is purged unless KeepHistory is set.
+func (c *Clients) uninstallWithWait(ctx context.Context, currentModel *Model, name *string, e *Event, vpc bool) handler.ProgressEvent {
+	e.Action = CheckReleaseAction
+	var s *HelmStatusData
+	err := trace(ctx, "HelmStatus", func() (err error) {
+		s, err = c.helmStatusWrapper(name, e, c.LambdaResource.functionName, vpc)
+		return err
+	})
+	if err != nil && !isReleaseNotFound(err) {
+		return makeEvent(currentModel, NoStage, err)
+	}
+	if err == nil && s.Status != release.StatusUninstalled {
+		e.Action = UninstallReleaseAction
+		err = trace(ctx, "HelmUninstall", func() error {
+			return c.helmDeleteWrapper(name, e, c.LambdaResource.functionName, vpc)
+		})
+		if err != nil {
+			return makeEvent(currentModel, NoStage, err)
+		}
+		return makeEvent(currentModel, UninstallStabilize, nil)
+	}
+	if err == nil {
+		e.ReleaseData = &ReleaseData{
+			Name:      *name,
+			Namespace: s.Namespace,
+			Chart:     s.Chart,
+			Manifest:  s.Manifest,
+		}
+		e.Action = CheckDeletedAction
+		var pending bool
+		err = trace(ctx, "DeletionCheck", func() (err error) {
+			pending, err = c.kubeDeletedWrapper(e, c.LambdaResource.functionName, vpc)
+			return err
+		})
+		if err != nil {
+			return makeEvent(currentModel, NoStage, err)
+		}
+		if pending {
+			timeOut := aws.Int(defaultUninstallTime)
+			if currentModel.UninstallTimeOut != nil {
+				timeOut = currentModel.UninstallTimeOut
+			}
+			if checkTimeOut(os.Getenv("StartTime"), timeOut) {
+				return makeEvent(currentModel, NoStage, withReason(TimedOut, fmt.Errorf("resources of release %s/%s not deleted within %d minutes", s.Namespace, *name, *timeOut)))
+			}
+			return makeEvent(currentModel, UninstallStabilize, nil)
+		}
+	}
+	log.Printf("Release %s resources deleted", *name)
+	e.Action = UninstallReleaseAction
+	e.Inputs.Config.UninstallWait = false
+	err = trace(ctx, "HelmUninstall", func() error {
+		return c.helmDeleteWrapper(name, e, c.LambdaResource.functionName, vpc)
+	})
+	if err != nil {
+		return makeEvent(currentModel, NoStage, err)
+	}
+	return c.lambdaDestroy(currentModel)
+}
+
 func (c *Clients) lambdaDestroy(currentModel *Model) handler.ProgressEvent {
-	if IsZero(currentModel.VPCConfiguration) {
+	// Externally managed connectors are left to their owners.
+	if IsZero(currentModel.VPCConfiguration) || currentModel.ConnectorFunctionArn != nil {
 		return makeEvent(currentModel, CompleteStage, nil)
 	}
+	// The connector is shared by releases in the same VPC, and only deleted with the last one using it.
+	var tag string
+	if currentModel.ID != nil {
+		tag = releaseTag(currentModel)
+	}
 	l := newLambdaResource(nil, currentModel.ClusterID, currentModel.KubeConfig, currentModel.VPCConfiguration)
-	err := deleteFunction(c.AWSClients.LambdaClient(nil, nil), l.functionName)
+	err := releaseConnector(c.AWSClients.LambdaClient(c.region, nil), l.functionName, tag)
 	if err != nil {
 		return makeEvent(currentModel, NoStage, err)
 	}
@@ -199,25 +487,40 @@ func (c *Clients) lambdaDestroy(currentModel *Model) handler.ProgressEvent {
 }
 
 func (c *Clients) initializeLambda(l *lambdaResource) (bool, error) {
-	state, err := checklambdaState(c.AWSClients.LambdaClient(nil, nil), l.functionName)
+	state, err := checklambdaState(c.AWSClients.LambdaClient(c.region, nil), l.functionName)
 	if err != nil {
 		return false, err
 	}
+	if l.external {
+		switch state {
+		case StateActive:
+			return true, nil
+		case StatePending:
+			return false, nil
+		default:
+			return false, withReason(ConnectorFailure, fmt.Errorf("VPC connector %s not in desired state: %s", *l.functionName, state))
+		}
+	}
 	switch state {
 	case StateNotFound:
 		log.Printf("VPC connector %s not found", *l.functionName)
-		err := createFunction(c.AWSClients.LambdaClient(nil, nil), l)
+		if l.customRole {
+			if err := validateConnectorRole(c.AWSClients.IAMClient(nil, nil), l.roleArn); err != nil {
+				return false, err
+			}
+		}
+		err := createFunction(c.AWSClients.LambdaClient(c.region, nil), l)
 		if err != nil {
 			return false, err
 		}
 		count := 0
 		for count < retryCount {
-			state, err = checklambdaState(c.AWSClients.LambdaClient(nil, nil), l.functionName)
+			state, err = checklambdaState(c.AWSClients.LambdaClient(c.region, nil), l.functionName)
 			if err != nil {
 				return false, err
 			}
 			if state == StateActive {
-				return true, nil
+				return c.warmUpLambda(l)
 			}
 			time.Sleep(5 * time.Second)
 			count++
@@ -225,24 +528,31 @@ func (c *Clients) initializeLambda(l *lambdaResource) (bool, error) {
 		return false, nil
 	case StateActive:
 		var err error
-		l.functionOutput, err = getFunction(c.AWSClients.LambdaClient(nil, nil), l.functionName)
+		l.functionOutput, err = getFunction(c.AWSClients.LambdaClient(c.region, nil), l.functionName)
 		if err != nil {
 			return false, err
 		}
-		err = updateFunction(c.AWSClients.LambdaClient(nil, nil), l)
-		if err != nil {
+		if err := c.connectorRole(l); err != nil {
 			return false, err
 		}
-		return true, nil
+		ready, err := updateFunction(c.AWSClients.LambdaClient(c.region, nil), l)
+		if err != nil || !ready {
+			return false, err
+		}
+		// Only a connector created or updated recently may still be waiting on its ENI.
+		if !modifiedWithin(l.functionOutput.Configuration, warmUpWindow) {
+			return true, nil
+		}
+		return c.warmUpLambda(l)
 	case StatePending:
 		count := 0
 		for count < retryCount {
-			state, err = checklambdaState(c.AWSClients.LambdaClient(nil, nil), l.functionName)
+			state, err = checklambdaState(c.AWSClients.LambdaClient(c.region, nil), l.functionName)
 			if err != nil {
 				return false, err
 			}
 			if state == StateActive {
-				return true, nil
+				return c.warmUpLambda(l)
 			}
 			time.Sleep(8 * time.Second)
 			count++
@@ -253,28 +563,105 @@ func (c *Clients) initializeLambda(l *lambdaResource) (bool, error) {
 	}
 }
 
+// connectorRole keeps the role of a connector other releases use, so stacks sharing it with different roles don't
+// move it back and forth. A custom role is validated before the connector is moved to it.
+func (c *Clients) connectorRole(l *lambdaResource) error {
+	current := l.functionOutput.Configuration
+	if aws.StringValue(l.roleArn) == aws.StringValue(current.Role) {
+		return nil
+	}
+	if sharedConnector(l.functionOutput.Tags, l.tags) {
+		log.Printf("VPC connector %s is used by other releases, keeping its role %s instead of %s", *l.functionName, aws.StringValue(current.Role), aws.StringValue(l.roleArn))
+		l.roleArn = current.Role
+		return nil
+	}
+	if l.customRole {
+		return validateConnectorRole(c.AWSClients.IAMClient(nil, nil), l.roleArn)
+	}
+	return nil
+}
+
+// warmUpLambda pings the connector until it responds, so a connector that isn't network ready yet, like a new one
+// waiting on its ENI, is told apart from a failed release action. Only errors of a connector not ready yet are
+// retried, the connector failing the ping or the provider not being allowed to invoke it fails at once.
+func (c *Clients) warmUpLambda(l *lambdaResource) (bool, error) {
+	ctx := c.opContext()
+	svc := c.AWSClients.LambdaClient(c.region, nil)
+	payload, err := json.Marshal(&Event{Action: PingAction})
+	if err != nil {
+		return false, err
+	}
+	for attempt := 0; attempt < warmUpAttempts; attempt++ {
+		result, err := svc.InvokeWithContext(ctx, &lambda.InvokeInput{FunctionName: l.functionName, Payload: payload})
+		if err == nil {
+			if _, err := connectorResponse(PingAction, result); err != nil {
+				return false, withReason(ConnectorFailure, fmt.Errorf("VPC connector %s failed to answer a ping, it may predate %s support: %w", *l.functionName, PingAction, err))
+			}
+			log.Printf("VPC connector %s is ready", *l.functionName)
+			return true, nil
+		}
+		if !retryableInvokeError(err) {
+			return false, withReason(ConnectorFailure, fmt.Errorf("VPC connector %s can't be invoked: %s", *l.functionName, AWSError(err)))
+		}
+		log.Printf("VPC connector %s not ready yet: %s", *l.functionName, err)
+		select {
+		case <-ctx.Done():
+			return false, nil
+		case <-time.After(5 * time.Second):
+		}
+	}
+	return false, nil
+}
+
+// vpcConfig returns the VPC configuration recorded in the ID, only detecting it for IDs created before it was recorded.
+// Nothing is returned when detection is disabled, the cluster is then treated as publicly reachable.
+func (c *Clients) vpcConfig(m *Model) (*VPCConfiguration, error) {
+	if aws.BoolValue(m.DisableAutoVPCDetection) {
+		log.Printf("VPC detection disabled, treating cluster %s as public", aws.StringValue(m.ClusterID))
+		return nil, nil
+	}
+	if m.ID != nil {
+		data, err := DecodeID(m.ID)
+		if err != nil {
+			return nil, err
+		}
+		if data.VPCResolved {
+			return data.VPCConfiguration, nil
+		}
+	}
+	return getVpcConfig(c.AWSClients.EKSClient(c.region, nil), c.AWSClients.EC2Client(c.region, nil), m)
+}
+
 func (c *Clients) helmStatusWrapper(name *string, e *Event, functionName *string, vpc bool) (*HelmStatusData, error) {
 	switch vpc {
 	case true:
-		r, err := invokeLambda(c.AWSClients.LambdaClient(nil, nil), functionName, e)
+		r, err := invokeLambda(c.opContext(), c.AWSClients.LambdaClient(c.region, nil), functionName, e)
 		if err != nil {
 			return nil, err
 		}
 		return r.StatusData, err
 
 	default:
-		return c.HelmStatus(*name)
+		var s *HelmStatusData
+		err := runWithContext(c.opContext(), "helm status", func() (err error) {
+			s, err = c.HelmStatus(*name)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
 	}
 }
 
-func (c *Clients) helmListWrapper(e *Event, functionName *string, vpc bool) ([]HelmListData, error) {
+func (c *Clients) helmListWrapper(e *Event, functionName *string, vpc bool) ([]HelmListData, []string, error) {
 	switch vpc {
 	case true:
-		r, err := invokeLambda(c.AWSClients.LambdaClient(nil, nil), functionName, e)
+		r, err := invokeLambda(c.opContext(), c.AWSClients.LambdaClient(c.region, nil), functionName, e)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		return r.ListData, err
+		return r.ListData, r.ListWarnings, err
 	default:
 		return c.HelmList(e.Inputs.Config, e.Inputs.ChartDetails)
 	}
@@ -283,37 +670,76 @@ func (c *Clients) helmListWrapper(e *Event, functionName *string, vpc bool) ([]H
 func (c *Clients) helmInstallWrapper(e *Event, functionName *string, vpc bool) error {
 	switch vpc {
 	case true:
-		_, err := invokeLambda(c.AWSClients.LambdaClient(nil, nil), functionName, e)
+		_, err := invokeLambda(c.opContext(), c.AWSClients.LambdaClient(c.region, nil), functionName, e)
 		return err
 	default:
-		return c.HelmInstall(e.Inputs.Config, e.Inputs.ValueOpts, e.Inputs.ChartDetails, *e.Model.ID)
+		return runWithContext(c.opContext(), "helm install", func() error {
+			return c.HelmInstall(e.Inputs.Config, e.Inputs.ValueOpts, e.Inputs.ChartDetails, *e.Model.ID)
+		})
 	}
 }
 
 func (c *Clients) helmUpgradeWrapper(name *string, e *Event, functionName *string, vpc bool) error {
 	switch vpc {
 	case true:
-		_, err := invokeLambda(c.AWSClients.LambdaClient(nil, nil), functionName, e)
+		_, err := invokeLambda(c.opContext(), c.AWSClients.LambdaClient(c.region, nil), functionName, e)
 		return err
 	default:
-		return c.HelmUpgrade(*name, e.Inputs.Config, e.Inputs.ValueOpts, e.Inputs.ChartDetails)
+		return runWithContext(c.opContext(), "helm upgrade", func() error {
+			return c.HelmUpgrade(*name, e.Inputs.Config, e.Inputs.ValueOpts, e.Inputs.ChartDetails)
+		})
 	}
 }
 
 func (c *Clients) helmDeleteWrapper(name *string, e *Event, functionName *string, vpc bool) error {
 	switch vpc {
 	case true:
-		_, err := invokeLambda(c.AWSClients.LambdaClient(nil, nil), functionName, e)
+		_, err := invokeLambda(c.opContext(), c.AWSClients.LambdaClient(c.region, nil), functionName, e)
 		return err
 	default:
-		return c.HelmUninstall(*name)
+		return runWithContext(c.opContext(), "helm uninstall", func() error {
+			return c.HelmUninstall(*name, e.Inputs.Config)
+		})
+	}
+}
+
+func (c *Clients) helmUnlockWrapper(name *string, e *Event, functionName *string, vpc bool) error {
+	switch vpc {
+	case true:
+		_, err := invokeLambda(c.opContext(), c.AWSClients.LambdaClient(c.region, nil), functionName, e)
+		return err
+	default:
+		return c.HelmUnlock(*name)
+	}
+}
+
+// pendingTooLong reports whether a release last deployed at lastDeployed has been pending beyond pendingReleaseTimeOut.
+func pendingTooLong(lastDeployed string) bool {
+	t, err := time.Parse(time.RFC3339, lastDeployed)
+	if err != nil {
+		return false
+	}
+	return time.Since(t) > pendingReleaseTimeOut
+}
+
+func (c *Clients) kubeDeletedWrapper(e *Event, functionName *string, vpc bool) (bool, error) {
+	switch vpc {
+	case true:
+		r, err := invokeLambda(c.opContext(), c.AWSClients.LambdaClient(c.region, nil), functionName, e)
+		if err != nil {
+			return true, err
+		}
+		LastKnownErrors = r.LastKnownErrors
+		return r.PendingResources, err
+	default:
+		return c.CheckPendingDeletion(e.ReleaseData)
 	}
 }
 
 func (c *Clients) kubePendingWrapper(e *Event, functionName *string, vpc bool) (bool, error) {
 	switch vpc {
 	case true:
-		r, err := invokeLambda(c.AWSClients.LambdaClient(nil, nil), functionName, e)
+		r, err := invokeLambda(c.opContext(), c.AWSClients.LambdaClient(c.region, nil), functionName, e)
 		if err != nil {
 			return true, err
 		}
@@ -324,10 +750,23 @@ func (c *Clients) kubePendingWrapper(e *Event, functionName *string, vpc bool) (
 	}
 }
 
+func (c *Clients) diagnosticsWrapper(e *Event, functionName *string, vpc bool) ([]PodDiagnostics, error) {
+	switch vpc {
+	case true:
+		r, err := invokeLambda(c.opContext(), c.AWSClients.LambdaClient(c.region, nil), functionName, e)
+		if err != nil {
+			return nil, err
+		}
+		return r.Diagnostics, err
+	default:
+		return c.GetDiagnostics(e.ReleaseData)
+	}
+}
+
 func (c *Clients) kubeResourcesWrapper(e *Event, functionName *string, vpc bool) (map[string]interface{}, error) {
 	switch vpc {
 	case true:
-		r, err := invokeLambda(c.AWSClients.LambdaClient(nil, nil), functionName, e)
+		r, err := invokeLambda(c.opContext(), c.AWSClients.LambdaClient(c.region, nil), functionName, e)
 		if err != nil {
 			return nil, err
 		}
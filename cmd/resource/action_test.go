@@ -1,6 +1,7 @@
 package resource
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -8,11 +9,15 @@ import (
 	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/aws-cloudformation/cloudformation-cli-go-plugin/cfn/handler"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/lambda"
 	"github.com/stretchr/testify/assert"
+	"helm.sh/helm/v3/pkg/release"
+	htime "helm.sh/helm/v3/pkg/time"
 )
 
 func TestInitialize(t *testing.T) {
@@ -42,13 +47,13 @@ func TestInitialize(t *testing.T) {
 	}{
 		"InstallWithVPC": {
 			action:    InstallReleaseAction,
-			name:      "Test",
+			name:      "test",
 			vpc:       true,
 			nextStage: ReleaseStabilize,
 		},
 		"InstallWithOutVPC": {
 			action:    InstallReleaseAction,
-			name:      "Test",
+			name:      "test",
 			vpc:       false,
 			nextStage: ReleaseStabilize,
 		},
@@ -84,7 +89,7 @@ func TestInitialize(t *testing.T) {
 		},
 		"PendingLambda": {
 			action:    InstallReleaseAction,
-			name:      "Test",
+			name:      "test",
 			vpc:       true,
 			nextStage: LambdaStabilize,
 		},
@@ -99,17 +104,17 @@ func TestInitialize(t *testing.T) {
 					m.VPCConfiguration = vpcPending
 				}
 			}
-			NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, role *string, customKubeconfig []byte, vpcConfig *VPCConfiguration) (*Clients, error) {
+			NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, region *string, role *string, customKubeconfig []byte, vpcConfig *VPCConfiguration, kubeContext *string, insecure bool) (*Clients, error) {
 				return NewMockClient(t, m), nil
 			}
 			m.Name = aws.String(d.name)
-			m.ID, _ = generateID(m, d.name, "eu-west-1", "default")
+			m.ID, _ = generateID(m, d.name, "eu-west-1", "default", false)
 			if name == "Unknown" {
 				eRes = makeEvent(m, d.nextStage, fmt.Errorf("unhandled stage %s", d.action))
 			} else {
 				eRes = makeEvent(m, d.nextStage, nil)
 			}
-			res := initialize(MockSession, m, d.action)
+			res := initialize(MockSession, m, d.action, "TestHelm", "")
 			assert.EqualValues(t, eRes, res)
 		})
 	}
@@ -174,7 +179,7 @@ func TestCheckReleaseStatus(t *testing.T) {
 	for name, d := range tests {
 		t.Run(name, func(t *testing.T) {
 			m.VPCConfiguration = nil
-			NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, role *string, customKubeconfig []byte, vpcConfig *VPCConfiguration) (*Clients, error) {
+			NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, region *string, role *string, customKubeconfig []byte, vpcConfig *VPCConfiguration, kubeContext *string, insecure bool) (*Clients, error) {
 				return NewMockClient(t, m), nil
 			}
 			if d.vpc {
@@ -190,11 +195,60 @@ func TestCheckReleaseStatus(t *testing.T) {
 			default:
 				eRes = makeEvent(m, d.nextStage, nil)
 			}
+			m.Version = nil
 			res := checkReleaseStatus(MockSession, m, d.nextStage)
 			assert.EqualValues(t, eRes, res)
+			if d.nextStage == CompleteStage {
+				assert.Equal(t, "0.1.0", aws.StringValue(m.Version))
+			}
 		})
 	}
 }
+
+// TestCheckReleaseStatusStuck to test checkReleaseStatus unlocks a release left pending
+func TestCheckReleaseStatusStuck(t *testing.T) {
+	m := &Model{
+		ClusterID: aws.String("eks"),
+		ID:        aws.String("eyJDbHVzdGVySUQiOiJla3MiLCJSZWdpb24iOiJldS13ZXN0LTEiLCJOYW1lIjoiVGVzdCIsIk5hbWVzcGFjZSI6IlRlc3QifQ"),
+		Name:      aws.String("stuck"),
+	}
+	c := NewMockClient(t, m)
+	stuck := namedRelease("stuck", release.StatusPendingInstall)
+	stuck.Namespace = "default"
+	stuck.Info.LastDeployed = htime.Time{Time: time.Now().Add(-time.Hour)}
+	assert.Nil(t, c.HelmClient.Releases.Create(stuck))
+	NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, region *string, role *string, customKubeconfig []byte, vpcConfig *VPCConfiguration, kubeContext *string, insecure bool) (*Clients, error) {
+		return c, nil
+	}
+	res := checkReleaseStatus(MockSession, m, CompleteStage)
+	assert.Equal(t, handler.Failed, res.OperationStatus)
+	assert.Contains(t, res.Message, "release default/stuck was in pending-install state for over 15m0s")
+	rel, err := c.HelmClient.Releases.Last("stuck")
+	assert.Nil(t, err)
+	assert.Equal(t, release.StatusFailed, rel.Info.Status)
+}
+
+// TestUninstallWithWait to test uninstallWithWait
+func TestUninstallWithWait(t *testing.T) {
+	m := &Model{
+		ClusterID: aws.String("eks"),
+		Name:      aws.String("one"),
+	}
+	c := NewMockClient(t, m)
+	e := &Event{Inputs: &Inputs{Config: &Config{UninstallWait: true}}}
+	res := c.uninstallWithWait(context.Background(), m, m.Name, e, false)
+	assert.Equal(t, makeEvent(m, UninstallStabilize, nil), res)
+	rel, err := c.HelmClient.Releases.Last("one")
+	assert.Nil(t, err)
+	assert.Equal(t, release.StatusUninstalled, rel.Info.Status)
+
+	e = &Event{Inputs: &Inputs{Config: &Config{UninstallWait: true}}}
+	res = c.uninstallWithWait(context.Background(), m, m.Name, e, false)
+	assert.Equal(t, makeEvent(m, CompleteStage, nil), res)
+	_, err = c.HelmClient.Releases.Last("one")
+	assert.True(t, isReleaseNotFound(err))
+}
+
 func TestLambdaDestroy(t *testing.T) {
 	m := &Model{
 		ClusterID: aws.String("eks"),
@@ -250,6 +304,228 @@ func TestInitializeLambda(t *testing.T) {
 	}
 }
 
+// TestInitializeLambdaExternal to test initializeLambda only checks the state of an external connector
+func TestInitializeLambdaExternal(t *testing.T) {
+	tests := map[string]struct {
+		name      *string
+		assertion assert.BoolAssertionFunc
+		eErr      string
+	}{
+		"StateActive": {
+			name:      aws.String("function1"),
+			assertion: assert.True,
+		},
+		"StateFailed": {
+			name:      aws.String("function2"),
+			assertion: assert.False,
+			eErr:      "not in desired state: Failed",
+		},
+		"StateNotFound": {
+			name:      aws.String("arn:aws:lambda:us-east-1:1234567890:function:Nofunct"),
+			assertion: assert.False,
+			eErr:      "not in desired state: NotFound",
+		},
+	}
+	c := NewMockClient(t, nil)
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			l := &lambdaResource{}
+			l.useConnector(d.name)
+			result, err := c.initializeLambda(l)
+			if d.eErr != "" {
+				assert.Contains(t, err.Error(), d.eErr)
+			} else {
+				assert.Nil(t, err)
+			}
+			d.assertion(t, result)
+		})
+	}
+}
+
+// TestWarmUpLambda to test warmUpLambda only retries errors of a connector that isn't ready
+func TestWarmUpLambda(t *testing.T) {
+	tests := map[string]struct {
+		name      string
+		assertion assert.BoolAssertionFunc
+		eErr      string
+	}{
+		"Ready":         {name: "function1", assertion: assert.True},
+		"NotReady":      {name: "functionRetry", assertion: assert.False},
+		"FunctionError": {name: "function2", assertion: assert.False, eErr: "failed to answer a ping"},
+		"AccessDenied":  {name: "functionAccessDenied", assertion: assert.False, eErr: "lambda:InvokeFunction"},
+		"Invalid":       {name: "functionNRetry", assertion: assert.False, eErr: "can't be invoked"},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			c := NewMockClient(t, nil).WithContext(ctx)
+			result, err := c.warmUpLambda(&lambdaResource{functionName: aws.String(d.name)})
+			d.assertion(t, result)
+			if d.eErr == "" {
+				assert.Nil(t, err)
+				return
+			}
+			assert.Contains(t, err.Error(), d.eErr)
+			assert.Equal(t, ConnectorFailure, errorReason(err))
+		})
+	}
+}
+
+// TestModifiedWithin to test modifiedWithin
+func TestModifiedWithin(t *testing.T) {
+	tests := map[string]struct {
+		lastModified *string
+		assertion    assert.BoolAssertionFunc
+	}{
+		"Recent":  {lastModified: aws.String(time.Now().Add(-time.Minute).Format(lastModifiedLayout)), assertion: assert.True},
+		"Old":     {lastModified: aws.String(time.Now().Add(-time.Hour).Format(lastModifiedLayout)), assertion: assert.False},
+		"Example": {lastModified: aws.String("2019-10-28T20:26:39.904+0000"), assertion: assert.False},
+		"Unset":   {assertion: assert.False},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			d.assertion(t, modifiedWithin(&lambda.FunctionConfiguration{LastModified: d.lastModified}, warmUpWindow))
+		})
+	}
+}
+
+// TestNamespaceTerminating to test namespaceTerminating
+func TestNamespaceTerminating(t *testing.T) {
+	defer func() { LastKnownErrors = nil }()
+	_ = os.Setenv("StartTime", time.Now().Format(time.RFC3339))
+	defer os.Unsetenv("StartTime")
+	tests := map[string]struct {
+		err      error
+		retry    bool
+		expected handler.Status
+	}{
+		"Terminating": {
+			err:      withReason(NamespaceTerminating, errors.New("namespace test is still terminating")),
+			retry:    true,
+			expected: handler.InProgress,
+		},
+		"Connector": {
+			err:      &connectorError{msg: "namespace test is still terminating", reason: NamespaceTerminating},
+			retry:    true,
+			expected: handler.InProgress,
+		},
+		"OtherError": {
+			err: errors.New("fail"),
+		},
+		"NoError": {},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			ev, retry := namespaceTerminating(&Model{}, d.err)
+			assert.Equal(t, d.retry, retry)
+			assert.EqualValues(t, d.expected, ev.OperationStatus)
+			if retry {
+				assert.Equal(t, InitStage, ev.CallbackContext["Stage"])
+			}
+		})
+	}
+	assert.Contains(t, LastKnownErrors, "namespace test is still terminating")
+}
+
+// TestConnectorRole to test connectorRole keeps the role of a shared connector
+func TestConnectorRole(t *testing.T) {
+	current := "arn:aws:iam::1234567890:role/current"
+	connector := "arn:aws:iam::1234567890:role/connector"
+	own := map[string]string{ReleaseTagPrefix + "own": "stack-1"}
+	tests := map[string]struct {
+		role  string
+		tags  map[string]string
+		other bool
+		eRole string
+		eErr  string
+	}{
+		"Unchanged":   {role: current, tags: own, other: true, eRole: current},
+		"Changed":     {role: connector, tags: own, eRole: connector},
+		"Shared":      {role: connector, tags: own, other: true, eRole: current},
+		"StatusCheck": {role: connector, eRole: current},
+		"Invalid":     {role: "arn:aws:iam::1234567890:role/ec2", tags: own, eErr: "can't be assumed by lambda.amazonaws.com"},
+	}
+	c := NewMockClient(t, nil)
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			config := getFunctionConfig()
+			config.Role = aws.String(current)
+			tags := map[string]*string{ReleaseTagPrefix + "own": aws.String("stack-1")}
+			if d.other {
+				tags[ReleaseTagPrefix+"other"] = aws.String("stack-2")
+			}
+			l := &lambdaResource{
+				functionName:   config.FunctionName,
+				functionOutput: &lambda.GetFunctionOutput{Configuration: config, Tags: tags},
+				tags:           d.tags,
+			}
+			l.useRole(aws.String(d.role))
+			err := c.connectorRole(l)
+			if d.eErr != "" {
+				assert.Contains(t, err.Error(), d.eErr)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, d.eRole, aws.StringValue(l.roleArn))
+		})
+	}
+}
+
+// TestVpcConfig to test vpcConfig uses the configuration recorded in the ID
+func TestVpcConfig(t *testing.T) {
+	vpc := &VPCConfiguration{
+		SecurityGroupIds: []string{"sg-01"},
+		SubnetIds:        []string{"subnet-01"},
+	}
+	c := &Clients{}
+	tests := map[string]struct {
+		vpc     *VPCConfiguration
+		disable bool
+		eVpc    *VPCConfiguration
+	}{
+		"Recorded":    {vpc: vpc, eVpc: vpc},
+		"RecordedNil": {},
+		"Disabled":    {vpc: vpc, disable: true},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			m := &Model{ClusterID: aws.String("eks"), VPCConfiguration: d.vpc}
+			m.ID, _ = generateID(m, "test", "eu-west-1", "default", false)
+			m.VPCConfiguration = nil
+			m.DisableAutoVPCDetection = aws.Bool(d.disable)
+			result, err := c.vpcConfig(m)
+			assert.Nil(t, err)
+			assert.EqualValues(t, d.eVpc, result)
+		})
+	}
+}
+
+type regionAWSClients struct {
+	mockAWSClients
+	regions []string
+}
+
+func (m *regionAWSClients) EKSClient(region *string, role *string) EKSAPI {
+	m.regions = append(m.regions, aws.StringValue(region))
+	return &mockEKSClient{}
+}
+
+func (m *regionAWSClients) EC2Client(region *string, role *string) EC2API {
+	m.regions = append(m.regions, aws.StringValue(region))
+	return &mockEC2Client{}
+}
+
+// TestVpcConfigCrossRegion to test the cluster's region is used for detection
+func TestVpcConfigCrossRegion(t *testing.T) {
+	m := &Model{ClusterID: aws.String("eks"), ClusterRegion: aws.String("eu-west-1")}
+	clients := &regionAWSClients{}
+	c := &Clients{AWSClients: clients, region: clusterRegion(m)}
+	_, err := c.vpcConfig(m)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"eu-west-1", "eu-west-1"}, clients.regions)
+}
+
 func TestHelmStatusWrapper(t *testing.T) {
 	c := NewMockClient(t, nil)
 	event := &Event{
@@ -293,13 +569,12 @@ func TestHelmListWrapper(t *testing.T) {
 			testName = "WithVPC"
 		}
 		t.Run(testName, func(t *testing.T) {
-			_, err := c.helmListWrapper(event, functionName, d)
+			_, _, err := c.helmListWrapper(event, functionName, d)
 			assert.Nil(t, err)
 		})
 	}
 }
 func TestHelmInstallWrapper(t *testing.T) {
-	defer os.Remove(chartLocalPath)
 	testServer := httptest.NewServer(http.StripPrefix("/", http.FileServer(http.Dir(TestFolder))))
 	defer func() { testServer.Close() }()
 	c := NewMockClient(t, nil)
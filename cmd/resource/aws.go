@@ -5,17 +5,25 @@ import (
 	"encoding/base64"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
 	"github.com/aws/aws-sdk-go/service/eks"
 	"github.com/aws/aws-sdk-go/service/eks/eksiface"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
 	"github.com/aws/aws-sdk-go/service/lambda"
 	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -23,6 +31,8 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/aws/aws-sdk-go/service/secretsmanager"
 	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
 	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/aws/aws-sdk-go/service/sts/stsiface"
 	"sigs.k8s.io/aws-iam-authenticator/pkg/token"
@@ -30,6 +40,8 @@ import (
 
 type clusterData struct {
 	endpoint           string
+	arn                string
+	oidcIssuer         string
 	CAData             []byte
 	resourcesVpcConfig *eks.VpcConfigResponse
 }
@@ -40,6 +52,10 @@ type STSAPI stsiface.STSAPI
 type SecretsManagerAPI secretsmanageriface.SecretsManagerAPI
 type EKSAPI eksiface.EKSAPI
 type EC2API ec2iface.EC2API
+type KMSAPI kmsiface.KMSAPI
+type SNSAPI snsiface.SNSAPI
+type IAMAPI iamiface.IAMAPI
+type ECRAPI ecriface.ECRAPI
 
 type AWSClients struct {
 	AWSSession *session.Session
@@ -53,6 +69,10 @@ type AWSClientsIface interface {
 	SecretsManagerClient(region *string, role *string) SecretsManagerAPI
 	EKSClient(region *string, role *string) EKSAPI
 	EC2Client(region *string, role *string) EC2API
+	KMSClient(region *string, role *string) KMSAPI
+	SNSClient(region *string, role *string) SNSAPI
+	IAMClient(region *string, role *string) IAMAPI
+	ECRClient(region *string, role *string) ECRAPI
 	Session(region *string, role *string) *session.Session
 }
 
@@ -80,6 +100,22 @@ func (c *AWSClients) EC2Client(region *string, role *string) EC2API {
 	return ec2.New(c.Session(region, role))
 }
 
+func (c *AWSClients) KMSClient(region *string, role *string) KMSAPI {
+	return kms.New(c.Session(region, role))
+}
+
+func (c *AWSClients) SNSClient(region *string, role *string) SNSAPI {
+	return sns.New(c.Session(region, role))
+}
+
+func (c *AWSClients) IAMClient(region *string, role *string) IAMAPI {
+	return iam.New(c.Session(region, role))
+}
+
+func (c *AWSClients) ECRClient(region *string, role *string) ECRAPI {
+	return ecr.New(c.Session(region, role))
+}
+
 func (c *AWSClients) Session(region *string, role *string) *session.Session {
 	if region != nil || role != nil {
 		return c.AWSSession.Copy(c.Config(region, role))
@@ -119,12 +155,32 @@ func getClusterDetails(svc eksiface.EKSAPI, clusterName string) (*clusterData, e
 			return nil, genericError("Decoding CA", err)
 		}
 		c.resourcesVpcConfig = result.Cluster.ResourcesVpcConfig
+		c.arn = aws.StringValue(result.Cluster.Arn)
+		if result.Cluster.Identity != nil && result.Cluster.Identity.Oidc != nil {
+			c.oidcIssuer = aws.StringValue(result.Cluster.Identity.Oidc.Issuer)
+		}
 	default:
 		return nil, fmt.Errorf("cluster %s in unexpected state %s", clusterName, *result.Cluster.Status)
 	}
 	return c, nil
 }
 
+// setClusterOutputs sets the cluster ARN and OIDC issuer outputs on the model
+func setClusterOutputs(svc EKSAPI, m *Model) error {
+	if m.ClusterID == nil {
+		return nil
+	}
+	c, err := getClusterDetails(svc, *m.ClusterID)
+	if err != nil {
+		return err
+	}
+	m.ClusterArn = aws.String(c.arn)
+	if c.oidcIssuer != "" {
+		m.OIDCIssuer = aws.String(c.oidcIssuer)
+	}
+	return nil
+}
+
 // generateKubeToken using the aws-iam-auth pkg
 func generateKubeToken(svc STSAPI, clusterID *string) (*string, error) {
 	roleArn, err := getCurrentRoleARN(svc)
@@ -153,7 +209,7 @@ func downloadS3(svc S3API, bucket string, key string, filename string) error {
 	// Create a file to write the S3 Object contents to.
 	f, err := os.Create(filename)
 	if err != nil {
-		return genericError("downloadS3", err)
+		return withReason(ChartNotFound, genericError("downloadS3", err))
 	}
 
 	// Write the contents of S3 Object to the file
@@ -162,7 +218,7 @@ func downloadS3(svc S3API, bucket string, key string, filename string) error {
 		Key:    aws.String(key),
 	})
 	if err != nil {
-		return genericError("downloadS3", err)
+		return withReason(ChartNotFound, genericError("downloadS3", err))
 	}
 
 	log.Printf("Downloaded %s - %v bytes ", f.Name(), numBytes)
@@ -218,6 +274,35 @@ func getCurrentRoleARN(svc STSAPI) (*string, error) {
 	return toRoleArn(response.Arn), nil
 }
 
+// validateConnectorRole checks the role exists and trusts Lambda to assume it.
+func validateConnectorRole(svc IAMAPI, roleArn *string) error {
+	a, err := arn.Parse(aws.StringValue(roleArn))
+	if err != nil || a.Service != "iam" || !strings.HasPrefix(a.Resource, "role/") {
+		return fmt.Errorf("invalid connector role arn %s", aws.StringValue(roleArn))
+	}
+	name := a.Resource[strings.LastIndex(a.Resource, "/")+1:]
+	res, err := svc.GetRole(&iam.GetRoleInput{RoleName: aws.String(name)})
+	if err != nil {
+		return AWSError(err)
+	}
+	policy, err := url.QueryUnescape(aws.StringValue(res.Role.AssumeRolePolicyDocument))
+	if err != nil {
+		return genericError("Reading connector role trust policy", err)
+	}
+	if !strings.Contains(policy, "lambda.amazonaws.com") {
+		return withReason(AccessDenied, fmt.Errorf("connector role %s can't be assumed by lambda.amazonaws.com", aws.StringValue(roleArn)))
+	}
+	return nil
+}
+
+func getAccountID(svc STSAPI) (*string, error) {
+	response, err := svc.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return nil, AWSError(err)
+	}
+	return response.Account, nil
+}
+
 func toRoleArn(arn *string) *string {
 	arnParts := strings.Split(*arn, ":")
 	if arnParts[2] != "sts" || !strings.HasPrefix(arnParts[5], "assumed-role") {
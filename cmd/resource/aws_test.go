@@ -6,15 +6,18 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"sync"
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/eks"
+	"github.com/aws/aws-sdk-go/service/iam"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/secretsmanager"
 	"github.com/aws/aws-sdk-go/service/sts"
@@ -42,6 +45,22 @@ type mockS3Client struct {
 	S3API
 }
 
+type mockKMSClient struct {
+	KMSAPI
+}
+
+type mockSNSClient struct {
+	SNSAPI
+}
+
+type mockIAMClient struct {
+	IAMAPI
+}
+
+type mockECRClient struct {
+	ECRAPI
+}
+
 func (m *mockAWSClients) EKSClient(region *string, role *string) EKSAPI {
 	return &mockEKSClient{}
 }
@@ -60,6 +79,18 @@ func (m *mockAWSClients) LambdaClient(region *string, role *string) LambdaAPI {
 func (m *mockAWSClients) SecretsManagerClient(region *string, role *string) SecretsManagerAPI {
 	return &mockSecretsManagerClient{}
 }
+func (m *mockAWSClients) KMSClient(region *string, role *string) KMSAPI {
+	return &mockKMSClient{}
+}
+func (m *mockAWSClients) SNSClient(region *string, role *string) SNSAPI {
+	return &mockSNSClient{}
+}
+func (m *mockAWSClients) IAMClient(region *string, role *string) IAMAPI {
+	return &mockIAMClient{}
+}
+func (m *mockAWSClients) ECRClient(region *string, role *string) ECRAPI {
+	return &mockECRClient{}
+}
 func (m *mockAWSClients) Session(region *string, role *string) *session.Session {
 	return MockSession
 }
@@ -75,8 +106,13 @@ func (m *mockEKSClient) DescribeCluster(c *eks.DescribeClusterInput) (*eks.Descr
 					Data: aws.String("LS0tLS1CRUdJTiBDRVJUSUZJQ0FURS0tLS0tCi0tLS0tRU5EIENFUlRJRklDQVRFLS0tLS0="),
 				},
 				Endpoint: aws.String("https://EKS.yl4.us-east-2.eks.amazonaws.com"),
-				Name:     aws.String("eks"),
-				Status:   aws.String(eks.ClusterStatusActive),
+				Identity: &eks.Identity{
+					Oidc: &eks.OIDC{
+						Issuer: aws.String("https://oidc.eks.us-east-2.amazonaws.com/id/EXAMPLE"),
+					},
+				},
+				Name:   aws.String("eks"),
+				Status: aws.String(eks.ClusterStatusActive),
 				ResourcesVpcConfig: &eks.VpcConfigResponse{
 					EndpointPublicAccess: aws.Bool(true),
 					PublicAccessCidrs:    aws.StringSlice([]string{"0.0.0.0/0"}),
@@ -202,6 +238,13 @@ func (m *mockSecretsManagerClient) GetSecretValue(s *secretsmanager.GetSecretVal
 				SecretBinary: []byte("Test"),
 			},
 		},
+		"sec3": {
+			GetSecretValueOutput: &secretsmanager.GetSecretValueOutput{
+				ARN:          aws.String("arn:aws:secretsmanager:us-east-2:1234567890:secret:registry-Ab"),
+				Name:         aws.String("registry"),
+				SecretString: aws.String(`{"username": "user", "password": "pass"}`),
+			},
+		},
 	}
 	for _, d := range secrets {
 		if aws.StringValue(s.SecretId) == aws.StringValue(d.GetSecretValueOutput.ARN) {
@@ -308,6 +351,44 @@ func TestGetClusterDetails(t *testing.T) {
 	}
 }
 
+func TestSetClusterOutputs(t *testing.T) {
+	mockSvc := &mockEKSClient{}
+	tests := map[string]struct {
+		m           *Model
+		eArn        *string
+		eOIDCIssuer *string
+		expectedErr *string
+	}{
+		"WithOIDC": {
+			m:           &Model{ClusterID: aws.String("eks")},
+			eArn:        aws.String("arn:aws:eks:us-east-2:1234567890:cluster/eks"),
+			eOIDCIssuer: aws.String("https://oidc.eks.us-east-2.amazonaws.com/id/EXAMPLE"),
+		},
+		"WithOutOIDC": {
+			m:    &Model{ClusterID: aws.String("private")},
+			eArn: aws.String("arn:aws:eks:us-east-2:1234567890:cluster/private"),
+		},
+		"KubeConfig": {
+			m: &Model{KubeConfig: aws.String("arn")},
+		},
+		"NotActive": {
+			m:           &Model{ClusterID: aws.String("eks1")},
+			expectedErr: aws.String("in unexpected state"),
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := setClusterOutputs(mockSvc, d.m)
+			if err != nil {
+				assert.Contains(t, err.Error(), aws.StringValue(d.expectedErr))
+				return
+			}
+			assert.EqualValues(t, d.eArn, d.m.ClusterArn)
+			assert.EqualValues(t, d.eOIDCIssuer, d.m.OIDCIssuer)
+		})
+	}
+}
+
 func TestGenerateKubeToken(t *testing.T) {
 	mockSvc := &mockSTSClient{}
 	cluster := aws.String("eks")
@@ -407,6 +488,13 @@ func TestGetCurrentRoleARN(t *testing.T) {
 	assert.EqualValues(t, aws.StringValue(expectedARN), aws.StringValue(res))
 }
 
+func TestGetAccountID(t *testing.T) {
+	mockSvc := &mockSTSClient{}
+	res, err := getAccountID(mockSvc)
+	assert.Nil(t, err)
+	assert.EqualValues(t, "1234567890", aws.StringValue(res))
+}
+
 func TestToRoleArn(t *testing.T) {
 	arns := []string{"arn:aws:sts::1234567890:assumed-role/TestRole/session-1587810408", "arn:aws:iam::1234567890:role/TestRole"}
 	expectedARN := aws.String("arn:aws:iam::1234567890:role/TestRole")
@@ -473,3 +561,37 @@ func TestFilterNattedSubnets(t *testing.T) {
 		})
 	}
 }
+
+func (m *mockIAMClient) GetRole(i *iam.GetRoleInput) (*iam.GetRoleOutput, error) {
+	switch aws.StringValue(i.RoleName) {
+	case "connector":
+		return &iam.GetRoleOutput{Role: &iam.Role{AssumeRolePolicyDocument: aws.String(url.QueryEscape(`{"Statement":[{"Effect":"Allow","Principal":{"Service":"lambda.amazonaws.com"},"Action":"sts:AssumeRole"}]}`))}}, nil
+	case "ec2":
+		return &iam.GetRoleOutput{Role: &iam.Role{AssumeRolePolicyDocument: aws.String(url.QueryEscape(`{"Statement":[{"Effect":"Allow","Principal":{"Service":"ec2.amazonaws.com"},"Action":"sts:AssumeRole"}]}`))}}, nil
+	}
+	return nil, awserr.New(iam.ErrCodeNoSuchEntityException, "role not found", fmt.Errorf("role not found"))
+}
+
+// TestValidateConnectorRole to test validateConnectorRole
+func TestValidateConnectorRole(t *testing.T) {
+	tests := map[string]struct {
+		arn  string
+		eErr string
+	}{
+		"Valid":       {arn: "arn:aws:iam::1234567890:role/path/connector"},
+		"NotLambda":   {arn: "arn:aws:iam::1234567890:role/ec2", eErr: "can't be assumed by lambda.amazonaws.com"},
+		"Missing":     {arn: "arn:aws:iam::1234567890:role/missing", eErr: "role not found"},
+		"InvalidArn":  {arn: "connector", eErr: "invalid connector role arn"},
+		"NotARoleArn": {arn: "arn:aws:iam::1234567890:user/connector", eErr: "invalid connector role arn"},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := validateConnectorRole(&mockIAMClient{}, aws.String(d.arn))
+			if d.eErr == "" {
+				assert.Nil(t, err)
+			} else {
+				assert.Contains(t, err.Error(), d.eErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package resource
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// ChartCacheDirEnvVar set on the provider moves the chart cache, e.g. to an EFS mount shared by its invocations.
+const ChartCacheDirEnvVar = "HELM_PROVIDER_CHART_CACHE"
+
+// Values of the ChartCache property.
+const (
+	ChartCacheRefresh = "Refresh"
+	ChartCachePrefer  = "Prefer"
+	ChartCacheOffline = "Offline"
+)
+
+func chartCacheDir() string {
+	if dir := os.Getenv(ChartCacheDirEnvVar); dir != "" {
+		return dir
+	}
+	return filepath.Join(HelmCacheHomeEnvVar, "charts")
+}
+
+// offline reports whether config only allows cached charts, with no repository updates.
+func offline(config *Config) bool {
+	return config.ChartCache == ChartCacheOffline
+}
+
+// chartCachePath returns where the archive of chart is cached, or "" if it's never cached: charts on the local
+// filesystem are already local and those from a ConfigMap are read from the cluster.
+func chartCachePath(chart *Chart) string {
+	switch aws.StringValue(chart.ChartType) {
+	case "Remote":
+	case "Local":
+		if aws.StringValue(chart.ChartPath) == aws.StringValue(chart.Chart) {
+			return ""
+		}
+	default:
+		return ""
+	}
+	key := strings.Join([]string{
+		aws.StringValue(chart.ChartType),
+		aws.StringValue(chart.ChartRepoURL),
+		aws.StringValue(chart.Chart),
+		aws.StringValue(chart.ChartPath),
+		aws.StringValue(chart.ChartVersion),
+	}, "\n")
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(chartCacheDir(), hex.EncodeToString(sum[:16])+".tgz")
+}
+
+// cachedChart returns the cached archive of chart when config's ChartCache allows using it, or "" to fetch it.
+func cachedChart(config *Config, chart *Chart) (string, error) {
+	if config.ChartCache == "" || config.ChartCache == ChartCacheRefresh {
+		return "", nil
+	}
+	path := chartCachePath(chart)
+	if path == "" {
+		return "", nil
+	}
+	info, err := os.Stat(path)
+	switch {
+	case err == nil && offline(config):
+	case err == nil && config.ChartCacheTTL > 0 && time.Since(info.ModTime()) > time.Duration(config.ChartCacheTTL)*time.Minute:
+		log.Printf("Cached chart %s is older than %d minutes, fetching it", aws.StringValue(chart.Chart), config.ChartCacheTTL)
+		return "", nil
+	case err == nil:
+	case offline(config):
+		return "", withReason(ChartNotFound, fmt.Errorf("chart %s is not cached and ChartCache is Offline", aws.StringValue(chart.Chart)))
+	default:
+		return "", nil
+	}
+	log.Printf("Using cached chart %s", aws.StringValue(chart.Chart))
+	return path, nil
+}
+
+// storeChart copies the fetched archive of chart into the cache when config's ChartCache uses it. Failures are only
+// logged, the chart is fetched again next time.
+func storeChart(config *Config, chart *Chart, fetched string) {
+	if config.ChartCache != ChartCachePrefer {
+		return
+	}
+	path := chartCachePath(chart)
+	if path == "" {
+		return
+	}
+	if err := copyChart(fetched, path); err != nil {
+		log.Printf("Warning: Got error caching chart %s %s", aws.StringValue(chart.Chart), err.Error())
+	}
+}
+
+// copyChart copies src to dst through a temp file in the same directory, so a concurrent reader never sees a partial
+// archive.
+func copyChart(src string, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := ioutil.TempFile(filepath.Dir(dst), "chart-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), dst)
+}
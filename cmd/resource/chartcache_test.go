@@ -0,0 +1,81 @@
+package resource
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestCachedChart to test cachedChart and storeChart
+func TestCachedChart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chart-cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer os.Unsetenv(ChartCacheDirEnvVar)
+	os.Setenv(ChartCacheDirEnvVar, dir)
+
+	remote := &Chart{
+		Chart:        aws.String("stable/test"),
+		ChartType:    aws.String("Remote"),
+		ChartRepoURL: aws.String("https://charts.example.com"),
+		ChartVersion: aws.String("0.1.0"),
+	}
+	other := &Chart{
+		Chart:        aws.String("stable/test"),
+		ChartType:    aws.String("Remote"),
+		ChartRepoURL: aws.String("https://charts.example.com"),
+		ChartVersion: aws.String("0.2.0"),
+	}
+	prefer := &Config{ChartCache: ChartCachePrefer, ChartCacheTTL: 10}
+
+	path, err := cachedChart(prefer, remote)
+	assert.Nil(t, err)
+	assert.Empty(t, path)
+	storeChart(&Config{}, remote, TestFolder+"/test.tgz")
+	path, _ = cachedChart(prefer, remote)
+	assert.Empty(t, path)
+
+	storeChart(prefer, remote, TestFolder+"/test.tgz")
+	path, err = cachedChart(prefer, remote)
+	assert.Nil(t, err)
+	assert.Equal(t, chartCachePath(remote), path)
+	path, _ = cachedChart(prefer, other)
+	assert.Empty(t, path)
+	path, _ = cachedChart(&Config{ChartCache: ChartCacheRefresh}, remote)
+	assert.Empty(t, path)
+
+	old := time.Now().Add(-time.Hour)
+	assert.Nil(t, os.Chtimes(chartCachePath(remote), old, old))
+	path, _ = cachedChart(prefer, remote)
+	assert.Empty(t, path)
+	path, _ = cachedChart(&Config{ChartCache: ChartCachePrefer}, remote)
+	assert.Equal(t, chartCachePath(remote), path)
+	path, err = cachedChart(&Config{ChartCache: ChartCacheOffline, ChartCacheTTL: 10}, remote)
+	assert.Nil(t, err)
+	assert.Equal(t, chartCachePath(remote), path)
+
+	_, err = cachedChart(&Config{ChartCache: ChartCacheOffline}, other)
+	assert.EqualError(t, err, "chart stable/test is not cached and ChartCache is Offline")
+}
+
+// TestChartCachePath to test chartCachePath
+func TestChartCachePath(t *testing.T) {
+	tests := map[string]struct {
+		chart   *Chart
+		eCached bool
+	}{
+		"Remote":    {chart: &Chart{Chart: aws.String("stable/test"), ChartType: aws.String("Remote")}, eCached: true},
+		"URL":       {chart: &Chart{Chart: aws.String("test.tgz"), ChartPath: aws.String("s3://bucket/test.tgz"), ChartType: aws.String("Local")}, eCached: true},
+		"LocalPath": {chart: &Chart{Chart: aws.String("/opt/charts/test"), ChartPath: aws.String("/opt/charts/test"), ChartType: aws.String("Local")}},
+		"ConfigMap": {chart: &Chart{Chart: aws.String("test.tgz"), ChartType: aws.String("ConfigMap")}},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, d.eCached, chartCachePath(d.chart) != "")
+		})
+	}
+}
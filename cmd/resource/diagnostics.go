@@ -0,0 +1,213 @@
+package resource
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/kube"
+	appsv1 "k8s.io/api/apps/v1"
+	appsv1beta1 "k8s.io/api/apps/v1beta1"
+	appsv1beta2 "k8s.io/api/apps/v1beta2"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DiagnosticsEnvVar makes a failed release report the logs and events of its not ready pods when set to true.
+const DiagnosticsEnvVar = "HELM_PROVIDER_DIAGNOSTICS"
+
+// podLogLines is how many of the last log lines are returned for each container.
+const podLogLines int64 = 20
+
+// PodDiagnostics describes a not ready pod of a release.
+type PodDiagnostics struct {
+	Name, Namespace, Phase string
+	Reason                 string            `json:",omitempty"`
+	Events                 []string          `json:",omitempty"`
+	Logs                   map[string]string `json:",omitempty"`
+}
+
+// diagnosticsEnabled reports whether diagnostics are collected for failed releases, they're off by default.
+func diagnosticsEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv(DiagnosticsEnvVar))
+	return enabled
+}
+
+// Summary is a one line description of the pod, its logs are left out.
+func (p PodDiagnostics) Summary() string {
+	s := fmt.Sprintf("pod %s/%s %s", p.Namespace, p.Name, p.Phase)
+	if p.Reason != "" {
+		s += ": " + p.Reason
+	}
+	if len(p.Events) > 0 {
+		s += ", last event: " + p.Events[len(p.Events)-1]
+	}
+	return s
+}
+
+// GetDiagnostics returns the logs and warning events of the not ready pods of the release's workloads and hooks.
+func (c *Clients) GetDiagnostics(r *ReleaseData) ([]PodDiagnostics, error) {
+	log.Printf("Getting diagnostics for %s", r.Name)
+	manifest := r.Manifest
+	// Hooks aren't in the release manifest but are often what failed.
+	if rel, err := action.NewGet(c.HelmClient).Run(r.Name); err != nil {
+		log.Printf("Warning: Got error getting release hooks %s", err.Error())
+	} else {
+		for _, h := range rel.Hooks {
+			manifest += "\n---\n" + h.Manifest
+		}
+	}
+	infos, err := c.getManifestDetails(&ReleaseData{Name: r.Name, Namespace: r.Namespace, Manifest: manifest})
+	if err != nil && len(infos) == 0 {
+		return nil, err
+	}
+	var out []PodDiagnostics
+	for _, info := range infos {
+		var selector *metav1.LabelSelector
+		switch value := kube.AsVersioned(info).(type) {
+		case *appsv1.Deployment, *appsv1beta1.Deployment, *appsv1beta2.Deployment, *extensionsv1beta1.Deployment:
+			dep, err := c.ClientSet.AppsV1().Deployments(info.Namespace).Get(c.opContext(), info.Name, metav1.GetOptions{})
+			if err == nil {
+				selector = dep.Spec.Selector
+			}
+		case *extensionsv1beta1.DaemonSet, *appsv1.DaemonSet, *appsv1beta2.DaemonSet:
+			ds, err := c.ClientSet.AppsV1().DaemonSets(info.Namespace).Get(c.opContext(), info.Name, metav1.GetOptions{})
+			if err == nil {
+				selector = ds.Spec.Selector
+			}
+		case *appsv1.StatefulSet, *appsv1beta1.StatefulSet, *appsv1beta2.StatefulSet:
+			sts, err := c.ClientSet.AppsV1().StatefulSets(info.Namespace).Get(c.opContext(), info.Name, metav1.GetOptions{})
+			if err == nil {
+				selector = sts.Spec.Selector
+			}
+		case *batchv1.Job:
+			job, err := c.ClientSet.BatchV1().Jobs(info.Namespace).Get(c.opContext(), info.Name, metav1.GetOptions{})
+			if err == nil {
+				selector = job.Spec.Selector
+			}
+		case *corev1.Pod:
+			pod, err := c.ClientSet.CoreV1().Pods(info.Namespace).Get(c.opContext(), value.Name, metav1.GetOptions{})
+			if err == nil && !podReady(pod) {
+				out = append(out, c.podDiagnostics(pod))
+			}
+			continue
+		}
+		if selector != nil {
+			out = append(out, c.selectorDiagnostics(info.Namespace, selector)...)
+		}
+	}
+	return out, nil
+}
+
+// selectorDiagnostics returns the diagnostics of the selected pods which aren't ready.
+func (c *Clients) selectorDiagnostics(namespace string, selector *metav1.LabelSelector) []PodDiagnostics {
+	s, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		log.Printf("Warning: Got error parsing selector %s", err.Error())
+		return nil
+	}
+	pods, err := c.ClientSet.CoreV1().Pods(namespace).List(c.opContext(), metav1.ListOptions{LabelSelector: s.String()})
+	if err != nil {
+		log.Printf("Warning: Got error listing pods %s", err.Error())
+		return nil
+	}
+	var out []PodDiagnostics
+	for i := range pods.Items {
+		if !podReady(&pods.Items[i]) {
+			out = append(out, c.podDiagnostics(&pods.Items[i]))
+		}
+	}
+	return out
+}
+
+// podDiagnostics collects the pod's warning events and the last lines logged by each of its containers, from the
+// previous run of those that restarted.
+func (c *Clients) podDiagnostics(pod *corev1.Pod) PodDiagnostics {
+	d := PodDiagnostics{Name: pod.Name, Namespace: pod.Namespace, Phase: string(pod.Status.Phase)}
+	if reason, failed := podFailed(pod); failed {
+		d.Reason = reason
+	} else if pod.Status.Message != "" {
+		d.Reason = pod.Status.Message
+	}
+	events, err := c.ClientSet.CoreV1().Events(pod.Namespace).List(c.opContext(), metav1.ListOptions{
+		FieldSelector: fmt.Sprintf("involvedObject.kind=Pod,involvedObject.name=%s", pod.Name),
+	})
+	if err != nil {
+		log.Printf("Warning: Got error listing events %s", err.Error())
+	} else {
+		for _, e := range events.Items {
+			if e.InvolvedObject.Name == pod.Name && e.Type == corev1.EventTypeWarning {
+				d.Events = append(d.Events, fmt.Sprintf("%s: %s", e.Reason, e.Message))
+			}
+		}
+	}
+	var statuses []corev1.ContainerStatus
+	statuses = append(statuses, pod.Status.InitContainerStatuses...)
+	statuses = append(statuses, pod.Status.ContainerStatuses...)
+	for _, cs := range statuses {
+		if cs.State.Waiting != nil && cs.LastTerminationState.Terminated == nil {
+			// Never started, there's nothing logged.
+			continue
+		}
+		lines := podLogLines
+		opts := &corev1.PodLogOptions{
+			Container: cs.Name,
+			TailLines: &lines,
+			Previous:  cs.RestartCount > 0 && cs.State.Running == nil,
+		}
+		b, err := c.ClientSet.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, opts).DoRaw(c.opContext())
+		if err != nil {
+			log.Printf("Warning: Got error getting logs of %s/%s %s", pod.Name, cs.Name, err.Error())
+			continue
+		}
+		if d.Logs == nil {
+			d.Logs = map[string]string{}
+		}
+		d.Logs[cs.Name] = strings.TrimSpace(string(b))
+	}
+	return d
+}
+
+func podReady(pod *corev1.Pod) bool {
+	if pod.Status.Phase == corev1.PodSucceeded {
+		return true
+	}
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// withDiagnostics logs the diagnostics of the release's not ready pods when DiagnosticsEnvVar is set, and adds their
+// summary to err.
+func (c *Clients) withDiagnostics(e *Event, name string, s *HelmStatusData, vpc bool, err error) error {
+	if !diagnosticsEnabled() || s == nil {
+		return err
+	}
+	e.Action = GetDiagnosticsAction
+	e.ReleaseData = &ReleaseData{Name: name, Namespace: s.Namespace, Manifest: s.Manifest}
+	d, derr := c.diagnosticsWrapper(e, c.LambdaResource.functionName, vpc)
+	if derr != nil {
+		log.Printf("Warning: Got error getting diagnostics %s", derr.Error())
+		return err
+	}
+	var summary []string
+	for _, p := range d {
+		log.Printf("Diagnostics for %s", p.Summary())
+		for container, logs := range p.Logs {
+			log.Printf("Logs of %s/%s container %s:\n%s", p.Namespace, p.Name, container, logs)
+		}
+		summary = append(summary, p.Summary())
+	}
+	if len(summary) == 0 {
+		return err
+	}
+	return fmt.Errorf("%w, not ready pods: %s", err, strings.Join(summary, "; "))
+}
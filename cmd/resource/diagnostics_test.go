@@ -0,0 +1,91 @@
+package resource
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+)
+
+// TestSelectorDiagnostics to test selectorDiagnostics
+func TestSelectorDiagnostics(t *testing.T) {
+	healthy := pod("healthy", "default", "", 0)
+	healthy.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+	starting := pod("starting", "default", "", 0)
+	starting.Status.Phase = corev1.PodRunning
+	c := &Clients{ClientSet: fakeclientset.NewSimpleClientset(
+		healthy,
+		starting,
+		pod("crash", "default", "CrashLoopBackOff", 5),
+		&corev1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Name: "crash.1", Namespace: "default"},
+			InvolvedObject: corev1.ObjectReference{Kind: "Pod", Name: "crash"},
+			Type:           corev1.EventTypeWarning,
+			Reason:         "BackOff",
+			Message:        "Back-off restarting failed container",
+		},
+	)}
+	tests := map[string]struct {
+		app      string
+		expected []PodDiagnostics
+	}{
+		"Ready": {
+			app: "healthy",
+		},
+		"NotReady": {
+			app: "starting",
+			expected: []PodDiagnostics{{
+				Name: "starting", Namespace: "default", Phase: "Running",
+				Logs: map[string]string{"app": "fake logs"},
+			}},
+		},
+		"Failed": {
+			app: "crash",
+			expected: []PodDiagnostics{{
+				Name: "crash", Namespace: "default",
+				Reason: "container app is in CrashLoopBackOff state: , restarted 5 times",
+				Events: []string{"BackOff: Back-off restarting failed container"},
+			}},
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			result := c.selectorDiagnostics("default", &metav1.LabelSelector{MatchLabels: map[string]string{"app": d.app}})
+			assert.EqualValues(t, d.expected, result)
+		})
+	}
+}
+
+// TestPodDiagnosticsSummary to test Summary
+func TestPodDiagnosticsSummary(t *testing.T) {
+	d := PodDiagnostics{
+		Name: "crash", Namespace: "default", Phase: "Running",
+		Reason: "container app is in CrashLoopBackOff state",
+		Events: []string{"Pulled: pulled image", "BackOff: Back-off restarting failed container"},
+		Logs:   map[string]string{"app": "panic"},
+	}
+	assert.Equal(t, "pod default/crash Running: container app is in CrashLoopBackOff state, last event: BackOff: Back-off restarting failed container", d.Summary())
+}
+
+// TestWithDiagnostics to test withDiagnostics
+func TestWithDiagnostics(t *testing.T) {
+	defer os.Unsetenv(DiagnosticsEnvVar)
+	c := NewMockClient(t, &Model{ClusterID: aws.String("eks")})
+	failed := errors.New("release failed")
+	s := &HelmStatusData{Namespace: "default", Manifest: TestManifest}
+
+	os.Unsetenv(DiagnosticsEnvVar)
+	assert.Equal(t, failed, c.withDiagnostics(&Event{}, "one", s, false, failed))
+
+	os.Setenv(DiagnosticsEnvVar, "true")
+	e := &Event{}
+	err := c.withDiagnostics(e, "one", s, false, failed)
+	assert.True(t, errors.Is(err, failed))
+	assert.Equal(t, GetDiagnosticsAction, e.Action)
+	assert.Equal(t, "one", e.ReleaseData.Name)
+}
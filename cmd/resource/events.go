@@ -1,6 +1,8 @@
 package resource
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -8,18 +10,174 @@ import (
 
 	"github.com/aws-cloudformation/cloudformation-cli-go-plugin/cfn/handler"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
 )
 
 const callbackDelaySeconds = 30
 
 var LastKnownErrors []string
 
+// FailureReason is the category of a failed operation. It prefixes the event message in brackets, e.g.
+// "[CHART_NOT_FOUND] ...", so automation can branch on it without parsing the rest of the message.
+type FailureReason string
+
+const (
+	ChartNotFound      FailureReason = "CHART_NOT_FOUND"
+	InvalidChart       FailureReason = "INVALID_CHART"
+	InvalidValues      FailureReason = "INVALID_VALUES"
+	InvalidRequest     FailureReason = "INVALID_REQUEST"
+	ReleaseNotFound    FailureReason = "RELEASE_NOT_FOUND"
+	ReleaseFailed      FailureReason = "RELEASE_FAILED"
+	AccessDenied       FailureReason = "ACCESS_DENIED"
+	Throttled          FailureReason = "THROTTLED"
+	TimedOut           FailureReason = "TIMEOUT"
+	Conflict           FailureReason = "CONFLICT"
+	ConnectorFailure   FailureReason = "CONNECTOR_FAILURE"
+	ClusterUnreachable FailureReason = "CLUSTER_UNREACHABLE"
+	InternalFailure    FailureReason = "INTERNAL_FAILURE"
+	// NamespaceTerminating is retried on the next callback, so it's only reported if it outlasts the TimeOut.
+	NamespaceTerminating FailureReason = "NAMESPACE_TERMINATING"
+)
+
+// failureCodes maps each FailureReason to the CloudFormation handler error code it's reported with.
+var failureCodes = map[FailureReason]string{
+	ChartNotFound:        cloudformation.HandlerErrorCodeInvalidRequest,
+	InvalidChart:         cloudformation.HandlerErrorCodeInvalidRequest,
+	InvalidValues:        cloudformation.HandlerErrorCodeInvalidRequest,
+	InvalidRequest:       cloudformation.HandlerErrorCodeInvalidRequest,
+	ReleaseNotFound:      cloudformation.HandlerErrorCodeNotFound,
+	ReleaseFailed:        cloudformation.HandlerErrorCodeNotStabilized,
+	AccessDenied:         cloudformation.HandlerErrorCodeAccessDenied,
+	Throttled:            cloudformation.HandlerErrorCodeThrottling,
+	TimedOut:             cloudformation.HandlerErrorCodeNotStabilized,
+	Conflict:             cloudformation.HandlerErrorCodeResourceConflict,
+	ConnectorFailure:     cloudformation.HandlerErrorCodeServiceInternalError,
+	ClusterUnreachable:   cloudformation.HandlerErrorCodeNetworkFailure,
+	InternalFailure:      cloudformation.HandlerErrorCodeGeneralServiceException,
+	NamespaceTerminating: cloudformation.HandlerErrorCodeNotStabilized,
+}
+
+// awsErrorReasons classify AWS errors by their code.
+var awsErrorReasons = map[string]FailureReason{
+	"AccessDenied":             AccessDenied,
+	"AccessDeniedException":    AccessDenied,
+	"UnauthorizedOperation":    AccessDenied,
+	"Throttling":               Throttled,
+	"ThrottlingException":      Throttled,
+	"TooManyRequestsException": Throttled,
+	"RequestLimitExceeded":     Throttled,
+	"NoSuchKey":                ChartNotFound,
+	"NoSuchBucket":             ChartNotFound,
+}
+
+// failureError carries the FailureReason of an error, set where it's raised.
+type failureError struct {
+	reason FailureReason
+	err    error
+}
+
+func (e *failureError) Error() string {
+	return e.err.Error()
+}
+
+func (e *failureError) Unwrap() error {
+	return e.err
+}
+
+// withReason classifies err as reason, unless it was already classified closer to where it was raised.
+func withReason(reason FailureReason, err error) error {
+	var f *failureError
+	if err == nil || errors.As(err, &f) {
+		return err
+	}
+	return &failureError{reason: reason, err: err}
+}
+
+// connectorError is an error returned by the VPC connector. Its reason is the one the connector classified it with,
+// empty when the connector failed without classifying it, e.g. on a crash or timeout.
+type connectorError struct {
+	msg    string
+	reason FailureReason
+}
+
+func (e *connectorError) Error() string {
+	return e.msg
+}
+
+// failureReason classifies err, returning its FailureReason and the matching CloudFormation handler error code.
+func failureReason(err error) (FailureReason, string) {
+	reason := errorReason(err)
+	return reason, failureCodes[reason]
+}
+
+// errorReason returns the FailureReason of err, InternalFailure when it has none.
+func errorReason(err error) FailureReason {
+	if isReleaseNotFound(err) {
+		return ReleaseNotFound
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, wait.ErrWaitTimeout) {
+		return TimedOut
+	}
+	var status kerrors.APIStatus
+	if errors.As(err, &status) {
+		switch status.Status().Reason {
+		case metav1.StatusReasonForbidden, metav1.StatusReasonUnauthorized:
+			return AccessDenied
+		case metav1.StatusReasonAlreadyExists, metav1.StatusReasonConflict:
+			return Conflict
+		case metav1.StatusReasonInvalid, metav1.StatusReasonBadRequest:
+			return InvalidRequest
+		case metav1.StatusReasonTimeout, metav1.StatusReasonServerTimeout:
+			return TimedOut
+		case metav1.StatusReasonTooManyRequests:
+			return Throttled
+		}
+	}
+	var f *failureError
+	if errors.As(err, &f) {
+		return f.reason
+	}
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		if reason, ok := awsErrorReasons[aerr.Code()]; ok {
+			return reason
+		}
+	}
+	var c *connectorError
+	if errors.As(err, &c) {
+		if c.reason != "" {
+			return c.reason
+		}
+		return ConnectorFailure
+	}
+	return InternalFailure
+}
+
 func errorEvent(model *Model, err error) handler.ProgressEvent {
 	log.Printf("Returning ERROR...")
+	reason, code := failureReason(err)
+	msg := err.Error()
+	if prefix := fmt.Sprintf("[%s] ", reason); !strings.HasPrefix(msg, prefix) {
+		msg = prefix + msg
+	}
 	return handler.ProgressEvent{
-		OperationStatus: handler.Failed,
-		Message:         err.Error(),
-		ResourceModel:   model,
+		OperationStatus:  handler.Failed,
+		HandlerErrorCode: code,
+		Message:          msg,
+		ResourceModel:    model,
+	}
+}
+
+func notFoundEvent(err error) handler.ProgressEvent {
+	log.Printf("Returning NOT FOUND...")
+	return handler.ProgressEvent{
+		OperationStatus:  handler.Failed,
+		HandlerErrorCode: cloudformation.HandlerErrorCodeNotFound,
+		Message:          err.Error(),
 	}
 }
 
@@ -33,15 +191,19 @@ func successEvent(model *Model) handler.ProgressEvent {
 
 func inProgressEvent(model *Model, stage Stage) handler.ProgressEvent {
 	log.Printf("Returning IN_PROGRESS next stage %v...\n", stage)
+	callbackContext := map[string]interface{}{
+		"Stage":     stage,
+		"StartTime": os.Getenv("StartTime"),
+		"Name":      aws.StringValue(model.Name),
+	}
+	if InFlightOperation != "" {
+		callbackContext["InFlight"] = InFlightOperation
+	}
 	return handler.ProgressEvent{
-		OperationStatus: handler.InProgress,
-		ResourceModel:   model,
-		Message:         fmt.Sprintf("%v in progress\n", stage),
-		CallbackContext: map[string]interface{}{
-			"Stage":     stage,
-			"StartTime": os.Getenv("StartTime"),
-			"Name":      aws.StringValue(model.Name),
-		},
+		OperationStatus:      handler.InProgress,
+		ResourceModel:        model,
+		Message:              fmt.Sprintf("%v in progress\n", stage),
+		CallbackContext:      callbackContext,
 		CallbackDelaySeconds: callbackDelaySeconds,
 	}
 }
@@ -50,7 +212,7 @@ func makeEvent(model *Model, nextStage Stage, err error) handler.ProgressEvent {
 	timeout := checkTimeOut(os.Getenv("StartTime"), model.TimeOut)
 	if timeout && nextStage != CompleteStage {
 		errorString := fmt.Sprintf("resource creation timed out\n, LastKnownErrors: %s", strings.Join(LastKnownErrors, "\n "))
-		return errorEvent(nil, fmt.Errorf(errorString))
+		return errorEvent(nil, withReason(TimedOut, errors.New(errorString)))
 	}
 	if err != nil {
 		return errorEvent(model, err)
@@ -1,6 +1,8 @@
 package resource
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"testing"
@@ -8,7 +10,13 @@ import (
 
 	"github.com/aws-cloudformation/cloudformation-cli-go-plugin/cfn/handler"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
 	"github.com/stretchr/testify/assert"
+	"helm.sh/helm/v3/pkg/storage/driver"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
 )
 
 func validateContext(t *testing.T, h handler.ProgressEvent, expectedContext map[string]interface{}) {
@@ -27,7 +35,7 @@ func validateMessage(t *testing.T, h handler.ProgressEvent, e string) {
 }
 
 func TestErrorEvent(t *testing.T) {
-	expectedMessage := "Test Error"
+	expectedMessage := "[INTERNAL_FAILURE] Test Error"
 	expectedStatus := handler.Failed
 	m := &Model{
 		Name: aws.String("Test"),
@@ -35,6 +43,126 @@ func TestErrorEvent(t *testing.T) {
 	result := errorEvent(m, fmt.Errorf("Test Error"))
 	validateMessage(t, result, expectedMessage)
 	validateOStatus(t, result, expectedStatus)
+	assert.EqualValues(t, cloudformation.HandlerErrorCodeGeneralServiceException, result.HandlerErrorCode)
+
+	result = errorEvent(m, withReason(ChartNotFound, errors.New("[CHART_NOT_FOUND] chart is required")))
+	validateMessage(t, result, "[CHART_NOT_FOUND] chart is required")
+}
+
+// TestFailureReason to test failureReason
+func TestFailureReason(t *testing.T) {
+	gr := schema.GroupResource{Resource: "configmaps"}
+	tests := map[string]struct {
+		err            error
+		expectedReason FailureReason
+		expectedCode   string
+	}{
+		"ReleaseNotFound": {
+			err:            genericError("Helm status", driver.ErrReleaseNotFound),
+			expectedReason: ReleaseNotFound,
+			expectedCode:   cloudformation.HandlerErrorCodeNotFound,
+		},
+		"Deadline": {
+			err:            fmt.Errorf("operation cancelled near deadline during install: %w", context.DeadlineExceeded),
+			expectedReason: TimedOut,
+			expectedCode:   cloudformation.HandlerErrorCodeNotStabilized,
+		},
+		"Forbidden": {
+			err:            genericError("Create NS", kerrors.NewForbidden(gr, "test", errors.New("denied"))),
+			expectedReason: AccessDenied,
+			expectedCode:   cloudformation.HandlerErrorCodeAccessDenied,
+		},
+		"AlreadyExists": {
+			err:            genericError("Applying PreInstallManifests", kerrors.NewAlreadyExists(gr, "test")),
+			expectedReason: Conflict,
+			expectedCode:   cloudformation.HandlerErrorCodeResourceConflict,
+		},
+		"AWSAccessDenied": {
+			err:            withReason(ChartNotFound, genericError("downloadS3", AWSError(awserr.New("AccessDenied", "Access Denied", nil)))),
+			expectedReason: AccessDenied,
+			expectedCode:   cloudformation.HandlerErrorCodeAccessDenied,
+		},
+		"AWSUnwrapped": {
+			err:            fmt.Errorf("describing cluster: %w", awserr.New("AccessDeniedException", "denied", nil)),
+			expectedReason: AccessDenied,
+			expectedCode:   cloudformation.HandlerErrorCodeAccessDenied,
+		},
+		"Throttled": {
+			err:            AWSError(awserr.New("ThrottlingException", "Rate exceeded", nil)),
+			expectedReason: Throttled,
+			expectedCode:   cloudformation.HandlerErrorCodeThrottling,
+		},
+		"ChartDownload": {
+			err:            withReason(ChartNotFound, genericError("Downloading file", errors.New("got response 404 from https://example.com/test.tgz"))),
+			expectedReason: ChartNotFound,
+			expectedCode:   cloudformation.HandlerErrorCodeInvalidRequest,
+		},
+		"ChartDigest": {
+			err:            withReason(InvalidChart, genericError("Verifying chart digest", errors.New("chart archive has SHA-256 00, expected 01"))),
+			expectedReason: InvalidChart,
+			expectedCode:   cloudformation.HandlerErrorCodeInvalidRequest,
+		},
+		"Values": {
+			err:            withReason(InvalidValues, genericError("Validating values", errors.New("values don't meet the specifications of the schema(s)"))),
+			expectedReason: InvalidValues,
+			expectedCode:   cloudformation.HandlerErrorCodeInvalidRequest,
+		},
+		"Connector": {
+			err:            withReason(ConnectorFailure, errors.New("VPC connector helm-provider-vpc-connector-abc not in desired state Active")),
+			expectedReason: ConnectorFailure,
+			expectedCode:   cloudformation.HandlerErrorCodeServiceInternalError,
+		},
+		"ConnectorReturned": {
+			err:            &connectorError{msg: "Error: At Validating values - values don't meet the specifications of the schema(s) ", reason: InvalidValues},
+			expectedReason: InvalidValues,
+			expectedCode:   cloudformation.HandlerErrorCodeInvalidRequest,
+		},
+		"ConnectorCrashed": {
+			err:            &connectorError{msg: "[Runtime.ExitError] exit status 2"},
+			expectedReason: ConnectorFailure,
+			expectedCode:   cloudformation.HandlerErrorCodeServiceInternalError,
+		},
+		"ReleaseFailed": {
+			err:            withReason(ReleaseFailed, errors.New("Deployment default/test not ready within 5 mins")),
+			expectedReason: ReleaseFailed,
+			expectedCode:   cloudformation.HandlerErrorCodeNotStabilized,
+		},
+		"WaitTimeout": {
+			err:            fmt.Errorf("release test failed: %w", wait.ErrWaitTimeout),
+			expectedReason: TimedOut,
+			expectedCode:   cloudformation.HandlerErrorCodeNotStabilized,
+		},
+		"Lock": {
+			err:            genericError("Helm install", withReason(Conflict, errors.New("release test is locked by another operation"))),
+			expectedReason: Conflict,
+			expectedCode:   cloudformation.HandlerErrorCodeResourceConflict,
+		},
+		"UntypedMessage": {
+			err:            errors.New("VPC connector helm-provider-vpc-connector-abc not in desired state Active"),
+			expectedReason: InternalFailure,
+			expectedCode:   cloudformation.HandlerErrorCodeGeneralServiceException,
+		},
+		"Unknown": {
+			err:            errors.New("Test Error"),
+			expectedReason: InternalFailure,
+			expectedCode:   cloudformation.HandlerErrorCodeGeneralServiceException,
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			reason, code := failureReason(d.err)
+			assert.EqualValues(t, d.expectedReason, reason)
+			assert.EqualValues(t, d.expectedCode, code)
+		})
+	}
+}
+
+func TestNotFoundEvent(t *testing.T) {
+	expectedStatus := handler.Failed
+	result := notFoundEvent(fmt.Errorf("release: not found"))
+	validateMessage(t, result, "release: not found")
+	validateOStatus(t, result, expectedStatus)
+	assert.EqualValues(t, cloudformation.HandlerErrorCodeNotFound, result.HandlerErrorCode)
 }
 
 func TestSuccessEvent(t *testing.T) {
@@ -96,7 +224,7 @@ func TestMakeEvent(t *testing.T) {
 			},
 			stage:           ReleaseStabilize,
 			err:             fmt.Errorf("Test Error"),
-			expectedMessage: "Test Error",
+			expectedMessage: "[INTERNAL_FAILURE] Test Error",
 			expectedStatus:  handler.Failed,
 			expectedContext: nil,
 		},
@@ -116,7 +244,7 @@ func TestMakeEvent(t *testing.T) {
 			},
 			stage:           ReleaseStabilize,
 			err:             nil,
-			expectedMessage: "resource creation timed out\n, LastKnownErrors: Test",
+			expectedMessage: "[TIMEOUT] resource creation timed out\n, LastKnownErrors: Test",
 			expectedStatus:  handler.Failed,
 			expectedContext: nil,
 		},
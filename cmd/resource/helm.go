@@ -1,7 +1,11 @@
 package resource
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"k8s.io/cli-runtime/pkg/genericclioptions"
@@ -9,20 +13,31 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/gofrs/flock"
 	"github.com/pkg/errors"
 	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
 	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
 	"helm.sh/helm/v3/pkg/cli"
 	"helm.sh/helm/v3/pkg/downloader"
 	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/kube"
 	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/releaseutil"
 	"helm.sh/helm/v3/pkg/repo"
+	"helm.sh/helm/v3/pkg/storage/driver"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/cli-runtime/pkg/resource"
 	"sigs.k8s.io/yaml"
 )
 
@@ -32,9 +47,22 @@ const (
 	HelmDataHomeEnvVar   = "/tmp/data"
 	HelmDriver           = "secret"
 	stableRepoURL        = "https://kubernetes-charts.storage.googleapis.com"
-	chartLocalPath       = "/tmp/chart.tgz"
+	defaultMaxHistory    = 10
+	defaultUninstallTime = 5
+	// Helm runs within a single Lambda invocation, capped at 15 minutes, so a release pending longer than
+	// this has no helm process left to finish it.
+	pendingReleaseTimeOut = 15 * time.Minute
+	// defaultHookTimeout matches the helm CLI's --timeout, used when the invocation has no deadline.
+	defaultHookTimeout = 5 * time.Minute
 )
 
+// helmStorageLabels are set on the release secret by Helm itself.
+var helmStorageLabels = []string{"owner", "name", "status", "version"}
+
+// ReleaseHashLabel on the release secret records the hash of the chart, values and options the revision was
+// installed or upgraded with.
+const ReleaseHashLabel = "awsqs-kubernetes-helm/release-hash"
+
 type HelmStatusData struct {
 	Status       release.Status `json:",omitempty"`
 	Namespace    string         `json:",omitempty"`
@@ -43,6 +71,8 @@ type HelmStatusData struct {
 	Chart        string         `json:",omitempty"`
 	Manifest     string         `json:",omitempty"`
 	Description  string `json:",omitempty"`
+	ChartChecksum string `json:",omitempty"`
+	LastDeployed  string `json:",omitempty"`
 }
 type HelmListData struct {
 	ReleaseName  string `json:",omitempty"`
@@ -66,10 +96,75 @@ func helmClientInvoke(namespace *string, getter genericclioptions.RESTClientGett
 	return actionConfig, nil
 }
 
+// UseStorageNamespace keeps the release records in namespace instead of the release namespace. Only helm's storage
+// moves, the release's objects are still created in the release namespace.
+func (c *Clients) UseStorageNamespace(namespace *string) error {
+	if aws.StringValue(namespace) == "" {
+		return nil
+	}
+	h, err := helmClientInvoke(namespace, c.Settings.RESTClientGetter())
+	if err != nil {
+		return err
+	}
+	c.HelmClient = h
+	c.storageNamespace = namespace
+	return nil
+}
+
+// setCapabilities overrides the kube version and api versions used for rendering the chart.
+func (c *Clients) setCapabilities(config *Config) error {
+	if config.KubeVersion == nil && len(config.APIVersions) == 0 {
+		return nil
+	}
+	dc := c.ClientSet.Discovery()
+	kv, err := dc.ServerVersion()
+	if err != nil {
+		return genericError("Getting kube version", err)
+	}
+	vs, err := action.GetVersionSet(dc)
+	if err != nil {
+		return genericError("Getting api versions", err)
+	}
+	caps := *chartutil.DefaultCapabilities
+	caps.KubeVersion = chartutil.KubeVersion{
+		Version: kv.GitVersion,
+		Major:   kv.Major,
+		Minor:   kv.Minor,
+	}
+	if config.KubeVersion != nil {
+		v, err := parseKubeVersion(*config.KubeVersion)
+		if err != nil {
+			return err
+		}
+		caps.KubeVersion = *v
+	}
+	caps.APIVersions = append(vs, config.APIVersions...)
+	log.Printf("Using kube version %s for chart capabilities", caps.KubeVersion.Version)
+	c.HelmClient.Capabilities = &caps
+	return nil
+}
+
+// parseKubeVersion parses versions like 1.29 or v1.29.0
+func parseKubeVersion(v string) (*chartutil.KubeVersion, error) {
+	re := regexp.MustCompile(`^v?(\d+)\.(\d+)(\.\d+)?$`)
+	m := re.FindStringSubmatch(v)
+	if m == nil {
+		return nil, withReason(InvalidRequest, fmt.Errorf("invalid KubeVersion %q, expected a version like 1.29 or v1.29.0", v))
+	}
+	patch := m[3]
+	if patch == "" {
+		patch = ".0"
+	}
+	return &chartutil.KubeVersion{
+		Version: fmt.Sprintf("v%s.%s%s", m[1], m[2], patch),
+		Major:   m[1],
+		Minor:   m[2],
+	}, nil
+}
+
 // addHelmRepoUpdate Add the repo and fire repo update
 func addHelmRepoUpdate(name string, url string, settings *cli.EnvSettings) error {
 	file := settings.RepositoryConfig
-	os.Remove(file)
 	//Ensure the file directory exists as it is required for file locking
 	err := os.MkdirAll(filepath.Dir(file), os.ModePerm)
 	if err != nil && !os.IsExist(err) {
@@ -102,14 +197,16 @@ func addHelmRepoUpdate(name string, url string, settings *cli.EnvSettings) error
 		Name: name,
 		URL:  url,
 	}
+	// Only the repository this install needs is refreshed and updated, the other entries are kept as they are.
+	log.Printf("Hang tight while we grab the latest from your chart repositories...")
 	r, err := repo.NewChartRepository(&c, getter.All(settings))
 	if err != nil {
 		return genericError("Adding helm repository", err)
 	}
-
 	if _, err := r.DownloadIndexFile(); err != nil {
 		return genericError("Adding helm repository", errors.Wrapf(err, "looks like %q is not a valid chart repository or cannot be reached", url))
 	}
+	log.Printf("...Successfully got an update from the %q chart repository\n", name)
 
 	f.Update(&c)
 
@@ -117,32 +214,114 @@ func addHelmRepoUpdate(name string, url string, settings *cli.EnvSettings) error
 		return genericError("Adding helm repository", err)
 	}
 	log.Printf("%q has been added to your repositories\n", name)
-	var repos []*repo.ChartRepository
-	for _, cfg := range f.Repositories {
-		r, err := repo.NewChartRepository(cfg, getter.All(settings))
-		if err != nil {
-			genericError("Adding helm repository", err)
+	log.Printf("Update Complete. ⎈ Happy Helming!⎈ ")
+	return nil
+}
+
+// labelRelease adds labels to the storage secret of the release revision. Helm resets the labels when a
+// revision is superseded, so only the current revision carries them.
+func (c *Clients) labelRelease(rel *release.Release, labels map[string]string) error {
+	if rel == nil || len(labels) == 0 {
+		return nil
+	}
+	s, err := c.releaseSecret(rel)
+	if err != nil {
+		return genericError("Label release", err)
+	}
+	if s.Labels == nil {
+		s.Labels = map[string]string{}
+	}
+	for k, v := range labels {
+		if stringInSlice(k, helmStorageLabels) {
+			log.Printf("Warning: Skipping release label %s, it's set by Helm", k)
+			continue
 		}
-		repos = append(repos, r)
+		s.Labels[k] = v
 	}
-	log.Printf("Hang tight while we grab the latest from your chart repositories...")
-	var wg sync.WaitGroup
-	for _, re := range repos {
-		wg.Add(1)
-		go func(re *repo.ChartRepository) {
-			defer wg.Done()
-			if _, err := re.DownloadIndexFile(); err != nil {
-				log.Printf("...Unable to get an update from the %q chart repository (%s):\n\t%s\n", re.Config.Name, re.Config.URL, err)
-			} else {
-				log.Printf("...Successfully got an update from the %q chart repository\n", re.Config.Name)
-			}
-		}(re)
+	if _, err := c.ClientSet.CoreV1().Secrets(s.Namespace).Update(c.opContext(), s, metav1.UpdateOptions{}); err != nil {
+		return genericError("Label release", err)
 	}
-	wg.Wait()
-	log.Printf("Update Complete. ⎈ Happy Helming!⎈ ")
 	return nil
 }
 
+// releaseSecret gets the storage secret of the release revision.
+func (c *Clients) releaseSecret(rel *release.Release) (*corev1.Secret, error) {
+	namespace := rel.Namespace
+	if c.storageNamespace != nil {
+		namespace = *c.storageNamespace
+	}
+	return c.ClientSet.CoreV1().Secrets(namespace).Get(c.opContext(), fmt.Sprintf("sh.helm.release.v1.%s.v%d", rel.Name, rel.Version), metav1.GetOptions{})
+}
+
+// recordReleaseHash labels the release revision with hash. Failing to is only logged, the next update then runs the
+// upgrade rather than skipping it.
+func (c *Clients) recordReleaseHash(rel *release.Release, hash string) {
+	if err := c.labelRelease(rel, map[string]string{ReleaseHashLabel: hash}); err != nil {
+		log.Printf("Warning: Recording the hash of release %s failed: %s", rel.Name, err)
+	}
+}
+
+// hookTimeout bounds helm's wait on hooks by the time left in this invocation, so a slow hook fails the
+// release rather than the invocation being cut off with the release left pending. The operation context's deadline
+// already leaves deadlineMargin to report, and operations aren't started with less than minOperationBudget left.
+func (c *Clients) hookTimeout() time.Duration {
+	deadline, ok := c.opContext().Deadline()
+	if !ok {
+		return defaultHookTimeout
+	}
+	if left := time.Until(deadline); left > 0 {
+		return left
+	}
+	return 0
+}
+
+// addHelmRepos adds and updates each of the repositories.
+func addHelmRepos(repos []ChartRepository, settings *cli.EnvSettings) error {
+	for _, r := range repos {
+		if err := addHelmRepoUpdate(aws.StringValue(r.Name), aws.StringValue(r.URL), settings); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateDependencies downloads the chart's missing dependencies from the added repositories and reloads it. Helm only
+// updates unpacked charts, so archives are expanded to a temp dir, removed by the returned cleanup.
+func (c *Clients) updateDependencies(cp string, ch *chart.Chart) (*chart.Chart, func(), error) {
+	cleanup := func() {}
+	if fi, err := os.Stat(cp); err == nil && !fi.IsDir() {
+		dir, err := ioutil.TempDir("", "chart-")
+		if err != nil {
+			return nil, nil, genericError("Updating dependencies", err)
+		}
+		cleanup = func() { os.RemoveAll(dir) }
+		if err := chartutil.ExpandFile(dir, cp); err != nil {
+			cleanup()
+			return nil, nil, genericError("Updating dependencies", err)
+		}
+		cp = filepath.Join(dir, ch.Name())
+	}
+	man := &downloader.Manager{
+		Out:       log.Writer(),
+		ChartPath: cp,
+		// The repositories were just updated by addHelmRepoUpdate.
+		SkipUpdate:       true,
+		Getters:          getter.All(c.Settings),
+		RepositoryConfig: c.Settings.RepositoryConfig,
+		RepositoryCache:  c.Settings.RepositoryCache,
+	}
+	if err := man.Update(); err != nil {
+		cleanup()
+		return nil, nil, genericError("Updating dependencies", err)
+	}
+	updated, err := loader.Load(cp)
+	if err != nil {
+		cleanup()
+		return nil, nil, genericError("Updating dependencies", err)
+	}
+	return updated, cleanup, nil
+}
+
 // HelmInstall invokes the helm install client
 func (c *Clients) HelmInstall(config *Config, values map[string]interface{}, chart *Chart, id string) error {
 	log.Printf("Installing release %s", *config.Name)
@@ -151,9 +330,28 @@ func (c *Clients) HelmInstall(config *Config, values map[string]interface{}, cha
 	client := action.NewInstall(c.HelmClient)
 	client.Description = id
 	client.ReleaseName = *config.Name
+	client.DisableHooks = config.DisableHooks
+	client.DisableOpenAPIValidation = config.DisableOpenAPIValidation
+	// Readiness is polled by later invocations, only hooks are waited on here.
+	client.Timeout = c.hookTimeout()
+	client.DependencyUpdate = len(config.Repositories) > 0 && !offline(config)
+	if pr := newCommonMetadata(config); pr != nil {
+		client.PostRenderer = pr
+	}
+	if !offline(config) {
+		if err := addHelmRepos(config.Repositories, c.Settings); err != nil {
+			return err
+		}
+	}
 
-	switch *chart.ChartType {
-	case "Remote":
+	cached, err := cachedChart(config, chart)
+	if err != nil {
+		return err
+	}
+	switch {
+	case cached != "":
+		cp = cached
+	case *chart.ChartType == "Remote":
 		if chart.ChartVersion != nil {
 			client.Version = *chart.ChartVersion
 		}
@@ -163,16 +361,28 @@ func (c *Clients) HelmInstall(config *Config, values map[string]interface{}, cha
 		}
 		cp, err = client.ChartPathOptions.LocateChart(*chart.Chart, c.Settings)
 		if err != nil {
-			return genericError("Helm Upgrade", err)
+			return withReason(ChartNotFound, genericError("Helm Upgrade", err))
+		}
+		storeChart(config, chart, cp)
+	case *chart.ChartType == "ConfigMap":
+		var cleanup func()
+		cp, cleanup, err = c.configMapChart(chart.ChartConfigMap, *config.Namespace)
+		if err != nil {
+			return err
 		}
+		defer cleanup()
 	default:
-		err = c.downloadChart(*chart.ChartPath, chartLocalPath)
+		var cleanup func()
+		cp, cleanup, err = c.fetchChart(chart)
 		if err != nil {
 			return err
 		}
-		cp = *chart.Chart
+		defer cleanup()
+		storeChart(config, chart, cp)
+	}
+	if err := verifyChartDigest(cp, chart.ChartSha256); err != nil {
+		return err
 	}
-	p := getter.All(c.Settings)
 	chartRequested, err := loader.Load(cp)
 	if err != nil {
 		return genericError("Helm install", err)
@@ -180,37 +390,75 @@ func (c *Clients) HelmInstall(config *Config, values map[string]interface{}, cha
 
 	if req := chartRequested.Metadata.Dependencies; req != nil {
 		if err := action.CheckDependencies(chartRequested, req); err != nil {
-			if client.DependencyUpdate {
-				man := &downloader.Manager{
-					ChartPath:        cp,
-					Keyring:          client.ChartPathOptions.Keyring,
-					SkipUpdate:       false,
-					Getters:          p,
-					RepositoryConfig: c.Settings.RepositoryConfig,
-					RepositoryCache:  c.Settings.RepositoryCache,
-				}
-				if err := man.Update(); err != nil {
-					return genericError("Helm install", err)
-				}
-			} else {
+			if !client.DependencyUpdate {
 				return genericError("Helm install", err)
 			}
+			var cleanup func()
+			chartRequested, cleanup, err = c.updateDependencies(cp, chartRequested)
+			if err != nil {
+				return err
+			}
+			defer cleanup()
 		}
 	}
+	values, err = c.clusterValues(config, values)
+	if err != nil {
+		return err
+	}
+	values, err = chartValueFiles(chartRequested, config.ValueFiles, values)
+	if err != nil {
+		return err
+	}
+	if err := validateValues(chartRequested, values); err != nil {
+		return err
+	}
 
-	err = c.createNamespace(*config.Namespace)
+	err = c.createNamespace(*config.Namespace, *config.Name)
 	// Here is fine still
 	if err != nil {
 		return err
 	}
+	unlock, err := c.lockRelease(*config.Name, *config.Namespace)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := c.ensurePullSecret(*config.Namespace, config.PullSecretName, config.PullSecretConfig); err != nil {
+		return err
+	}
+	if err := c.applyNamespaceManifests(*config.Namespace, *config.Name, config.NamespaceManifests); err != nil {
+		return err
+	}
+	if err := c.applyManifests("PreInstallManifests", *config.Namespace, config.PreInstallManifests); err != nil {
+		return err
+	}
+	if err := c.setCapabilities(config); err != nil {
+		return err
+	}
+	if len(chartRequested.CRDs()) > 0 {
+		if err := c.installCRDs(chartRequested); err != nil {
+			return err
+		}
+		client.SkipCRDs = true
+		// The OpenAPI schema used for validation is cached for the life of the process
+		// and won't know the kinds we just established.
+		if kinds := crdKinds(chartRequested); !client.DisableOpenAPIValidation && templatesUseKinds(chartRequested, kinds) {
+			log.Printf("Chart templates use kinds defined by its CRDs, disabling OpenAPI validation")
+			client.DisableOpenAPIValidation = true
+		}
+	}
 	client.Namespace = *config.Namespace
+	hash, err := releaseHash(chartRequested, values, config)
+	if err != nil {
+		return genericError("Helm install", err)
+	}
 	fmt.Println("calling client.Run...")
-	_, err = client.Run(chartRequested, values)
+	rel, err := client.Run(chartRequested, values)
 	fmt.Println("client.Run call completed.")
 	if err != nil {
 		fmt.Printf("err.Error(): \"%v\"", err.Error())
 		if err.Error() != "cannot re-use a name that is still in use" {
-			return genericError("Helm install", err)
+			return genericError("Helm install", describeApplyError(err))
 		}
 		status, staterr := c.HelmStatus(client.ReleaseName)
 		if staterr != nil {
@@ -218,33 +466,316 @@ func (c *Clients) HelmInstall(config *Config, values map[string]interface{}, cha
 		}
 		fmt.Printf("status.Description: \"%v\" id: \"%v\"", status.Description, id)
 		if status.Description != id {
-			return genericError("another release exists with the same name", err)
+			return withReason(ReleaseFailed, genericError("another release exists with the same name", err))
+		}
+	}
+	if err == nil {
+		c.recordReleaseHash(rel, hash)
+		if err := c.labelRelease(rel, config.ReleaseLabels); err != nil {
+			return err
 		}
 	}
 	log.Println("Successfully installed release: ", client.ReleaseName)
 	return nil
 }
 
+// chartValueFiles merges the named value files of the chart in order, beneath the provided values.
+func chartValueFiles(ch *chart.Chart, files []string, values map[string]interface{}) (map[string]interface{}, error) {
+	base := map[string]interface{}{}
+	for _, name := range files {
+		var data []byte
+		for _, f := range ch.Files {
+			if f.Name == filepath.ToSlash(filepath.Clean(name)) {
+				data = f.Data
+				break
+			}
+		}
+		if data == nil {
+			return nil, withReason(InvalidValues, genericError("Loading value files", fmt.Errorf("%s not found in chart %s", name, ch.Name())))
+		}
+		current := map[string]interface{}{}
+		if err := yaml.Unmarshal(data, &current); err != nil {
+			return nil, withReason(InvalidValues, genericError("Parsing value file "+name, err))
+		}
+		base = mergeMaps(base, current)
+	}
+	return mergeMaps(base, values), nil
+}
+
+// validateValues checks the values, over the chart's defaults, against the values.schema.json of the chart and its
+// subcharts, so a bad override is reported by key before anything is applied to the cluster.
+func validateValues(ch *chart.Chart, values map[string]interface{}) error {
+	merged, err := chartutil.CoalesceValues(ch, values)
+	if err != nil {
+		return withReason(InvalidValues, genericError("Validating values", err))
+	}
+	if err := chartutil.ValidateAgainstSchema(ch, merged); err != nil {
+		return withReason(InvalidValues, genericError("Validating values", err))
+	}
+	return nil
+}
+
+// clusterValues merges the values held in the referenced ConfigMap and Secret, in that order, beneath the provided values.
+func (c *Clients) clusterValues(config *Config, values map[string]interface{}) (map[string]interface{}, error) {
+	base := map[string]interface{}{}
+	for _, ref := range []struct {
+		kind string
+		from *ValueFrom
+	}{{"ConfigMap", config.ValueFromConfigMap}, {"Secret", config.ValueFromSecret}} {
+		if ref.from == nil {
+			continue
+		}
+		namespace := aws.StringValue(config.Namespace)
+		if ref.from.Namespace != nil {
+			namespace = *ref.from.Namespace
+		}
+		data, err := c.getValueFrom(ref.kind, namespace, aws.StringValue(ref.from.Name), aws.StringValue(ref.from.Key))
+		if err != nil {
+			return nil, withReason(InvalidValues, genericError("Loading values from "+ref.kind, err))
+		}
+		current := map[string]interface{}{}
+		if err := yaml.Unmarshal(data, &current); err != nil {
+			return nil, withReason(InvalidValues, genericError("Parsing values from "+ref.kind, err))
+		}
+		base = mergeMaps(base, current)
+	}
+	return mergeMaps(base, values), nil
+}
+
+// installCRDs creates the chart CRDs ahead of the release and waits for them to be established,
+// so custom resources of those kinds can be installed by the same release.
+func (c *Clients) installCRDs(ch *chart.Chart) error {
+	var all kube.ResourceList
+	for _, crd := range ch.CRDs() {
+		res, err := c.HelmClient.KubeClient.Build(bytes.NewBuffer(crd.Data), false)
+		if err != nil {
+			return genericError("Building CRDs", err)
+		}
+		if _, err := c.HelmClient.KubeClient.Create(res); err != nil {
+			if !kerrors.IsAlreadyExists(err) {
+				return genericError("Installing CRDs", err)
+			}
+			log.Printf("CRD %s is already present. Skipping.", crd.Name)
+		}
+		all = append(all, res...)
+	}
+	if err := c.HelmClient.KubeClient.Wait(all, c.hookTimeout()); err != nil {
+		return genericError("Waiting for CRDs", err)
+	}
+	c.resetDiscovery()
+	return nil
+}
+
+// templateKindRegex matches the kind of a resource in a template, which is usually literal.
+var templateKindRegex = regexp.MustCompile(`(?m)^\s*kind:\s*["']?([A-Za-z0-9]+)`)
+
+// crdKinds returns the kinds defined by the chart CRDs, including those of its dependencies.
+func crdKinds(ch *chart.Chart) map[string]bool {
+	kinds := map[string]bool{}
+	for _, crd := range ch.CRDs() {
+		for _, doc := range releaseutil.SplitManifests(string(crd.Data)) {
+			var def struct {
+				Spec struct {
+					Names struct {
+						Kind string `json:"kind"`
+					} `json:"names"`
+				} `json:"spec"`
+			}
+			if err := yaml.Unmarshal([]byte(doc), &def); err == nil && def.Spec.Names.Kind != "" {
+				kinds[def.Spec.Names.Kind] = true
+			}
+		}
+	}
+	return kinds
+}
+
+// templatesUseKinds reports whether a template of the chart or its dependencies has a resource of one of kinds.
+func templatesUseKinds(ch *chart.Chart, kinds map[string]bool) bool {
+	if len(kinds) == 0 {
+		return false
+	}
+	for _, t := range ch.Templates {
+		for _, m := range templateKindRegex.FindAllStringSubmatch(string(t.Data), -1) {
+			if kinds[m[1]] {
+				return true
+			}
+		}
+	}
+	for _, dep := range ch.Dependencies() {
+		if templatesUseKinds(dep, kinds) {
+			return true
+		}
+	}
+	return false
+}
+
+// resetDiscovery drops cached discovery data and REST mappings so newly established kinds are found.
+func (c *Clients) resetDiscovery() {
+	if c.HelmClient.RESTClientGetter == nil {
+		return
+	}
+	dc, err := c.HelmClient.RESTClientGetter.ToDiscoveryClient()
+	if err != nil {
+		log.Printf("Warning: Got error getting discovery client %s", err.Error())
+		return
+	}
+	dc.Invalidate()
+	if _, _, err := dc.ServerGroupsAndResources(); err != nil {
+		log.Printf("Warning: Got error refreshing discovery %s", err.Error())
+	}
+	mapper, err := c.HelmClient.RESTClientGetter.ToRESTMapper()
+	if err != nil {
+		log.Printf("Warning: Got error getting REST mapper %s", err.Error())
+		return
+	}
+	if r, ok := mapper.(interface{ Reset() }); ok {
+		r.Reset()
+	}
+}
+
+// takeOwnership renders the chart and stamps helm's ownership metadata on any existing objects
+// not owned by the release, so the upgrade adopts them rather than failing the conflict check.
+func (c *Clients) takeOwnership(name, namespace string, ch *chart.Chart, values map[string]interface{}) error {
+	// Render client only on a copy, as it swaps out the kube client and storage of the configuration.
+	cfg := *c.HelmClient
+	client := action.NewInstall(&cfg)
+	client.DryRun = true
+	client.ClientOnly = true
+	client.Replace = true
+	client.ReleaseName = name
+	client.Namespace = namespace
+	rel, err := client.Run(ch, values)
+	if err != nil {
+		return genericError("Rendering manifest", err)
+	}
+	res, err := c.HelmClient.KubeClient.Build(bytes.NewBufferString(rel.Manifest), false)
+	if err != nil {
+		return genericError("Building resources", err)
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels":      map[string]string{"app.kubernetes.io/managed-by": "Helm"},
+			"annotations": map[string]string{"meta.helm.sh/release-name": name, "meta.helm.sh/release-namespace": namespace},
+		},
+	})
+	if err != nil {
+		return genericError("Taking ownership", err)
+	}
+	for _, info := range res {
+		if err := info.Get(); err != nil {
+			if kerrors.IsNotFound(err) {
+				continue
+			}
+			return genericError("Taking ownership", err)
+		}
+		m, err := meta.Accessor(info.Object)
+		if err != nil {
+			return genericError("Taking ownership", err)
+		}
+		a := m.GetAnnotations()
+		if a["meta.helm.sh/release-name"] == name && a["meta.helm.sh/release-namespace"] == namespace {
+			continue
+		}
+		log.Printf("Taking ownership of %s %s/%s", info.Mapping.GroupVersionKind.Kind, info.Namespace, info.Name)
+		_, err = resource.NewHelper(info.Client, info.Mapping).Patch(info.Namespace, info.Name, types.MergePatchType, patch, nil)
+		if err != nil {
+			return genericError("Taking ownership", err)
+		}
+	}
+	return nil
+}
+
 // HelmUninstall invokes the helm uninstaller client
-func (c *Clients) HelmUninstall(name string) error {
+func (c *Clients) HelmUninstall(name string, config *Config) error {
 	log.Printf("Uninstalling release %s", name)
 	client := action.NewUninstall(c.HelmClient)
-	res, err := client.Run(name)
-	re := regexp.MustCompile(`not found`)
+	client.Timeout = defaultUninstallTime * time.Minute
+	if config != nil {
+		client.DisableHooks = config.DisableHooks
+		// With UninstallWait the record is kept so later invocations can poll its manifest, and purged once done.
+		client.KeepHistory = config.KeepHistory || config.UninstallWait
+		if config.UninstallTimeOut != nil {
+			client.Timeout = time.Duration(*config.UninstallTimeOut) * time.Minute
+		}
+	}
+	// Pre-delete hooks still running when the invocation is cut off would leave the release half uninstalled.
+	if t := c.hookTimeout(); t < client.Timeout {
+		client.Timeout = t
+	}
+	var namespace string
+	if config != nil {
+		namespace = aws.StringValue(config.Namespace)
+	}
+	unlock, err := c.lockRelease(name, namespace)
 	if err != nil {
-		if re.MatchString(err.Error()) {
-			log.Printf("Release not found..")
+		return err
+	}
+	defer unlock()
+	res, err := client.Run(name)
+	switch {
+	case isReleaseNotFound(err):
+		log.Printf("Release not found..")
+	case isReleaseDeleted(err):
+		log.Printf("Release \"%s\" already uninstalled\n", name)
+	case err != nil:
+		return genericError("Helm Uninstall", err)
+	default:
+		if res != nil && res.Info != "" {
+			log.Printf(res.Info)
+		}
+		// The uninstall action in this helm version has no description, it's set on the kept record instead.
+		if config != nil && client.KeepHistory && config.UninstallDescription != nil && res != nil && res.Release != nil {
+			res.Release.Info.Description = *config.UninstallDescription
+			if err := c.HelmClient.Releases.Update(res.Release); err != nil {
+				return genericError("Helm Uninstall", err)
+			}
+		}
+		if config != nil && config.UninstallWait {
+			log.Printf("Release \"%s\" uninstalled, waiting for its resources to be deleted\n", name)
 			return nil
 		}
-		return genericError("Helm Uninstall", err)
+		log.Printf("Release \"%s\" uninstalled\n", name)
+	}
+	if config != nil && config.DeletePreInstallManifests {
+		if err := c.deleteManifests("PreInstallManifests", aws.StringValue(config.Namespace), config.PreInstallManifests); err != nil {
+			return err
+		}
 	}
-	if res != nil && res.Info != "" {
-		log.Printf(res.Info)
+	// Also on not found, so a retry after a failed namespace delete still cleans up.
+	if config != nil && config.DeleteNamespaceOnUninstall {
+		return c.deleteNamespace(aws.StringValue(config.Namespace), name)
 	}
-	log.Printf("Release \"%s\" uninstalled\n", name)
 	return nil
 }
 
+// CheckPendingDeletion reports whether any resource in the release manifest still exists, skipping any kept by resource policy.
+func (c *Clients) CheckPendingDeletion(r *ReleaseData) (bool, error) {
+	log.Printf("Checking resources of %s are deleted", r.Name)
+	if r.Manifest == "" {
+		return true, errors.New("Manifest not provided in the request")
+	}
+	res, err := c.HelmClient.KubeClient.Build(bytes.NewBufferString(r.Manifest), false)
+	if err != nil {
+		return true, genericError("Building resources", err)
+	}
+	for _, info := range res {
+		if m, err := meta.Accessor(info.Object); err == nil && m.GetAnnotations()[kube.ResourcePolicyAnno] == kube.KeepPolicy {
+			continue
+		}
+		err := info.Get()
+		if err == nil {
+			msg := fmt.Sprintf("%s %s/%s still present", info.Mapping.GroupVersionKind.Kind, info.Namespace, info.Name)
+			log.Printf(msg)
+			pushLastKnownError(msg)
+			return true, nil
+		}
+		if !kerrors.IsNotFound(err) {
+			return true, genericError("Checking resource deletion", err)
+		}
+	}
+	return false, nil
+}
+
 // HelmStatus check the Status for specified release
 func (c *Clients) HelmStatus(name string) (*HelmStatusData, error) {
 	log.Printf("Checking release status %s", name)
@@ -259,28 +790,137 @@ func (c *Clients) HelmStatus(name string) (*HelmStatusData, error) {
 		h.Manifest = res.Manifest
 		if res.Info != nil {
 			h.Status = res.Info.Status
+			h.LastDeployed = res.Info.LastDeployed.Format(time.RFC3339)
 		}
 		if res.Chart != nil {
 			h.ChartName = res.Chart.Metadata.Name
 			h.ChartVersion = res.Chart.Metadata.Version
 			h.Chart = res.Chart.Metadata.Name + "-" + res.Chart.Metadata.Version
+			h.ChartChecksum, err = chartChecksum(res.Chart)
+			if err != nil {
+				return nil, genericError("Chart checksum", err)
+			}
 		}
 	}
 	log.Printf("Found release in %s status", h.Status)
 	return h, nil
 }
 
+// HelmUnlock marks the latest revision of a release failed when it's stuck in a pending state, so helm accepts
+// another operation on it. It's only done holding the release's lock, so no operation of the provider is running on
+// it, and fails asking for a manual recovery when the lock can't be managed.
+func (c *Clients) HelmUnlock(name string) error {
+	log.Printf("Unlocking release %s", name)
+	rel, err := c.HelmClient.Releases.Last(name)
+	if err != nil {
+		return genericError("Helm unlock", err)
+	}
+	switch rel.Info.Status {
+	case release.StatusPendingInstall, release.StatusPendingUpgrade, release.StatusPendingRollback:
+	default:
+		return nil
+	}
+	unlock, err := c.takeReleaseLock(name, rel.Namespace)
+	if kerrors.IsForbidden(err) {
+		return withReason(ReleaseFailed, fmt.Errorf("release %s is stuck in %s state and can't be checked for a running operation as leases can't be managed (%s), recover it manually, e.g. with helm rollback or, if it was never deployed, helm uninstall", name, rel.Info.Status, err))
+	}
+	if err != nil {
+		log.Printf("Release %s is locked by a running operation, leaving it %s", name, rel.Info.Status)
+		return err
+	}
+	defer unlock()
+	rel.SetStatus(release.StatusFailed, fmt.Sprintf("Marked failed after staying in %s state with no helm operation running", rel.Info.Status))
+	if err := c.HelmClient.Releases.Update(rel); err != nil {
+		return genericError("Helm unlock", err)
+	}
+	return nil
+}
+
+// unchangedRelease returns the deployed release if its revision was installed or upgraded with hash, in which case
+// an upgrade would only add a revision. The hash recorded at the time is compared, as the stored release keeps neither
+// the chart's dependencies nor the options it was rendered with.
+func (c *Clients) unchangedRelease(name string, hash string) (*release.Release, error) {
+	rel, err := c.HelmClient.Releases.Last(name)
+	if err != nil || rel.Info == nil || rel.Info.Status != release.StatusDeployed {
+		return nil, nil
+	}
+	s, err := c.releaseSecret(rel)
+	if err != nil {
+		if kerrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, genericError("Comparing release", err)
+	}
+	if s.Labels[ReleaseHashLabel] != hash {
+		return nil, nil
+	}
+	return rel, nil
+}
+
+// releaseHash hashes a chart together with the values and the options changing how it's rendered.
+func releaseHash(ch *chart.Chart, values map[string]interface{}, config *Config) (string, error) {
+	sum, err := chartChecksum(ch)
+	if err != nil {
+		return "", err
+	}
+	if values == nil {
+		values = map[string]interface{}{}
+	}
+	b, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+	o, err := json.Marshal(struct {
+		KubeVersion  *string
+		APIVersions  []string
+		DisableHooks bool
+	}{config.KubeVersion, config.APIVersions, config.DisableHooks})
+	if err != nil {
+		return "", err
+	}
+	return *getHash(sum + string(b) + string(o)), nil
+}
+
+// chartChecksum hashes the chart metadata, default values, templates, files and dependencies.
+func chartChecksum(ch *chart.Chart) (string, error) {
+	h := sha256.New()
+	for _, v := range []interface{}{ch.Metadata, ch.Values} {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		h.Write(b)
+	}
+	files := append(append([]*chart.File{}, ch.Templates...), ch.Files...)
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	for _, f := range files {
+		h.Write([]byte(f.Name))
+		h.Write(f.Data)
+	}
+	for _, d := range ch.Dependencies() {
+		sum, err := chartChecksum(d)
+		if err != nil {
+			return "", err
+		}
+		h.Write([]byte(sum))
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
 // HelmList list the release with specific chart and version in a namespace.
-func (c *Clients) HelmList(config *Config, chart *Chart) ([]HelmListData, error) {
+// Namespaces that can't be listed are reported as warnings instead of failing the list.
+func (c *Clients) HelmList(config *Config, chart *Chart) ([]HelmListData, []string, error) {
 	a := []HelmListData{}
 	l := HelmListData{}
+	var warnings []string
 	client := action.NewList(c.HelmClient)
 	client.All = true
 	client.AllNamespaces = true
 	client.SetStateMask()
 	res, err := client.Run()
 	if err != nil {
-		return nil, err
+		log.Printf("Listing releases in all namespaces failed, listing each namespace: %s", err)
+		res, warnings = c.listByNamespace(aws.StringValue(config.Namespace))
 	}
 	for _, r := range res {
 		if chart.ChartVersion != nil {
@@ -305,18 +945,78 @@ func (c *Clients) HelmList(config *Config, chart *Chart) ([]HelmListData, error)
 			a = append(a, l)
 		}
 	}
-	return a, nil
+	return a, warnings, nil
+}
+
+// listByNamespace lists the latest revision of the releases in each namespace it is allowed to read.
+// It falls back to namespace when namespaces can't be listed.
+func (c *Clients) listByNamespace(namespace string) ([]*release.Release, []string) {
+	var warnings []string
+	namespaces := []string{namespace}
+	nsList, err := c.ClientSet.CoreV1().Namespaces().List(c.opContext(), metav1.ListOptions{})
+	if err != nil {
+		warnings = append(warnings, fmt.Sprintf("listing namespaces: %s", err))
+	} else {
+		namespaces = nil
+		for _, ns := range nsList.Items {
+			namespaces = append(namespaces, ns.Name)
+		}
+	}
+	latest := map[string]*release.Release{}
+	for _, ns := range namespaces {
+		rels, err := driver.NewSecrets(c.ClientSet.CoreV1().Secrets(ns)).List(func(*release.Release) bool { return true })
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("listing releases in namespace %s: %s", ns, err))
+			continue
+		}
+		for _, r := range rels {
+			key := r.Namespace + "/" + r.Name
+			if cur, ok := latest[key]; !ok || r.Version > cur.Version {
+				latest[key] = r
+			}
+		}
+	}
+	res := make([]*release.Release, 0, len(latest))
+	for _, r := range latest {
+		res = append(res, r)
+	}
+	for _, w := range warnings {
+		log.Printf("Warning: %s", w)
+	}
+	return res, warnings
 }
 
 // HelmUpgrade invokes the helm upgrade client
 func (c *Clients) HelmUpgrade(name string, config *Config, values map[string]interface{}, chart *Chart) error {
 	log.Printf("Upgrading release %s", name)
 	client := action.NewUpgrade(c.HelmClient)
+	client.MaxHistory = defaultMaxHistory
+	if config.MaxHistory != nil {
+		client.MaxHistory = *config.MaxHistory
+	}
+	client.DisableOpenAPIValidation = config.DisableOpenAPIValidation
+	client.DisableHooks = config.DisableHooks
+	client.Timeout = c.hookTimeout()
+	metadata := newCommonMetadata(config)
+	if metadata != nil {
+		client.PostRenderer = metadata
+	}
+	if !offline(config) {
+		if err := addHelmRepos(config.Repositories, c.Settings); err != nil {
+			return err
+		}
+	}
 	var cp string
 	var err error
 
-	switch *chart.ChartType {
-	case "Remote":
+	cached, err := cachedChart(config, chart)
+	if err != nil {
+		return err
+	}
+	switch {
+	case cached != "":
+		cp = cached
+	case *chart.ChartType == "Remote":
 		if chart.ChartVersion != nil {
 			client.Version = *chart.ChartVersion
 		}
@@ -326,14 +1026,27 @@ func (c *Clients) HelmUpgrade(name string, config *Config, values map[string]int
 		}
 		cp, err = client.ChartPathOptions.LocateChart(*chart.Chart, c.Settings)
 		if err != nil {
-			return genericError("Helm Upgrade", err)
+			return withReason(ChartNotFound, genericError("Helm Upgrade", err))
+		}
+		storeChart(config, chart, cp)
+	case *chart.ChartType == "ConfigMap":
+		var cleanup func()
+		cp, cleanup, err = c.configMapChart(chart.ChartConfigMap, *config.Namespace)
+		if err != nil {
+			return err
 		}
+		defer cleanup()
 	default:
-		err = c.downloadChart(*chart.ChartPath, chartLocalPath)
+		var cleanup func()
+		cp, cleanup, err = c.fetchChart(chart)
 		if err != nil {
 			return err
 		}
-		cp = *chart.Chart
+		defer cleanup()
+		storeChart(config, chart, cp)
+	}
+	if err := verifyChartDigest(cp, chart.ChartSha256); err != nil {
+		return err
 	}
 	// Check chart dependencies to make sure all are present in /charts
 	ch, err := loader.Load(cp)
@@ -342,14 +1055,71 @@ func (c *Clients) HelmUpgrade(name string, config *Config, values map[string]int
 	}
 	if req := ch.Metadata.Dependencies; req != nil {
 		if err := action.CheckDependencies(ch, req); err != nil {
-			return genericError("Helm Upgrade", err)
+			if len(config.Repositories) == 0 || offline(config) {
+				return genericError("Helm Upgrade", err)
+			}
+			var cleanup func()
+			ch, cleanup, err = c.updateDependencies(cp, ch)
+			if err != nil {
+				return err
+			}
+			defer cleanup()
 		}
 	}
+	values, err = c.clusterValues(config, values)
+	if err != nil {
+		return err
+	}
+	values, err = chartValueFiles(ch, config.ValueFiles, values)
+	if err != nil {
+		return err
+	}
+	if err := validateValues(ch, values); err != nil {
+		return err
+	}
 
-	rel, err := client.Run(name, ch, values)
+	if err := c.setCapabilities(config); err != nil {
+		return err
+	}
+	if err := c.ensurePullSecret(*config.Namespace, config.PullSecretName, config.PullSecretConfig); err != nil {
+		return err
+	}
+	if err := c.applyNamespaceManifests(*config.Namespace, name, config.NamespaceManifests); err != nil {
+		return err
+	}
+	if err := c.applyManifests("PreInstallManifests", *config.Namespace, config.PreInstallManifests); err != nil {
+		return err
+	}
+	unlock, err := c.lockRelease(name, *config.Namespace)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	hash, err := releaseHash(ch, values, config)
 	if err != nil {
 		return genericError("Helm Upgrade", err)
 	}
+	current, err := c.unchangedRelease(name, hash)
+	if err != nil {
+		return err
+	}
+	if current != nil && metadata.applied(current.Manifest) {
+		log.Printf("Release %q chart and values are unchanged, skipping the upgrade\n", name)
+		return c.labelRelease(current, config.ReleaseLabels)
+	}
+	if config.TakeOwnership {
+		if err := c.takeOwnership(name, *config.Namespace, ch, values); err != nil {
+			return err
+		}
+	}
+	rel, err := client.Run(name, ch, values)
+	if err != nil {
+		return genericError("Helm Upgrade", describeApplyError(err))
+	}
+	c.recordReleaseHash(rel, hash)
+	if err := c.labelRelease(rel, config.ReleaseLabels); err != nil {
+		return err
+	}
 	log.Printf("Release %q has been upgraded. Happy Helming!\n", rel.Name)
 	return nil
 
@@ -1,15 +1,34 @@
 package resource
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"helm.sh/helm/v3/pkg/cli"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/stretchr/testify/assert"
+	"helm.sh/helm/v3/pkg/chart"
+	kubefake "helm.sh/helm/v3/pkg/kube/fake"
+	"helm.sh/helm/v3/pkg/release"
 	"helm.sh/helm/v3/pkg/repo"
+	"helm.sh/helm/v3/pkg/storage/driver"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/kubectl/pkg/scheme"
 )
 
 func TestHelmClientInvoke(t *testing.T) {
@@ -20,18 +39,28 @@ func TestHelmClientInvoke(t *testing.T) {
 
 // TestAddHelmRepoUpdate to test addHelmRepoUpdate
 func TestAddHelmRepoUpdate(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("apiVersion: v1\nentries: {}\n"))
+	}))
+	defer testServer.Close()
 	c := NewMockClient(t, nil)
 	defer os.Remove(c.Settings.RepositoryConfig)
+	other := &repo.Entry{Name: "other", URL: "https://other.example.com"}
+	f := repo.NewFile()
+	f.Update(other)
+	assert.Nil(t, f.WriteFile(c.Settings.RepositoryConfig, 0644))
 	tests := map[string]struct {
 		name        string
 		url         string
-		eCount      int
 		expectedErr *string
 	}{
 		"StableRepo": {
-			name:   "stable",
-			url:    "https://kubernetes-charts.storage.googleapis.com",
-			eCount: 1,
+			name: "stable",
+			url:  "https://kubernetes-charts.storage.googleapis.com",
+		},
+		"LocalRepo": {
+			name: "local",
+			url:  testServer.URL,
 		},
 		"WrongRepo": {
 			name:        "stable",
@@ -42,19 +71,44 @@ func TestAddHelmRepoUpdate(t *testing.T) {
 	for name, d := range tests {
 		t.Run(name, func(t *testing.T) {
 			err := addHelmRepoUpdate(d.name, d.url, c.Settings)
+			r, _ := repo.LoadFile(c.Settings.RepositoryConfig)
+			assert.True(t, r.Has(other.Name))
 			if err != nil {
 				assert.Contains(t, err.Error(), aws.StringValue(d.expectedErr))
 			} else {
-				r, _ := repo.LoadFile(c.Settings.RepositoryConfig)
-				assert.Equal(t, d.eCount, len(r.Repositories))
+				for _, e := range r.Repositories {
+					if e.Name == d.name {
+						assert.Equal(t, d.url, e.URL)
+					}
+				}
+				assert.True(t, r.Has(d.name))
 			}
 		})
 	}
 }
 
+// TestAddHelmRepos to test addHelmRepos
+func TestAddHelmRepos(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("apiVersion: v1\nentries: {}\n"))
+	}))
+	defer testServer.Close()
+	c := NewMockClient(t, nil)
+	defer os.Remove(c.Settings.RepositoryConfig)
+	repos := []ChartRepository{
+		{Name: aws.String("one"), URL: aws.String(testServer.URL + "/one")},
+		{Name: aws.String("two"), URL: aws.String(testServer.URL + "/two")},
+	}
+	assert.Nil(t, addHelmRepos(repos, c.Settings))
+	r, err := repo.LoadFile(c.Settings.RepositoryConfig)
+	assert.Nil(t, err)
+	assert.True(t, r.Has("one"))
+	assert.True(t, r.Has("two"))
+	assert.Contains(t, addHelmRepos([]ChartRepository{{Name: aws.String("bad"), URL: aws.String("https://test.com")}}, c.Settings).Error(), "is not a valid chart repository")
+}
+
 // TestHelmInstall to test HelmInstall
 func TestHelmInstall(t *testing.T) {
-	defer os.Remove(chartLocalPath)
 	testServer := httptest.NewServer(http.StripPrefix("/", http.FileServer(http.Dir(TestFolder))))
 	defer func() { testServer.Close() }()
 	c := NewMockClient(t, nil)
@@ -101,6 +155,14 @@ func TestHelmInstall(t *testing.T) {
 				Namespace: aws.String("default"),
 			},
 		},
+		"DisableHooks": {
+			m: &Model{Chart: aws.String(testServer.URL + "/test.tgz")},
+			config: &Config{
+				Name:         aws.String("DisableHooks"),
+				Namespace:    aws.String("default"),
+				DisableHooks: true,
+			},
+		},
 	}
 
 	for name, d := range tests {
@@ -114,17 +176,217 @@ func TestHelmInstall(t *testing.T) {
 	}
 }
 
+// TestHookTimeout to test hookTimeout
+func TestHookTimeout(t *testing.T) {
+	c := NewMockClient(t, nil)
+	assert.Equal(t, defaultHookTimeout, c.hookTimeout())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	c.WithContext(ctx)
+	timeout := c.hookTimeout()
+	assert.True(t, timeout > time.Minute-deadlineMargin && timeout <= time.Minute)
+	// Past the deadline it's clamped rather than negative.
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	c.WithContext(ctx)
+	assert.Equal(t, time.Duration(0), c.hookTimeout())
+}
+
+// TestUnchangedRelease to test unchangedRelease compares the hash recorded on the release
+func TestUnchangedRelease(t *testing.T) {
+	c := NewMockClient(t, nil)
+	withDependency := func(version string) *chart.Chart {
+		ch := buildChart()
+		dep := buildChart()
+		dep.Metadata.Name = "sub"
+		dep.Metadata.Version = version
+		ch.AddDependency(dep)
+		return ch
+	}
+	hash, err := releaseHash(withDependency("0.1.0"), nil, &Config{})
+	assert.Nil(t, err)
+	_, err = c.ClientSet.CoreV1().Secrets("default").Create(context.Background(), &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "sh.helm.release.v1.one.v1",
+			Namespace: "default",
+			Labels:    map[string]string{ReleaseHashLabel: hash},
+		},
+	}, metav1.CreateOptions{})
+	assert.Nil(t, err)
+	tests := map[string]struct {
+		name      string
+		chart     *chart.Chart
+		values    map[string]interface{}
+		config    *Config
+		unchanged bool
+	}{
+		"Unchanged": {
+			name:      "one",
+			chart:     withDependency("0.1.0"),
+			unchanged: true,
+		},
+		"ValuesChanged": {
+			name:   "one",
+			chart:  withDependency("0.1.0"),
+			values: map[string]interface{}{"replicas": 2},
+		},
+		"ChartChanged": {
+			name: "one",
+			chart: func() *chart.Chart {
+				ch := withDependency("0.1.0")
+				ch.Metadata.Version = "0.2.0"
+				return ch
+			}(),
+		},
+		"DependencyChanged": {
+			name:  "one",
+			chart: withDependency("0.2.0"),
+		},
+		"KubeVersionChanged": {
+			name:   "one",
+			chart:  withDependency("0.1.0"),
+			config: &Config{KubeVersion: aws.String("1.20")},
+		},
+		"HooksDisabled": {
+			name:   "one",
+			chart:  withDependency("0.1.0"),
+			config: &Config{DisableHooks: true},
+		},
+		"NotRecorded": {
+			name:  "three",
+			chart: withDependency("0.1.0"),
+		},
+		"NotDeployed": {
+			name:  "two",
+			chart: withDependency("0.1.0"),
+		},
+		"NotFound": {
+			name:  "missing",
+			chart: withDependency("0.1.0"),
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			config := d.config
+			if config == nil {
+				config = &Config{}
+			}
+			hash, err := releaseHash(d.chart, d.values, config)
+			assert.Nil(t, err)
+			rel, err := c.unchangedRelease(d.name, hash)
+			assert.Nil(t, err)
+			assert.Equal(t, d.unchanged, rel != nil)
+		})
+	}
+}
+
+// TestValidateValues to test validateValues
+func TestValidateValues(t *testing.T) {
+	ch := buildChart()
+	ch.Values = map[string]interface{}{"replicas": 1}
+	ch.Schema = []byte(`{"properties": {"replicas": {"type": "integer"}, "name": {"type": "string"}}, "required": ["replicas"]}`)
+	tests := map[string]struct {
+		values      map[string]interface{}
+		expectedErr string
+	}{
+		"Defaults": {},
+		"Valid": {
+			values: map[string]interface{}{"replicas": 2, "name": "test"},
+		},
+		"WrongType": {
+			values:      map[string]interface{}{"replicas": "two"},
+			expectedErr: "replicas: Invalid type. Expected: integer, given: string",
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := validateValues(ch, d.values)
+			if d.expectedErr != "" {
+				assert.Contains(t, err.Error(), d.expectedErr)
+			} else {
+				assert.Nil(t, err)
+			}
+		})
+	}
+	assert.Nil(t, validateValues(buildChart(), map[string]interface{}{"any": "value"}))
+}
+
 // TestHelmUninstall to test HelmUninstall
 func TestHelmUninstall(t *testing.T) {
 	expectedErr := "not found"
 	c := NewMockClient(t, nil)
-	releases := []string{"one", "five"}
-	for _, rel := range releases {
-		t.Run(rel, func(t *testing.T) {
-			err := c.HelmUninstall(rel)
+	tests := map[string]struct {
+		name   string
+		config *Config
+	}{
+		"Default": {
+			name: "one",
+		},
+		"NoHooks": {
+			name: "two",
+			config: &Config{
+				DisableHooks:     true,
+				KeepHistory:      true,
+				UninstallTimeOut: aws.Int(1),
+			},
+		},
+		"Wait": {
+			name: "three",
+			config: &Config{
+				UninstallWait:    true,
+				UninstallTimeOut: aws.Int(1),
+			},
+		},
+		"NonExt": {
+			name: "five",
+		},
+		"Description": {
+			name: "four",
+			config: &Config{
+				KeepHistory:          true,
+				UninstallDescription: aws.String("Replaced by the payments-v2 stack"),
+			},
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := c.HelmUninstall(d.name, d.config)
 			if err != nil {
 				assert.Contains(t, err.Error(), expectedErr)
 			}
+			if d.config != nil && d.config.UninstallDescription != nil {
+				rel, err := c.HelmClient.Releases.Last(d.name)
+				assert.Nil(t, err)
+				assert.Equal(t, *d.config.UninstallDescription, rel.Info.Description)
+			}
+		})
+	}
+}
+
+// TestCheckPendingDeletion to test CheckPendingDeletion
+func TestCheckPendingDeletion(t *testing.T) {
+	c := NewMockClient(t, nil)
+	tests := map[string]struct {
+		manifest    string
+		expectedErr string
+	}{
+		"Deleted": {
+			manifest: TestManifest,
+		},
+		"NoManifest": {
+			expectedErr: "Manifest not provided in the request",
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			pending, err := c.CheckPendingDeletion(&ReleaseData{Name: "test", Namespace: "default", Manifest: d.manifest})
+			if d.expectedErr != "" {
+				assert.EqualError(t, err, d.expectedErr)
+				assert.True(t, pending)
+				return
+			}
+			assert.Nil(t, err)
+			assert.False(t, pending)
 		})
 	}
 }
@@ -132,6 +394,8 @@ func TestHelmUninstall(t *testing.T) {
 // TestHelmStatus to test HelmStatus
 func TestHelmStatus(t *testing.T) {
 	c := NewMockClient(t, nil)
+	sum, err := chartChecksum(buildChart())
+	assert.Nil(t, err)
 	tests := map[string]struct {
 		name        string
 		eStatus     *HelmStatusData
@@ -140,12 +404,13 @@ func TestHelmStatus(t *testing.T) {
 		"Deployed": {
 			name: "one",
 			eStatus: &HelmStatusData{
-				Chart:        "hello-0.1.0",
-				ChartName:    "hello",
-				Status:       "deployed",
-				Namespace:    "default",
-				ChartVersion: "0.1.0",
-				Manifest:     TestManifest,
+				Chart:         "hello-0.1.0",
+				ChartName:     "hello",
+				Status:        "deployed",
+				Namespace:     "default",
+				ChartVersion:  "0.1.0",
+				Manifest:      TestManifest,
+				ChartChecksum: sum,
 			},
 		},
 		"NonExt": {
@@ -159,12 +424,50 @@ func TestHelmStatus(t *testing.T) {
 			if err != nil {
 				assert.Contains(t, err.Error(), aws.StringValue(d.expectedErr))
 			} else {
+				assert.NotEmpty(t, h.LastDeployed)
+				h.LastDeployed = ""
 				assert.EqualValues(t, d.eStatus, h)
 			}
 		})
 	}
 }
 
+// TestChartChecksum to test chartChecksum
+func TestChartChecksum(t *testing.T) {
+	base, err := chartChecksum(buildChart())
+	assert.Nil(t, err)
+	tests := map[string]struct {
+		chart  *chart.Chart
+		eEqual bool
+	}{
+		"Same": {
+			chart:  buildChart(),
+			eEqual: true,
+		},
+		"Template": {
+			chart: func() *chart.Chart {
+				c := buildChart()
+				c.Templates[0].Data = []byte("changed")
+				return c
+			}(),
+		},
+		"Values": {
+			chart: func() *chart.Chart {
+				c := buildChart()
+				c.Values = map[string]interface{}{"replicas": 2}
+				return c
+			}(),
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			sum, err := chartChecksum(d.chart)
+			assert.Nil(t, err)
+			assert.Equal(t, d.eEqual, sum == base)
+		})
+	}
+}
+
 // TestHelmList to test HelmList
 func TestHelmList(t *testing.T) {
 	c := NewMockClient(t, nil)
@@ -195,7 +498,7 @@ func TestHelmList(t *testing.T) {
 	}
 	for name, d := range tests {
 		t.Run(name, func(t *testing.T) {
-			h, err := c.HelmList(d.config, d.chart)
+			h, _, err := c.HelmList(d.config, d.chart)
 			if err != nil {
 				assert.Contains(t, err.Error(), aws.StringValue(d.expectedErr))
 			} else {
@@ -205,9 +508,36 @@ func TestHelmList(t *testing.T) {
 	}
 }
 
+// TestListByNamespace to test listByNamespace skips namespaces it can't read
+func TestListByNamespace(t *testing.T) {
+	cs := fakeclientset.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-b"}},
+	)
+	cs.PrependReactor("list", "secrets", func(a k8stesting.Action) (bool, runtime.Object, error) {
+		if a.GetNamespace() == "team-b" {
+			return true, nil, kerrors.NewForbidden(schema.GroupResource{Resource: "secrets"}, "", errors.New("denied"))
+		}
+		return false, nil, nil
+	})
+	for ns, versions := range map[string][]int{"team-a": {1, 2}, "team-b": {1}} {
+		d := driver.NewSecrets(cs.CoreV1().Secrets(ns))
+		for _, v := range versions {
+			r := &release.Release{Name: "app", Namespace: ns, Version: v, Info: &release.Info{Status: release.StatusDeployed}, Chart: &chart.Chart{Metadata: &chart.Metadata{Name: "hello", Version: "0.1.0"}}}
+			assert.Nil(t, d.Create(fmt.Sprintf("sh.helm.release.v1.app.v%d", v), r))
+		}
+	}
+	c := &Clients{ClientSet: cs}
+	res, warnings := c.listByNamespace("default")
+	assert.Len(t, res, 1)
+	assert.Equal(t, "team-a", res[0].Namespace)
+	assert.Equal(t, 2, res[0].Version)
+	assert.Len(t, warnings, 1)
+	assert.Contains(t, warnings[0], "namespace team-b")
+}
+
 // TestHelmUpgrade to test HelmUpgrade
 func TestHelmUpgrade(t *testing.T) {
-	defer os.Remove(chartLocalPath)
 	testServer := httptest.NewServer(http.StripPrefix("/", http.FileServer(http.Dir(TestFolder))))
 	defer func() { testServer.Close() }()
 	c := NewMockClient(t, nil)
@@ -254,6 +584,14 @@ func TestHelmUpgrade(t *testing.T) {
 			},
 			expectedErr: aws.String("failed to download"),
 		},
+		"TakeOwnership": {
+			m: &Model{Chart: aws.String(testServer.URL + "/test.tgz")},
+			config: &Config{
+				Name:          aws.String("test"),
+				Namespace:     aws.String("default"),
+				TakeOwnership: true,
+			},
+		},
 	}
 
 	for name, d := range tests {
@@ -266,3 +604,368 @@ func TestHelmUpgrade(t *testing.T) {
 		})
 	}
 }
+
+// TestSetCapabilities to test setCapabilities
+func TestSetCapabilities(t *testing.T) {
+	c := NewMockClient(t, nil)
+	tests := map[string]struct {
+		config       *Config
+		eKubeVersion string
+		eAPIVersion  string
+		expectedErr  *string
+	}{
+		"KubeVersion": {
+			config:       &Config{KubeVersion: aws.String("1.29")},
+			eKubeVersion: "v1.29.0",
+		},
+		"FullKubeVersion": {
+			config:       &Config{KubeVersion: aws.String("v1.28.3")},
+			eKubeVersion: "v1.28.3",
+		},
+		"APIVersions": {
+			config:      &Config{APIVersions: []string{"monitoring.coreos.com/v1"}},
+			eAPIVersion: "monitoring.coreos.com/v1",
+		},
+		"WrongKubeVersion": {
+			config:      &Config{KubeVersion: aws.String("latest")},
+			expectedErr: aws.String("invalid KubeVersion"),
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := c.setCapabilities(d.config)
+			if err != nil {
+				assert.Contains(t, err.Error(), aws.StringValue(d.expectedErr))
+				return
+			}
+			if d.eKubeVersion != "" {
+				assert.Equal(t, d.eKubeVersion, c.HelmClient.Capabilities.KubeVersion.Version)
+			}
+			if d.eAPIVersion != "" {
+				assert.True(t, c.HelmClient.Capabilities.APIVersions.Has(d.eAPIVersion))
+			}
+		})
+	}
+}
+
+// TestInstallCRDs to test installCRDs
+func TestInstallCRDs(t *testing.T) {
+	c := NewMockClient(t, nil)
+	crds := buildChart()
+	crds.Files = append(crds.Files, &chart.File{
+		Name: "crds/crd.yaml",
+		Data: []byte("apiVersion: apiextensions.k8s.io/v1\nkind: CustomResourceDefinition\nmetadata:\n  name: tests.example.com"),
+	})
+	tests := map[string]struct {
+		chart *chart.Chart
+	}{
+		"WithCRDs": {
+			chart: crds,
+		},
+		"WithOutCRDs": {
+			chart: buildChart(),
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := c.installCRDs(d.chart)
+			assert.Nil(t, err)
+		})
+	}
+}
+
+// TestTemplatesUseKinds to test crdKinds and templatesUseKinds
+func TestTemplatesUseKinds(t *testing.T) {
+	crd := &chart.File{
+		Name: "crds/crd.yaml",
+		Data: []byte("apiVersion: apiextensions.k8s.io/v1\nkind: CustomResourceDefinition\nmetadata:\n  name: widgets.example.com\nspec:\n  names:\n    kind: Widget\n"),
+	}
+	widget := &chart.File{Name: "templates/widget.yaml", Data: []byte("apiVersion: example.com/v1\nkind: Widget\nmetadata:\n  name: {{ .Release.Name }}\n")}
+	withCRD := func(templates ...*chart.File) *chart.Chart {
+		ch := buildChart()
+		ch.Files = append(ch.Files, crd)
+		ch.Templates = append(ch.Templates, templates...)
+		return ch
+	}
+	sub := buildChart()
+	sub.Metadata.Name = "sub"
+	sub.Templates = append(sub.Templates, widget)
+	parent := withCRD()
+	parent.AddDependency(sub)
+	tests := map[string]struct {
+		chart    *chart.Chart
+		expected bool
+	}{
+		"UsesKind": {chart: withCRD(widget), expected: true},
+		"OnlyCRD":  {chart: withCRD()},
+		"NoCRDs":   {chart: buildChart()},
+		"Subchart": {chart: parent, expected: true},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, d.expected, templatesUseKinds(d.chart, crdKinds(d.chart)))
+		})
+	}
+	assert.Equal(t, map[string]bool{"Widget": true}, crdKinds(withCRD()))
+}
+
+// TestTakeOwnership to test takeOwnership
+func TestTakeOwnership(t *testing.T) {
+	header := http.Header{}
+	header.Set("Content-Type", runtime.ContentTypeJSON)
+	codec := scheme.Codecs.LegacyCodec(scheme.Scheme.PrioritizedVersionsAllGroups()...)
+	owned := svc("owned", "default", corev1.ServiceTypeClusterIP)
+	owned.Annotations = map[string]string{"meta.helm.sh/release-name": "test", "meta.helm.sh/release-namespace": "default"}
+	var requests []string
+	var patch map[string]interface{}
+	c := NewMockClient(t, nil)
+	c.HelmClient.KubeClient = &buildingKubeClient{
+		PrintingKubeClient: kubefake.PrintingKubeClient{Out: ioutil.Discard},
+		builder: fakeBuilder(func(req *http.Request) (*http.Response, error) {
+			requests = append(requests, req.Method+" "+req.URL.Path)
+			switch p, m := req.URL.Path, req.Method; {
+			case p == "/namespaces/default/services/unowned" && m == "GET":
+				return &http.Response{StatusCode: http.StatusOK, Header: header, Body: ObjBody(codec, svc("unowned", "default", corev1.ServiceTypeClusterIP))}, nil
+			case p == "/namespaces/default/services/unowned" && m == "PATCH":
+				b, err := ioutil.ReadAll(req.Body)
+				assert.Nil(t, err)
+				assert.Nil(t, json.Unmarshal(b, &patch))
+				return &http.Response{StatusCode: http.StatusOK, Header: header, Body: ObjBody(codec, svc("unowned", "default", corev1.ServiceTypeClusterIP))}, nil
+			case p == "/namespaces/default/services/owned" && m == "GET":
+				return &http.Response{StatusCode: http.StatusOK, Header: header, Body: ObjBody(codec, owned)}, nil
+			default:
+				return &http.Response{StatusCode: http.StatusNotFound, Header: header, Body: ObjBody(codec, &metav1.Status{Status: metav1.StatusFailure, Reason: metav1.StatusReasonNotFound, Code: http.StatusNotFound})}, nil
+			}
+		}),
+	}
+	ch := buildChart()
+	ch.Templates = []*chart.File{{Name: "templates/services", Data: []byte(`apiVersion: v1
+kind: Service
+metadata:
+  name: unowned
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: owned
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: missing
+`)}}
+	err := c.takeOwnership("test", "default", ch, map[string]interface{}{})
+	assert.Nil(t, err)
+	// Only the existing object not owned by the release yet is patched.
+	assert.ElementsMatch(t, []string{
+		"GET /namespaces/default/services/unowned",
+		"PATCH /namespaces/default/services/unowned",
+		"GET /namespaces/default/services/owned",
+		"GET /namespaces/default/services/missing",
+	}, requests)
+	assert.Equal(t, map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels":      map[string]interface{}{"app.kubernetes.io/managed-by": "Helm"},
+			"annotations": map[string]interface{}{"meta.helm.sh/release-name": "test", "meta.helm.sh/release-namespace": "default"},
+		},
+	}, patch)
+}
+
+// TestClusterValues to test clusterValues
+func TestClusterValues(t *testing.T) {
+	c := NewMockClient(t, nil)
+	_, _ = c.ClientSet.CoreV1().ConfigMaps("platform").Create(context.Background(), &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "defaults", Namespace: "platform"},
+		Data:       map[string]string{"values.yaml": "a: cm\nb: cm"},
+	}, metav1.CreateOptions{})
+	_, _ = c.ClientSet.CoreV1().Secrets("default").Create(context.Background(), &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "defaults", Namespace: "default"},
+		Data:       map[string][]byte{"values.yaml": []byte("b: secret\nc: secret")},
+	}, metav1.CreateOptions{})
+	cmRef := &ValueFrom{Namespace: aws.String("platform"), Name: aws.String("defaults"), Key: aws.String("values.yaml")}
+	secretRef := &ValueFrom{Name: aws.String("defaults"), Key: aws.String("values.yaml")}
+	tests := map[string]struct {
+		config      *Config
+		eValues     map[string]interface{}
+		expectedErr string
+	}{
+		"None": {
+			config:  &Config{Namespace: aws.String("default")},
+			eValues: map[string]interface{}{"c": "value"},
+		},
+		"ConfigMap": {
+			config:  &Config{Namespace: aws.String("default"), ValueFromConfigMap: cmRef},
+			eValues: map[string]interface{}{"a": "cm", "b": "cm", "c": "value"},
+		},
+		"Both": {
+			config:  &Config{Namespace: aws.String("default"), ValueFromConfigMap: cmRef, ValueFromSecret: secretRef},
+			eValues: map[string]interface{}{"a": "cm", "b": "secret", "c": "value"},
+		},
+		"MissingKey": {
+			config:      &Config{Namespace: aws.String("default"), ValueFromSecret: &ValueFrom{Name: aws.String("defaults"), Key: aws.String("other")}},
+			expectedErr: "key other not found in Secret default/defaults",
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			values, err := c.clusterValues(d.config, map[string]interface{}{"c": "value"})
+			if d.expectedErr != "" {
+				assert.Contains(t, err.Error(), d.expectedErr)
+			} else {
+				assert.Nil(t, err)
+				assert.EqualValues(t, d.eValues, values)
+			}
+		})
+	}
+}
+
+// TestChartValueFiles to test chartValueFiles
+func TestChartValueFiles(t *testing.T) {
+	ch := buildChart()
+	ch.Files = append(ch.Files,
+		&chart.File{Name: "values-prod.yaml", Data: []byte("replicas: 3\nimage:\n  tag: prod\n  pullPolicy: Always")},
+		&chart.File{Name: "env/values-eu.yaml", Data: []byte("region: eu\nimage:\n  tag: eu")},
+	)
+	tests := map[string]struct {
+		files       []string
+		values      map[string]interface{}
+		eValues     map[string]interface{}
+		expectedErr *string
+	}{
+		"NoFiles": {
+			values:  map[string]interface{}{"replicas": 1},
+			eValues: map[string]interface{}{"replicas": 1},
+		},
+		"InOrder": {
+			files:   []string{"values-prod.yaml", "./env/values-eu.yaml"},
+			values:  map[string]interface{}{"replicas": 1},
+			eValues: map[string]interface{}{"replicas": 1, "region": "eu", "image": map[string]interface{}{"tag": "eu", "pullPolicy": "Always"}},
+		},
+		"Missing": {
+			files:       []string{"values-dev.yaml"},
+			expectedErr: aws.String("values-dev.yaml not found"),
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			res, err := chartValueFiles(ch, d.files, d.values)
+			if err != nil {
+				assert.Contains(t, err.Error(), aws.StringValue(d.expectedErr))
+				return
+			}
+			assert.EqualValues(t, d.eValues, res)
+		})
+	}
+}
+
+// TestLabelRelease to test labelRelease
+func TestLabelRelease(t *testing.T) {
+	c := NewMockClient(t, nil)
+	_, err := c.ClientSet.CoreV1().Secrets("default").Create(context.Background(), &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "sh.helm.release.v1.test.v2",
+			Namespace: "default",
+			Labels:    map[string]string{"owner": "helm", "name": "test", "status": "deployed", "version": "2"},
+		},
+	}, metav1.CreateOptions{})
+	assert.Nil(t, err)
+	rel := &release.Release{Name: "test", Namespace: "default", Version: 2}
+	err = c.labelRelease(rel, map[string]string{"team": "payments", "owner": "payments"})
+	assert.Nil(t, err)
+	s, err := c.ClientSet.CoreV1().Secrets("default").Get(context.Background(), "sh.helm.release.v1.test.v2", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.EqualValues(t, map[string]string{"owner": "helm", "name": "test", "status": "deployed", "version": "2", "team": "payments"}, s.Labels)
+
+	err = c.labelRelease(&release.Release{Name: "missing", Namespace: "default", Version: 1}, map[string]string{"team": "payments"})
+	assert.NotNil(t, err)
+
+	// Records kept in a storage namespace are labelled there.
+	_, err = c.ClientSet.CoreV1().Secrets("helm-releases").Create(context.Background(), &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "sh.helm.release.v1.test.v1", Namespace: "helm-releases"},
+	}, metav1.CreateOptions{})
+	assert.Nil(t, err)
+	c.storageNamespace = aws.String("helm-releases")
+	err = c.labelRelease(&release.Release{Name: "test", Namespace: "default", Version: 1}, map[string]string{"team": "payments"})
+	assert.Nil(t, err)
+	s, err = c.ClientSet.CoreV1().Secrets("helm-releases").Get(context.Background(), "sh.helm.release.v1.test.v1", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.EqualValues(t, map[string]string{"team": "payments"}, s.Labels)
+}
+
+// TestUseStorageNamespace to test UseStorageNamespace
+func TestUseStorageNamespace(t *testing.T) {
+	c := NewMockClient(t, nil)
+	h := c.HelmClient
+	assert.Nil(t, c.UseStorageNamespace(nil))
+	assert.Equal(t, h, c.HelmClient)
+	assert.Nil(t, c.storageNamespace)
+
+	assert.Nil(t, c.UseStorageNamespace(aws.String("helm-releases")))
+	assert.NotEqual(t, h, c.HelmClient)
+	assert.Equal(t, "helm-releases", aws.StringValue(c.storageNamespace))
+}
+
+// TestHelmUnlock to test HelmUnlock
+func TestHelmUnlock(t *testing.T) {
+	defer func(wait time.Duration) { releaseLockWait = wait }(releaseLockWait)
+	releaseLockWait = 0
+	tests := map[string]struct {
+		name    string
+		setup   func(c *Clients)
+		eStatus release.Status
+		eErr    string
+	}{
+		"Pending": {
+			name:    "five",
+			eStatus: release.StatusFailed,
+		},
+		"Deployed": {
+			name:    "one",
+			eStatus: release.StatusDeployed,
+		},
+		"Locked": {
+			name: "five",
+			setup: func(c *Clients) {
+				renewed := metav1.NewMicroTime(time.Now())
+				_, err := c.ClientSet.CoordinationV1().Leases("default").Create(context.Background(), &coordinationv1.Lease{
+					ObjectMeta: metav1.ObjectMeta{Name: releaseLockPrefix + "five", Namespace: "default"},
+					Spec: coordinationv1.LeaseSpec{
+						HolderIdentity:       aws.String("other"),
+						LeaseDurationSeconds: func(i int32) *int32 { return &i }(60),
+						RenewTime:            &renewed,
+					},
+				}, metav1.CreateOptions{})
+				assert.Nil(t, err)
+			},
+			eStatus: release.StatusPendingUpgrade,
+			eErr:    "locked by another operation",
+		},
+		"LeasesForbidden": {
+			name: "five",
+			setup: func(c *Clients) {
+				c.ClientSet.(*fakeclientset.Clientset).PrependReactor("*", "leases", func(action k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, kerrors.NewForbidden(schema.GroupResource{Group: "coordination.k8s.io", Resource: "leases"}, "", errors.New("denied"))
+				})
+			},
+			eStatus: release.StatusPendingUpgrade,
+			eErr:    "recover it manually",
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := NewMockClient(t, nil)
+			if d.setup != nil {
+				d.setup(c)
+			}
+			err := c.HelmUnlock(d.name)
+			if d.eErr != "" {
+				assert.Contains(t, err.Error(), d.eErr)
+			} else {
+				assert.Nil(t, err)
+			}
+			rel, err := c.HelmClient.Releases.Last(d.name)
+			assert.Nil(t, err)
+			assert.Equal(t, d.eStatus, rel.Info.Status)
+		})
+	}
+}
@@ -2,61 +2,115 @@ package resource
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
 	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"helm.sh/helm/v3/pkg/kube"
+	"helm.sh/helm/v3/pkg/release"
 	appsv1 "k8s.io/api/apps/v1"
 	appsv1beta1 "k8s.io/api/apps/v1beta1"
 	appsv1beta2 "k8s.io/api/apps/v1beta2"
 	corev1 "k8s.io/api/core/v1"
 	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
 	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	storagev1 "k8s.io/api/storage/v1"
 	apiextv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	apiextv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
 	kerrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/cli-runtime/pkg/resource"
 	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/tools/clientcmd/api"
 	kubeconfigutil "k8s.io/kubernetes/cmd/kubeadm/app/util/kubeconfig"
 )
 
 const (
 	KubeConfigLocalPath = "/tmp/kubeConfig"
-	TempManifest        = "/tmp/manifest.yaml"
 	chunkSize           = 500
 	ResourcesOutputSize = 12288 // Set 12 KB as resources output limit
+	crashLoopRestarts   = 3
+	probeTimeout        = 10 * time.Second
+
+	namespaceReleaseAnnotation = "awsqs-kubernetes-helm/created-for-release"
+	// defaultReadyCondition is the condition custom resources are checked for when their kind isn't configured.
+	defaultReadyCondition = "Ready"
+	// claimPendingTimeOut is how long, in minutes, a PersistentVolumeClaim may stay unbound unless
+	// ReadinessTimeOuts sets one for the PersistentVolumeClaim kind.
+	claimPendingTimeOut = 10
+	// namespaceRetries bounds the retries creating a namespace, about a minute with namespaceBackoffBase.
+	namespaceRetries = 6
+	// maxConfigMapChartSize is the size limit of a ConfigMap, the whole object including its other keys.
+	maxConfigMapChartSize = 1 << 20
 )
 
+// namespaceBackoffBase is the delay before the first retry creating a namespace, doubled on each further retry.
+var namespaceBackoffBase = time.Second
+
 var (
 	ResourcesOutputIgnoredTypes = []string{"*v1.ConfigMap", "*v1.Secret"}
 	ResourcesOutputIncludedSpec = []string{"*v1.Service"}
+	probeHostRegex              = regexp.MustCompile(`{{\s*LoadBalancerHostname\s*}}`)
+	protectedNamespaces         = []string{"default", "kube-system", "kube-public", "kube-node-lease"}
 )
 
 type ReleaseData struct {
-	Name, Chart, Namespace, Manifest string `json:",omitempty"`
+	Name, Chart, Namespace, Manifest string            `json:",omitempty"`
+	FailFast                         bool              `json:",omitempty"`
+	ReadinessProbe                   string            `json:",omitempty"`
+	StartTime                        string            `json:",omitempty"`
+	ReadinessTimeOuts                map[string]int    `json:",omitempty"`
+	ReadinessConditions              map[string]string `json:",omitempty"`
+}
+
+// ReleaseObject describes one object from a release manifest.
+type ReleaseObject struct {
+	Kind, APIVersion, Name, Namespace string
+	Ready                             bool
+	Reason                            string `json:",omitempty"`
 }
 
 // createKubeConfig create kubeconfig from ClusterID or Secret manager.
-func createKubeConfig(esvc EKSAPI, ssvc STSAPI, secsvc SecretsManagerAPI, cluster *string, kubeconfig *string, customKubeconfig []byte) error {
+func createKubeConfig(esvc EKSAPI, ssvc STSAPI, secsvc SecretsManagerAPI, cluster *string, kubeconfig *string, customKubeconfig []byte, kubeContext *string, insecure bool) error {
+	// Drop any kubeconfig left by an earlier invocation, so a failure below can't fall back to another cluster.
+	path := kubeConfigPath(cluster, kubeconfig, customKubeconfig)
+	if err := wipeFile(path); err != nil {
+		return genericError("Remove stale kubeconfig", err)
+	}
 	switch {
 	case cluster != nil && kubeconfig != nil:
-		return errors.New("both ClusterID or KubeConfig can not be specified")
+		return withReason(InvalidRequest, errors.New("both ClusterID or KubeConfig can not be specified"))
 	case cluster != nil:
 		defaultConfig := api.NewConfig()
 		c, err := getClusterDetails(esvc, *cluster)
 		if err != nil {
 			return genericError("Getting Cluster details", err)
 		}
-		defaultConfig.Clusters[*cluster] = &api.Cluster{
+		kc := &api.Cluster{
 			Server:                   c.endpoint,
 			CertificateAuthorityData: []byte(c.CAData),
 		}
+		// The CA data has to be dropped, as client-go rejects it combined with insecure.
+		if insecure {
+			log.Printf("Warning: Skipping TLS verification for cluster %s. This is insecure.", *cluster)
+			kc.CertificateAuthorityData = nil
+			kc.InsecureSkipTLSVerify = true
+		}
+		defaultConfig.Clusters[*cluster] = kc
 		token, err := generateKubeToken(ssvc, cluster)
 		if err != nil {
 			return err
@@ -69,9 +123,9 @@ func createKubeConfig(esvc EKSAPI, ssvc STSAPI, secsvc SecretsManagerAPI, cluste
 			AuthInfo: "aws",
 		}
 		defaultConfig.CurrentContext = "aws"
-		log.Printf("Writing kubeconfig file to %s", KubeConfigLocalPath)
+		log.Printf("Writing kubeconfig file to %s", path)
 
-		err = kubeconfigutil.WriteToDisk(KubeConfigLocalPath, defaultConfig)
+		err = kubeconfigutil.WriteToDisk(path, defaultConfig)
 		if err != nil {
 			return genericError("Write file: ", err)
 		}
@@ -81,48 +135,283 @@ func createKubeConfig(esvc EKSAPI, ssvc STSAPI, secsvc SecretsManagerAPI, cluste
 		if err != nil {
 			return err
 		}
-		log.Printf("Writing kubeconfig file to %s", KubeConfigLocalPath)
-		err = ioutil.WriteFile(KubeConfigLocalPath, s, 0600)
+		if s, err = narrowKubeConfig(s, kubeContext); err != nil {
+			return err
+		}
+		log.Printf("Writing kubeconfig file to %s", path)
+		err = ioutil.WriteFile(path, s, 0600)
 		if err != nil {
 			return genericError("Write file: ", err)
 		}
 		return nil
 	case customKubeconfig != nil:
-		log.Printf("Writing kubeconfig file to %s", KubeConfigLocalPath)
-		err := ioutil.WriteFile(KubeConfigLocalPath, customKubeconfig, 0600)
+		s, err := narrowKubeConfig(customKubeconfig, kubeContext)
+		if err != nil {
+			return err
+		}
+		log.Printf("Writing kubeconfig file to %s", path)
+		err = ioutil.WriteFile(path, s, 0600)
 		if err != nil {
 			return genericError("Write file: ", err)
 		}
 		return nil
 	default:
-		return errors.New("either ClusterID or KubeConfig must be specified")
+		return withReason(InvalidRequest, errors.New("either ClusterID or KubeConfig must be specified"))
 	}
 }
 
-// createNamespace create NS if not exists
-func (c *Clients) createNamespace(namespace string) error {
-	nsSpec := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}}
-	_, err := c.ClientSet.CoreV1().Namespaces().Create(context.Background(), nsSpec, metav1.CreateOptions{})
-	switch err {
-	case nil:
-		return nil
+// narrowKubeConfig keeps only kubeContext, its cluster and its user in the kubeconfig and makes it the current
+// context, so a shared multi-cluster kubeconfig can't be used against another cluster. The kubeconfig is returned
+// as is when kubeContext isn't set.
+func narrowKubeConfig(data []byte, kubeContext *string) ([]byte, error) {
+	if aws.StringValue(kubeContext) == "" {
+		return data, nil
+	}
+	name := *kubeContext
+	config, err := clientcmd.Load(data)
+	if err != nil {
+		return nil, genericError("Parsing kubeconfig", err)
+	}
+	ctx, ok := config.Contexts[name]
+	if !ok {
+		var names []string
+		for n := range config.Contexts {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("context %q not found in kubeconfig, it has: %s", name, strings.Join(names, ", "))
+	}
+	cluster, ok := config.Clusters[ctx.Cluster]
+	if !ok {
+		return nil, fmt.Errorf("cluster %q of context %q not found in kubeconfig", ctx.Cluster, name)
+	}
+	narrowed := api.NewConfig()
+	narrowed.Clusters[ctx.Cluster] = cluster
+	if ctx.AuthInfo != "" {
+		user, ok := config.AuthInfos[ctx.AuthInfo]
+		if !ok {
+			return nil, fmt.Errorf("user %q of context %q not found in kubeconfig", ctx.AuthInfo, name)
+		}
+		narrowed.AuthInfos[ctx.AuthInfo] = user
+	}
+	narrowed.Contexts[name] = ctx
+	narrowed.CurrentContext = name
+	out, err := clientcmd.Write(*narrowed)
+	if err != nil {
+		return nil, genericError("Writing kubeconfig", err)
+	}
+	return out, nil
+}
+
+// getValueFrom reads a data key of a ConfigMap or Secret.
+func (c *Clients) getValueFrom(kind string, namespace string, name string, key string) ([]byte, error) {
+	switch kind {
+	case "ConfigMap":
+		cm, err := c.ClientSet.CoreV1().ConfigMaps(namespace).Get(c.opContext(), name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		if v, ok := cm.Data[key]; ok {
+			return []byte(v), nil
+		}
+	case "Secret":
+		secret, err := c.ClientSet.CoreV1().Secrets(namespace).Get(c.opContext(), name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		if v, ok := secret.Data[key]; ok {
+			return v, nil
+		}
 	default:
-		switch kerrors.IsAlreadyExists(err) {
-		case true:
-			log.Printf("Namespace : %s. Already exists. Continue to install...", namespace)
+		return nil, fmt.Errorf("unsupported kind %s", kind)
+	}
+	return nil, fmt.Errorf("key %s not found in %s %s/%s", key, kind, namespace, name)
+}
+
+// configMapChart writes the chart archive held in a key of a ConfigMap to a temp file, wiped by the returned cleanup.
+// The archive is read from binaryData as is, or base64 decoded from data.
+func (c *Clients) configMapChart(ref *ValueFrom, namespace string) (string, func(), error) {
+	if ref.Namespace != nil {
+		namespace = *ref.Namespace
+	}
+	name, key := aws.StringValue(ref.Name), aws.StringValue(ref.Key)
+	cm, err := c.ClientSet.CoreV1().ConfigMaps(namespace).Get(c.opContext(), name, metav1.GetOptions{})
+	if err != nil {
+		return "", nil, withReason(InvalidChart, genericError("Reading chart from ConfigMap", err))
+	}
+	archive, ok := cm.BinaryData[key]
+	if !ok {
+		encoded, ok := cm.Data[key]
+		if !ok {
+			return "", nil, withReason(InvalidChart, genericError("Reading chart from ConfigMap", fmt.Errorf("key %s not found in ConfigMap %s/%s", key, namespace, name)))
+		}
+		archive, err = base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return "", nil, withReason(InvalidChart, genericError("Reading chart from ConfigMap", fmt.Errorf("key %s of ConfigMap %s/%s isn't a base64 chart archive: %w", key, namespace, name, err)))
+		}
+	}
+	if len(archive) >= maxConfigMapChartSize {
+		return "", nil, withReason(InvalidChart, genericError("Reading chart from ConfigMap", fmt.Errorf("chart in ConfigMap %s/%s is %d bytes, at the %d byte ConfigMap limit it's likely truncated", namespace, name, len(archive), maxConfigMapChartSize)))
+	}
+	path, err := tempFile("chart-*.tgz")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { wipeFile(path) }
+	if err := ioutil.WriteFile(path, archive, 0600); err != nil {
+		cleanup()
+		return "", nil, withReason(InvalidChart, genericError("Reading chart from ConfigMap", err))
+	}
+	if err := checkChartArchive(path); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return path, cleanup, nil
+}
+
+// kubeConfigPath returns the kubeconfig file for a target, so a warm container never reuses another target's file.
+func kubeConfigPath(cluster *string, kubeconfig *string, customKubeconfig []byte) string {
+	var key string
+	switch {
+	case cluster != nil:
+		key = "cluster/" + *cluster
+	case kubeconfig != nil:
+		key = "secret/" + *kubeconfig
+	case customKubeconfig != nil:
+		key = "custom/" + string(customKubeconfig)
+	default:
+		return KubeConfigLocalPath
+	}
+	return fmt.Sprintf("%s-%s", KubeConfigLocalPath, *getHash(key))
+}
+
+// CheckClusterAccess asks the cluster for its version, so a cluster that can't be reached or won't accept the
+// credentials fails here with a clear error instead of deep in a helm call.
+func (c *Clients) CheckClusterAccess() error {
+	err := runWithContext(c.opContext(), "checking cluster access", func() error {
+		_, err := c.ClientSet.Discovery().ServerVersion()
+		return err
+	})
+	if err == nil {
+		return nil
+	}
+	host := "(unknown endpoint)"
+	if c.Settings != nil {
+		if cfg, cerr := c.Settings.RESTClientGetter().ToRESTConfig(); cerr == nil {
+			host = cfg.Host
+		}
+	}
+	return clusterAccessError(host, err)
+}
+
+// clusterAccessError tells rejected credentials apart from a cluster that couldn't be reached.
+func clusterAccessError(cluster string, err error) error {
+	var status kerrors.APIStatus
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	if errors.As(err, &status) {
+		switch status.Status().Reason {
+		case metav1.StatusReasonUnauthorized:
+			return withReason(AccessDenied, fmt.Errorf("cannot authenticate to cluster %s: credentials rejected (401), check the role is mapped in the cluster's aws-auth ConfigMap or the kubeconfig's credentials are valid: %w", cluster, err))
+		case metav1.StatusReasonForbidden:
+			return withReason(AccessDenied, fmt.Errorf("cannot authenticate to cluster %s: access denied (403), the identity isn't allowed to use the cluster: %w", cluster, err))
+		}
+	}
+	switch {
+	case errors.As(err, &dnsErr):
+		return withReason(ClusterUnreachable, fmt.Errorf("cannot reach cluster %s: DNS lookup of %s failed, check the endpoint resolves from where the provider runs: %w", cluster, dnsErr.Name, err))
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return withReason(ClusterUnreachable, fmt.Errorf("cannot reach cluster %s: connection timed out, check the endpoint's public access or VPCConfiguration: %w", cluster, err))
+	}
+	return withReason(ClusterUnreachable, fmt.Errorf("cannot reach cluster %s: %w", cluster, err))
+}
+
+// createNamespace create NS if not exists, annotated with the release it was created for. Transient errors are
+// retried. A namespace still terminating, e.g. from an earlier uninstall, can take minutes to go, so it's reported
+// with the NamespaceTerminating reason for the install to be tried again on the next callback.
+func (c *Clients) createNamespace(namespace string, name string) error {
+	nsSpec := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:        namespace,
+		Annotations: map[string]string{namespaceReleaseAnnotation: name},
+	}}
+	for attempt := 0; ; attempt++ {
+		_, err := c.ClientSet.CoreV1().Namespaces().Create(c.opContext(), nsSpec, metav1.CreateOptions{})
+		switch {
+		case err == nil:
 			return nil
+		case kerrors.IsAlreadyExists(err), kerrors.IsForbidden(err):
+			ns, gerr := c.ClientSet.CoreV1().Namespaces().Get(c.opContext(), namespace, metav1.GetOptions{})
+			switch {
+			case gerr == nil && ns.Status.Phase == corev1.NamespaceTerminating:
+				log.Printf("Namespace %s is terminating, waiting for it to be deleted", namespace)
+				return withReason(NamespaceTerminating, fmt.Errorf("namespace %s is still terminating", namespace))
+			case gerr == nil:
+				log.Printf("Namespace : %s. Already exists. Continue to install...", namespace)
+				return nil
+			case kerrors.IsForbidden(err):
+				// RBAC won't change on retry.
+				return genericError("Create NS", fmt.Errorf("not allowed to create namespace %s, create it beforehand or allow the role to create namespaces: %w", namespace, err))
+			case !kerrors.IsNotFound(gerr):
+				return genericError("Get NS", gerr)
+			}
+		case kerrors.IsConflict(err), kerrors.IsServerTimeout(err), kerrors.IsTimeout(err), kerrors.IsTooManyRequests(err):
+			log.Printf("Warning: Got error creating namespace %s %s", namespace, err.Error())
 		default:
 			return genericError("Create NS", err)
 		}
+		if attempt >= namespaceRetries {
+			return genericError("Create NS", err)
+		}
+		select {
+		case <-c.opContext().Done():
+			return genericError("Create NS", err)
+		case <-time.After(namespaceBackoffBase << uint(attempt)):
+		}
 	}
 }
 
+// deleteNamespace deletes the NS if it was created for the release and holds no other releases.
+func (c *Clients) deleteNamespace(namespace string, name string) error {
+	if stringInSlice(namespace, protectedNamespaces) {
+		log.Printf("Namespace %s is protected. Skipping delete.", namespace)
+		return nil
+	}
+	ns, err := c.ClientSet.CoreV1().Namespaces().Get(c.opContext(), namespace, metav1.GetOptions{})
+	if err != nil {
+		if kerrors.IsNotFound(err) {
+			return nil
+		}
+		return genericError("Get NS", err)
+	}
+	if ns.Annotations[namespaceReleaseAnnotation] != name {
+		log.Printf("Namespace %s was not created for release %s. Skipping delete.", namespace, name)
+		return nil
+	}
+	others, err := c.HelmClient.Releases.List(func(r *release.Release) bool {
+		return r.Namespace == namespace && r.Name != name && r.Info.Status != release.StatusUninstalled
+	})
+	if err != nil {
+		return genericError("List releases", err)
+	}
+	if len(others) > 0 {
+		log.Printf("Namespace %s holds %d other releases. Skipping delete.", namespace, len(others))
+		return nil
+	}
+	log.Printf("Deleting namespace %s", namespace)
+	err = c.ClientSet.CoreV1().Namespaces().Delete(c.opContext(), namespace, metav1.DeleteOptions{})
+	if err != nil && !kerrors.IsNotFound(err) {
+		return genericError("Delete NS", err)
+	}
+	return nil
+}
+
 // CheckPendingResources checks pending resources in for the specific release.
 func (c *Clients) CheckPendingResources(r *ReleaseData) (bool, error) {
 	log.Printf("Checking pending resources in %s", r.Name)
 	var err error
 	var errCount int
 	var pArray []bool
+	var lbHost string
 	if r.Manifest == "" {
 		return true, errors.New("Manifest not provided in the request")
 	}
@@ -134,9 +423,10 @@ func (c *Clients) CheckPendingResources(r *ReleaseData) (bool, error) {
 		if errCount >= retryCount*2 {
 			return true, fmt.Errorf("couldn't get the resources")
 		}
+		pending := len(pArray)
 		switch value := kube.AsVersioned(info).(type) {
 		case *appsv1.Deployment, *appsv1beta1.Deployment, *appsv1beta2.Deployment, *extensionsv1beta1.Deployment:
-			currentDeployment, err := c.ClientSet.AppsV1().Deployments(info.Namespace).Get(context.Background(), info.Name, metav1.GetOptions{})
+			currentDeployment, err := c.ClientSet.AppsV1().Deployments(info.Namespace).Get(c.opContext(), info.Name, metav1.GetOptions{})
 			if err != nil {
 				errCount++
 				log.Printf("Warning: Got error getting deployment %s", err.Error())
@@ -148,17 +438,29 @@ func (c *Clients) CheckPendingResources(r *ReleaseData) (bool, error) {
 			}
 			if !deploymentReady(currentDeployment) {
 				pArray = append(pArray, false)
+				if r.FailFast {
+					if err := c.checkPodFailures(info.Namespace, currentDeployment.Spec.Selector); err != nil {
+						return true, err
+					}
+				}
 			}
 		case *corev1.PersistentVolumeClaim:
-			if !volumeReady(value) {
+			bound, err := c.claimBound(value, r)
+			if err != nil {
+				return true, err
+			}
+			if !bound {
 				pArray = append(pArray, false)
 			}
 		case *corev1.Service:
 			if !serviceReady(value) {
 				pArray = append(pArray, false)
 			}
+			if lbHost == "" {
+				lbHost = loadBalancerHost(value)
+			}
 		case *extensionsv1beta1.DaemonSet, *appsv1.DaemonSet, *appsv1beta2.DaemonSet:
-			ds, err := c.ClientSet.AppsV1().DaemonSets(info.Namespace).Get(context.Background(), info.Name, metav1.GetOptions{})
+			ds, err := c.ClientSet.AppsV1().DaemonSets(info.Namespace).Get(c.opContext(), info.Name, metav1.GetOptions{})
 
 			if err != nil {
 				log.Printf("Warning: Got error getting daemonset %s", err.Error())
@@ -167,9 +469,14 @@ func (c *Clients) CheckPendingResources(r *ReleaseData) (bool, error) {
 			}
 			if !daemonSetReady(ds) {
 				pArray = append(pArray, false)
+				if r.FailFast {
+					if err := c.checkPodFailures(info.Namespace, ds.Spec.Selector); err != nil {
+						return true, err
+					}
+				}
 			}
 		case *appsv1.StatefulSet, *appsv1beta1.StatefulSet, *appsv1beta2.StatefulSet:
-			sts, err := c.ClientSet.AppsV1().StatefulSets(info.Namespace).Get(context.Background(), info.Name, metav1.GetOptions{})
+			sts, err := c.ClientSet.AppsV1().StatefulSets(info.Namespace).Get(c.opContext(), info.Name, metav1.GetOptions{})
 			if err != nil {
 				log.Printf("Warning: Got error getting statefulset %s", err.Error())
 				errCount++
@@ -177,6 +484,14 @@ func (c *Clients) CheckPendingResources(r *ReleaseData) (bool, error) {
 			}
 			if !statefulSetReady(sts) {
 				pArray = append(pArray, false)
+				if err := c.checkStatefulSetClaims(sts, r); err != nil {
+					return true, err
+				}
+				if r.FailFast {
+					if err := c.checkPodFailures(info.Namespace, sts.Spec.Selector); err != nil {
+						return true, err
+					}
+				}
 			}
 		case *extensionsv1beta1.Ingress:
 			if !ingressReady(value) {
@@ -212,14 +527,138 @@ func (c *Clients) CheckPendingResources(r *ReleaseData) (bool, error) {
 			if !crdReady(crd) {
 				pArray = append(pArray, false)
 			}
+		case *unstructured.Unstructured:
+			// Kinds the client has no types for are custom resources.
+			if !customResourceReady(value, r.ReadinessConditions) {
+				pArray = append(pArray, false)
+			}
+		}
+		if len(pArray) > pending {
+			if err := r.checkKindTimeOut(info); err != nil {
+				return true, err
+			}
 		}
 	}
 	if len(pArray) > 0 || errCount != 0 {
 		return true, err
 	}
+	if r.ReadinessProbe != "" {
+		return !probeReady(r.ReadinessProbe, lbHost), nil
+	}
 	return false, err
 }
 
+// checkPodFailures returns an error when any of the selected pods is in a state it won't recover from.
+func (c *Clients) checkPodFailures(namespace string, selector *metav1.LabelSelector) error {
+	if selector == nil {
+		return nil
+	}
+	s, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		log.Printf("Warning: Got error parsing selector %s", err.Error())
+		return nil
+	}
+	pods, err := c.ClientSet.CoreV1().Pods(namespace).List(c.opContext(), metav1.ListOptions{LabelSelector: s.String()})
+	if err != nil {
+		log.Printf("Warning: Got error listing pods %s", err.Error())
+		return nil
+	}
+	for _, pod := range pods.Items {
+		if reason, failed := podFailed(&pod); failed {
+			return withReason(ReleaseFailed, fmt.Errorf("pod %s/%s failed: %s", pod.Namespace, pod.Name, reason))
+		}
+	}
+	return nil
+}
+
+// checkStatefulSetClaims checks the claims made from the StatefulSet's volumeClaimTemplates, which aren't in the
+// manifest but are often what keeps its pods from starting.
+func (c *Clients) checkStatefulSetClaims(sts *appsv1.StatefulSet, r *ReleaseData) error {
+	replicas := int32(1)
+	if sts.Spec.Replicas != nil {
+		replicas = *sts.Spec.Replicas
+	}
+	for _, t := range sts.Spec.VolumeClaimTemplates {
+		for i := int32(0); i < replicas; i++ {
+			name := fmt.Sprintf("%s-%s-%d", t.Name, sts.Name, i)
+			pvc, err := c.ClientSet.CoreV1().PersistentVolumeClaims(sts.Namespace).Get(c.opContext(), name, metav1.GetOptions{})
+			if err != nil {
+				if !kerrors.IsNotFound(err) {
+					log.Printf("Warning: Got error getting persistentvolumeclaim %s", err.Error())
+				}
+				continue
+			}
+			if _, err := c.claimBound(pvc, r); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// claimBound reports whether the claim is bound. An unbound claim is reported with the reason from its latest
+// warning event, and fails once pending longer than the PersistentVolumeClaim readiness timeout. Claims of a
+// WaitForFirstConsumer storage class are only bound once a pod using them is scheduled, so they aren't waited for.
+func (c *Clients) claimBound(pvc *corev1.PersistentVolumeClaim, r *ReleaseData) (bool, error) {
+	if pvc.Status.Phase == corev1.ClaimBound {
+		popLastKnownError(pvc.Name)
+		return true, nil
+	}
+	if c.waitsForConsumer(pvc) {
+		log.Printf("PVC %s waits for its first consumer to be bound", pvc.Name)
+		return true, nil
+	}
+	msg := fmt.Sprintf("PVC %s pending: %s", pvc.Name, c.claimPendingReason(pvc))
+	log.Printf(msg)
+	pushLastKnownError(msg)
+	timeOut := claimPendingTimeOut
+	if t, ok := r.ReadinessTimeOuts["PersistentVolumeClaim"]; ok {
+		timeOut = t
+	}
+	if !pvc.CreationTimestamp.IsZero() && time.Since(pvc.CreationTimestamp.Time) > time.Duration(timeOut)*time.Minute {
+		return false, withReason(ReleaseFailed, errors.New(msg))
+	}
+	return false, nil
+}
+
+// waitsForConsumer reports whether the claim's storage class has the WaitForFirstConsumer volume binding mode.
+func (c *Clients) waitsForConsumer(pvc *corev1.PersistentVolumeClaim) bool {
+	name := aws.StringValue(pvc.Spec.StorageClassName)
+	if name == "" {
+		name = pvc.Annotations[corev1.BetaStorageClassAnnotation]
+	}
+	if name == "" {
+		return false
+	}
+	sc, err := c.ClientSet.StorageV1().StorageClasses().Get(c.opContext(), name, metav1.GetOptions{})
+	if err != nil {
+		log.Printf("Warning: Got error getting storageclass %s", err.Error())
+		return false
+	}
+	return sc.VolumeBindingMode != nil && *sc.VolumeBindingMode == storagev1.VolumeBindingWaitForFirstConsumer
+}
+
+// claimPendingReason returns the message of the claim's latest warning event, such as a failed provisioning.
+func (c *Clients) claimPendingReason(pvc *corev1.PersistentVolumeClaim) string {
+	reason := "waiting to be bound"
+	events, err := c.ClientSet.CoreV1().Events(pvc.Namespace).List(c.opContext(), metav1.ListOptions{
+		FieldSelector: fmt.Sprintf("involvedObject.kind=PersistentVolumeClaim,involvedObject.name=%s", pvc.Name),
+	})
+	if err != nil {
+		log.Printf("Warning: Got error listing events %s", err.Error())
+		return reason
+	}
+	var latest time.Time
+	for _, e := range events.Items {
+		if e.InvolvedObject.Name != pvc.Name || e.Type != corev1.EventTypeWarning || e.LastTimestamp.Time.Before(latest) {
+			continue
+		}
+		latest = e.LastTimestamp.Time
+		reason = e.Message
+	}
+	return reason
+}
+
 // GetKubeResources get resources for the specific release.
 func (c *Clients) GetKubeResources(r *ReleaseData) (map[string]interface{}, error) {
 	log.Printf("Getting resources for %s", r.Name)
@@ -229,9 +668,12 @@ func (c *Clients) GetKubeResources(r *ReleaseData) (map[string]interface{}, erro
 	resources := map[string]interface{}{}
 	infos, err := c.getManifestDetails(r)
 	if err != nil {
-		return nil, err
+		// Skip objects that can't be read rather than failing the whole lookup.
+		if len(infos) == 0 {
+			return nil, err
+		}
+		log.Printf("Warning: Skipping unreadable resources: %s", err.Error())
 	}
-	namespace := "default"
 	for _, info := range infos {
 		var spec interface{}
 		kind := info.Object.GetObjectKind().GroupVersionKind().GroupKind().Kind
@@ -240,7 +682,8 @@ func (c *Clients) GetKubeResources(r *ReleaseData) (map[string]interface{}, erro
 			break
 		}
 
-		if stringInSlice(reflect.TypeOf(v).String(), ResourcesOutputIgnoredTypes) {
+		keys, isData := dataKeys(v)
+		if !isData && stringInSlice(reflect.TypeOf(v).String(), ResourcesOutputIgnoredTypes) {
 			continue
 		}
 		inner := make(map[string]interface{})
@@ -248,6 +691,8 @@ func (c *Clients) GetKubeResources(r *ReleaseData) (map[string]interface{}, erro
 		if !ok {
 			continue
 		}
+		// Prefer the object's own namespace, cluster-scoped objects have none.
+		namespace := info.Namespace
 		ns, ok := ScanFromStruct(v, "ObjectMeta.Namespace")
 		if ok {
 			namespace = fmt.Sprint(ns)
@@ -262,12 +707,20 @@ func (c *Clients) GetKubeResources(r *ReleaseData) (map[string]interface{}, erro
 		if ok {
 			status = structToMap(status)
 		}
+		details := map[string]interface{}{
+			"Spec":   spec,
+			"Status": status,
+		}
+		if isData {
+			details = map[string]interface{}{
+				"Keys": keys,
+			}
+		}
+		if namespace != "" {
+			details["Namespace"] = namespace
+		}
 		inner = map[string]interface{}{
-			fmt.Sprint(name): map[string]interface{}{
-				"Namespace": namespace,
-				"Spec":      spec,
-				"Status":    status,
-			},
+			fmt.Sprint(name): details,
 		}
 		if IsZero(resources[kind]) {
 			resources[kind] = map[string]interface{}{}
@@ -278,18 +731,159 @@ func (c *Clients) GetKubeResources(r *ReleaseData) (map[string]interface{}, erro
 	return resources, nil
 }
 
+// GetReleaseObjects returns every object in the release manifest, with Ready computed for the kinds it's known for.
+func (c *Clients) GetReleaseObjects(r *ReleaseData) ([]ReleaseObject, error) {
+	log.Printf("Getting objects for %s", r.Name)
+	if r.Manifest == "" {
+		return nil, errors.New("manifest not provided in the request")
+	}
+	infos, err := c.getManifestDetails(r)
+	if err != nil {
+		if len(infos) == 0 {
+			return nil, err
+		}
+		log.Printf("Warning: Skipping unreadable resources: %s", err.Error())
+	}
+	// The readiness checks record their reasons in LastKnownErrors, which is restored afterwards.
+	saved := LastKnownErrors
+	defer func() { LastKnownErrors = saved }()
+	objects := []ReleaseObject{}
+	for _, info := range infos {
+		gvk := info.Object.GetObjectKind().GroupVersionKind()
+		LastKnownErrors = nil
+		objects = append(objects, ReleaseObject{
+			Kind:       gvk.Kind,
+			APIVersion: gvk.GroupVersion().String(),
+			Name:       info.Name,
+			Namespace:  info.Namespace,
+			Ready:      objectReady(info.Object),
+			Reason:     strings.Join(LastKnownErrors, "; "),
+		})
+	}
+	return objects, nil
+}
+
+// objectReady checks the live object with the readiness check for its kind. Custom resources are checked
+// for a Ready condition, other kinds without a check are ready.
+func objectReady(obj runtime.Object) bool {
+	u, ok := obj.(runtime.Unstructured)
+	if !ok {
+		return true
+	}
+	var into interface{}
+	gk := obj.GetObjectKind().GroupVersionKind()
+	switch gk.GroupKind().String() {
+	case "Deployment.apps", "Deployment.extensions":
+		into = &appsv1.Deployment{}
+	case "DaemonSet.apps", "DaemonSet.extensions":
+		into = &appsv1.DaemonSet{}
+	case "StatefulSet.apps":
+		into = &appsv1.StatefulSet{}
+	case "Service":
+		into = &corev1.Service{}
+	case "PersistentVolumeClaim":
+		into = &corev1.PersistentVolumeClaim{}
+	case "Pod":
+		into = &corev1.Pod{}
+	case "Ingress.extensions", "Ingress.networking.k8s.io":
+		into = &networkingv1beta1.Ingress{}
+	case "CustomResourceDefinition.apiextensions.k8s.io":
+		into = &apiextv1.CustomResourceDefinition{}
+		if gk.Version == "v1beta1" {
+			into = &apiextv1beta1.CustomResourceDefinition{}
+		}
+	default:
+		if cr, ok := obj.(*unstructured.Unstructured); ok && !scheme.Scheme.Recognizes(gk) {
+			return customResourceReady(cr, nil)
+		}
+		return true
+	}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), into); err != nil {
+		pushLastKnownError(fmt.Sprintf("Couldn't read %s: %s", gk.Kind, err.Error()))
+		return false
+	}
+	switch v := into.(type) {
+	case *appsv1.Deployment:
+		if v.Spec.Replicas == nil {
+			v.Spec.Replicas = aws.Int32(1)
+		}
+		return deploymentReady(v)
+	case *appsv1.DaemonSet:
+		return daemonSetReady(v)
+	case *appsv1.StatefulSet:
+		return statefulSetReady(v)
+	case *corev1.Service:
+		return serviceReady(v)
+	case *corev1.PersistentVolumeClaim:
+		return volumeReady(v)
+	case *corev1.Pod:
+		if reason, failed := podFailed(v); failed {
+			pushLastKnownError(reason)
+			return false
+		}
+		if v.Status.Phase != corev1.PodRunning && v.Status.Phase != corev1.PodSucceeded {
+			pushLastKnownError(fmt.Sprintf("Pod is not ready: %s/%s. Phase is %s", v.Namespace, v.Name, v.Status.Phase))
+			return false
+		}
+		return true
+	case *networkingv1beta1.Ingress:
+		return ingressNReady(v)
+	case *apiextv1beta1.CustomResourceDefinition:
+		return crdBetaReady(v)
+	case *apiextv1.CustomResourceDefinition:
+		return crdReady(v)
+	}
+	return true
+}
+
+// dataKeys returns the sorted data keys of a ConfigMap or Secret. Values are never returned.
+func dataKeys(v interface{}) ([]string, bool) {
+	set := map[string]bool{}
+	switch obj := v.(type) {
+	case *corev1.ConfigMap:
+		for k := range obj.Data {
+			set[k] = true
+		}
+		for k := range obj.BinaryData {
+			set[k] = true
+		}
+	case *corev1.Secret:
+		for k := range obj.Data {
+			set[k] = true
+		}
+		for k := range obj.StringData {
+			set[k] = true
+		}
+	default:
+		return nil, false
+	}
+	keys := []string{}
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, true
+}
+
 func (c *Clients) getManifestDetails(r *ReleaseData) ([]*resource.Info, error) {
 	log.Printf("Getting resources for %s's manifest", r.Name)
 
-	err := ioutil.WriteFile(TempManifest, []byte(r.Manifest), 0600)
+	manifest, err := tempFile("manifest-*.yaml")
+	if err != nil {
+		return nil, err
+	}
+	defer wipeFile(manifest)
+	err = ioutil.WriteFile(manifest, []byte(r.Manifest), 0600)
 	if err != nil {
 		return nil, genericError("Write manifest file: ", err)
 	}
 
 	f := &resource.FilenameOptions{
-		Filenames: []string{TempManifest},
+		Filenames: []string{manifest},
 	}
 
+	// The release namespace is only a default for objects which don't set
+	// metadata.namespace, cluster-scoped objects are left without one.
 	res := c.ResourceBuilder().
 		Unstructured().
 		NamespaceParam(r.Namespace).DefaultNamespace().AllNamespaces(false).
@@ -301,11 +895,16 @@ func (c *Clients) getManifestDetails(r *ReleaseData) ([]*resource.Info, error) {
 		TransformRequests().
 		Do()
 
-	infos, err := res.Infos()
-	if err != nil {
+	// Infos read so far are returned alongside the error as the builder continues on error.
+	var infos []*resource.Info
+	err = runWithContext(c.opContext(), "reading release resources", func() (err error) {
+		infos, err = res.Infos()
+		return err
+	})
+	if c.opContext().Err() != nil {
 		return nil, err
 	}
-	return infos, nil
+	return infos, err
 }
 
 func ingressReady(i *extensionsv1beta1.Ingress) bool {
@@ -375,6 +974,137 @@ func serviceReady(s *corev1.Service) bool {
 	return true
 }
 
+// customResourceReady checks a custom resource with the readiness check configured for its kind, either a
+// status.conditions type that must be True or a path=value field match. Unconfigured kinds wait only on a
+// Ready condition they report.
+func customResourceReady(u *unstructured.Unstructured, conditions map[string]string) bool {
+	check, configured := conditions[u.GetKind()]
+	if !configured {
+		check = defaultReadyCondition
+	}
+	var msg string
+	if i := strings.Index(check, "="); i > 0 {
+		path, want := check[:i], check[i+1:]
+		got, found, _ := unstructured.NestedFieldNoCopy(u.Object, strings.Split(path, ".")...)
+		if found && fmt.Sprint(got) == want {
+			popLastKnownError(u.GetName())
+			return true
+		}
+		msg = fmt.Sprintf("%s is not ready: %s/%s. %s is not %s", u.GetKind(), u.GetNamespace(), u.GetName(), path, want)
+	} else {
+		conds, _, _ := unstructured.NestedSlice(u.Object, "status", "conditions")
+		found := false
+		for _, c := range conds {
+			cond, ok := c.(map[string]interface{})
+			if !ok || cond["type"] != check {
+				continue
+			}
+			found = true
+			if cond["status"] == string(metav1.ConditionTrue) {
+				popLastKnownError(u.GetName())
+				return true
+			}
+			msg = fmt.Sprintf("%s is not ready: %s/%s. %s condition is %v: %v", u.GetKind(), u.GetNamespace(), u.GetName(), check, cond["status"], cond["message"])
+		}
+		if !found {
+			if !configured {
+				return true
+			}
+			msg = fmt.Sprintf("%s is not ready: %s/%s. Waiting for %s condition", u.GetKind(), u.GetNamespace(), u.GetName(), check)
+		}
+	}
+	log.Printf(msg)
+	pushLastKnownError(msg)
+	return false
+}
+
+// checkKindTimeOut fails a pending resource once it has waited longer than the timeout for its kind.
+func (r *ReleaseData) checkKindTimeOut(info *resource.Info) error {
+	if len(r.ReadinessTimeOuts) == 0 || info.Mapping == nil {
+		return nil
+	}
+	kind := info.Mapping.GroupVersionKind.Kind
+	timeOut, ok := r.ReadinessTimeOuts[kind]
+	if !ok {
+		return nil
+	}
+	start, err := time.Parse(time.RFC3339, r.StartTime)
+	if err != nil {
+		return nil
+	}
+	if time.Since(start) > time.Duration(timeOut)*time.Minute {
+		return withReason(ReleaseFailed, fmt.Errorf("%s %s/%s not ready within %d mins", kind, info.Namespace, info.Name, timeOut))
+	}
+	return nil
+}
+
+// loadBalancerHost returns the hostname or IP of the service load balancer if assigned.
+func loadBalancerHost(s *corev1.Service) string {
+	if s.Spec.Type != corev1.ServiceTypeLoadBalancer {
+		return ""
+	}
+	for _, i := range s.Status.LoadBalancer.Ingress {
+		if i.Hostname != "" {
+			return i.Hostname
+		}
+		if i.IP != "" {
+			return i.IP
+		}
+	}
+	return ""
+}
+
+// probeReady requests the readiness probe URL once and checks for a 2xx response.
+func probeReady(probe string, lbHost string) bool {
+	if probeHostRegex.MatchString(probe) {
+		if lbHost == "" {
+			msg := "Readiness probe waiting for load balancer hostname"
+			log.Printf(msg)
+			pushLastKnownError(msg)
+			return false
+		}
+		probe = probeHostRegex.ReplaceAllString(probe, lbHost)
+	}
+	client := &http.Client{Timeout: probeTimeout}
+	resp, err := client.Get(probe)
+	if err != nil {
+		msg := fmt.Sprintf("Readiness probe %s failed: %s", probe, err.Error())
+		log.Printf(msg)
+		pushLastKnownError(msg)
+		return false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg := fmt.Sprintf("Readiness probe %s returned %s", probe, resp.Status)
+		log.Printf(msg)
+		pushLastKnownError(msg)
+		return false
+	}
+	popLastKnownError("Readiness probe")
+	return true
+}
+
+func podFailed(pod *corev1.Pod) (string, bool) {
+	var statuses []corev1.ContainerStatus
+	statuses = append(statuses, pod.Status.InitContainerStatuses...)
+	statuses = append(statuses, pod.Status.ContainerStatuses...)
+	for _, cs := range statuses {
+		if cs.State.Waiting == nil {
+			continue
+		}
+		reason := fmt.Sprintf("container %s is in %s state: %s", cs.Name, cs.State.Waiting.Reason, cs.State.Waiting.Message)
+		switch cs.State.Waiting.Reason {
+		case "ImagePullBackOff", "ErrImagePull", "InvalidImageName", "CreateContainerConfigError":
+			return reason, true
+		case "CrashLoopBackOff":
+			if cs.RestartCount >= crashLoopRestarts {
+				return fmt.Sprintf("%s, restarted %d times", reason, cs.RestartCount), true
+			}
+		}
+	}
+	return "", false
+}
+
 func deploymentReady(dep *appsv1.Deployment) bool {
 	if !(dep.Status.ReadyReplicas >= *dep.Spec.Replicas) {
 		msg := fmt.Sprintf("Deployment is not ready: %s/%s. %d out of %d expected pods are ready", dep.Namespace, dep.Name, dep.Status.ReadyReplicas, *dep.Spec.Replicas)
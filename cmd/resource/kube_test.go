@@ -1,28 +1,53 @@
 package resource
 
 import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/api/extensions/v1beta1"
 	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	storagev1 "k8s.io/api/storage/v1"
 	apiextv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	apiextv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/cli-runtime/pkg/resource"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/clientcmd"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/stretchr/testify/assert"
+	"helm.sh/helm/v3/pkg/release"
 )
 
 // TestCreateKubeConfig to test createKubeConfig
 func TestCreateKubeConfig(t *testing.T) {
-	defer os.Remove(KubeConfigLocalPath)
 	mockEKSSvc := &mockEKSClient{}
 	mockSTSSvc := &mockSTSClient{}
 	mockSMSvc := &mockSecretsManagerClient{}
 	tests := map[string]struct {
 		cluster, kubeconfig, role *string
 		customKubeconfig          []byte
+		kubeContext               *string
+		insecure                  bool
 		expectedErr               string
 	}{
 		"AllValues": {
@@ -35,6 +60,11 @@ func TestCreateKubeConfig(t *testing.T) {
 			cluster:     aws.String("eks"),
 			expectedErr: "",
 		},
+		"InsecureCluster": {
+			cluster:     aws.String("eks"),
+			insecure:    true,
+			expectedErr: "",
+		},
 		"ClusterWithRole": {
 			cluster:     aws.String("eks"),
 			role:        aws.String("arn:aws:iam::1234567890:role/TestRole"),
@@ -51,29 +81,241 @@ func TestCreateKubeConfig(t *testing.T) {
 			customKubeconfig: []byte("Test"),
 			expectedErr:      "",
 		},
+		"CustomKubeconfigContext": {
+			customKubeconfig: []byte(testFleetKubeConfig),
+			kubeContext:      aws.String("staging"),
+			expectedErr:      "",
+		},
+		"CustomKubeconfigMissingContext": {
+			customKubeconfig: []byte(testFleetKubeConfig),
+			kubeContext:      aws.String("dev"),
+			expectedErr:      `context "dev" not found in kubeconfig, it has: prod, staging`,
+		},
 	}
 	for name, d := range tests {
 		t.Run(name, func(t *testing.T) {
-			err := createKubeConfig(mockEKSSvc, mockSTSSvc, mockSMSvc, d.cluster, d.kubeconfig, d.customKubeconfig)
+			path := kubeConfigPath(d.cluster, d.kubeconfig, d.customKubeconfig)
+			defer os.Remove(path)
+			err := createKubeConfig(mockEKSSvc, mockSTSSvc, mockSMSvc, d.cluster, d.kubeconfig, d.customKubeconfig, d.kubeContext, d.insecure)
 			if err != nil {
 				assert.Contains(t, err.Error(), d.expectedErr)
+				assert.NoFileExists(t, path)
 			} else {
-				assert.FileExists(t, KubeConfigLocalPath)
+				assert.FileExists(t, path)
 			}
 		})
 	}
 }
 
+const testFleetKubeConfig = `apiVersion: v1
+kind: Config
+current-context: prod
+clusters:
+- name: prod
+  cluster:
+    server: https://prod.example.com
+- name: staging
+  cluster:
+    server: https://staging.example.com
+users:
+- name: prod-admin
+  user:
+    token: prod-token
+- name: staging-admin
+  user:
+    token: staging-token
+contexts:
+- name: prod
+  context:
+    cluster: prod
+    user: prod-admin
+- name: staging
+  context:
+    cluster: staging
+    user: staging-admin
+`
+
+// TestNarrowKubeConfig to test narrowKubeConfig
+func TestNarrowKubeConfig(t *testing.T) {
+	out, err := narrowKubeConfig([]byte(testFleetKubeConfig), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, testFleetKubeConfig, string(out))
+
+	out, err = narrowKubeConfig([]byte(testFleetKubeConfig), aws.String("staging"))
+	assert.Nil(t, err)
+	config, err := clientcmd.Load(out)
+	assert.Nil(t, err)
+	assert.Equal(t, "staging", config.CurrentContext)
+	assert.Len(t, config.Contexts, 1)
+	assert.Len(t, config.Clusters, 1)
+	assert.Equal(t, "https://staging.example.com", config.Clusters["staging"].Server)
+	assert.Len(t, config.AuthInfos, 1)
+	assert.Equal(t, "staging-token", config.AuthInfos["staging-admin"].Token)
+
+	_, err = narrowKubeConfig([]byte(testFleetKubeConfig), aws.String("dev"))
+	assert.EqualError(t, err, `context "dev" not found in kubeconfig, it has: prod, staging`)
+
+	_, err = narrowKubeConfig([]byte(strings.Replace(testFleetKubeConfig, "cluster: staging", "cluster: missing", 1)), aws.String("staging"))
+	assert.EqualError(t, err, `cluster "missing" of context "staging" not found in kubeconfig`)
+}
+
+// TestKubeConfigPath to test kubeConfigPath keeps targets apart
+func TestKubeConfigPath(t *testing.T) {
+	paths := map[string]bool{
+		kubeConfigPath(aws.String("eks"), nil, nil):  true,
+		kubeConfigPath(aws.String("eks2"), nil, nil): true,
+		kubeConfigPath(nil, aws.String("eks"), nil):  true,
+		kubeConfigPath(nil, nil, []byte("Test")):     true,
+		kubeConfigPath(nil, nil, nil):                true,
+	}
+	assert.Len(t, paths, 5)
+	assert.Equal(t, kubeConfigPath(aws.String("eks"), nil, nil), kubeConfigPath(aws.String("eks"), nil, nil))
+}
+
 // TestCreateNamespace to test createNamespace
 func TestCreateNamespace(t *testing.T) {
 	c := NewMockClient(t, nil)
-	err := c.createNamespace("test")
+	err := c.createNamespace("test", "one")
 	assert.NoError(t, err)
+	ns, _ := c.ClientSet.CoreV1().Namespaces().Get(context.Background(), "test", metav1.GetOptions{})
+	assert.Equal(t, "one", ns.Annotations[namespaceReleaseAnnotation])
+}
+
+// TestCreateNamespaceRetries to test createNamespace with terminating namespaces and errors
+func TestCreateNamespaceRetries(t *testing.T) {
+	defer func(b time.Duration) { namespaceBackoffBase = b }(namespaceBackoffBase)
+	namespaceBackoffBase = time.Millisecond
+	terminating := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "test"},
+		Status:     corev1.NamespaceStatus{Phase: corev1.NamespaceTerminating},
+	}
+	gr := schema.GroupResource{Resource: "namespaces"}
+	tests := map[string]struct {
+		existing       *corev1.Namespace
+		reactors       func(cs *fakeclientset.Clientset)
+		created        bool
+		expectedErr    string
+		expectedReason FailureReason
+	}{
+		"Exists": {
+			existing: &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "test"}},
+		},
+		"Terminated": {
+			existing: terminating.DeepCopy(),
+			reactors: func(cs *fakeclientset.Clientset) {
+				// The namespace finishes terminating between the create and the get.
+				cs.PrependReactor("get", "namespaces", func(a k8stesting.Action) (bool, runtime.Object, error) {
+					_ = cs.Tracker().Delete(corev1.SchemeGroupVersion.WithResource("namespaces"), "", "test")
+					return false, nil, nil
+				})
+			},
+			created: true,
+		},
+		"StillTerminating": {
+			existing:       terminating.DeepCopy(),
+			expectedErr:    "namespace test is still terminating",
+			expectedReason: NamespaceTerminating,
+		},
+		"Conflict": {
+			reactors: func(cs *fakeclientset.Clientset) {
+				calls := 0
+				cs.PrependReactor("create", "namespaces", func(a k8stesting.Action) (bool, runtime.Object, error) {
+					calls++
+					return calls == 1, nil, kerrors.NewConflict(gr, "test", errors.New("try again"))
+				})
+			},
+			created: true,
+		},
+		"Forbidden": {
+			reactors: func(cs *fakeclientset.Clientset) {
+				cs.PrependReactor("create", "namespaces", func(a k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, kerrors.NewForbidden(gr, "test", errors.New("denied"))
+				})
+			},
+			expectedErr: "not allowed to create namespace test",
+		},
+		"ForbiddenExists": {
+			existing: &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "test"}},
+			reactors: func(cs *fakeclientset.Clientset) {
+				cs.PrependReactor("create", "namespaces", func(a k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, kerrors.NewForbidden(gr, "test", errors.New("denied"))
+				})
+			},
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			cs := fakeclientset.NewSimpleClientset()
+			if d.existing != nil {
+				_ = cs.Tracker().Add(d.existing)
+			}
+			if d.reactors != nil {
+				d.reactors(cs)
+			}
+			c := &Clients{ClientSet: cs}
+			err := c.createNamespace("test", "one")
+			if d.expectedErr != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), d.expectedErr)
+				if d.expectedReason != "" {
+					assert.Equal(t, d.expectedReason, errorReason(err))
+				}
+				return
+			}
+			assert.Nil(t, err)
+			ns, err := cs.CoreV1().Namespaces().Get(context.Background(), "test", metav1.GetOptions{})
+			assert.Nil(t, err)
+			if d.created {
+				assert.Equal(t, "one", ns.Annotations[namespaceReleaseAnnotation])
+			}
+		})
+	}
+}
+
+// TestDeleteNamespace to test deleteNamespace
+func TestDeleteNamespace(t *testing.T) {
+	c := NewMockClient(t, nil)
+	shared := namedRelease("shared", release.StatusDeployed)
+	shared.Namespace = "shared"
+	_ = c.HelmClient.Releases.Create(shared)
+	for _, ns := range []string{"owned", "shared", "default"} {
+		_ = c.createNamespace(ns, "one")
+	}
+	_, _ = c.ClientSet.CoreV1().Namespaces().Create(context.Background(), &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "existing"}}, metav1.CreateOptions{})
+	tests := map[string]struct {
+		namespace string
+		deleted   bool
+	}{
+		"Owned": {
+			namespace: "owned",
+			deleted:   true,
+		},
+		"OtherReleases": {
+			namespace: "shared",
+		},
+		"Default": {
+			namespace: "default",
+		},
+		"Existing": {
+			namespace: "existing",
+		},
+		"NotFound": {
+			namespace: "gone",
+			deleted:   true,
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := c.deleteNamespace(d.namespace, "one")
+			assert.NoError(t, err)
+			_, err = c.ClientSet.CoreV1().Namespaces().Get(context.Background(), d.namespace, metav1.GetOptions{})
+			assert.Equal(t, d.deleted, err != nil)
+		})
+	}
 }
 
 // TestCheckPendingResources to test CheckPendingResources
 func TestCheckPendingResources(t *testing.T) {
-	defer os.Remove(TempManifest)
 	c := NewMockClient(t, nil)
 	rd := &ReleaseData{
 		Name:      "test",
@@ -104,7 +346,6 @@ func TestCheckPendingResources(t *testing.T) {
 
 // TestGetKubeResources to test GetKubeResources
 func TestGetKubeResources(t *testing.T) {
-	defer os.Remove(TempManifest)
 	c := NewMockClient(t, nil)
 	manifest := `---
 apiVersion: apps/v1
@@ -162,9 +403,185 @@ metadata:
 	assert.EqualValues(t, expectedMap, result)
 }
 
+// TestGetKubeResourcesUnreadable to test GetKubeResources skips objects that can't be read
+func TestGetKubeResourcesUnreadable(t *testing.T) {
+	c := NewMockClient(t, nil)
+	manifest := `---
+apiVersion: v1
+kind: Service
+metadata:
+ name: my-service
+
+---
+apiVersion: v1
+kind: Service
+metadata:
+ name: missing-service`
+	expectedMap := map[string]interface{}{
+		"Service": map[string]interface{}{
+			"my-service": map[string]interface{}{
+				"Namespace": "default", "Spec": map[string]interface{}{
+					"ClusterIP": "127.0.0.1", "Type": "ClusterIP",
+				}, "Status": interface{}(nil),
+			},
+		},
+	}
+	rd := &ReleaseData{
+		Name:      "test",
+		Namespace: "default",
+		Manifest:  manifest,
+	}
+	result, err := c.GetKubeResources(rd)
+	assert.Nil(t, err)
+	assert.EqualValues(t, expectedMap, result)
+}
+
+// TestGetKubeResourcesDataKeys to test GetKubeResources returns only the keys of ConfigMaps and Secrets
+func TestGetKubeResourcesDataKeys(t *testing.T) {
+	c := NewMockClient(t, nil)
+	manifest := `---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+ name: test-cm
+
+---
+apiVersion: v1
+kind: Secret
+metadata:
+ name: test-secret`
+	expectedMap := map[string]interface{}{
+		"ConfigMap": map[string]interface{}{
+			"test-cm": map[string]interface{}{
+				"Namespace": "default", "Keys": []string{"cert.der", "config.yaml"},
+			},
+		},
+		"Secret": map[string]interface{}{
+			"test-secret": map[string]interface{}{
+				"Namespace": "default", "Keys": []string{"password", "username"},
+			},
+		},
+	}
+	rd := &ReleaseData{
+		Name:      "test",
+		Namespace: "default",
+		Manifest:  manifest,
+	}
+	result, err := c.GetKubeResources(rd)
+	assert.Nil(t, err)
+	assert.EqualValues(t, expectedMap, result)
+}
+
+// TestGetReleaseObjects to test GetReleaseObjects
+func TestGetReleaseObjects(t *testing.T) {
+	c := NewMockClient(t, nil)
+	LastKnownErrors = []string{"previous error"}
+	defer func() { LastKnownErrors = nil }()
+	manifest := `---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+ name: nginx-deployment-foo
+
+---
+apiVersion: v1
+kind: Service
+metadata:
+ name: my-service
+
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+ name: test-cm`
+	expected := []ReleaseObject{
+		{
+			Kind:       "Deployment",
+			APIVersion: "apps/v1",
+			Name:       "nginx-deployment-foo",
+			Namespace:  "default",
+			Ready:      false,
+			Reason:     "Deployment is not ready: default/nginx-deployment-foo. 0 out of 1 expected pods are ready",
+		},
+		{Kind: "Service", APIVersion: "v1", Name: "my-service", Namespace: "default", Ready: true},
+		{Kind: "ConfigMap", APIVersion: "v1", Name: "test-cm", Namespace: "default", Ready: true},
+	}
+	rd := &ReleaseData{
+		Name:      "test",
+		Namespace: "default",
+		Manifest:  manifest,
+	}
+	result, err := c.GetReleaseObjects(rd)
+	assert.Nil(t, err)
+	assert.EqualValues(t, expected, result)
+	assert.EqualValues(t, []string{"previous error"}, LastKnownErrors)
+}
+
+// TestCustomResourceReady to test customResourceReady
+func TestCustomResourceReady(t *testing.T) {
+	cr := func(status map[string]interface{}) *unstructured.Unstructured {
+		u := &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "cert-manager.io/v1",
+			"kind":       "Certificate",
+			"metadata":   map[string]interface{}{"name": "test-cert", "namespace": "default"},
+		}}
+		if status != nil {
+			u.Object["status"] = status
+		}
+		return u
+	}
+	conditions := func(cType, status string) map[string]interface{} {
+		return map[string]interface{}{"conditions": []interface{}{
+			map[string]interface{}{"type": cType, "status": status, "message": "reconciling"},
+		}}
+	}
+	tests := map[string]struct {
+		u          *unstructured.Unstructured
+		conditions map[string]string
+		assertion  assert.BoolAssertionFunc
+	}{
+		"NoStatus": {
+			u:         cr(nil),
+			assertion: assert.True,
+		},
+		"ReadyTrue": {
+			u:         cr(conditions("Ready", "True")),
+			assertion: assert.True,
+		},
+		"ReadyFalse": {
+			u:         cr(conditions("Ready", "False")),
+			assertion: assert.False,
+		},
+		"ConfiguredMissing": {
+			u:          cr(nil),
+			conditions: map[string]string{"Certificate": "Ready"},
+			assertion:  assert.False,
+		},
+		"ConfiguredType": {
+			u:          cr(conditions("Synced", "True")),
+			conditions: map[string]string{"Certificate": "Synced"},
+			assertion:  assert.True,
+		},
+		"PathMatch": {
+			u:          cr(map[string]interface{}{"phase": "Ready"}),
+			conditions: map[string]string{"Certificate": "status.phase=Ready"},
+			assertion:  assert.True,
+		},
+		"PathMismatch": {
+			u:          cr(map[string]interface{}{"phase": "Pending"}),
+			conditions: map[string]string{"Certificate": "status.phase=Ready"},
+			assertion:  assert.False,
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			d.assertion(t, customResourceReady(d.u, d.conditions))
+		})
+	}
+}
+
 // TestGetManifestDetails to test getManifestDetails
 func TestGetManifestDetails(t *testing.T) {
-	defer os.Remove(TempManifest)
 	c := NewMockClient(t, nil)
 	rd := &ReleaseData{
 		Name:      "test",
@@ -175,6 +592,38 @@ func TestGetManifestDetails(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+// TestGetManifestDetailsNamespaces to test getManifestDetails keeps the object namespace
+func TestGetManifestDetailsNamespaces(t *testing.T) {
+	c := NewMockClient(t, nil)
+	manifest := `---
+apiVersion: v1
+kind: Service
+metadata:
+ name: my-service
+
+---
+apiVersion: v1
+kind: Service
+metadata:
+ name: other-service
+ namespace: other`
+	expected := map[string]string{
+		"my-service":    "default",
+		"other-service": "other",
+	}
+	rd := &ReleaseData{
+		Name:      "test",
+		Namespace: "default",
+		Manifest:  manifest,
+	}
+	infos, err := c.getManifestDetails(rd)
+	assert.Nil(t, err)
+	assert.Len(t, infos, len(expected))
+	for _, info := range infos {
+		assert.Equal(t, expected[info.Name], info.Namespace)
+	}
+}
+
 // TestReady to test ingressReady, volumeReady and deploymentReady
 func TestReady(t *testing.T) {
 	tests := map[string]struct {
@@ -213,6 +662,216 @@ func TestReady(t *testing.T) {
 	}
 }
 
+// TestClaimBound to test claimBound and checkStatefulSetClaims
+func TestClaimBound(t *testing.T) {
+	defer func() { LastKnownErrors = nil }()
+	reason := "no persistent volumes available for this claim and no storage class is set"
+	old := vol("data-nginx-ss-1", "default", true)
+	old.CreationTimestamp = metav1.NewTime(time.Now().Add(-time.Hour))
+	waiting := vol("waiting-pvc", "default", true)
+	waiting.CreationTimestamp = old.CreationTimestamp
+	waiting.Spec.StorageClassName = aws.String("local")
+	immediate := vol("immediate-pvc", "default", true)
+	immediate.CreationTimestamp = old.CreationTimestamp
+	immediate.Annotations = map[string]string{corev1.BetaStorageClassAnnotation: "gp2"}
+	waitMode := storagev1.VolumeBindingWaitForFirstConsumer
+	immediateMode := storagev1.VolumeBindingImmediate
+	c := &Clients{ClientSet: fakeclientset.NewSimpleClientset(
+		vol("data-nginx-ss-0", "default", true),
+		old,
+		&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "local"}, VolumeBindingMode: &waitMode},
+		&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "gp2"}, VolumeBindingMode: &immediateMode},
+		&corev1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Name: "data-nginx-ss-0.1", Namespace: "default"},
+			InvolvedObject: corev1.ObjectReference{Kind: "PersistentVolumeClaim", Name: "data-nginx-ss-0"},
+			Type:           corev1.EventTypeWarning,
+			Message:        reason,
+			LastTimestamp:  metav1.Now(),
+		},
+	)}
+	tests := map[string]struct {
+		pvc         *corev1.PersistentVolumeClaim
+		timeOuts    map[string]int
+		bound       bool
+		expectedErr string
+	}{
+		"Bound": {
+			pvc:   vol("test-pvc", "default", false),
+			bound: true,
+		},
+		"Pending": {
+			pvc: vol("data-nginx-ss-0", "default", true),
+		},
+		"Stuck": {
+			pvc:         old,
+			expectedErr: "PVC data-nginx-ss-1 pending: waiting to be bound",
+		},
+		"StuckWithinTimeOut": {
+			pvc:      old,
+			timeOuts: map[string]int{"PersistentVolumeClaim": 90},
+		},
+		"WaitForFirstConsumer": {
+			pvc:   waiting,
+			bound: true,
+		},
+		"StuckImmediate": {
+			pvc:         immediate,
+			expectedErr: "PVC immediate-pvc pending: waiting to be bound",
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			bound, err := c.claimBound(d.pvc, &ReleaseData{ReadinessTimeOuts: d.timeOuts})
+			assert.Equal(t, d.bound, bound)
+			if d.expectedErr != "" {
+				assert.EqualError(t, err, d.expectedErr)
+				assert.Equal(t, ReleaseFailed, errorReason(err))
+			} else {
+				assert.Nil(t, err)
+			}
+		})
+	}
+	assert.Contains(t, LastKnownErrors, "PVC data-nginx-ss-0 pending: "+reason)
+
+	sts := ss("nginx-ss", "default", appsv1.RollingUpdateStatefulSetStrategyType, true)
+	sts.Spec.VolumeClaimTemplates = []corev1.PersistentVolumeClaim{{ObjectMeta: metav1.ObjectMeta{Name: "data"}}}
+	assert.EqualError(t, c.checkStatefulSetClaims(sts, &ReleaseData{}), "PVC data-nginx-ss-1 pending: waiting to be bound")
+	assert.Nil(t, c.checkStatefulSetClaims(sts, &ReleaseData{ReadinessTimeOuts: map[string]int{"PersistentVolumeClaim": 90}}))
+}
+
+// TestPodFailed to test podFailed
+func TestPodFailed(t *testing.T) {
+	tests := map[string]struct {
+		assertion assert.BoolAssertionFunc
+		pod       *corev1.Pod
+	}{
+		"Running": {
+			assertion: assert.False,
+			pod:       pod("test-pod", "default", "", 0),
+		},
+		"ContainerCreating": {
+			assertion: assert.False,
+			pod:       pod("test-pod", "default", "ContainerCreating", 0),
+		},
+		"ImagePullBackOff": {
+			assertion: assert.True,
+			pod:       pod("test-pod", "default", "ImagePullBackOff", 0),
+		},
+		"CreateContainerConfigError": {
+			assertion: assert.True,
+			pod:       pod("test-pod", "default", "CreateContainerConfigError", 0),
+		},
+		"CrashLoopBackOffFirstRestart": {
+			assertion: assert.False,
+			pod:       pod("test-pod", "default", "CrashLoopBackOff", 1),
+		},
+		"CrashLoopBackOff": {
+			assertion: assert.True,
+			pod:       pod("test-pod", "default", "CrashLoopBackOff", crashLoopRestarts),
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, result := podFailed(d.pod)
+			d.assertion(t, result)
+		})
+	}
+}
+
+// TestCheckPodFailures to test checkPodFailures
+func TestCheckPodFailures(t *testing.T) {
+	c := NewMockClient(t, nil)
+	_, _ = c.ClientSet.CoreV1().Pods("default").Create(context.Background(), pod("crash", "default", "CrashLoopBackOff", 5), metav1.CreateOptions{})
+	_, _ = c.ClientSet.CoreV1().Pods("default").Create(context.Background(), pod("healthy", "default", "", 0), metav1.CreateOptions{})
+	err := c.checkPodFailures("default", &metav1.LabelSelector{MatchLabels: map[string]string{"app": "healthy"}})
+	assert.Nil(t, err)
+	err = c.checkPodFailures("default", &metav1.LabelSelector{MatchLabels: map[string]string{"app": "crash"}})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "default/crash")
+}
+
+// TestCheckKindTimeOut to test checkKindTimeOut
+func TestCheckKindTimeOut(t *testing.T) {
+	info := &resource.Info{
+		Name:      "nginx-deployment",
+		Namespace: "default",
+		Mapping:   &meta.RESTMapping{GroupVersionKind: schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}},
+	}
+	tests := map[string]struct {
+		r           *ReleaseData
+		expectedErr *string
+	}{
+		"NoTimeOuts": {
+			r: &ReleaseData{StartTime: time.Now().Add(-time.Hour).Format(time.RFC3339)},
+		},
+		"OtherKind": {
+			r: &ReleaseData{StartTime: time.Now().Add(-time.Hour).Format(time.RFC3339), ReadinessTimeOuts: map[string]int{"Service": 5}},
+		},
+		"WithinTimeOut": {
+			r: &ReleaseData{StartTime: time.Now().Add(-time.Minute).Format(time.RFC3339), ReadinessTimeOuts: map[string]int{"Deployment": 5}},
+		},
+		"TimedOut": {
+			r:           &ReleaseData{StartTime: time.Now().Add(-10 * time.Minute).Format(time.RFC3339), ReadinessTimeOuts: map[string]int{"Deployment": 5}},
+			expectedErr: aws.String("Deployment default/nginx-deployment not ready within 5 mins"),
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := d.r.checkKindTimeOut(info)
+			if d.expectedErr == nil {
+				assert.Nil(t, err)
+				return
+			}
+			assert.EqualError(t, err, *d.expectedErr)
+		})
+	}
+}
+
+// TestProbeReady to test probeReady
+func TestProbeReady(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer testServer.Close()
+	host := strings.TrimPrefix(testServer.URL, "http://")
+	tests := map[string]struct {
+		probe    string
+		lbHost   string
+		expected bool
+	}{
+		"Ready": {
+			probe:    testServer.URL + "/healthz",
+			expected: true,
+		},
+		"NotReady": {
+			probe:    testServer.URL + "/unavailable",
+			expected: false,
+		},
+		"LoadBalancerHostname": {
+			probe:    "http://{{ LoadBalancerHostname }}/healthz",
+			lbHost:   host,
+			expected: true,
+		},
+		"NoLoadBalancer": {
+			probe:    "http://{{ LoadBalancerHostname }}/healthz",
+			expected: false,
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, d.expected, probeReady(d.probe, d.lbHost))
+		})
+	}
+}
+
+// TestLoadBalancerHost to test loadBalancerHost
+func TestLoadBalancerHost(t *testing.T) {
+	assert.Equal(t, "elb.test.com", loadBalancerHost(svc("lb-service", "default", corev1.ServiceTypeLoadBalancer)))
+	assert.Equal(t, "", loadBalancerHost(svc("my-service", "default", corev1.ServiceTypeClusterIP)))
+}
+
 // TestDaemonSetReadyReady to test daemonSetReady
 func TestDaemonSetReadyReady(t *testing.T) {
 	tests := map[string]struct {
@@ -326,3 +985,88 @@ func TestCrdBetaReady(t *testing.T) {
 		})
 	}
 }
+
+// TestCheckClusterAccess to test CheckClusterAccess
+func TestCheckClusterAccess(t *testing.T) {
+	c := NewMockClient(t, nil)
+	assert.Nil(t, c.CheckClusterAccess())
+}
+
+// TestClusterAccessError to test clusterAccessError
+func TestClusterAccessError(t *testing.T) {
+	tests := map[string]struct {
+		err         error
+		expectedErr string
+	}{
+		"Unauthorized": {
+			err:         kerrors.NewUnauthorized("Unauthorized"),
+			expectedErr: "cannot authenticate to cluster https://eks: credentials rejected (401)",
+		},
+		"Forbidden": {
+			err:         kerrors.NewForbidden(schema.GroupResource{}, "", errors.New("denied")),
+			expectedErr: "cannot authenticate to cluster https://eks: access denied (403)",
+		},
+		"DNS": {
+			err:         &url.Error{Op: "Get", URL: "https://eks/version", Err: &net.DNSError{Name: "eks", Err: "no such host", IsNotFound: true}},
+			expectedErr: "cannot reach cluster https://eks: DNS lookup of eks failed",
+		},
+		"TimeOut": {
+			err:         fmt.Errorf("operation cancelled near deadline during checking cluster access: %w", context.DeadlineExceeded),
+			expectedErr: "cannot reach cluster https://eks: connection timed out",
+		},
+		"Other": {
+			err:         errors.New("connection refused"),
+			expectedErr: "cannot reach cluster https://eks: connection refused",
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := clusterAccessError("https://eks", d.err)
+			assert.Contains(t, err.Error(), d.expectedErr)
+			assert.True(t, errors.Is(err, d.err))
+		})
+	}
+}
+
+// TestConfigMapChart to test configMapChart
+func TestConfigMapChart(t *testing.T) {
+	archive, err := ioutil.ReadFile("testdata/test.tgz")
+	assert.Nil(t, err)
+	cm := func(name string, data map[string]string, binaryData map[string][]byte) *corev1.ConfigMap {
+		return &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "charts"}, Data: data, BinaryData: binaryData}
+	}
+	c := &Clients{ClientSet: fakeclientset.NewSimpleClientset(
+		cm("encoded", map[string]string{"test.tgz": base64.StdEncoding.EncodeToString(archive)}, nil),
+		cm("binary", nil, map[string][]byte{"test.tgz": archive}),
+		cm("invalid", map[string]string{"test.tgz": "not base64!"}, nil),
+		cm("notarchive", map[string]string{"test.tgz": base64.StdEncoding.EncodeToString([]byte("apiVersion: v2"))}, nil),
+		cm("oversized", nil, map[string][]byte{"test.tgz": make([]byte, maxConfigMapChartSize)}),
+	)}
+	tests := map[string]struct {
+		name string
+		eErr string
+	}{
+		"Encoded":    {name: "encoded"},
+		"Binary":     {name: "binary"},
+		"NotFound":   {name: "missing", eErr: "not found"},
+		"Invalid":    {name: "invalid", eErr: "isn't a base64 chart archive"},
+		"NotArchive": {name: "notarchive", eErr: "At Reading chart"},
+		"Oversized":  {name: "oversized", eErr: "at the 1048576 byte ConfigMap limit"},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			path, cleanup, err := c.configMapChart(&ValueFrom{Name: aws.String(d.name), Key: aws.String("test.tgz")}, "charts")
+			if d.eErr != "" {
+				assert.Contains(t, err.Error(), d.eErr)
+				return
+			}
+			assert.Nil(t, err)
+			defer cleanup()
+			b, err := ioutil.ReadFile(path)
+			assert.Nil(t, err)
+			assert.Equal(t, archive, b)
+		})
+	}
+	_, _, err = c.configMapChart(&ValueFrom{Name: aws.String("encoded"), Key: aws.String("other.tgz")}, "charts")
+	assert.Contains(t, err.Error(), "key other.tgz not found in ConfigMap charts/encoded")
+}
@@ -4,10 +4,12 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -20,13 +22,42 @@ import (
 const (
 	ZipFile            string = "k8svpc.zip"
 	FunctionNamePrefix string = "helm-provider-vpc-connector-"
-	Handler            string = "k8svpc"
+	Handler            string = "bootstrap"
 	MemorySize         int64  = 384
-	Runtime            string = "go1.x"
+	Runtime            string = "provided.al2023"
 	Timeout            int64  = 900
 	UpdateInProgress   string = "The function could not be updated due to a concurrent update operation."
+	ManagedByTag       string = "quickstart-helm"
+	ReleaseTagPrefix   string = "helm-release:"
 )
 
+// Values of the ConnectorSource property.
+const (
+	ConnectorProvided              = "Provided"
+	ConnectorCreated               = "Created"
+	ConnectorCreatedForDetectedVPC = "CreatedForDetectedVPC"
+)
+
+// ConnectorRuntimeEnvVar set on the provider overrides Runtime, the Lambda runtime of the VPC connector, e.g. with
+// provided.al2 where provided.al2023 isn't available yet. The connector's executable is named bootstrap as custom
+// runtimes require, which go1.x also runs, though go1.x functions can no longer be created.
+const ConnectorRuntimeEnvVar = "HELM_PROVIDER_CONNECTOR_RUNTIME"
+
+// MaxPayloadEnvVar set on the VPC connector lowers, in bytes, the largest response it returns.
+const MaxPayloadEnvVar = "HELM_CONNECTOR_MAX_PAYLOAD"
+
+const (
+	// maxPayloadSize is Lambda's limit on a synchronous invocation's response.
+	maxPayloadSize = 6 * 1024 * 1024
+	// responseTooLargeError is the error type Lambda reports when a response exceeds maxPayloadSize.
+	responseTooLargeError = "Function.ResponseSizeTooLarge"
+	// lastModifiedLayout is the layout of a function's LastModified, e.g. 2019-10-28T20:26:39.904+0000.
+	lastModifiedLayout = "2006-01-02T15:04:05.999-0700"
+)
+
+// invokeBackoffBase is the delay before the first invoke retry, doubled on each further retry.
+var invokeBackoffBase = time.Second
+
 type Event struct {
 	Kubeconfig  []byte       `json:",omitempty"`
 	Inputs      *Inputs      `json:",omitempty"`
@@ -46,6 +77,10 @@ const (
 	GetResourcesAction     Action = "GetResources"
 	UninstallReleaseAction Action = "UninstallRelease"
 	ListReleaseAction      Action = "ListRelease"
+	PingAction             Action = "Ping"
+	UnlockReleaseAction    Action = "UnlockRelease"
+	CheckDeletedAction     Action = "CheckDeleted"
+	GetDiagnosticsAction   Action = "GetDiagnostics"
 )
 
 type lambdaResource struct {
@@ -56,14 +91,31 @@ type lambdaResource struct {
 	functionName   *string
 	functionFile   string
 	awssession     *session.Session
+	tags           map[string]string
+	environment    map[string]string
+	kmsKeyArn      *string
+	external       bool
+	customRole     bool
 }
 
 type LambdaResponse struct {
 	StatusData       *HelmStatusData        `json:",omitempty"`
 	ListData         []HelmListData         `json:",omitempty"`
+	ListWarnings     []string               `json:",omitempty"`
 	Resources        map[string]interface{} `json:",omitempty"`
 	PendingResources bool                   `json:",omitempty"`
 	LastKnownErrors  []string               `json:",omitempty"`
+	Diagnostics      []PodDiagnostics       `json:",omitempty"`
+	// Error and FailureReason report an action that failed, with the reason it was classified with by the connector.
+	Error         string        `json:",omitempty"`
+	FailureReason FailureReason `json:",omitempty"`
+}
+
+// ErrorResponse returns the connector's response for an action that failed with err. It's returned as data rather
+// than a function error, which Lambda reduces to a message and a Go type name, so the reason isn't lost.
+func ErrorResponse(err error) *LambdaResponse {
+	reason, _ := failureReason(err)
+	return &LambdaResponse{Error: err.Error(), FailureReason: reason}
 }
 
 type State string
@@ -76,6 +128,14 @@ const (
 	StateNotFound State = "NotFound"
 )
 
+// connectorRuntime returns the runtime the connector is created and updated with.
+func connectorRuntime() string {
+	if r := os.Getenv(ConnectorRuntimeEnvVar); r != "" {
+		return r
+	}
+	return Runtime
+}
+
 func createFunction(svc LambdaAPI, l *lambdaResource) error {
 	log.Printf("Creating the VPC connector %s", aws.StringValue(l.functionName))
 	zip, _, err := getZip(l.functionFile)
@@ -90,13 +150,28 @@ func createFunction(svc LambdaAPI, l *lambdaResource) error {
 		Handler:      aws.String(Handler),
 		MemorySize:   aws.Int64(MemorySize),
 		Role:         l.roleArn,
-		Runtime:      aws.String(Runtime),
+		Runtime:      aws.String(connectorRuntime()),
 		Timeout:      aws.Int64(Timeout),
 		VpcConfig: &lambda.VpcConfig{
 			SecurityGroupIds: aws.StringSlice(l.vpcConfig.SecurityGroupIds),
 			SubnetIds:        aws.StringSlice(l.vpcConfig.SubnetIds),
 		},
 	}
+	if len(l.tags) > 0 {
+		input.Tags = aws.StringMap(l.tags)
+	}
+	environment := l.environment
+	if environment == nil {
+		environment = connectorEnvironment(nil)
+	}
+	input.Environment = &lambda.Environment{Variables: aws.StringMap(environment)}
+	if aws.StringValue(l.kmsKeyArn) != "" {
+		input.KMSKeyArn = l.kmsKeyArn
+	}
+	// Active tracing lets the connector join the trace propagated on invoke.
+	if tracingEnabled() {
+		input.TracingConfig = &lambda.TracingConfig{Mode: aws.String(lambda.TracingModeActive)}
+	}
 
 	_, err = svc.CreateFunction(input)
 	// Resource already exists error is fine
@@ -130,47 +205,251 @@ func getFunction(svc LambdaAPI, functionName *string) (*lambda.GetFunctionOutput
 	return functionOutput, nil
 }
 
-func updateFunction(svc LambdaAPI, l *lambdaResource) error {
+// updateFunction brings the connector in line with l, reporting whether it can serve invokes. Lambda applies an update
+// asynchronously and rejects another until it's done, so at most one is started per call rather than waiting for it,
+// and the next invocation carries on.
+func updateFunction(svc LambdaAPI, l *lambdaResource) (bool, error) {
 	log.Printf("Checking for any updates required for VPC connector %s", *l.functionName)
 	zip, hash, err := getZip(l.functionFile)
 	if err != nil {
-		return err
+		return false, err
 	}
-
-	if hash != *l.functionOutput.Configuration.CodeSha256 {
-		log.Printf("Proceeding with code update for VPC connector %s", *l.functionName)
-		codeInput := &lambda.UpdateFunctionCodeInput{
-			FunctionName: l.functionName,
-			ZipFile:      zip,
-		}
-		_, err = svc.UpdateFunctionCode(codeInput)
-		if err != nil {
-			return AWSError(err)
+	current := l.functionOutput.Configuration
+	// Tags are only added when the caller provided them, status checks leave them alone.
+	if l.tags != nil {
+		if err := addTags(svc, current.FunctionArn, l.functionOutput.Tags, l.tags); err != nil {
+			return false, err
 		}
 	}
+	if aws.StringValue(current.LastUpdateStatus) == lambda.LastUpdateStatusInProgress {
+		log.Printf("VPC connector %s update in progress", *l.functionName)
+		return false, nil
+	}
 	configInput := &lambda.UpdateFunctionConfigurationInput{
 		FunctionName: l.functionName,
 		Handler:      aws.String(Handler),
 		MemorySize:   aws.Int64(MemorySize),
 		Role:         l.roleArn,
-		Runtime:      aws.String(Runtime),
+		Runtime:      aws.String(connectorRuntime()),
 		Timeout:      aws.Int64(Timeout),
 		VpcConfig: &lambda.VpcConfig{
 			SecurityGroupIds: aws.StringSlice(l.vpcConfig.SecurityGroupIds),
 			SubnetIds:        aws.StringSlice(l.vpcConfig.SubnetIds),
 		},
 	}
-	if !needsUpdate(configInput, l.functionOutput.Configuration) {
-		return AWSError(nil)
+	// Like tags, the environment is only merged when the caller provided it.
+	if l.environment != nil {
+		configInput.Environment = &lambda.Environment{Variables: aws.StringMap(mergeEnvironment(current.Environment, l.environment))}
+	}
+	// Other releases in the VPC share the connector, so a key is only set on a connector without one.
+	if aws.StringValue(l.kmsKeyArn) != "" && aws.StringValue(current.KMSKeyArn) == "" {
+		configInput.KMSKeyArn = l.kmsKeyArn
+	}
+	// Code of a go1.x connector can no longer be updated, so it's moved to the new runtime and bootstrap handler
+	// first. It can't serve invokes until the code holding bootstrap follows.
+	if aws.StringValue(current.Runtime) != connectorRuntime() || aws.StringValue(current.Handler) != Handler {
+		log.Printf("Moving VPC connector %s from %s to %s", *l.functionName, aws.StringValue(current.Runtime), connectorRuntime())
+		return false, startUpdate(func() error {
+			_, err := svc.UpdateFunctionConfiguration(configInput)
+			return err
+		})
+	}
+	// The hash is of the embedded zip, so a connector still running the old go1.x artifact gets the bootstrap one.
+	if hash != aws.StringValue(current.CodeSha256) {
+		log.Printf("Proceeding with code update for VPC connector %s", *l.functionName)
+		return false, startUpdate(func() error {
+			_, err := svc.UpdateFunctionCode(&lambda.UpdateFunctionCodeInput{
+				FunctionName: l.functionName,
+				ZipFile:      zip,
+			})
+			return err
+		})
+	}
+	if !needsUpdate(configInput, current) {
+		return true, nil
 	}
-	_, err = svc.UpdateFunctionConfiguration(configInput)
+	// Invokes are served with the previous configuration while it's applied.
+	err = startUpdate(func() error {
+		_, err := svc.UpdateFunctionConfiguration(configInput)
+		return err
+	})
+	return err == nil, err
+}
+
+// startUpdate starts an update of the connector with fn. One rejected because another is still being applied isn't
+// an error, it's started again by the next invocation.
+func startUpdate(fn func() error) error {
+	err := fn()
+	if err != nil && updateInProgress(err) {
+		log.Printf("VPC connector update in progress, retrying later")
+		return nil
+	}
+	return AWSError(err)
+}
+
+// updateInProgress reports whether err rejected an update because another hasn't finished.
+func updateInProgress(err error) bool {
+	if strings.Contains(err.Error(), UpdateInProgress) {
+		return true
+	}
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == lambda.ErrCodeResourceConflictException {
+		return strings.Contains(aerr.Message(), "update is in progress")
+	}
+	return false
+}
+
+// addTags adds the desired tags the connector doesn't have yet. The connector is shared by releases in the same VPC,
+// so tags already on it, set by this or another stack, are neither overwritten nor removed.
+func addTags(svc LambdaAPI, arn *string, current map[string]*string, desired map[string]string) error {
+	add := map[string]*string{}
+	for k, v := range desired {
+		if _, ok := current[k]; !ok {
+			add[k] = aws.String(v)
+		}
+	}
+	if len(add) == 0 {
+		return nil
+	}
+	log.Printf("Tagging VPC connector %s", aws.StringValue(arn))
+	if _, err := svc.TagResource(&lambda.TagResourceInput{Resource: arn, Tags: add}); err != nil {
+		return AWSError(err)
+	}
+	return nil
+}
+
+// connectorTags returns the model's tags plus the defaults. As tags are only added, stack-id records the stack that
+// first tagged the connector. The release's own tag marks it as using the connector until it's deleted.
+func connectorTags(m *Model, stackID string) map[string]string {
+	tags := map[string]string{}
+	for k, v := range m.Tags {
+		tags[k] = v
+	}
+	tags["managed-by"] = ManagedByTag
+	if m.ClusterID != nil {
+		tags["cluster"] = *m.ClusterID
+	}
+	if stackID != "" {
+		tags["stack-id"] = stackID
+	}
+	if m.ID != nil {
+		tags[releaseTag(m)] = stackID
+	}
+	return tags
+}
+
+// releaseTag returns the key of the tag the release adds to the connector it uses.
+func releaseTag(m *Model) string {
+	return ReleaseTagPrefix + *getHash(*m.ID)
+}
+
+// releaseConnector removes the release's tag from the connector and deletes it unless another release still tags it.
+// Connectors created before releases tagged them have no such tags and are deleted, a release still using one creates
+// it again.
+func releaseConnector(svc LambdaAPI, functionName *string, tag string) error {
+	o, err := getFunction(svc, functionName)
 	if err != nil {
-		if strings.Contains(err.Error(), UpdateInProgress) {
-			time.Sleep(5 * time.Second)
-			return updateFunction(svc, l)
+		if functionNotExists(err) {
+			return nil
 		}
+		return AWSError(err)
 	}
-	return AWSError(err)
+	if _, ok := o.Tags[tag]; ok {
+		log.Printf("Removing tag %s from VPC connector %s", tag, *functionName)
+		_, err = svc.UntagResource(&lambda.UntagResourceInput{Resource: o.Configuration.FunctionArn, TagKeys: aws.StringSlice([]string{tag})})
+		if err != nil {
+			return AWSError(err)
+		}
+		// Read after untagging, so of two releases deleted at once at least one sees neither tag.
+		o, err = getFunction(svc, functionName)
+		if err != nil {
+			if functionNotExists(err) {
+				return nil
+			}
+			return AWSError(err)
+		}
+	}
+	for k := range o.Tags {
+		if strings.HasPrefix(k, ReleaseTagPrefix) {
+			log.Printf("VPC connector %s still used by other releases, not deleting it", *functionName)
+			return nil
+		}
+	}
+	return deleteFunction(svc, functionName)
+}
+
+// sharedConnector reports whether the connector's tags hold a release tag other than those in own.
+func sharedConnector(tags map[string]*string, own map[string]string) bool {
+	for k := range tags {
+		if _, ok := own[k]; strings.HasPrefix(k, ReleaseTagPrefix) && !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// providerEnvironment lists the connector's variables set by the provider rather than ConnectorEnvironment.
+var providerEnvironment = []string{"HELM_DRIVER", TracingEnvVar}
+
+// connectorEnvironment returns the model's ConnectorEnvironment with the variables the connector needs set over it.
+func connectorEnvironment(m *Model) map[string]string {
+	environment := map[string]string{}
+	if m != nil {
+		for k, v := range m.ConnectorEnvironment {
+			environment[k] = v
+		}
+	}
+	environment["HELM_DRIVER"] = HelmDriver
+	if tracingEnabled() {
+		environment[TracingEnvVar] = "true"
+	} else {
+		delete(environment, TracingEnvVar)
+	}
+	return environment
+}
+
+// mergeEnvironment returns the connector's environment with the desired variables it doesn't have yet added. The
+// connector is shared by releases in the same VPC, so variables another release set are kept, only those in
+// providerEnvironment follow desired.
+func mergeEnvironment(current *lambda.EnvironmentResponse, desired map[string]string) map[string]string {
+	environment := map[string]string{}
+	if current != nil {
+		for k, v := range current.Variables {
+			environment[k] = aws.StringValue(v)
+		}
+	}
+	for k, v := range desired {
+		if _, ok := environment[k]; !ok {
+			environment[k] = v
+		}
+	}
+	for _, k := range providerEnvironment {
+		if v, ok := desired[k]; ok {
+			environment[k] = v
+		} else {
+			delete(environment, k)
+		}
+	}
+	return environment
+}
+
+// environmentEqual reports whether the connector's environment matches desired, which is nil when not reconciled.
+func environmentEqual(desired *lambda.Environment, current *lambda.EnvironmentResponse) bool {
+	if desired == nil {
+		return true
+	}
+	var variables map[string]*string
+	if current != nil {
+		variables = current.Variables
+	}
+	if len(desired.Variables) != len(variables) {
+		return false
+	}
+	for k, v := range desired.Variables {
+		if c, ok := variables[k]; !ok || aws.StringValue(c) != aws.StringValue(v) {
+			return false
+		}
+	}
+	return true
 }
 
 func needsUpdate(desired *lambda.UpdateFunctionConfigurationInput, current *lambda.FunctionConfiguration) bool {
@@ -181,7 +460,9 @@ func needsUpdate(desired *lambda.UpdateFunctionConfigurationInput, current *lamb
 		*desired.Runtime == *current.Runtime &&
 		*desired.Timeout == *current.Timeout &&
 		roughlyEqual(desired.VpcConfig.SecurityGroupIds, current.VpcConfig.SecurityGroupIds) &&
-		roughlyEqual(desired.VpcConfig.SubnetIds, current.VpcConfig.SubnetIds) {
+		roughlyEqual(desired.VpcConfig.SubnetIds, current.VpcConfig.SubnetIds) &&
+		environmentEqual(desired.Environment, current.Environment) &&
+		(desired.KMSKeyArn == nil || *desired.KMSKeyArn == aws.StringValue(current.KMSKeyArn)) {
 		return false
 	}
 	return true
@@ -201,7 +482,7 @@ func checklambdaState(svc LambdaAPI, functionName *string) (State, error) {
 	return State(*o.Configuration.State), nil
 }
 
-func invokeLambda(svc LambdaAPI, functionName *string, event *Event) (*LambdaResponse, error) {
+func invokeLambda(ctx aws.Context, svc LambdaAPI, functionName *string, event *Event) (*LambdaResponse, error) {
 	log.Printf("Invoking VPC connector %s for action: %s", *functionName, event.Action)
 	eventJSON, err := json.Marshal(event)
 	if err != nil {
@@ -211,32 +492,28 @@ func invokeLambda(svc LambdaAPI, functionName *string, event *Event) (*LambdaRes
 		FunctionName: functionName,
 		Payload:      eventJSON,
 	}
-	count := 0
 	var result *lambda.InvokeOutput
-	for count <= retryCount {
-		result, err = svc.Invoke(input)
-		if err != nil {
-			if aerr, ok := err.(awserr.Error); ok {
-				switch aerr.Code() {
-				case lambda.ErrCodeTooManyRequestsException, lambda.ErrCodeServiceException,
-					lambda.ErrCodeEC2UnexpectedException, lambda.ErrCodeEC2ThrottledException,
-					lambda.ErrCodeResourceConflictException, lambda.ErrCodeResourceNotReadyException:
-					log.Printf("Got error from the lambda: %s. Retrying...", aerr.Code())
-					time.Sleep(5 * time.Second)
-					count++
-					if count >= retryCount {
-						return nil, AWSError(err)
-					}
-				default:
-					return nil, AWSError(err)
-				}
-			} else {
-				return nil, AWSError(err)
-			}
-		} else {
+	for attempt := 0; ; attempt++ {
+		result, err = svc.InvokeWithContext(ctx, input)
+		if err == nil {
 			break
 		}
+		if !retryableInvokeError(err) || attempt >= retryCount {
+			return nil, AWSError(err)
+		}
+		delay := invokeBackoffBase << uint(attempt)
+		log.Printf("Got error from the lambda: %s. Retrying in %s...", err, delay)
+		select {
+		case <-ctx.Done():
+			return nil, AWSError(err)
+		case <-time.After(delay):
+		}
 	}
+	return connectorResponse(event.Action, result)
+}
+
+// connectorResponse decodes the connector's response to action, returning a connectorError for a failed invocation.
+func connectorResponse(action Action, result *lambda.InvokeOutput) (*LambdaResponse, error) {
 	if result.FunctionError != nil {
 		log.Printf("Remote execution error: %v\n", *result.FunctionError)
 		errorDetails := make(map[string]string)
@@ -245,19 +522,67 @@ func invokeLambda(svc LambdaAPI, functionName *string, event *Event) (*LambdaRes
 		if err != nil {
 			log.Println(err.Error())
 			errMsg = fmt.Sprintf("[%v] %v", *result.FunctionError, string(result.Payload))
+		} else if errorDetails["errorType"] == responseTooLargeError {
+			return nil, payloadTooLarge(action, errorDetails["errorMessage"])
 		} else {
 			errMsg = fmt.Sprintf("[%v] %v", errorDetails["errorType"], errorDetails["errorMessage"])
 		}
-		return nil, errors.New(errMsg)
+		return nil, &connectorError{msg: errMsg}
 	}
 	resp := &LambdaResponse{}
-	err = json.Unmarshal(result.Payload, resp)
-	if err != nil {
+	if err := json.Unmarshal(result.Payload, resp); err != nil {
 		return nil, err
 	}
+	if resp.Error != "" {
+		return nil, &connectorError{msg: resp.Error, reason: resp.FailureReason}
+	}
 	return resp, nil
 }
 
+// CheckPayloadSize errors when the connector's response for action exceeds its payload limit, which Lambda
+// would otherwise fail with an opaque error.
+func CheckPayloadSize(action Action, res *LambdaResponse) error {
+	b, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	if max := maxPayload(); len(b) > max {
+		return payloadTooLarge(action, fmt.Sprintf("%d bytes over the %d bytes limit", len(b), max))
+	}
+	return nil
+}
+
+// maxPayload is the connector's response limit, lowered by MaxPayloadEnvVar.
+func maxPayload() int {
+	if max, err := strconv.Atoi(os.Getenv(MaxPayloadEnvVar)); err == nil && max > 0 && max < maxPayloadSize {
+		return max
+	}
+	return maxPayloadSize
+}
+
+func payloadTooLarge(action Action, detail string) error {
+	return withReason(ConnectorFailure, fmt.Errorf("VPC connector response for %s is too large (%s), reduce its scope, e.g. set ReturnResources to false or list fewer releases", action, detail))
+}
+
+// retryableInvokeError reports whether an invoke failed on throttling, a server error or the connector not being ready.
+// Errors raised by the connector itself are returned as FunctionError and never retried.
+func retryableInvokeError(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+	switch aerr.Code() {
+	case lambda.ErrCodeTooManyRequestsException, lambda.ErrCodeServiceException,
+		lambda.ErrCodeEC2UnexpectedException, lambda.ErrCodeEC2ThrottledException,
+		lambda.ErrCodeResourceConflictException, lambda.ErrCodeResourceNotReadyException:
+		return true
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		return reqErr.StatusCode() >= 500
+	}
+	return false
+}
+
 func getZip(file string) ([]byte, string, error) {
 	hasher := sha256.New()
 	s, err := ioutil.ReadFile(file)
@@ -275,6 +600,57 @@ func functionNotExists(err error) bool {
 	return false
 }
 
+// modifiedWithin reports whether the connector was created or last updated less than d ago.
+func modifiedWithin(config *lambda.FunctionConfiguration, d time.Duration) bool {
+	t, err := time.Parse(lastModifiedLayout, aws.StringValue(config.LastModified))
+	return err == nil && time.Since(t) < d
+}
+
+// useConnector points l at an externally managed connector, which is invoked but never created, updated or deleted.
+func (l *lambdaResource) useConnector(arn *string) {
+	if arn == nil {
+		return
+	}
+	l.functionName = arn
+	l.external = true
+}
+
+// setConnectorOutputs reports the connector in use and how it was chosen in the model's read-only properties.
+func setConnectorOutputs(m *Model, l *lambdaResource) {
+	m.ConnectorFunction = l.functionName
+	source := ConnectorCreated
+	if data, err := DecodeID(m.ID); err == nil && data.VPCDetected {
+		source = ConnectorCreatedForDetectedVPC
+	}
+	if l.external {
+		source = ConnectorProvided
+	}
+	m.ConnectorSource = aws.String(source)
+}
+
+// useRole runs the connector as arn rather than the provider's own role.
+func (l *lambdaResource) useRole(arn *string) {
+	if arn == nil {
+		return
+	}
+	l.roleArn = arn
+	l.customRole = true
+}
+
+// normalizeIDs returns a sorted copy of ids without duplicates.
+func normalizeIDs(ids []string) []string {
+	seen := make(map[string]bool, len(ids))
+	var out []string
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			out = append(out, id)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
 func newLambdaResource(svc STSAPI, cluster *string, kubeconfig *string, vpc *VPCConfiguration) *lambdaResource {
 	nameSuffix := aws.String("default")
 	var err error
@@ -282,7 +658,8 @@ func newLambdaResource(svc STSAPI, cluster *string, kubeconfig *string, vpc *VPC
 		functionFile: ZipFile,
 	}
 	if vpc != nil {
-		suffix := fmt.Sprintf("%s-%s", strings.Join(vpc.SecurityGroupIds, "-"), strings.Join(vpc.SubnetIds, "-"))
+		// Normalized so configurations listing the same IDs in another order share a connector.
+		suffix := fmt.Sprintf("%s-%s", strings.Join(normalizeIDs(vpc.SecurityGroupIds), "-"), strings.Join(normalizeIDs(vpc.SubnetIds), "-"))
 
 		switch {
 		case cluster != nil:
@@ -1,12 +1,16 @@
 package resource
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/lambda"
 	"github.com/stretchr/testify/assert"
 	"helm.sh/helm/v3/pkg/release"
@@ -17,6 +21,9 @@ type mockLambdaClient struct {
 	LambdaAPI
 }
 
+// invokeAttempts counts invokes of the functions simulating retries.
+var invokeAttempts int
+
 func (m *mockLambdaClient) CreateFunction(*lambda.CreateFunctionInput) (*lambda.FunctionConfiguration, error) {
 	return nil, nil
 }
@@ -86,6 +93,14 @@ func (m *mockLambdaClient) UpdateFunctionConfiguration(*lambda.UpdateFunctionCon
 	return nil, nil
 }
 
+func (m *mockLambdaClient) TagResource(*lambda.TagResourceInput) (*lambda.TagResourceOutput, error) {
+	return nil, nil
+}
+
+func (m *mockLambdaClient) UntagResource(*lambda.UntagResourceInput) (*lambda.UntagResourceOutput, error) {
+	return nil, nil
+}
+
 func (m *mockLambdaClient) Invoke(i *lambda.InvokeInput) (*lambda.InvokeOutput, error) {
 	switch aws.StringValue(i.FunctionName) {
 	case "function2":
@@ -95,10 +110,33 @@ func (m *mockLambdaClient) Invoke(i *lambda.InvokeInput) (*lambda.InvokeOutput,
 			FunctionError: aws.String("Function error"),
 			Payload:       p,
 		}, nil
+	case "functionTooLarge":
+		t := map[string]string{"errorType": responseTooLargeError, "errorMessage": "Response payload size exceeded maximum allowed payload size (6291556 bytes)."}
+		p, _ := json.Marshal(t)
+		return &lambda.InvokeOutput{
+			FunctionError: aws.String("Unhandled"),
+			Payload:       p,
+		}, nil
+	case "functionReason":
+		p, _ := json.Marshal(&LambdaResponse{Error: "release one is locked by another operation", FailureReason: Conflict})
+		return &lambda.InvokeOutput{Payload: p}, nil
 	case "functionNRetry":
 		return nil, awserr.New(lambda.ErrCodeInvalidRequestContentException, "ErrCodeInvalidRequestContentException", fmt.Errorf("ErrCodeInvalidRequestContentException"))
+	case "functionAccessDenied":
+		return nil, awserr.New("AccessDeniedException", "not authorized to perform: lambda:InvokeFunction", nil)
 	case "functionRetry":
 		return nil, awserr.New(lambda.ErrCodeTooManyRequestsException, "ErrCodeTooManyRequestsException", fmt.Errorf("ErrCodeTooManyRequestsException"))
+	case "functionServerError":
+		return nil, awserr.NewRequestFailure(awserr.New("InternalFailure", "InternalFailure", fmt.Errorf("InternalFailure")), 502, "id")
+	case "functionNotFound":
+		invokeAttempts++
+		return nil, awserr.New(lambda.ErrCodeResourceNotFoundException, "ResourceNotFoundException", fmt.Errorf("ResourceNotFoundException"))
+	case "functionColdStart":
+		invokeAttempts++
+		if invokeAttempts < 3 {
+			return nil, awserr.New(lambda.ErrCodeEC2ThrottledException, "EC2ThrottledException", fmt.Errorf("EC2ThrottledException"))
+		}
+		return m.Invoke(&lambda.InvokeInput{FunctionName: aws.String("function1")})
 	default:
 		r, _ := json.Marshal(&LambdaResponse{
 			StatusData: &HelmStatusData{
@@ -115,6 +153,10 @@ func (m *mockLambdaClient) Invoke(i *lambda.InvokeInput) (*lambda.InvokeOutput,
 	}
 }
 
+func (m *mockLambdaClient) InvokeWithContext(_ aws.Context, i *lambda.InvokeInput, _ ...request.Option) (*lambda.InvokeOutput, error) {
+	return m.Invoke(i)
+}
+
 // TestCreateFunction to test createFunction
 func TestCreateFunction(t *testing.T) {
 	eErr := "no such file or directory"
@@ -163,6 +205,70 @@ func TestDeleteFunction(t *testing.T) {
 	}
 }
 
+// mockSharedLambdaClient keeps the tags of a single connector and whether it was deleted.
+type mockSharedLambdaClient struct {
+	LambdaAPI
+	tags    map[string]*string
+	deleted bool
+}
+
+func (m *mockSharedLambdaClient) GetFunction(*lambda.GetFunctionInput) (*lambda.GetFunctionOutput, error) {
+	if m.deleted {
+		return nil, awserr.New(lambda.ErrCodeResourceNotFoundException, "NotFound", fmt.Errorf("NotFound"))
+	}
+	tags := map[string]*string{}
+	for k, v := range m.tags {
+		tags[k] = v
+	}
+	return &lambda.GetFunctionOutput{Configuration: getFunctionConfig(), Tags: tags}, nil
+}
+
+func (m *mockSharedLambdaClient) UntagResource(i *lambda.UntagResourceInput) (*lambda.UntagResourceOutput, error) {
+	for _, k := range i.TagKeys {
+		delete(m.tags, *k)
+	}
+	return nil, nil
+}
+
+func (m *mockSharedLambdaClient) DeleteFunction(*lambda.DeleteFunctionInput) (*lambda.DeleteFunctionOutput, error) {
+	m.deleted = true
+	return nil, nil
+}
+
+// TestReleaseConnector to test releaseConnector
+func TestReleaseConnector(t *testing.T) {
+	one := &Model{ClusterID: aws.String("eks"), ID: aws.String("one")}
+	two := &Model{ClusterID: aws.String("eks"), ID: aws.String("two")}
+	tags := connectorTags(one, "stack-one")
+	for k, v := range connectorTags(two, "stack-two") {
+		if _, ok := tags[k]; !ok {
+			tags[k] = v
+		}
+	}
+
+	t.Run("Shared", func(t *testing.T) {
+		svc := &mockSharedLambdaClient{tags: aws.StringMap(tags)}
+		err := releaseConnector(svc, aws.String("t-name"), releaseTag(one))
+		assert.Nil(t, err)
+		assert.False(t, svc.deleted)
+		assert.NotContains(t, svc.tags, releaseTag(one))
+		assert.Contains(t, svc.tags, releaseTag(two))
+
+		err = releaseConnector(svc, aws.String("t-name"), releaseTag(two))
+		assert.Nil(t, err)
+		assert.True(t, svc.deleted)
+
+		err = releaseConnector(svc, aws.String("t-name"), releaseTag(two))
+		assert.Nil(t, err)
+	})
+	t.Run("Untagged", func(t *testing.T) {
+		svc := &mockSharedLambdaClient{tags: aws.StringMap(map[string]string{"managed-by": ManagedByTag})}
+		err := releaseConnector(svc, aws.String("t-name"), releaseTag(one))
+		assert.Nil(t, err)
+		assert.True(t, svc.deleted)
+	})
+}
+
 // TestGetFunction to test getFunction
 func TestGetFunction(t *testing.T) {
 	mockSvc := &mockLambdaClient{}
@@ -203,7 +309,9 @@ func TestUpdateFunction(t *testing.T) {
 		SubnetIds:        []string{"subnet-1"},
 	}
 	tests := map[string]struct {
-		lr *lambdaResource
+		lr     *lambdaResource
+		status string
+		ready  bool
 	}{
 		"Correct": {
 			lr: &lambdaResource{
@@ -211,6 +319,7 @@ func TestUpdateFunction(t *testing.T) {
 				functionFile: TestZipFile,
 				vpcConfig:    vpc,
 			},
+			ready: true,
 		},
 		"CodeChange": {
 			lr: &lambdaResource{
@@ -218,13 +327,256 @@ func TestUpdateFunction(t *testing.T) {
 				functionFile: TestZipFile,
 				vpcConfig:    vpc,
 			},
+			ready: true,
+		},
+		"Tags": {
+			lr: &lambdaResource{
+				functionName: aws.String("function1"),
+				functionFile: TestZipFile,
+				vpcConfig:    vpc,
+				tags:         map[string]string{"managed-by": ManagedByTag},
+			},
+			ready: true,
+		},
+		"InProgress": {
+			lr: &lambdaResource{
+				functionName: aws.String("function1"),
+				functionFile: TestZipFile,
+				vpcConfig:    vpc,
+			},
+			status: lambda.LastUpdateStatusInProgress,
 		},
 	}
 	for name, d := range tests {
 		t.Run(name, func(t *testing.T) {
 			d.lr.functionOutput, _ = getFunction(mockSvc, d.lr.functionName)
-			err := updateFunction(mockSvc, d.lr)
+			if d.status != "" {
+				d.lr.functionOutput.Configuration.LastUpdateStatus = aws.String(d.status)
+			}
+			ready, err := updateFunction(mockSvc, d.lr)
+			assert.Nil(t, err)
+			assert.Equal(t, d.ready, ready)
+		})
+	}
+}
+
+type mockMigrateLambdaClient struct {
+	LambdaAPI
+	calls    []string
+	conflict bool
+}
+
+func (m *mockMigrateLambdaClient) UpdateFunctionConfiguration(i *lambda.UpdateFunctionConfigurationInput) (*lambda.FunctionConfiguration, error) {
+	m.calls = append(m.calls, "config:"+aws.StringValue(i.Runtime)+":"+aws.StringValue(i.Handler))
+	return nil, nil
+}
+
+func (m *mockMigrateLambdaClient) UpdateFunctionCode(*lambda.UpdateFunctionCodeInput) (*lambda.FunctionConfiguration, error) {
+	m.calls = append(m.calls, "code")
+	if m.conflict {
+		return nil, awserr.New(lambda.ErrCodeResourceConflictException, "The operation cannot be performed at this time. An update is in progress for resource", nil)
+	}
+	return nil, nil
+}
+
+// TestUpdateFunctionMigrate to test updateFunction moving a go1.x connector to the custom runtime over invocations
+func TestUpdateFunctionMigrate(t *testing.T) {
+	config := getFunctionConfig()
+	config.FunctionName = aws.String("function1")
+	config.Runtime = aws.String("go1.x")
+	config.Handler = aws.String("k8svpc")
+	config.CodeSha256 = aws.String("go1.x-artifact")
+	l := &lambdaResource{
+		functionName:   aws.String("function1"),
+		functionFile:   TestZipFile,
+		vpcConfig:      &VPCConfiguration{SecurityGroupIds: []string{"sg-a", "sg-b"}, SubnetIds: []string{"subnet-a", "subnet-b"}},
+		roleArn:        aws.String("t-role-arn"),
+		functionOutput: &lambda.GetFunctionOutput{Configuration: config},
+	}
+	svc := &mockMigrateLambdaClient{}
+	steps := []struct {
+		update   func(c *lambda.FunctionConfiguration)
+		conflict bool
+		calls    []string
+		ready    bool
+	}{
+		// The runtime and handler move first.
+		{
+			calls: []string{"config:provided.al2023:bootstrap"},
+		},
+		// Nothing is started while that's applied.
+		{
+			update: func(c *lambda.FunctionConfiguration) {
+				c.Runtime, c.Handler = aws.String(Runtime), aws.String(Handler)
+				c.LastUpdateStatus = aws.String(lambda.LastUpdateStatusInProgress)
+			},
+		},
+		// The code follows, started again when the first attempt is rejected.
+		{
+			update: func(c *lambda.FunctionConfiguration) {
+				c.LastUpdateStatus = aws.String(lambda.LastUpdateStatusSuccessful)
+			},
+			conflict: true,
+			calls:    []string{"code"},
+		},
+		{
+			calls: []string{"code"},
+		},
+		{
+			update: func(c *lambda.FunctionConfiguration) { c.CodeSha256 = getFunctionConfig().CodeSha256 },
+			ready:  true,
+		},
+	}
+	for i, step := range steps {
+		svc.calls, svc.conflict = nil, step.conflict
+		if step.update != nil {
+			step.update(config)
+		}
+		ready, err := updateFunction(svc, l)
+		assert.Nil(t, err, "step %d", i)
+		assert.Equal(t, step.ready, ready, "step %d", i)
+		assert.Equal(t, step.calls, svc.calls, "step %d", i)
+	}
+}
+
+type mockKMSLambdaClient struct {
+	LambdaAPI
+	input *lambda.UpdateFunctionConfigurationInput
+}
+
+func (m *mockKMSLambdaClient) UpdateFunctionConfiguration(i *lambda.UpdateFunctionConfigurationInput) (*lambda.FunctionConfiguration, error) {
+	m.input = i
+	return nil, nil
+}
+
+// TestUpdateFunctionKMSKey to test updateFunction only sets a key on a connector without one
+func TestUpdateFunctionKMSKey(t *testing.T) {
+	key := "arn:aws:kms:us-east-1:123456789012:key/test"
+	other := "arn:aws:kms:us-east-1:123456789012:key/other"
+	tests := map[string]struct {
+		desired *string
+		current *string
+		updated *string
+	}{
+		"Unset": {
+			current: aws.String(key),
+		},
+		"Kept": {
+			desired: aws.String(other),
+			current: aws.String(key),
+		},
+		"Set": {
+			desired: aws.String(key),
+			updated: aws.String(key),
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			config := getFunctionConfig()
+			config.KMSKeyArn = d.current
+			l := &lambdaResource{
+				functionName:   config.FunctionName,
+				functionFile:   TestZipFile,
+				vpcConfig:      &VPCConfiguration{SecurityGroupIds: []string{"sg-a", "sg-b"}, SubnetIds: []string{"subnet-a", "subnet-b"}},
+				roleArn:        config.Role,
+				kmsKeyArn:      d.desired,
+				functionOutput: &lambda.GetFunctionOutput{Configuration: config},
+			}
+			svc := &mockKMSLambdaClient{}
+			ready, err := updateFunction(svc, l)
 			assert.Nil(t, err)
+			assert.True(t, ready)
+			if d.updated == nil {
+				assert.Nil(t, svc.input)
+			} else {
+				assert.Equal(t, d.updated, svc.input.KMSKeyArn)
+			}
+		})
+	}
+}
+
+type mockTagLambdaClient struct {
+	LambdaAPI
+	tagged map[string]*string
+}
+
+func (m *mockTagLambdaClient) TagResource(i *lambda.TagResourceInput) (*lambda.TagResourceOutput, error) {
+	m.tagged = i.Tags
+	return nil, nil
+}
+
+// TestAddTags to test addTags
+func TestAddTags(t *testing.T) {
+	tests := map[string]struct {
+		current map[string]*string
+		desired map[string]string
+		eTagged map[string]*string
+	}{
+		"InSync": {
+			current: aws.StringMap(map[string]string{"managed-by": ManagedByTag}),
+			desired: map[string]string{"managed-by": ManagedByTag},
+		},
+		"Add": {
+			desired: map[string]string{"managed-by": ManagedByTag},
+			eTagged: aws.StringMap(map[string]string{"managed-by": ManagedByTag}),
+		},
+		"KeepOtherStacks": {
+			current: aws.StringMap(map[string]string{"managed-by": ManagedByTag, "stack-id": "stack-one", "team": "a"}),
+			desired: map[string]string{"managed-by": ManagedByTag, "stack-id": "stack-two", "team": "b", "env": "dev"},
+			eTagged: aws.StringMap(map[string]string{"env": "dev"}),
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			mockSvc := &mockTagLambdaClient{}
+			err := addTags(mockSvc, aws.String("arn"), d.current, d.desired)
+			assert.Nil(t, err)
+			assert.EqualValues(t, d.eTagged, mockSvc.tagged)
+		})
+	}
+}
+
+// TestConnectorTags to test connectorTags
+func TestConnectorTags(t *testing.T) {
+	m := &Model{
+		ClusterID: aws.String("eks"),
+		Tags:      map[string]string{"team": "a", "managed-by": "me"},
+	}
+	assert.EqualValues(t, map[string]string{"team": "a", "managed-by": ManagedByTag, "cluster": "eks", "stack-id": "stack"}, connectorTags(m, "stack"))
+	assert.EqualValues(t, map[string]string{"managed-by": ManagedByTag}, connectorTags(&Model{}, ""))
+	m.ID = aws.String("id")
+	assert.Equal(t, "stack", connectorTags(m, "stack")[ReleaseTagPrefix+"b80bb7740288fda1f201890375a60c8f"])
+}
+
+// TestConnectorRuntime to test connectorRuntime
+func TestConnectorRuntime(t *testing.T) {
+	defer os.Unsetenv(ConnectorRuntimeEnvVar)
+	os.Unsetenv(ConnectorRuntimeEnvVar)
+	assert.Equal(t, "provided.al2023", connectorRuntime())
+	os.Setenv(ConnectorRuntimeEnvVar, "provided.al2")
+	assert.Equal(t, "provided.al2", connectorRuntime())
+}
+
+// TestSetConnectorOutputs to test setConnectorOutputs
+func TestSetConnectorOutputs(t *testing.T) {
+	created, _ := generateID(&Model{ClusterID: aws.String("eks")}, "test", "eu-west-1", "default", false)
+	detected, _ := generateID(&Model{ClusterID: aws.String("eks")}, "test", "eu-west-1", "default", true)
+	tests := map[string]struct {
+		id       *string
+		external bool
+		expected string
+	}{
+		"Created":  {id: created, expected: ConnectorCreated},
+		"Detected": {id: detected, expected: ConnectorCreatedForDetectedVPC},
+		"Provided": {id: detected, external: true, expected: ConnectorProvided},
+		"NoID":     {expected: ConnectorCreated},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			m := &Model{ID: d.id}
+			setConnectorOutputs(m, &lambdaResource{functionName: aws.String("helm-provider-vpc-connector"), external: d.external})
+			assert.Equal(t, "helm-provider-vpc-connector", aws.StringValue(m.ConnectorFunction))
+			assert.Equal(t, d.expected, aws.StringValue(m.ConnectorSource))
 		})
 	}
 }
@@ -264,26 +616,91 @@ func TestInvokeLambda(t *testing.T) {
 	event := &Event{
 		Action: CheckReleaseAction,
 	}
+	defer func(b time.Duration) { invokeBackoffBase = b }(invokeBackoffBase)
+	invokeBackoffBase = time.Millisecond
 	tests := map[string]struct {
 		functionName string
 		expectedErr  string
+		eAttempts    int
 	}{
-		"Correct":                  {"function1", ""},
-		"FunctionError":            {"function2", "SomeMessage"},
-		"ServiceErrorWithOutRetry": {"functionNRetry", "InvalidRequestContentException"},
-		"ServiceErrorWithRetry":    {"functionRetry", "TooManyRequestsException"},
+		"Correct":                  {"function1", "", 0},
+		"FunctionError":            {"function2", "SomeMessage", 0},
+		"ErrorResponse":            {"functionReason", "locked by another operation", 0},
+		"ResponseTooLarge":         {"functionTooLarge", "VPC connector response for CheckRelease is too large", 0},
+		"ServiceErrorWithOutRetry": {"functionNRetry", "InvalidRequestContentException", 0},
+		"ServiceErrorWithRetry":    {"functionRetry", "TooManyRequestsException", 0},
+		"ServerErrorWithRetry":     {"functionServerError", "InternalFailure", 0},
+		"NotFoundWithOutRetry":     {"functionNotFound", "ResourceNotFoundException", 1},
+		"ColdStart":                {"functionColdStart", "", 3},
 	}
 
 	for name, d := range tests {
 		t.Run(name, func(t *testing.T) {
-			_, err := invokeLambda(mockSvc, aws.String(d.functionName), event)
-			if err != nil {
+			invokeAttempts = 0
+			_, err := invokeLambda(context.Background(), mockSvc, aws.String(d.functionName), event)
+			if d.expectedErr != "" {
 				assert.Contains(t, err.Error(), d.expectedErr)
+			} else {
+				assert.Nil(t, err)
+			}
+			if d.eAttempts > 0 {
+				assert.Equal(t, d.eAttempts, invokeAttempts)
 			}
 		})
 	}
 }
 
+// TestInvokeLambdaReason to test errors returned by the connector keep their failure reason
+func TestInvokeLambdaReason(t *testing.T) {
+	_, err := invokeLambda(context.Background(), &mockLambdaClient{}, aws.String("functionReason"), &Event{Action: CheckReleaseAction})
+	reason, _ := failureReason(err)
+	assert.Equal(t, Conflict, reason)
+
+	_, err = invokeLambda(context.Background(), &mockLambdaClient{}, aws.String("function2"), &Event{Action: CheckReleaseAction})
+	reason, _ = failureReason(err)
+	assert.Equal(t, ConnectorFailure, reason)
+}
+
+// TestCheckPayloadSize to test CheckPayloadSize
+func TestCheckPayloadSize(t *testing.T) {
+	res := &LambdaResponse{StatusData: &HelmStatusData{Manifest: TestManifest}}
+	tests := map[string]struct {
+		max         string
+		expectedErr string
+	}{
+		"Default": {},
+		"Limited": {
+			max:         "10",
+			expectedErr: "VPC connector response for CheckRelease is too large",
+		},
+		"AboveLambdaLimit": {
+			max: "100000000",
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			os.Setenv(MaxPayloadEnvVar, d.max)
+			defer os.Unsetenv(MaxPayloadEnvVar)
+			err := CheckPayloadSize(CheckReleaseAction, res)
+			if d.expectedErr != "" {
+				assert.Contains(t, err.Error(), d.expectedErr)
+			} else {
+				assert.Nil(t, err)
+			}
+		})
+	}
+}
+
+// TestInvokeLambdaCancelled to test retries stop once the context is done
+func TestInvokeLambdaCancelled(t *testing.T) {
+	defer func(b time.Duration) { invokeBackoffBase = b }(invokeBackoffBase)
+	invokeBackoffBase = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := invokeLambda(ctx, &mockLambdaClient{}, aws.String("functionRetry"), &Event{Action: CheckReleaseAction})
+	assert.Contains(t, err.Error(), "TooManyRequestsException")
+}
+
 // TestGetZip to test getZip
 func TestGetZip(t *testing.T) {
 	tests := map[string]struct {
@@ -379,6 +796,37 @@ func TestNewLambdaResource(t *testing.T) {
 	}
 }
 
+// TestNewLambdaResourceOrdering to test equivalent VPC configurations share a connector
+func TestNewLambdaResourceOrdering(t *testing.T) {
+	base := newLambdaResource(nil, aws.String("eks"), nil, &VPCConfiguration{
+		SecurityGroupIds: []string{"sg-a", "sg-b"},
+		SubnetIds:        []string{"subnet-a", "subnet-b"},
+	})
+	tests := map[string]struct {
+		vpc    *VPCConfiguration
+		eEqual bool
+	}{
+		"Reordered": {
+			vpc:    &VPCConfiguration{SecurityGroupIds: []string{"sg-b", "sg-a"}, SubnetIds: []string{"subnet-b", "subnet-a"}},
+			eEqual: true,
+		},
+		"Duplicated": {
+			vpc:    &VPCConfiguration{SecurityGroupIds: []string{"sg-a", "sg-b", "sg-a"}, SubnetIds: []string{"subnet-b", "subnet-a", "subnet-b"}},
+			eEqual: true,
+		},
+		"Different": {
+			vpc:    &VPCConfiguration{SecurityGroupIds: []string{"sg-a"}, SubnetIds: []string{"subnet-a", "subnet-b"}},
+			eEqual: false,
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			result := newLambdaResource(nil, aws.String("eks"), nil, d.vpc)
+			assert.Equal(t, d.eEqual, aws.StringValue(base.functionName) == aws.StringValue(result.functionName))
+		})
+	}
+}
+
 func TestNeedsUpdate(t *testing.T) {
 	desired := &lambda.UpdateFunctionConfigurationInput{
 		FunctionName: aws.String("t-name"),
@@ -410,4 +858,55 @@ func TestNeedsUpdate(t *testing.T) {
 	current.VpcConfig.SecurityGroupIds = aws.StringSlice([]string{"sg-a", "sg-b"})
 	current.MemorySize = aws.Int64(99999)
 	assert.True(t, needsUpdate(desired, current))
+	current.MemorySize = aws.Int64(MemorySize)
+	desired.Environment = &lambda.Environment{Variables: aws.StringMap(map[string]string{"HELM_DRIVER": "secret"})}
+	assert.True(t, needsUpdate(desired, current))
+	current.Environment = &lambda.EnvironmentResponse{Variables: aws.StringMap(map[string]string{"HELM_DRIVER": "secret"})}
+	assert.False(t, needsUpdate(desired, current))
+	current.Environment.Variables["HTTPS_PROXY"] = aws.String("http://proxy:3128")
+	assert.True(t, needsUpdate(desired, current))
+	delete(current.Environment.Variables, "HTTPS_PROXY")
+	desired.KMSKeyArn = aws.String("arn:aws:kms:us-east-1:123456789012:key/test")
+	assert.True(t, needsUpdate(desired, current))
+	current.KMSKeyArn = aws.String("arn:aws:kms:us-east-1:123456789012:key/test")
+	assert.False(t, needsUpdate(desired, current))
+}
+
+// TestConnectorEnvironment to test connectorEnvironment
+func TestConnectorEnvironment(t *testing.T) {
+	defer os.Unsetenv(TracingEnvVar)
+	m := &Model{ConnectorEnvironment: map[string]string{"HTTPS_PROXY": "http://proxy:3128", "HELM_DRIVER": "memory", TracingEnvVar: "true"}}
+	os.Unsetenv(TracingEnvVar)
+	assert.EqualValues(t, map[string]string{"HTTPS_PROXY": "http://proxy:3128", "HELM_DRIVER": HelmDriver}, connectorEnvironment(m))
+	os.Setenv(TracingEnvVar, "true")
+	assert.EqualValues(t, map[string]string{"HELM_DRIVER": HelmDriver, TracingEnvVar: "true"}, connectorEnvironment(nil))
+}
+
+// TestMergeEnvironment to test mergeEnvironment
+func TestMergeEnvironment(t *testing.T) {
+	tests := map[string]struct {
+		current  *lambda.EnvironmentResponse
+		desired  map[string]string
+		expected map[string]string
+	}{
+		"Create": {
+			desired:  map[string]string{"HELM_DRIVER": HelmDriver, "HTTPS_PROXY": "http://proxy:3128"},
+			expected: map[string]string{"HELM_DRIVER": HelmDriver, "HTTPS_PROXY": "http://proxy:3128"},
+		},
+		"KeepOtherStacks": {
+			current:  &lambda.EnvironmentResponse{Variables: aws.StringMap(map[string]string{"HELM_DRIVER": HelmDriver, "HTTPS_PROXY": "http://one:3128", "NO_PROXY": "10.0.0.0/8"})},
+			desired:  map[string]string{"HELM_DRIVER": HelmDriver, "HTTPS_PROXY": "http://two:3128", "SSL_CERT_FILE": "/ca.pem"},
+			expected: map[string]string{"HELM_DRIVER": HelmDriver, "HTTPS_PROXY": "http://one:3128", "NO_PROXY": "10.0.0.0/8", "SSL_CERT_FILE": "/ca.pem"},
+		},
+		"ProviderVariables": {
+			current:  &lambda.EnvironmentResponse{Variables: aws.StringMap(map[string]string{"HELM_DRIVER": "memory", TracingEnvVar: "true"})},
+			desired:  map[string]string{"HELM_DRIVER": HelmDriver},
+			expected: map[string]string{"HELM_DRIVER": HelmDriver},
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.EqualValues(t, d.expected, mergeEnvironment(d.current, d.desired))
+		})
+	}
 }
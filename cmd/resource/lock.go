@@ -0,0 +1,143 @@
+package resource
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/rand"
+)
+
+// releaseLockPrefix names the Lease locking a release, it's kept next to the release records.
+const releaseLockPrefix = "awsqs-kubernetes-helm.lock."
+
+var (
+	// releaseLockWait is how long an operation waits for another to release the lock before failing.
+	releaseLockWait = time.Minute
+	// releaseLockPoll is how often a held lock is checked while waiting.
+	releaseLockPoll = 2 * time.Second
+)
+
+// newLockHolder identifies a single operation holding a lock. Warm Lambda containers run many operations, and one
+// abandoned at a deadline may still be running, so it's not per process.
+func newLockHolder() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%s", host, rand.String(8))
+}
+
+// lockNamespace is where the lock of a release in namespace is kept, the namespace of its records.
+func (c *Clients) lockNamespace(namespace string) string {
+	if c.storageNamespace != nil {
+		return *c.storageNamespace
+	}
+	if namespace == "" {
+		return "default"
+	}
+	return namespace
+}
+
+// lockRelease takes the lock on a release before installing, upgrading or uninstalling it, so overlapping operations
+// from the provider run one after the other rather than leaving the release pending. The lock expires once the
+// invocation's deadline passes, so a crashed operation doesn't keep it. Plain helm users don't take the lock. The
+// returned func releases it. Roles not allowed to manage leases run without the lock.
+func (c *Clients) lockRelease(name string, namespace string) (func(), error) {
+	unlock, err := c.takeReleaseLock(name, namespace)
+	if kerrors.IsForbidden(err) {
+		log.Printf("Warning: Not allowed to lock release %s, continuing without the lock: %s", name, err.Error())
+		return func() {}, nil
+	}
+	return unlock, err
+}
+
+// takeReleaseLock is lockRelease failing with the Forbidden error when leases can't be managed.
+func (c *Clients) takeReleaseLock(name string, namespace string) (func(), error) {
+	namespace = c.lockNamespace(namespace)
+	leases := c.ClientSet.CoordinationV1().Leases(namespace)
+	lockName := releaseLockPrefix + name
+	holder := newLockHolder()
+	ttl := int32((c.hookTimeout() + deadlineMargin).Seconds())
+	waitUntil := time.Now().Add(releaseLockWait)
+	if deadline, ok := c.opContext().Deadline(); ok && deadline.Add(-deadlineMargin).Before(waitUntil) {
+		waitUntil = deadline.Add(-deadlineMargin)
+	}
+	for {
+		now := metav1.NewMicroTime(time.Now())
+		lease, err := leases.Get(c.opContext(), lockName, metav1.GetOptions{})
+		switch {
+		case kerrors.IsNotFound(err):
+			lease = &coordinationv1.Lease{
+				ObjectMeta: metav1.ObjectMeta{Name: lockName, Namespace: namespace},
+				Spec: coordinationv1.LeaseSpec{
+					HolderIdentity:       &holder,
+					LeaseDurationSeconds: &ttl,
+					AcquireTime:          &now,
+					RenewTime:            &now,
+				},
+			}
+			_, err = leases.Create(c.opContext(), lease, metav1.CreateOptions{})
+		case err != nil:
+		case leaseHeld(lease, now.Time):
+			locked := withReason(Conflict, fmt.Errorf("release %s is locked by another operation (%s) until %s", name, *lease.Spec.HolderIdentity,
+				lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds)*time.Second).Format(time.RFC3339)))
+			if !time.Now().Add(releaseLockPoll).Before(waitUntil) {
+				return nil, locked
+			}
+			log.Printf("Release %s is locked by %s, waiting", name, *lease.Spec.HolderIdentity)
+			select {
+			case <-c.opContext().Done():
+				return nil, locked
+			case <-time.After(releaseLockPoll):
+			}
+			continue
+		default:
+			lease.Spec.HolderIdentity = &holder
+			lease.Spec.LeaseDurationSeconds = &ttl
+			lease.Spec.AcquireTime = &now
+			lease.Spec.RenewTime = &now
+			_, err = leases.Update(c.opContext(), lease, metav1.UpdateOptions{})
+		}
+		// Another operation took the lock between the get and the write.
+		if kerrors.IsAlreadyExists(err) || kerrors.IsConflict(err) {
+			continue
+		}
+		if kerrors.IsForbidden(err) {
+			return nil, err
+		}
+		if err != nil {
+			return nil, genericError("Locking release", err)
+		}
+		log.Printf("Locked release %s for %ds", name, ttl)
+		return func() { c.unlockRelease(namespace, lockName, holder) }, nil
+	}
+}
+
+// unlockRelease deletes the lock if holder still holds it. Failures are only logged, the lock expires anyway.
+func (c *Clients) unlockRelease(namespace string, lockName string, holder string) {
+	leases := c.ClientSet.CoordinationV1().Leases(namespace)
+	lease, err := leases.Get(c.opContext(), lockName, metav1.GetOptions{})
+	if err != nil || lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != holder {
+		return
+	}
+	err = leases.Delete(c.opContext(), lockName, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{ResourceVersion: &lease.ResourceVersion},
+	})
+	if err != nil && !kerrors.IsNotFound(err) {
+		log.Printf("Warning: Got error releasing lock %s %s", lockName, err.Error())
+	}
+}
+
+// leaseHeld reports whether the lease is held and hasn't expired at now.
+func leaseHeld(lease *coordinationv1.Lease, now time.Time) bool {
+	s := lease.Spec
+	if s.HolderIdentity == nil || *s.HolderIdentity == "" {
+		return false
+	}
+	if s.RenewTime == nil || s.LeaseDurationSeconds == nil {
+		return false
+	}
+	return now.Before(s.RenewTime.Add(time.Duration(*s.LeaseDurationSeconds) * time.Second))
+}
@@ -0,0 +1,111 @@
+package resource
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// releaseLocked reports whether another operation holds the lock on the release.
+func (c *Clients) releaseLocked(name string, namespace string) bool {
+	lease, err := c.ClientSet.CoordinationV1().Leases(c.lockNamespace(namespace)).Get(c.opContext(), releaseLockPrefix+name, metav1.GetOptions{})
+	return err == nil && leaseHeld(lease, time.Now())
+}
+
+// TestLockRelease to test lockRelease
+func TestLockRelease(t *testing.T) {
+	defer func(wait, poll time.Duration) { releaseLockWait, releaseLockPoll = wait, poll }(releaseLockWait, releaseLockPoll)
+	releaseLockWait, releaseLockPoll = 0, time.Millisecond
+	renewed := metav1.NewMicroTime(time.Now())
+	expired := metav1.NewMicroTime(time.Now().Add(-time.Hour))
+	lease := func(name string, renew metav1.MicroTime) *coordinationv1.Lease {
+		return &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Name: releaseLockPrefix + name, Namespace: "default"},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       aws.String("other"),
+				LeaseDurationSeconds: func(i int32) *int32 { return &i }(60),
+				RenewTime:            &renew,
+			},
+		}
+	}
+	c := &Clients{ClientSet: fakeclientset.NewSimpleClientset(lease("held", renewed), lease("expired", expired))}
+	tests := map[string]struct {
+		name string
+		eErr string
+	}{
+		"Free":    {name: "free"},
+		"Expired": {name: "expired"},
+		"Held":    {name: "held", eErr: "release held is locked by another operation (other)"},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			unlock, err := c.lockRelease(d.name, "default")
+			if d.eErr != "" {
+				assert.Contains(t, err.Error(), d.eErr)
+				reason, _ := failureReason(err)
+				assert.Equal(t, Conflict, reason)
+				return
+			}
+			assert.Nil(t, err)
+			assert.True(t, c.releaseLocked(d.name, "default"))
+			_, err = c.lockRelease(d.name, "default")
+			assert.NotNil(t, err)
+			unlock()
+			assert.False(t, c.releaseLocked(d.name, "default"))
+		})
+	}
+}
+
+// TestLockReleaseDeadline to test lockRelease stops waiting before the invocation's deadline
+func TestLockReleaseDeadline(t *testing.T) {
+	defer func(wait, poll time.Duration) { releaseLockWait, releaseLockPoll = wait, poll }(releaseLockWait, releaseLockPoll)
+	releaseLockWait, releaseLockPoll = time.Minute, 10*time.Millisecond
+	renewed := metav1.NewMicroTime(time.Now())
+	c := &Clients{ClientSet: fakeclientset.NewSimpleClientset(&coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: releaseLockPrefix + "held", Namespace: "default"},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       aws.String("other"),
+			LeaseDurationSeconds: func(i int32) *int32 { return &i }(60),
+			RenewTime:            &renewed,
+		},
+	})}
+	ctx, cancel := context.WithTimeout(context.Background(), deadlineMargin+100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := c.WithContext(ctx).lockRelease("held", "default")
+	assert.Contains(t, err.Error(), "release held is locked by another operation (other)")
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+// TestLockReleaseForbidden to test lockRelease continues without the lock when leases are forbidden
+func TestLockReleaseForbidden(t *testing.T) {
+	cs := fakeclientset.NewSimpleClientset()
+	cs.PrependReactor("*", "leases", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, kerrors.NewForbidden(schema.GroupResource{Group: "coordination.k8s.io", Resource: "leases"}, "", errors.New("denied"))
+	})
+	c := &Clients{ClientSet: cs}
+	unlock, err := c.lockRelease("test", "default")
+	assert.Nil(t, err)
+	unlock()
+	assert.False(t, c.releaseLocked("test", "default"))
+}
+
+// TestLockNamespace to test lockNamespace
+func TestLockNamespace(t *testing.T) {
+	c := &Clients{}
+	assert.Equal(t, "web", c.lockNamespace("web"))
+	assert.Equal(t, "default", c.lockNamespace(""))
+	c.storageNamespace = aws.String("helm-releases")
+	assert.Equal(t, "helm-releases", c.lockNamespace("web"))
+}
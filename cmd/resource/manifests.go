@@ -0,0 +1,193 @@
+package resource
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/jsonmergepatch"
+	"k8s.io/cli-runtime/pkg/resource"
+)
+
+// readManifests reads the model's manifests property named source, fetching s3:// entries. They're read before invoking
+// the connector, which may not reach S3.
+func (c *Clients) readManifests(source string, manifests []string) ([]string, error) {
+	var out []string
+	for _, m := range manifests {
+		m = strings.TrimSpace(m)
+		if !strings.HasPrefix(strings.ToLower(m), "s3://") || strings.Contains(m, "\n") {
+			out = append(out, m)
+			continue
+		}
+		f, err := tempFile("manifest-*.yaml")
+		if err != nil {
+			return nil, err
+		}
+		err = c.downloadChart(m, f)
+		if err == nil {
+			var b []byte
+			b, err = ioutil.ReadFile(f)
+			m = string(b)
+		}
+		wipeFile(f)
+		if err != nil {
+			return nil, genericError("Reading "+source, err)
+		}
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+// buildManifests reads the objects in manifests, defaulting their namespace to namespace.
+func (c *Clients) buildManifests(source string, namespace string, manifests []string) ([]*resource.Info, error) {
+	if len(manifests) == 0 {
+		return nil, nil
+	}
+	infos, err := c.ResourceBuilder().
+		Unstructured().
+		NamespaceParam(namespace).DefaultNamespace().
+		Stream(bytes.NewBufferString(strings.Join(manifests, "\n---\n")), source).
+		Flatten().
+		Do().
+		Infos()
+	if err != nil {
+		return nil, genericError("Building "+source, err)
+	}
+	return infos, nil
+}
+
+// applyManifests creates the objects in manifests, or patches them if present, so a chart can rely on them. Like
+// kubectl apply, the patch is three-way from the last applied manifest, so fields set by the server, e.g. a Service's
+// clusterIP, are kept.
+func (c *Clients) applyManifests(source string, namespace string, manifests []string) error {
+	infos, err := c.buildManifests(source, namespace, manifests)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		helper := resource.NewHelper(info.Client, info.Mapping)
+		modified, err := setLastApplied(info.Object)
+		if err != nil {
+			return genericError("Applying "+source, err)
+		}
+		current, err := helper.Get(info.Namespace, info.Name, false)
+		switch {
+		case kerrors.IsNotFound(err):
+			log.Printf("Creating %s %s/%s", info.Mapping.GroupVersionKind.Kind, info.Namespace, info.Name)
+			_, err = helper.Create(info.Namespace, true, info.Object)
+		case err == nil:
+			log.Printf("Patching %s %s/%s", info.Mapping.GroupVersionKind.Kind, info.Namespace, info.Name)
+			var patch []byte
+			patch, err = lastAppliedPatch(modified, current)
+			if err == nil {
+				_, err = helper.Patch(info.Namespace, info.Name, types.MergePatchType, patch, nil)
+			}
+		}
+		if err != nil {
+			return genericError("Applying "+source, err)
+		}
+	}
+	return nil
+}
+
+// setLastApplied records obj as written in its last-applied-configuration annotation, and returns obj with it.
+func setLastApplied(obj runtime.Object) ([]byte, error) {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return nil, err
+	}
+	annotations := accessor.GetAnnotations()
+	delete(annotations, corev1.LastAppliedConfigAnnotation)
+	if len(annotations) == 0 {
+		annotations = nil
+	}
+	accessor.SetAnnotations(annotations)
+	applied, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[corev1.LastAppliedConfigAnnotation] = string(applied)
+	accessor.SetAnnotations(annotations)
+	return json.Marshal(obj)
+}
+
+// lastAppliedPatch returns the merge patch from current to modified. Fields are only removed if they were in the last
+// applied manifest, and only changed if they are in modified.
+func lastAppliedPatch(modified []byte, current runtime.Object) ([]byte, error) {
+	accessor, err := meta.Accessor(current)
+	if err != nil {
+		return nil, err
+	}
+	live, err := json.Marshal(current)
+	if err != nil {
+		return nil, err
+	}
+	original := accessor.GetAnnotations()[corev1.LastAppliedConfigAnnotation]
+	return jsonmergepatch.CreateThreeWayJSONMergePatch([]byte(original), modified, live)
+}
+
+// deleteManifests deletes the objects in manifests, ignoring any already gone.
+func (c *Clients) deleteManifests(source string, namespace string, manifests []string) error {
+	infos, err := c.buildManifests(source, namespace, manifests)
+	if err != nil {
+		return err
+	}
+	policy := metav1.DeletePropagationBackground
+	for _, info := range infos {
+		log.Printf("Deleting %s %s/%s", info.Mapping.GroupVersionKind.Kind, info.Namespace, info.Name)
+		_, err := resource.NewHelper(info.Client, info.Mapping).DeleteWithOptions(info.Namespace, info.Name, &metav1.DeleteOptions{PropagationPolicy: &policy})
+		if err != nil && !kerrors.IsNotFound(err) {
+			return genericError("Deleting "+source, err)
+		}
+	}
+	return nil
+}
+
+// defaultDenyManifest is the NetworkPolicy added to NamespaceManifests by NamespaceDefaultDeny.
+const defaultDenyManifest = `apiVersion: networking.k8s.io/v1
+kind: NetworkPolicy
+metadata:
+  name: default-deny
+spec:
+  podSelector: {}
+  policyTypes:
+  - Ingress
+`
+
+// namespaceManifests returns the model's NamespaceManifests, with the default-deny NetworkPolicy first when
+// NamespaceDefaultDeny is set.
+func namespaceManifests(m *Model) []string {
+	if !aws.BoolValue(m.NamespaceDefaultDeny) {
+		return m.NamespaceManifests
+	}
+	return append([]string{defaultDenyManifest}, m.NamespaceManifests...)
+}
+
+// applyNamespaceManifests applies the baseline objects in manifests to the namespace if it was created for the
+// release, so they're deleted with it. A namespace created beforehand or for another release is left as is.
+func (c *Clients) applyNamespaceManifests(namespace string, name string, manifests []string) error {
+	if len(manifests) == 0 {
+		return nil
+	}
+	ns, err := c.ClientSet.CoreV1().Namespaces().Get(c.opContext(), namespace, metav1.GetOptions{})
+	if err != nil {
+		return genericError("Get NS", err)
+	}
+	if ns.Annotations[namespaceReleaseAnnotation] != name {
+		log.Printf("Namespace %s was not created for release %s. Skipping NamespaceManifests.", namespace, name)
+		return nil
+	}
+	return c.applyManifests("NamespaceManifests", namespace, manifests)
+}
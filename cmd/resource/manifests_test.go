@@ -0,0 +1,119 @@
+package resource
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const testBootstrapManifest = `apiVersion: v1
+kind: Service
+metadata:
+  name: bootstrap-svc
+`
+
+const testExistingManifest = `apiVersion: v1
+kind: Service
+metadata:
+  name: my-service
+  namespace: default
+`
+
+// TestReadManifests to test readManifests
+func TestReadManifests(t *testing.T) {
+	c := NewMockClient(t, nil)
+	s3Manifest, err := ioutil.ReadFile(TestFolder + "/test.yaml")
+	assert.Nil(t, err)
+	tests := map[string]struct {
+		manifests []string
+		expected  []string
+	}{
+		"Inline": {
+			manifests: []string{testBootstrapManifest},
+			expected:  []string{strings.TrimSpace(testBootstrapManifest)},
+		},
+		"S3": {
+			manifests: []string{"s3://test-bucket/test.yaml"},
+			expected:  []string{string(s3Manifest)},
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			result, err := c.readManifests("PreInstallManifests", d.manifests)
+			assert.Nil(t, err)
+			assert.Equal(t, d.expected, result)
+		})
+	}
+}
+
+// TestApplyManifests to test applyManifests and deleteManifests
+func TestApplyManifests(t *testing.T) {
+	c := NewMockClient(t, nil)
+	manifests := []string{testBootstrapManifest, testExistingManifest}
+	assert.Nil(t, c.applyManifests("PreInstallManifests", "test", manifests))
+	assert.Nil(t, c.deleteManifests("PreInstallManifests", "test", manifests))
+	assert.Nil(t, c.applyManifests("PreInstallManifests", "test", nil))
+}
+
+// TestLastAppliedPatch to test setLastApplied and lastAppliedPatch keep fields set by the server
+func TestLastAppliedPatch(t *testing.T) {
+	service := func(spec map[string]interface{}) *unstructured.Unstructured {
+		return &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Service",
+			"metadata":   map[string]interface{}{"name": "my-service", "namespace": "default"},
+			"spec":       spec,
+		}}
+	}
+	first := service(map[string]interface{}{"selector": map[string]interface{}{"app": "web"}, "ports": []interface{}{map[string]interface{}{"port": int64(80)}}})
+	_, err := setLastApplied(first)
+	assert.Nil(t, err)
+	live := first.DeepCopy()
+	assert.Nil(t, unstructured.SetNestedField(live.Object, "10.100.0.1", "spec", "clusterIP"))
+
+	second := service(map[string]interface{}{"ports": []interface{}{map[string]interface{}{"port": int64(8080)}}})
+	modified, err := setLastApplied(second)
+	assert.Nil(t, err)
+	patch, err := lastAppliedPatch(modified, live)
+	assert.Nil(t, err)
+	p := map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal(patch, &p))
+	spec := p["spec"].(map[string]interface{})
+	assert.NotContains(t, spec, "clusterIP")
+	assert.Contains(t, spec, "selector")
+	assert.Nil(t, spec["selector"])
+	assert.Equal(t, []interface{}{map[string]interface{}{"port": float64(8080)}}, spec["ports"])
+	assert.Contains(t, p["metadata"].(map[string]interface{})["annotations"], corev1.LastAppliedConfigAnnotation)
+
+	// Unchanged manifests don't patch anything.
+	patch, err = lastAppliedPatch(modified, second)
+	assert.Nil(t, err)
+	assert.Equal(t, "{}", string(patch))
+}
+
+// TestNamespaceManifests to test namespaceManifests
+func TestNamespaceManifests(t *testing.T) {
+	m := &Model{NamespaceManifests: []string{testBootstrapManifest}}
+	assert.Equal(t, []string{testBootstrapManifest}, namespaceManifests(m))
+	m.NamespaceDefaultDeny = aws.Bool(true)
+	assert.Equal(t, []string{defaultDenyManifest, testBootstrapManifest}, namespaceManifests(m))
+	assert.Nil(t, namespaceManifests(&Model{}))
+}
+
+// TestApplyNamespaceManifests to test applyNamespaceManifests
+func TestApplyNamespaceManifests(t *testing.T) {
+	c := NewMockClient(t, nil)
+	manifests := []string{testBootstrapManifest}
+	assert.Nil(t, c.createNamespace("test", "one"))
+	assert.Nil(t, c.applyNamespaceManifests("test", "one", manifests))
+	assert.Nil(t, c.applyNamespaceManifests("test", "two", manifests))
+	assert.Nil(t, c.applyNamespaceManifests("missing", "one", nil))
+	err := c.applyNamespaceManifests("missing", "one", manifests)
+	assert.Contains(t, err.Error(), "Get NS")
+}
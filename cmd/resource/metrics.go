@@ -0,0 +1,57 @@
+package resource
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws-cloudformation/cloudformation-cli-go-plugin/cfn/handler"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+const metricsNamespace = "AWSQS/Kubernetes/Helm"
+
+// emitMetrics writes the outcome of a handler invocation to stdout in CloudWatch embedded metric format.
+func emitMetrics(action Action, stage Stage, model *Model, event handler.ProgressEvent) {
+	b, err := json.Marshal(metricRecord(action, stage, model, event, time.Now()))
+	if err != nil {
+		log.Printf("Warning: Got error marshalling metrics %s", err.Error())
+		return
+	}
+	fmt.Println(string(b))
+}
+
+// metricRecord builds the metric record. Release details are properties rather than dimensions to keep cardinality low.
+func metricRecord(action Action, stage Stage, model *Model, event handler.ProgressEvent, now time.Time) map[string]interface{} {
+	var duration float64
+	if start, err := time.Parse(time.RFC3339, os.Getenv("StartTime")); err == nil {
+		duration = now.Sub(start).Seconds()
+	}
+	r := map[string]interface{}{
+		"_aws": map[string]interface{}{
+			"Timestamp": now.UnixNano() / int64(time.Millisecond),
+			"CloudWatchMetrics": []map[string]interface{}{
+				{
+					"Namespace":  metricsNamespace,
+					"Dimensions": [][]string{{"Operation", "Status"}, {"Operation", "Stage"}},
+					"Metrics":    []map[string]string{{"Name": "Duration", "Unit": "Seconds"}},
+				},
+			},
+		},
+		"Operation": string(action),
+		"Stage":     string(stage),
+		"Status":    string(event.OperationStatus),
+		"Duration":  duration,
+	}
+	if event.CallbackContext != nil {
+		r["NextStage"] = fmt.Sprint(event.CallbackContext["Stage"])
+	}
+	if model != nil {
+		r["ReleaseName"] = aws.StringValue(model.Name)
+		r["Namespace"] = aws.StringValue(model.Namespace)
+		r["Cluster"] = aws.StringValue(model.ClusterID)
+	}
+	return r
+}
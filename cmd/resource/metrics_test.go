@@ -0,0 +1,51 @@
+package resource
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws-cloudformation/cloudformation-cli-go-plugin/cfn/handler"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestMetricRecord to test metricRecord
+func TestMetricRecord(t *testing.T) {
+	now := time.Now()
+	os.Setenv("StartTime", now.Add(-time.Minute).Format(time.RFC3339))
+	defer os.Unsetenv("StartTime")
+	m := &Model{
+		Name:      aws.String("test"),
+		Namespace: aws.String("default"),
+		ClusterID: aws.String("eks"),
+	}
+	tests := map[string]struct {
+		event      handler.ProgressEvent
+		eStatus    string
+		eNextStage interface{}
+	}{
+		"InProgress": {
+			event:      inProgressEvent(m, ReleaseStabilize),
+			eStatus:    "IN_PROGRESS",
+			eNextStage: "ReleaseStabilize",
+		},
+		"Failed": {
+			event:   errorEvent(m, assert.AnError),
+			eStatus: "FAILED",
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := metricRecord(InstallReleaseAction, InitStage, m, d.event, now)
+			assert.Equal(t, "InstallReleaseAction", r["Operation"])
+			assert.Equal(t, "Init", r["Stage"])
+			assert.Equal(t, d.eStatus, r["Status"])
+			assert.Equal(t, d.eNextStage, r["NextStage"])
+			assert.Equal(t, "test", r["ReleaseName"])
+			assert.Equal(t, "eks", r["Cluster"])
+			assert.InDelta(t, 60, r["Duration"], 1)
+			assert.Contains(t, r, "_aws")
+		})
+	}
+}
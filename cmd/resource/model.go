@@ -10,21 +10,75 @@ and executing the 'generate' command
 
 // Model is autogenerated from the json schema
 type Model struct {
-	ClusterID        *string                `json:",omitempty"`
-	KubeConfig       *string                `json:",omitempty"`
-	RoleArn          *string                `json:",omitempty"`
-	Repository       *string                `json:",omitempty"`
-	Chart            *string                `json:",omitempty"`
-	Namespace        *string                `json:",omitempty"`
-	Name             *string                `json:",omitempty"`
-	Values           map[string]string      `json:",omitempty"`
-	ValueYaml        *string                `json:",omitempty"`
-	Version          *string                `json:",omitempty"`
-	ValueOverrideURL *string                `json:",omitempty"`
-	ID               *string                `json:",omitempty"`
-	Resources        map[string]interface{} `json:",omitempty"`
-	TimeOut          *int                   `json:",omitempty"`
-	VPCConfiguration *VPCConfiguration      `json:",omitempty"`
+	ClusterID                  *string                `json:",omitempty"`
+	KubeConfig                 *string                `json:",omitempty"`
+	RoleArn                    *string                `json:",omitempty"`
+	Repository                 *string                `json:",omitempty"`
+	Chart                      *string                `json:",omitempty"`
+	Namespace                  *string                `json:",omitempty"`
+	Name                       *string                `json:",omitempty"`
+	Values                     map[string]string      `json:",omitempty"`
+	ValueYaml                  *string                `json:",omitempty"`
+	Version                    *string                `json:",omitempty"`
+	ValueOverrideURL           *string                `json:",omitempty"`
+	ID                         *string                `json:",omitempty"`
+	Resources                  map[string]interface{} `json:",omitempty"`
+	TimeOut                    *int                   `json:",omitempty"`
+	VPCConfiguration           *VPCConfiguration      `json:",omitempty"`
+	FailFast                   *bool                  `json:",omitempty"`
+	KubeVersion                *string                `json:",omitempty"`
+	ApiVersions                []string               `json:",omitempty"`
+	MaxHistory                 *int                   `json:",omitempty"`
+	DisableOpenAPIValidation   *bool                  `json:",omitempty"`
+	DisableHooks               *bool                  `json:",omitempty"`
+	KeepHistory                *bool                  `json:",omitempty"`
+	UninstallTimeOut           *int                   `json:",omitempty"`
+	UninstallWait              *bool                  `json:",omitempty"`
+	InstallIfMissing           *bool                  `json:",omitempty"`
+	TakeOwnership              *bool                  `json:",omitempty"`
+	ClusterArn                 *string                `json:",omitempty"`
+	OIDCIssuer                 *string                `json:",omitempty"`
+	ReadinessProbe             *string                `json:",omitempty"`
+	DeleteNamespaceOnUninstall *bool                  `json:",omitempty"`
+	KubeContext                *string                `json:",omitempty"`
+	ValueFiles                 []string               `json:",omitempty"`
+	InsecureSkipTLSVerify      *bool                  `json:",omitempty"`
+	ReadinessTimeOuts          map[string]int         `json:",omitempty"`
+	ChartChecksum              *string                `json:",omitempty"`
+	ReturnResources            *bool                  `json:",omitempty"`
+	MergeStrategy              *string                `json:",omitempty"`
+	ValueFromConfigMap         *ValueFrom             `json:",omitempty"`
+	ValueFromSecret            *ValueFrom             `json:",omitempty"`
+	ValueYamlGzipB64           *string                `json:",omitempty"`
+	DisableAutoVPCDetection    *bool                  `json:",omitempty"`
+	Tags                       map[string]string      `json:",omitempty"`
+	ConnectorFunctionArn       *string                `json:",omitempty"`
+	FailureTopicArn            *string                `json:",omitempty"`
+	ConnectorRoleArn           *string                `json:",omitempty"`
+	ClusterRegion              *string                `json:",omitempty"`
+	ValuePatches               []string               `json:",omitempty"`
+	ReadinessConditions        map[string]string      `json:",omitempty"`
+	ReleaseLabels              map[string]string      `json:",omitempty"`
+	PullSecret                 *PullSecret            `json:",omitempty"`
+	PreInstallManifests        []string               `json:",omitempty"`
+	DeletePreInstallManifests  *bool                  `json:",omitempty"`
+	Repositories               []ChartRepository      `json:",omitempty"`
+	Status                     *string                `json:",omitempty"`
+	Healthy                    *bool                  `json:",omitempty"`
+	ChartSha256                *string                `json:",omitempty"`
+	CommonLabels               map[string]string      `json:",omitempty"`
+	CommonAnnotations          map[string]string      `json:",omitempty"`
+	StorageNamespace           *string                `json:",omitempty"`
+	UninstallDescription       *string                `json:",omitempty"`
+	ConnectorFunction          *string                `json:",omitempty"`
+	ConnectorSource            *string                `json:",omitempty"`
+	ChartFromConfigMap         *ValueFrom             `json:",omitempty"`
+	ConnectorEnvironment       map[string]string      `json:",omitempty"`
+	ConnectorKMSKeyArn         *string                `json:",omitempty"`
+	ChartCache                 *string                `json:",omitempty"`
+	ChartCacheTTL              *int                   `json:",omitempty"`
+	NamespaceManifests         []string               `json:",omitempty"`
+	NamespaceDefaultDeny       *bool                  `json:",omitempty"`
 }
 
 // VPCConfiguration is autogenerated from the json schema
@@ -32,3 +86,23 @@ type VPCConfiguration struct {
 	SecurityGroupIds []string `json:",omitempty"`
 	SubnetIds        []string `json:",omitempty"`
 }
+
+// ValueFrom is autogenerated from the json schema
+type ValueFrom struct {
+	Namespace *string `json:",omitempty"`
+	Name      *string `json:",omitempty"`
+	Key       *string `json:",omitempty"`
+}
+
+// PullSecret is autogenerated from the json schema
+type PullSecret struct {
+	Name           *string `json:",omitempty"`
+	Registry       *string `json:",omitempty"`
+	CredentialsArn *string `json:",omitempty"`
+}
+
+// ChartRepository is autogenerated from the json schema
+type ChartRepository struct {
+	Name *string `json:",omitempty"`
+	URL  *string `json:",omitempty"`
+}
@@ -0,0 +1,55 @@
+package resource
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/aws-cloudformation/cloudformation-cli-go-plugin/cfn/handler"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/service/sns"
+)
+
+// notifyFailure publishes a failed event to the model's FailureTopicArn. It only logs errors so the event is returned unchanged.
+func notifyFailure(clients AWSClientsIface, action Action, stage Stage, model *Model, event handler.ProgressEvent) {
+	if model == nil || model.FailureTopicArn == nil || event.OperationStatus != handler.Failed {
+		return
+	}
+	if err := publishFailure(clients, action, stage, model, event); err != nil {
+		log.Printf("Warning: Got error notifying %s: %s", *model.FailureTopicArn, err.Error())
+	}
+}
+
+func publishFailure(clients AWSClientsIface, action Action, stage Stage, model *Model, event handler.ProgressEvent) error {
+	a, err := arn.Parse(*model.FailureTopicArn)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(map[string]interface{}{
+		"Operation":       string(action),
+		"Stage":           string(stage),
+		"ReleaseName":     aws.StringValue(model.Name),
+		"Namespace":       aws.StringValue(model.Namespace),
+		"Cluster":         aws.StringValue(model.ClusterID),
+		"Message":         event.Message,
+		"LastKnownErrors": LastKnownErrors,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = clients.SNSClient(aws.String(a.Region), nil).Publish(&sns.PublishInput{
+		TopicArn: model.FailureTopicArn,
+		Subject:  aws.String(truncateSubject(fmt.Sprintf("Helm %s of %s failed", action, aws.StringValue(model.Name)))),
+		Message:  aws.String(string(b)),
+	})
+	return AWSError(err)
+}
+
+// truncateSubject keeps the subject within the 100 characters SNS allows.
+func truncateSubject(s string) string {
+	if len(s) > 100 {
+		return s[:100]
+	}
+	return s
+}
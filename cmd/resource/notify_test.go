@@ -0,0 +1,65 @@
+package resource
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/aws-cloudformation/cloudformation-cli-go-plugin/cfn/handler"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/stretchr/testify/assert"
+)
+
+var published []*sns.PublishInput
+
+func (m *mockSNSClient) Publish(i *sns.PublishInput) (*sns.PublishOutput, error) {
+	published = append(published, i)
+	return &sns.PublishOutput{}, nil
+}
+
+// TestNotifyFailure to test notifyFailure
+func TestNotifyFailure(t *testing.T) {
+	LastKnownErrors = []string{"pod crashloop"}
+	defer func() { LastKnownErrors = nil }()
+	m := &Model{
+		Name:            aws.String("test"),
+		ClusterID:       aws.String("eks"),
+		FailureTopicArn: aws.String("arn:aws:sns:us-east-1:1234567890:alerts"),
+	}
+	tests := map[string]struct {
+		model     *Model
+		event     handler.ProgressEvent
+		published bool
+	}{
+		"Failed": {
+			model:     m,
+			event:     errorEvent(m, assert.AnError),
+			published: true,
+		},
+		"InProgress": {
+			model: m,
+			event: inProgressEvent(m, ReleaseStabilize),
+		},
+		"NoTopic": {
+			model: &Model{Name: aws.String("test")},
+			event: errorEvent(m, assert.AnError),
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			published = nil
+			notifyFailure(&mockAWSClients{}, InstallReleaseAction, ReleaseStabilize, d.model, d.event)
+			if !d.published {
+				assert.Empty(t, published)
+				return
+			}
+			assert.Len(t, published, 1)
+			assert.Equal(t, "Helm InstallRelease of test failed", aws.StringValue(published[0].Subject))
+			var msg map[string]interface{}
+			assert.Nil(t, json.Unmarshal([]byte(aws.StringValue(published[0].Message)), &msg))
+			assert.Equal(t, "ReleaseStabilize", msg["Stage"])
+			assert.Equal(t, "eks", msg["Cluster"])
+			assert.Equal(t, []interface{}{"pod crashloop"}, msg["LastKnownErrors"])
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package resource
+
+import (
+	"bytes"
+	"sort"
+
+	"helm.sh/helm/v3/pkg/releaseutil"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	stackIDAnnotation   = "awsqs-kubernetes-helm/stack-id"
+	logicalIDAnnotation = "awsqs-kubernetes-helm/logical-resource-id"
+)
+
+// commonMetadata is a post-renderer setting labels and annotations on every object rendered from the chart.
+type commonMetadata struct {
+	Labels, Annotations map[string]string
+}
+
+// newCommonMetadata returns the post-renderer for the config's CommonLabels and CommonAnnotations, or nil if there
+// are none.
+func newCommonMetadata(config *Config) *commonMetadata {
+	if len(config.CommonLabels) == 0 && len(config.CommonAnnotations) == 0 {
+		return nil
+	}
+	return &commonMetadata{Labels: config.CommonLabels, Annotations: config.CommonAnnotations}
+}
+
+// commonAnnotations adds the annotations linking objects to the stack and logical resource to annotations.
+func commonAnnotations(annotations map[string]string, stackID string, logicalID string) map[string]string {
+	out := map[string]string{}
+	for k, v := range annotations {
+		out[k] = v
+	}
+	if stackID != "" {
+		out[stackIDAnnotation] = stackID
+	}
+	if logicalID != "" {
+		out[logicalIDAnnotation] = logicalID
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+// Run sets the labels and annotations on each object of the rendered manifests, replacing those the chart set.
+func (m *commonMetadata) Run(rendered *bytes.Buffer) (*bytes.Buffer, error) {
+	objs, err := manifestObjects(rendered.String())
+	if err != nil {
+		return nil, genericError("Adding common metadata", err)
+	}
+	out := &bytes.Buffer{}
+	for _, obj := range objs {
+		metadata, _ := obj["metadata"].(map[string]interface{})
+		if metadata == nil {
+			metadata = map[string]interface{}{}
+			obj["metadata"] = metadata
+		}
+		setStrings(metadata, "labels", m.Labels)
+		setStrings(metadata, "annotations", m.Annotations)
+		b, err := yaml.Marshal(obj)
+		if err != nil {
+			return nil, genericError("Adding common metadata", err)
+		}
+		out.WriteString("---\n")
+		out.Write(b)
+	}
+	return out, nil
+}
+
+// applied reports whether every object in manifest already has the labels and annotations, so an upgrade made only
+// to add them can be skipped. A nil commonMetadata is always applied.
+func (m *commonMetadata) applied(manifest string) bool {
+	if m == nil {
+		return true
+	}
+	objs, err := manifestObjects(manifest)
+	if err != nil {
+		return false
+	}
+	for _, obj := range objs {
+		metadata, _ := obj["metadata"].(map[string]interface{})
+		if !hasStrings(metadata, "labels", m.Labels) || !hasStrings(metadata, "annotations", m.Annotations) {
+			return false
+		}
+	}
+	return true
+}
+
+// manifestObjects parses the non-empty documents of manifest, in order.
+func manifestObjects(manifest string) ([]map[string]interface{}, error) {
+	docs := releaseutil.SplitManifests(manifest)
+	keys := make([]string, 0, len(docs))
+	for k := range docs {
+		keys = append(keys, k)
+	}
+	sort.Sort(releaseutil.BySplitManifestsOrder(keys))
+	var objs []map[string]interface{}
+	for _, k := range keys {
+		obj := map[string]interface{}{}
+		if err := yaml.Unmarshal([]byte(docs[k]), &obj); err != nil {
+			return nil, err
+		}
+		if len(obj) > 0 {
+			objs = append(objs, obj)
+		}
+	}
+	return objs, nil
+}
+
+func setStrings(metadata map[string]interface{}, key string, values map[string]string) {
+	if len(values) == 0 {
+		return
+	}
+	m, _ := metadata[key].(map[string]interface{})
+	if m == nil {
+		m = map[string]interface{}{}
+		metadata[key] = m
+	}
+	for k, v := range values {
+		m[k] = v
+	}
+}
+
+func hasStrings(metadata map[string]interface{}, key string, values map[string]string) bool {
+	m, _ := metadata[key].(map[string]interface{})
+	for k, v := range values {
+		if s, ok := m[k].(string); !ok || s != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,76 @@
+package resource
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestCommonMetadata to test the commonMetadata post-renderer
+func TestCommonMetadata(t *testing.T) {
+	manifest := `---
+# Source: test/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: nginx-deployment
+  labels:
+    team: web
+    app: nginx
+---
+# Source: test/templates/empty.yaml
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: my-service`
+	m := newCommonMetadata(&Config{
+		CommonLabels:      map[string]string{"team": "platform"},
+		CommonAnnotations: map[string]string{stackIDAnnotation: "arn:aws:cloudformation:us-east-1:123456789012:stack/test/1"},
+	})
+	assert.False(t, m.applied(manifest))
+
+	out, err := m.Run(bytes.NewBufferString(manifest))
+	assert.Nil(t, err)
+	objs, err := manifestObjects(out.String())
+	assert.Nil(t, err)
+	assert.Len(t, objs, 2)
+	assert.EqualValues(t, map[string]interface{}{
+		"name":        "nginx-deployment",
+		"labels":      map[string]interface{}{"team": "platform", "app": "nginx"},
+		"annotations": map[string]interface{}{stackIDAnnotation: "arn:aws:cloudformation:us-east-1:123456789012:stack/test/1"},
+	}, objs[0]["metadata"])
+	assert.EqualValues(t, "my-service", objs[1]["metadata"].(map[string]interface{})["name"])
+	assert.True(t, m.applied(out.String()))
+
+	assert.Nil(t, newCommonMetadata(&Config{}))
+	assert.True(t, newCommonMetadata(&Config{}).applied(manifest))
+}
+
+// TestCommonAnnotations to test commonAnnotations
+func TestCommonAnnotations(t *testing.T) {
+	tests := map[string]struct {
+		annotations map[string]string
+		stackID     string
+		logicalID   string
+		expected    map[string]string
+	}{
+		"None": {},
+		"Seeded": {
+			annotations: map[string]string{"owner": "web"},
+			stackID:     "stack",
+			logicalID:   "Chart",
+			expected:    map[string]string{"owner": "web", stackIDAnnotation: "stack", logicalIDAnnotation: "Chart"},
+		},
+		"NoStack": {
+			annotations: map[string]string{"owner": "web"},
+			expected:    map[string]string{"owner": "web"},
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.EqualValues(t, d.expected, commonAnnotations(d.annotations, d.stackID, d.logicalID))
+		})
+	}
+}
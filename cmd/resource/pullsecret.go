@@ -0,0 +1,122 @@
+package resource
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var ecrRegistryRegex = regexp.MustCompile(`^([0-9]{12})\.dkr\.ecr\.([a-z0-9-]+)\.amazonaws\.com(\.cn)?$`)
+
+// pullSecretConfig builds the .dockerconfigjson for the model's PullSecret, from the CredentialsArn secret or an ECR
+// authorization token. It's built before invoking the connector, which may not reach AWS APIs.
+func (c *Clients) pullSecretConfig(p *PullSecret) (*string, []byte, error) {
+	if p == nil {
+		return nil, nil, nil
+	}
+	registry := aws.StringValue(p.Registry)
+	var username, password string
+	switch {
+	case p.CredentialsArn != nil:
+		a, err := arn.Parse(*p.CredentialsArn)
+		if err != nil {
+			return nil, nil, genericError("Parsing CredentialsArn", err)
+		}
+		data, err := getSecretsManager(c.AWSClients.SecretsManagerClient(aws.String(a.Region), nil), p.CredentialsArn)
+		if err != nil {
+			return nil, nil, err
+		}
+		creds := struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		}{}
+		if err := json.Unmarshal(data, &creds); err != nil {
+			return nil, nil, genericError("Parsing registry credentials", err)
+		}
+		username, password = creds.Username, creds.Password
+	default:
+		m := ecrRegistryRegex.FindStringSubmatch(registry)
+		if m == nil {
+			return nil, nil, withReason(InvalidRequest, fmt.Errorf("CredentialsArn is required for registry %s, only ECR registries can use an authorization token", registry))
+		}
+		log.Printf("Warning: pull secret %s uses an ECR authorization token, it expires in 12 hours unless the stack is updated", aws.StringValue(p.Name))
+		var err error
+		username, password, err = getECRCredentials(c.AWSClients.ECRClient(aws.String(m[2]), nil), m[1])
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	config, err := json.Marshal(map[string]interface{}{
+		"auths": map[string]interface{}{
+			registry: map[string]string{
+				"username": username,
+				"password": password,
+				"auth":     base64.StdEncoding.EncodeToString([]byte(username + ":" + password)),
+			},
+		},
+	})
+	if err != nil {
+		return nil, nil, genericError("Building pull secret", err)
+	}
+	return p.Name, config, nil
+}
+
+// getECRCredentials returns the username and password in an ECR authorization token for the registry account.
+func getECRCredentials(svc ECRAPI, account string) (string, string, error) {
+	log.Printf("Getting ECR authorization token...")
+	out, err := svc.GetAuthorizationToken(&ecr.GetAuthorizationTokenInput{RegistryIds: []*string{aws.String(account)}})
+	if err != nil {
+		return "", "", AWSError(err)
+	}
+	if len(out.AuthorizationData) == 0 {
+		return "", "", fmt.Errorf("no ECR authorization token returned for %s", account)
+	}
+	token, err := base64.StdEncoding.DecodeString(aws.StringValue(out.AuthorizationData[0].AuthorizationToken))
+	if err != nil {
+		return "", "", genericError("Decoding ECR authorization token", err)
+	}
+	creds := strings.SplitN(string(token), ":", 2)
+	if len(creds) != 2 {
+		return "", "", fmt.Errorf("malformed ECR authorization token for %s", account)
+	}
+	return creds[0], creds[1], nil
+}
+
+// ensurePullSecret creates or updates the docker-registry Secret in the release namespace before the chart is applied.
+func (c *Clients) ensurePullSecret(namespace string, name *string, config []byte) error {
+	if name == nil || len(config) == 0 {
+		return nil
+	}
+	secrets := c.ClientSet.CoreV1().Secrets(namespace)
+	s, err := secrets.Get(c.opContext(), *name, metav1.GetOptions{})
+	switch {
+	case kerrors.IsNotFound(err):
+		log.Printf("Creating pull secret %s/%s", namespace, *name)
+		_, err = secrets.Create(c.opContext(), &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: *name, Namespace: namespace},
+			Type:       corev1.SecretTypeDockerConfigJson,
+			Data:       map[string][]byte{corev1.DockerConfigJsonKey: config},
+		}, metav1.CreateOptions{})
+	case err != nil:
+	case s.Type != corev1.SecretTypeDockerConfigJson:
+		return fmt.Errorf("pull secret %s/%s exists with type %s", namespace, *name, s.Type)
+	default:
+		log.Printf("Updating pull secret %s/%s", namespace, *name)
+		s.Data = map[string][]byte{corev1.DockerConfigJsonKey: config}
+		_, err = secrets.Update(c.opContext(), s, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return genericError("Pull secret", err)
+	}
+	return nil
+}
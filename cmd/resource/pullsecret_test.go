@@ -0,0 +1,87 @@
+package resource
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func (m *mockECRClient) GetAuthorizationToken(i *ecr.GetAuthorizationTokenInput) (*ecr.GetAuthorizationTokenOutput, error) {
+	return &ecr.GetAuthorizationTokenOutput{
+		AuthorizationData: []*ecr.AuthorizationData{
+			{AuthorizationToken: aws.String(base64.StdEncoding.EncodeToString([]byte("AWS:token")))},
+		},
+	}, nil
+}
+
+// TestPullSecretConfig to test pullSecretConfig
+func TestPullSecretConfig(t *testing.T) {
+	c := NewMockClient(t, nil)
+	tests := map[string]struct {
+		p       *PullSecret
+		eConfig string
+		eErr    string
+	}{
+		"None": {},
+		"ECR": {
+			p:       &PullSecret{Name: aws.String("regcred"), Registry: aws.String("123456789012.dkr.ecr.us-east-1.amazonaws.com")},
+			eConfig: `{"auths":{"123456789012.dkr.ecr.us-east-1.amazonaws.com":{"auth":"QVdTOnRva2Vu","password":"token","username":"AWS"}}}`,
+		},
+		"Credentials": {
+			p:       &PullSecret{Name: aws.String("regcred"), Registry: aws.String("registry.example.com"), CredentialsArn: aws.String("arn:aws:secretsmanager:us-east-2:1234567890:secret:registry-Ab")},
+			eConfig: `{"auths":{"registry.example.com":{"auth":"dXNlcjpwYXNz","password":"pass","username":"user"}}}`,
+		},
+		"NoCredentials": {
+			p:    &PullSecret{Name: aws.String("regcred"), Registry: aws.String("registry.example.com")},
+			eErr: "CredentialsArn is required for registry registry.example.com, only ECR registries can use an authorization token",
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			secretName, config, err := c.pullSecretConfig(d.p)
+			if d.eErr != "" {
+				assert.EqualError(t, err, d.eErr)
+				return
+			}
+			assert.Nil(t, err)
+			if d.p == nil {
+				assert.Nil(t, secretName)
+				assert.Nil(t, config)
+				return
+			}
+			assert.Equal(t, d.p.Name, secretName)
+			assert.JSONEq(t, d.eConfig, string(config))
+		})
+	}
+}
+
+// TestEnsurePullSecret to test ensurePullSecret
+func TestEnsurePullSecret(t *testing.T) {
+	c := NewMockClient(t, nil)
+	secrets := c.ClientSet.CoreV1().Secrets("default")
+	_, err := secrets.Create(context.Background(), &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "opaque", Namespace: "default"},
+		Type:       corev1.SecretTypeOpaque,
+	}, metav1.CreateOptions{})
+	assert.Nil(t, err)
+
+	assert.Nil(t, c.ensurePullSecret("default", nil, nil))
+	assert.Nil(t, c.ensurePullSecret("default", aws.String("regcred"), []byte(`{"auths":{}}`)))
+	s, err := secrets.Get(context.Background(), "regcred", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, corev1.SecretTypeDockerConfigJson, s.Type)
+	assert.Equal(t, `{"auths":{}}`, string(s.Data[corev1.DockerConfigJsonKey]))
+
+	assert.Nil(t, c.ensurePullSecret("default", aws.String("regcred"), []byte(`{"auths":{"a":{}}}`)))
+	s, err = secrets.Get(context.Background(), "regcred", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, `{"auths":{"a":{}}}`, string(s.Data[corev1.DockerConfigJsonKey]))
+
+	assert.EqualError(t, c.ensurePullSecret("default", aws.String("opaque"), []byte(`{}`)), "pull secret default/opaque exists with type Opaque")
+}
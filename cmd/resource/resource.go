@@ -1,6 +1,7 @@
 package resource
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
@@ -10,6 +11,7 @@ import (
 	"github.com/aws-cloudformation/cloudformation-cli-go-plugin/cfn/handler"
 	"github.com/aws/aws-sdk-go/aws"
 	"helm.sh/helm/v3/pkg/helmpath/xdg"
+	"helm.sh/helm/v3/pkg/release"
 )
 
 func init() {
@@ -17,22 +19,28 @@ func init() {
 	os.Setenv(xdg.CacheHomeEnvVar, HelmCacheHomeEnvVar)
 	os.Setenv(xdg.ConfigHomeEnvVar, HelmConfigHomeEnvVar)
 	os.Setenv(xdg.DataHomeEnvVar, HelmDataHomeEnvVar)
+	// Default only; getStage restores StartTime from the callback context.
 	os.Setenv("StartTime", time.Now().Format(time.RFC3339))
 	os.Setenv("KUBECONFIG", KubeConfigLocalPath)
 	os.Setenv("AWS_STS_REGIONAL_ENDPOINTS", "regional")
 }
 
 // Create handles the Create event from the CloudFormation service.
-func Create(req handler.Request, _ *Model, currentModel *Model) (handler.ProgressEvent, error) {
+func Create(req handler.Request, _ *Model, currentModel *Model) (event handler.ProgressEvent, err error) {
 	defer LogPanic()
+	defer CleanupTempFiles()
 	stage := getStage(req.CallbackContext)
+	defer func() {
+		emitMetrics(InstallReleaseAction, stage, currentModel, event)
+		notifyFailure(&AWSClients{AWSSession: req.Session}, InstallReleaseAction, stage, currentModel, event)
+	}()
 	switch stage {
 	case InitStage, LambdaStabilize:
 		log.Printf("Starting %s...", stage)
 		if currentModel.Name == nil {
 			currentModel.Name = getReleaseNameContext(req.CallbackContext)
 		}
-		return initialize(req.Session, currentModel, InstallReleaseAction), nil
+		return initialize(req.Session, currentModel, InstallReleaseAction, req.LogicalResourceID, req.RequestContext.StackID), nil
 	case ReleaseStabilize:
 		log.Printf("Starting %s...", stage)
 		return checkReleaseStatus(req.Session, currentModel, CompleteStage), nil
@@ -44,6 +52,7 @@ func Create(req handler.Request, _ *Model, currentModel *Model) (handler.Progres
 
 // Read handles the Read event from the CloudFormation service.
 func Read(req handler.Request, _ *Model, currentModel *Model) (handler.ProgressEvent, error) {
+	defer CleanupTempFiles()
 	var err error
 	data, err := DecodeID(currentModel.ID)
 	if err != nil {
@@ -55,13 +64,21 @@ func Read(req handler.Request, _ *Model, currentModel *Model) (handler.ProgressE
 	currentModel.ClusterID = data.ClusterID
 	currentModel.KubeConfig = data.KubeConfig
 	currentModel.VPCConfiguration = data.VPCConfiguration
+	currentModel.StorageNamespace = data.StorageNamespace
 
-	client, err := NewClients(currentModel.ClusterID, currentModel.KubeConfig, data.Namespace, req.Session, currentModel.RoleArn, nil, currentModel.VPCConfiguration)
+	client, err := NewClients(currentModel.ClusterID, currentModel.KubeConfig, data.Namespace, req.Session, clusterRegion(currentModel), currentModel.RoleArn, nil, currentModel.VPCConfiguration, currentModel.KubeContext, aws.BoolValue(currentModel.InsecureSkipTLSVerify))
 	if err != nil {
 		return makeEvent(currentModel, NoStage, err), nil
 	}
+	if err := client.UseStorageNamespace(data.StorageNamespace); err != nil {
+		return makeEvent(currentModel, NoStage, err), nil
+	}
+	// Read has no stack operation timeout to honour, only the invocation's.
+	ctx, cancel := context.WithTimeout(context.Background(), handlerTimeout-deadlineMargin)
+	defer cancel()
+	client.WithContext(ctx)
 	if IsZero(currentModel.VPCConfiguration) && currentModel.ClusterID != nil {
-		currentModel.VPCConfiguration, err = getVpcConfig(client.AWSClients.EKSClient(nil, nil), client.AWSClients.EC2Client(nil, nil), currentModel)
+		currentModel.VPCConfiguration, err = client.vpcConfig(currentModel)
 		if err != nil {
 			return makeEvent(currentModel, NoStage, err), nil
 		}
@@ -77,6 +94,9 @@ func Read(req handler.Request, _ *Model, currentModel *Model) (handler.ProgressE
 	vpc := false
 	if !IsZero(currentModel.VPCConfiguration) {
 		vpc = true
+		client.LambdaResource.useConnector(currentModel.ConnectorFunctionArn)
+		client.LambdaResource.useRole(currentModel.ConnectorRoleArn)
+		setConnectorOutputs(currentModel, client.LambdaResource)
 		e.Kubeconfig, err = getLocalKubeConfig()
 		if err != nil {
 			return makeEvent(currentModel, NoStage, err), nil
@@ -86,42 +106,75 @@ func Read(req handler.Request, _ *Model, currentModel *Model) (handler.ProgressE
 			return makeEvent(currentModel, NoStage, err), nil
 		}
 		if !u {
-			return makeEvent(currentModel, NoStage, fmt.Errorf("vpc connector didn't stabilize in time")), nil
+			return makeEvent(currentModel, NoStage, withReason(ConnectorFailure, errors.New("vpc connector didn't stabilize in time"))), nil
 		}
 	}
 	e.Action = CheckReleaseAction
 	s, err := client.helmStatusWrapper(currentModel.Name, e, client.LambdaResource.functionName, vpc)
 	if err != nil {
+		if isReleaseNotFound(err) {
+			return notFoundEvent(err), nil
+		}
 		return makeEvent(currentModel, NoStage, err), nil
 	}
 	currentModel.Chart = aws.String(s.ChartName)
 	currentModel.Version = aws.String(s.ChartVersion)
-	/* Disable fetching resources created by helm
-	e.ReleaseData = &ReleaseData{
-		Name:      aws.StringValue(data.Name),
-		Namespace: s.Namespace,
-		Chart:     s.Chart,
-		Manifest:  s.Manifest,
+	currentModel.ChartChecksum = aws.String(s.ChartChecksum)
+	currentModel.Status = aws.String(string(s.Status))
+	currentModel.Healthy = aws.Bool(false)
+	if s.Status == release.StatusDeployed {
+		e.ReleaseData = &ReleaseData{
+			Name:                aws.StringValue(data.Name),
+			Namespace:           s.Namespace,
+			Chart:               s.Chart,
+			Manifest:            s.Manifest,
+			ReadinessProbe:      aws.StringValue(currentModel.ReadinessProbe),
+			ReadinessConditions: currentModel.ReadinessConditions,
+		}
+		e.Action = GetPendingAction
+		pending, err := client.kubePendingWrapper(e, client.LambdaResource.functionName, vpc)
+		if err != nil {
+			// Health is informational, a failed check reads as unhealthy rather than failing Read.
+			log.Printf("Warning: Got error checking release health %s", err.Error())
+		}
+		currentModel.Healthy = aws.Bool(err == nil && !pending)
 	}
-	e.Action = GetResourcesAction
-	currentModel.Resources, err = client.kubeResourcesWrapper(e, client.LambdaResource.functionName, vpc)
+	err = setClusterOutputs(client.AWSClients.EKSClient(client.region, nil), currentModel)
 	if err != nil {
 		return makeEvent(currentModel, NoStage, err), nil
-	}*/
+	}
+	if aws.BoolValue(currentModel.ReturnResources) {
+		e.ReleaseData = &ReleaseData{
+			Name:      aws.StringValue(data.Name),
+			Namespace: s.Namespace,
+			Chart:     s.Chart,
+			Manifest:  s.Manifest,
+		}
+		e.Action = GetResourcesAction
+		currentModel.Resources, err = client.kubeResourcesWrapper(e, client.LambdaResource.functionName, vpc)
+		if err != nil {
+			return makeEvent(currentModel, NoStage, err), nil
+		}
+	}
 	return makeEvent(currentModel, CompleteStage, nil), nil
 }
 
 // Update handles the Update event from the CloudFormation service.
-func Update(req handler.Request, _ *Model, currentModel *Model) (handler.ProgressEvent, error) {
+func Update(req handler.Request, _ *Model, currentModel *Model) (event handler.ProgressEvent, err error) {
 	defer LogPanic()
+	defer CleanupTempFiles()
 	stage := getStage(req.CallbackContext)
+	defer func() {
+		emitMetrics(UpdateReleaseAction, stage, currentModel, event)
+		notifyFailure(&AWSClients{AWSSession: req.Session}, UpdateReleaseAction, stage, currentModel, event)
+	}()
 	switch stage {
 	case InitStage, LambdaStabilize:
 		log.Printf("Starting %s...", stage)
 		if currentModel.Name == nil {
 			currentModel.Name = getReleaseNameContext(req.CallbackContext)
 		}
-		return initialize(req.Session, currentModel, UpdateReleaseAction), nil
+		return initialize(req.Session, currentModel, UpdateReleaseAction, req.LogicalResourceID, req.RequestContext.StackID), nil
 	case ReleaseStabilize:
 		log.Printf("Starting %s...", stage)
 		return checkReleaseStatus(req.Session, currentModel, CompleteStage), nil
@@ -132,13 +185,18 @@ func Update(req handler.Request, _ *Model, currentModel *Model) (handler.Progres
 }
 
 // Delete handles the Delete event from the CloudFormation service.
-func Delete(req handler.Request, _ *Model, currentModel *Model) (handler.ProgressEvent, error) {
+func Delete(req handler.Request, _ *Model, currentModel *Model) (event handler.ProgressEvent, err error) {
 	defer LogPanic()
+	defer CleanupTempFiles()
 	stage := getStage(req.CallbackContext)
+	defer func() {
+		emitMetrics(UninstallReleaseAction, stage, currentModel, event)
+		notifyFailure(&AWSClients{AWSSession: req.Session}, UninstallReleaseAction, stage, currentModel, event)
+	}()
 	switch stage {
-	case InitStage, LambdaStabilize, UninstallRelease, ReleaseStabilize:
+	case InitStage, LambdaStabilize, UninstallRelease, ReleaseStabilize, UninstallStabilize:
 		log.Printf("Starting %s...", stage)
-		return initialize(req.Session, currentModel, UninstallReleaseAction), nil
+		return initialize(req.Session, currentModel, UninstallReleaseAction, req.LogicalResourceID, req.RequestContext.StackID), nil
 	default:
 		log.Println("Failed to identify stage.")
 		return makeEvent(currentModel, NoStage, fmt.Errorf("unhandled stage %s", stage)), nil
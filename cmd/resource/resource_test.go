@@ -63,7 +63,7 @@ func TestCreate(t *testing.T) {
 					"Stage": aws.StringValue(d.stage),
 				}
 			}
-			NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, role *string, customKubeconfig []byte, vpcConfig *VPCConfiguration) (*Clients, error) {
+			NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, region *string, role *string, customKubeconfig []byte, vpcConfig *VPCConfiguration, kubeContext *string, insecure bool) (*Clients, error) {
 				return NewMockClient(t, d.model), nil
 			}
 			_, err := Create(req, &Model{}, d.model)
@@ -102,11 +102,14 @@ func TestRead(t *testing.T) {
 
 	for name, d := range tests {
 		t.Run(name, func(t *testing.T) {
-			NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, role *string, customKubeconfig []byte, vpcConfig *VPCConfiguration) (*Clients, error) {
+			NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, region *string, role *string, customKubeconfig []byte, vpcConfig *VPCConfiguration, kubeContext *string, insecure bool) (*Clients, error) {
 				return NewMockClient(t, d.model), nil
 			}
-			_, err := Read(req, &Model{}, d.model)
+			res, err := Read(req, &Model{}, d.model)
 			assert.Nil(t, err)
+			m := res.ResourceModel.(*Model)
+			assert.Equal(t, "deployed", aws.StringValue(m.Status))
+			assert.True(t, aws.BoolValue(m.Healthy))
 		})
 	}
 }
@@ -163,7 +166,7 @@ func TestUpdate(t *testing.T) {
 					"Stage": aws.StringValue(d.stage),
 				}
 			}
-			NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, role *string, customKubeconfig []byte, vpcConfig *VPCConfiguration) (*Clients, error) {
+			NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, region *string, role *string, customKubeconfig []byte, vpcConfig *VPCConfiguration, kubeContext *string, insecure bool) (*Clients, error) {
 				return NewMockClient(t, d.model), nil
 			}
 			_, err := Update(req, &Model{}, d.model)
@@ -215,7 +218,7 @@ func TestDelete(t *testing.T) {
 					"Stage": aws.StringValue(d.stage),
 				}
 			}
-			NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, role *string, customKubeconfig []byte, vpcConfig *VPCConfiguration) (*Clients, error) {
+			NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, region *string, role *string, customKubeconfig []byte, vpcConfig *VPCConfiguration, kubeContext *string, insecure bool) (*Clients, error) {
 				return NewMockClient(t, d.model), nil
 			}
 			_, err := Delete(req, &Model{}, d.model)
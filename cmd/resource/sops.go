@@ -0,0 +1,316 @@
+package resource
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"gopkg.in/yaml.v2"
+)
+
+// sopsMetadataKey is the top level key sops adds to the files it encrypts.
+const sopsMetadataKey = "sops"
+
+// sopsValueRegex matches a value encrypted by sops.
+var sopsValueRegex = regexp.MustCompile(`^ENC\[AES256_GCM,data:(.*),iv:(.+),tag:(.+),type:(.+)\]$`)
+
+// sopsKMSKey is a KMS master key entry of the sops metadata.
+type sopsKMSKey struct {
+	Arn     string
+	Enc     string
+	Role    string
+	Context map[string]*string
+}
+
+// isSops reports whether the values were encrypted by sops.
+func isSops(values map[string]interface{}) bool {
+	m, ok := values[sopsMetadataKey].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	_, ok = m["mac"]
+	return ok
+}
+
+// decryptSops decrypts values encrypted by sops with the data key held by one of its KMS master keys. Each value is
+// authenticated by AES-GCM and the file, data, as a whole by the sops MAC, so values can't be added, removed or
+// swapped either.
+func (c *Clients) decryptSops(data []byte, values map[string]interface{}) (map[string]interface{}, error) {
+	keys, err := sopsKMSKeys(values[sopsMetadataKey].(map[string]interface{}))
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("sops file has no KMS keys")
+	}
+	var dataKey []byte
+	for _, k := range keys {
+		if dataKey, err = c.sopsDataKey(k); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, genericError("Decrypting sops data key", err)
+	}
+	if err := verifySopsMAC(data, dataKey); err != nil {
+		return nil, err
+	}
+	out := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		if k == sopsMetadataKey {
+			continue
+		}
+		if out[k], err = sopsDecryptValue(v, dataKey, []string{k}); err != nil {
+			return nil, genericError("Decrypting sops values", err)
+		}
+	}
+	return out, nil
+}
+
+// sopsKMSKeys reads the KMS master keys of the sops metadata.
+func sopsKMSKeys(metadata map[string]interface{}) ([]sopsKMSKey, error) {
+	var keys []sopsKMSKey
+	entries, _ := metadata["kms"].([]interface{})
+	for _, e := range entries {
+		m, ok := e.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid sops kms entry")
+		}
+		k := sopsKMSKey{}
+		k.Arn, _ = m["arn"].(string)
+		k.Enc, _ = m["enc"].(string)
+		k.Role, _ = m["role"].(string)
+		if ctx, ok := m["context"].(map[string]interface{}); ok {
+			k.Context = map[string]*string{}
+			for ck, cv := range ctx {
+				k.Context[ck] = aws.String(fmt.Sprint(cv))
+			}
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// sopsDataKey decrypts the data key with KMS, in the key's region and with its role if set.
+func (c *Clients) sopsDataKey(k sopsKMSKey) ([]byte, error) {
+	a, err := arn.Parse(k.Arn)
+	if err != nil {
+		return nil, err
+	}
+	blob, err := base64.StdEncoding.DecodeString(k.Enc)
+	if err != nil {
+		return nil, err
+	}
+	var role *string
+	if k.Role != "" {
+		role = aws.String(k.Role)
+	}
+	res, err := c.AWSClients.KMSClient(aws.String(a.Region), role).Decrypt(&kms.DecryptInput{
+		CiphertextBlob:    blob,
+		EncryptionContext: k.Context,
+	})
+	if err != nil {
+		return nil, AWSError(err)
+	}
+	return res.Plaintext, nil
+}
+
+// sopsDecryptValue walks a value, decrypting the encrypted strings. sops authenticates each value with its path.
+func sopsDecryptValue(v interface{}, key []byte, path []string) (interface{}, error) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			d, err := sopsDecryptValue(val, key, append(append([]string{}, path...), k))
+			if err != nil {
+				return nil, err
+			}
+			out[k] = d
+		}
+		return out, nil
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, val := range v {
+			d, err := sopsDecryptValue(val, key, path)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = d
+		}
+		return out, nil
+	case string:
+		if !sopsValueRegex.MatchString(v) {
+			return v, nil
+		}
+		return sopsDecrypt(v, key, strings.Join(path, ":")+":")
+	default:
+		return v, nil
+	}
+}
+
+// sopsDecrypt decrypts a single sops value and converts it back to its type.
+func sopsDecrypt(value string, key []byte, additionalData string) (interface{}, error) {
+	m := sopsValueRegex.FindStringSubmatch(value)
+	var parts [3][]byte
+	for i := range parts {
+		var err error
+		if parts[i], err = base64.StdEncoding.DecodeString(m[i+1]); err != nil {
+			return nil, err
+		}
+	}
+	data, iv, tag := parts[0], parts[1], parts[2]
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return nil, err
+	}
+	plain, err := gcm.Open(nil, iv, append(data, tag...), []byte(additionalData))
+	if err != nil {
+		return nil, err
+	}
+	switch m[4] {
+	case "str", "bytes":
+		return string(plain), nil
+	case "int":
+		return strconv.Atoi(string(plain))
+	case "float":
+		return strconv.ParseFloat(string(plain), 64)
+	case "bool":
+		return strconv.ParseBool(string(plain))
+	default:
+		return nil, fmt.Errorf("unsupported sops value type %s", m[4])
+	}
+}
+
+// verifySopsMAC checks the sops MAC of the file. It's the SHA-512 of the values in file order, encrypted with the data
+// key and the last modified time as additional data, so the file is parsed keeping the order of its keys.
+func verifySopsMAC(data []byte, key []byte) error {
+	var file yaml.MapSlice
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return genericError("Parsing sops file", err)
+	}
+	var metadata yaml.MapSlice
+	for _, item := range file {
+		if item.Key == sopsMetadataKey {
+			metadata, _ = item.Value.(yaml.MapSlice)
+		}
+	}
+	var mac, lastModified string
+	var onlyEncrypted bool
+	for _, item := range metadata {
+		switch item.Key {
+		case "mac":
+			mac, _ = item.Value.(string)
+		case "lastmodified":
+			switch v := item.Value.(type) {
+			case string:
+				lastModified = v
+			case time.Time:
+				lastModified = v.Format(time.RFC3339)
+			}
+		case "mac_only_encrypted":
+			onlyEncrypted, _ = item.Value.(bool)
+		}
+	}
+	// sops formats the time again when encrypting the MAC, which may differ from the time written.
+	if t, err := time.Parse(time.RFC3339, lastModified); err == nil {
+		lastModified = t.Format(time.RFC3339)
+	}
+	if !sopsValueRegex.MatchString(mac) {
+		return withReason(InvalidValues, errors.New("sops file has no valid MAC"))
+	}
+	expected, err := sopsDecrypt(mac, key, lastModified)
+	if err != nil {
+		return withReason(InvalidValues, genericError("Decrypting sops MAC", err))
+	}
+	h := sha512.New()
+	for _, item := range file {
+		if item.Key == sopsMetadataKey {
+			continue
+		}
+		if err := sopsHashValue(h, item.Value, key, []string{fmt.Sprint(item.Key)}, onlyEncrypted); err != nil {
+			return withReason(InvalidValues, genericError("Computing sops MAC", err))
+		}
+	}
+	if fmt.Sprintf("%X", h.Sum(nil)) != expected {
+		return withReason(InvalidValues, errors.New("sops MAC mismatch, the values file was modified after it was encrypted"))
+	}
+	return nil
+}
+
+// sopsHashValue walks a value like sopsDecryptValue, adding each decrypted value to h. Unencrypted values are added as
+// well unless onlyEncrypted, null values never are.
+func sopsHashValue(h hash.Hash, v interface{}, key []byte, path []string, onlyEncrypted bool) error {
+	switch v := v.(type) {
+	case yaml.MapSlice:
+		for _, item := range v {
+			if err := sopsHashValue(h, item.Value, key, append(append([]string{}, path...), fmt.Sprint(item.Key)), onlyEncrypted); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []interface{}:
+		for _, val := range v {
+			if err := sopsHashValue(h, val, key, path, onlyEncrypted); err != nil {
+				return err
+			}
+		}
+		return nil
+	case nil:
+		return nil
+	}
+	encrypted := false
+	if s, ok := v.(string); ok && sopsValueRegex.MatchString(s) {
+		d, err := sopsDecrypt(s, key, strings.Join(path, ":")+":")
+		if err != nil {
+			return err
+		}
+		v, encrypted = d, true
+	}
+	if onlyEncrypted && !encrypted {
+		return nil
+	}
+	b, err := sopsBytes(v)
+	if err != nil {
+		return err
+	}
+	h.Write(b)
+	return nil
+}
+
+// sopsBytes returns a value as sops hashes it, with booleans capitalized.
+func sopsBytes(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case string:
+		return []byte(v), nil
+	case int:
+		return []byte(strconv.Itoa(v)), nil
+	case int64:
+		return []byte(strconv.FormatInt(v, 10)), nil
+	case uint64:
+		return []byte(strconv.FormatUint(v, 10)), nil
+	case float64:
+		return []byte(strconv.FormatFloat(v, 'f', -1, 64)), nil
+	case bool:
+		if v {
+			return []byte("True"), nil
+		}
+		return []byte("False"), nil
+	default:
+		return nil, fmt.Errorf("unsupported sops value type %T", v)
+	}
+}
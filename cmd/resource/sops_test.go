@@ -0,0 +1,115 @@
+package resource
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+	sigsyaml "sigs.k8s.io/yaml"
+)
+
+var testSopsKey = []byte("0123456789abcdef0123456789abcdef")
+
+func (m *mockKMSClient) Decrypt(i *kms.DecryptInput) (*kms.DecryptOutput, error) {
+	if string(i.CiphertextBlob) != "encrypted-key" {
+		return nil, awserr.New(kms.ErrCodeInvalidCiphertextException, "InvalidCiphertextException", fmt.Errorf("InvalidCiphertextException"))
+	}
+	return &kms.DecryptOutput{Plaintext: testSopsKey}, nil
+}
+
+// sopsEncrypt encrypts a value the way sops does.
+func sopsEncrypt(t *testing.T, value string, valueType string, path string) string {
+	block, err := aes.NewCipher(testSopsKey)
+	assert.Nil(t, err)
+	iv := make([]byte, 32)
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	assert.Nil(t, err)
+	out := gcm.Seal(nil, iv, []byte(value), []byte(path))
+	data, tag := out[:len(out)-gcm.Overhead()], out[len(out)-gcm.Overhead():]
+	enc := base64.StdEncoding.EncodeToString
+	return fmt.Sprintf("ENC[AES256_GCM,data:%s,iv:%s,tag:%s,type:%s]", enc(data), enc(iv), enc(tag), valueType)
+}
+
+// sopsFile writes values as a sops file, its MAC being over macValues.
+func sopsFile(t *testing.T, values yaml.MapSlice, macValues string, enc string, metadata ...yaml.MapItem) []byte {
+	lastModified := "2020-09-01T10:00:00Z"
+	metadata = append(metadata,
+		yaml.MapItem{Key: "kms", Value: []interface{}{yaml.MapSlice{
+			{Key: "arn", Value: "arn:aws:kms:us-east-1:1234567890:key/test"},
+			{Key: "enc", Value: base64.StdEncoding.EncodeToString([]byte(enc))},
+		}}},
+		yaml.MapItem{Key: "lastmodified", Value: lastModified},
+		yaml.MapItem{Key: "mac", Value: sopsEncrypt(t, fmt.Sprintf("%X", sha512.Sum512([]byte(macValues))), "str", lastModified)},
+	)
+	b, err := yaml.Marshal(append(values, yaml.MapItem{Key: "sops", Value: yaml.MapSlice(metadata)}))
+	assert.Nil(t, err)
+	return b
+}
+
+// TestDecryptSops to test decryptSops
+func TestDecryptSops(t *testing.T) {
+	c := NewMockClient(t, nil)
+	db := func(name string) yaml.MapSlice {
+		return yaml.MapSlice{{Key: "db", Value: yaml.MapSlice{
+			{Key: "password", Value: sopsEncrypt(t, "secret", "str", "db:password:")},
+			{Key: "port", Value: sopsEncrypt(t, "5432", "int", "db:port:")},
+			{Key: "hosts", Value: []interface{}{sopsEncrypt(t, "a", "str", "db:hosts:")}},
+			{Key: "name", Value: name},
+		}}}
+	}
+	eValues := map[string]interface{}{
+		"db": map[string]interface{}{
+			"password": "secret",
+			"port":     5432,
+			"hosts":    []interface{}{"a"},
+			"name":     "plain",
+		},
+	}
+	tests := map[string]struct {
+		file        []byte
+		eValues     map[string]interface{}
+		expectedErr string
+	}{
+		"Correct": {
+			file:    sopsFile(t, db("plain"), "secret5432aplain", "encrypted-key"),
+			eValues: eValues,
+		},
+		"OnlyEncryptedMAC": {
+			file:    sopsFile(t, db("plain"), "secret5432a", "encrypted-key", yaml.MapItem{Key: "mac_only_encrypted", Value: true}),
+			eValues: eValues,
+		},
+		"Tampered": {
+			file:        sopsFile(t, db("other"), "secret5432aplain", "encrypted-key"),
+			expectedErr: "sops MAC mismatch",
+		},
+		"WrongPath": {
+			file:        sopsFile(t, yaml.MapSlice{{Key: "password", Value: sopsEncrypt(t, "secret", "str", "other:")}}, "secret", "encrypted-key"),
+			expectedErr: "Computing sops MAC",
+		},
+		"WrongKey": {
+			file:        sopsFile(t, yaml.MapSlice{{Key: "password", Value: sopsEncrypt(t, "secret", "str", "password:")}}, "secret", "other-key"),
+			expectedErr: "InvalidCiphertextException",
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			values := map[string]interface{}{}
+			assert.Nil(t, sigsyaml.Unmarshal(d.file, &values))
+			assert.True(t, isSops(values))
+			values, err := c.decryptSops(d.file, values)
+			if d.expectedErr != "" {
+				assert.Contains(t, err.Error(), d.expectedErr)
+			} else {
+				assert.Nil(t, err)
+				assert.EqualValues(t, d.eValues, values)
+			}
+		})
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"helm.sh/helm/v3/pkg/chart"
 	"helm.sh/helm/v3/pkg/chartutil"
 	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/kube"
 	kubefake "helm.sh/helm/v3/pkg/kube/fake"
 	"helm.sh/helm/v3/pkg/release"
 	"helm.sh/helm/v3/pkg/storage"
@@ -118,43 +119,60 @@ metadata:
  name: nginx-deployment-foo`
 
 func newFakeBuilder(t *testing.T) func() *resource.Builder {
+	header := http.Header{}
+	header.Set("Content-Type", runtime.ContentTypeJSON)
+	codec := scheme.Codecs.LegacyCodec(scheme.Scheme.PrioritizedVersionsAllGroups()...)
+	return fakeBuilder(func(req *http.Request) (*http.Response, error) {
+		switch p, m := req.URL.Path, req.Method; {
+		case p == "/namespaces/test/services" && m == "POST":
+			return &http.Response{StatusCode: http.StatusCreated, Header: header, Body: ObjBody(codec, ns("test"))}, nil
+		case p == "/namespaces/default/deployments/nginx-deployment" && m == "GET":
+			return &http.Response{StatusCode: http.StatusOK, Header: header, Body: ObjBody(codec, dep("nginx-deployment", "default", false))}, nil
+		case p == "/namespaces/default/deployments/nginx-deployment-foo" && m == "GET":
+			return &http.Response{StatusCode: http.StatusOK, Header: header, Body: ObjBody(codec, dep("nginx-deployment-foo", "default", true))}, nil
+		case p == "/namespaces/default/services/my-service" && m == "GET":
+			return &http.Response{StatusCode: http.StatusOK, Header: header, Body: ObjBody(codec, svc("my-service", "default", v1.ServiceTypeClusterIP))}, nil
+		case p == "/namespaces/default/services/my-service" && (m == "PATCH" || m == "DELETE"):
+			return &http.Response{StatusCode: http.StatusOK, Header: header, Body: ObjBody(codec, svc("my-service", "default", v1.ServiceTypeClusterIP))}, nil
+		case p == "/namespaces/test/services/bootstrap-svc" && (m == "GET" || m == "DELETE"):
+			return &http.Response{StatusCode: http.StatusNotFound, Header: header, Body: ObjBody(codec, &metav1.Status{Status: metav1.StatusFailure, Reason: metav1.StatusReasonNotFound, Code: http.StatusNotFound})}, nil
+		case p == "/namespaces/default/configmaps/test-cm" && m == "GET":
+			return &http.Response{StatusCode: http.StatusOK, Header: header, Body: ObjBody(codec, cm("test-cm", "default"))}, nil
+		case p == "/namespaces/default/secrets/test-secret" && m == "GET":
+			return &http.Response{StatusCode: http.StatusOK, Header: header, Body: ObjBody(codec, secret("test-secret", "default"))}, nil
+		case p == "/namespaces/default/services/missing-service" && m == "GET":
+			return &http.Response{StatusCode: http.StatusNotFound, Header: header, Body: ObjBody(codec, &metav1.Status{Status: metav1.StatusFailure, Reason: metav1.StatusReasonNotFound, Code: http.StatusNotFound})}, nil
+		case p == "/namespaces/other/services/other-service" && m == "GET":
+			return &http.Response{StatusCode: http.StatusOK, Header: header, Body: ObjBody(codec, svc("other-service", "other", v1.ServiceTypeClusterIP))}, nil
+		case p == "/namespaces/default/services/lb-service" && m == "GET":
+			return &http.Response{StatusCode: http.StatusOK, Header: header, Body: ObjBody(codec, svc("lb-service", "default", v1.ServiceTypeLoadBalancer))}, nil
+		case p == "/namespaces/default/daemonsets/nginx-ds" && m == "GET":
+			return &http.Response{StatusCode: http.StatusOK, Header: header, Body: ObjBody(codec, ds("nginx-ds", "default", appsv1.RollingUpdateDaemonSetStrategyType, false))}, nil
+		case p == "/namespaces/default/statefulsets/nginx-ss" && m == "GET":
+			return &http.Response{StatusCode: http.StatusOK, Header: header, Body: ObjBody(codec, ss("nginx-ss", "default", appsv1.RollingUpdateStatefulSetStrategyType, false))}, nil
+		case p == "/namespaces/default/ingress/test-ingress" && m == "GET":
+			return &http.Response{StatusCode: http.StatusOK, Header: header, Body: ObjBody(codec, ing("test-ingress", "default", false))}, nil
+		default:
+			t.Fatalf("unexpected request: %#v\n%#v", req.URL, req)
+			return nil, nil
+		}
+	})
+}
+
+// fakeBuilder returns a resource builder whose REST client answers each request with fn.
+func fakeBuilder(fn func(req *http.Request) (*http.Response, error)) func() *resource.Builder {
 	cfg, _ := clientcmd.NewDefaultClientConfigLoadingRules().Load()
 	clientConfig := clientcmd.NewDefaultClientConfig(*cfg, &clientcmd.ConfigOverrides{})
 	configFlags := genericclioptions.NewTestConfigFlags().
 		WithClientConfig(clientConfig).
 		WithRESTMapper(testRESTMapper())
-	header := http.Header{}
-	header.Set("Content-Type", runtime.ContentTypeJSON)
-	codec := scheme.Codecs.LegacyCodec(scheme.Scheme.PrioritizedVersionsAllGroups()...)
 	return func() *resource.Builder {
 		return resource.NewFakeBuilder(
 			func(version schema.GroupVersion) (resource.RESTClient, error) {
 				return &fake.RESTClient{
 					GroupVersion:         schema.GroupVersion{Version: "v1"},
 					NegotiatedSerializer: resource.UnstructuredPlusDefaultContentConfig().NegotiatedSerializer,
-					Client: fake.CreateHTTPClient(func(req *http.Request) (*http.Response, error) {
-						switch p, m := req.URL.Path, req.Method; {
-						case p == "/namespaces/test/services" && m == "POST":
-							return &http.Response{StatusCode: http.StatusCreated, Header: header, Body: ObjBody(codec, ns("test"))}, nil
-						case p == "/namespaces/default/deployments/nginx-deployment" && m == "GET":
-							return &http.Response{StatusCode: http.StatusOK, Header: header, Body: ObjBody(codec, dep("nginx-deployment", "default", false))}, nil
-						case p == "/namespaces/default/deployments/nginx-deployment-foo" && m == "GET":
-							return &http.Response{StatusCode: http.StatusOK, Header: header, Body: ObjBody(codec, dep("nginx-deployment-foo", "default", true))}, nil
-						case p == "/namespaces/default/services/my-service" && m == "GET":
-							return &http.Response{StatusCode: http.StatusOK, Header: header, Body: ObjBody(codec, svc("my-service", "default", v1.ServiceTypeClusterIP))}, nil
-						case p == "/namespaces/default/services/lb-service" && m == "GET":
-							return &http.Response{StatusCode: http.StatusOK, Header: header, Body: ObjBody(codec, svc("lb-service", "default", v1.ServiceTypeLoadBalancer))}, nil
-						case p == "/namespaces/default/daemonsets/nginx-ds" && m == "GET":
-							return &http.Response{StatusCode: http.StatusOK, Header: header, Body: ObjBody(codec, ds("nginx-ds", "default", appsv1.RollingUpdateDaemonSetStrategyType, false))}, nil
-						case p == "/namespaces/default/statefulsets/nginx-ss" && m == "GET":
-							return &http.Response{StatusCode: http.StatusOK, Header: header, Body: ObjBody(codec, ss("nginx-ss", "default", appsv1.RollingUpdateStatefulSetStrategyType, false))}, nil
-						case p == "/namespaces/default/ingress/test-ingress" && m == "GET":
-							return &http.Response{StatusCode: http.StatusOK, Header: header, Body: ObjBody(codec, ing("test-ingress", "default", false))}, nil
-						default:
-							t.Fatalf("unexpected request: %#v\n%#v", req.URL, req)
-							return nil, nil
-						}
-					}),
+					Client:               fake.CreateHTTPClient(fn),
 				}, nil
 			},
 			configFlags.ToRESTMapper,
@@ -165,6 +183,17 @@ func newFakeBuilder(t *testing.T) func() *resource.Builder {
 	}
 }
 
+// buildingKubeClient is a helm kube client building resources with builder, so they're read and written through its
+// REST client.
+type buildingKubeClient struct {
+	kubefake.PrintingKubeClient
+	builder func() *resource.Builder
+}
+
+func (k *buildingKubeClient) Build(reader io.Reader, _ bool) (kube.ResourceList, error) {
+	return k.builder().Unstructured().ContinueOnError().NamespaceParam("default").DefaultNamespace().Stream(reader, "").Flatten().Do().Infos()
+}
+
 type mockAWSClients struct {
 	AWSSession *session.Session
 	AWSClientsIface
@@ -571,6 +600,50 @@ func ns(name string) *v1.Namespace {
 	}
 }
 
+func cm(name string, namespace string) *v1.ConfigMap {
+	return &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Data:       map[string]string{"config.yaml": "foo: bar"},
+		BinaryData: map[string][]byte{"cert.der": []byte("cert")},
+	}
+}
+
+func secret(name string, namespace string) *v1.Secret {
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Data: map[string][]byte{"username": []byte("admin"), "password": []byte("secret")},
+	}
+}
+
+func pod(name string, namespace string, reason string, restarts int32) *v1.Pod {
+	var state v1.ContainerState
+	if reason != "" {
+		state.Waiting = &v1.ContainerStateWaiting{Reason: reason}
+	} else {
+		state.Running = &v1.ContainerStateRunning{}
+	}
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    map[string]string{"app": name},
+		},
+		Status: v1.PodStatus{
+			ContainerStatuses: []v1.ContainerStatus{{
+				Name:         "app",
+				State:        state,
+				RestartCount: restarts,
+			}},
+		},
+	}
+}
+
 func vol(name string, namespace string, pending bool) *corev1.PersistentVolumeClaim {
 	p := corev1.ClaimBound
 	if pending {
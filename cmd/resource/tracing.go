@@ -0,0 +1,56 @@
+package resource
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-xray-sdk-go/strategy/ctxmissing"
+	"github.com/aws/aws-xray-sdk-go/xray"
+)
+
+// TracingEnvVar enables X-Ray tracing when set to true.
+const TracingEnvVar = "HELM_PROVIDER_XRAY_TRACING"
+
+var tracingSetup sync.Once
+
+// tracingEnabled reports whether X-Ray tracing is turned on, it is off by default.
+func tracingEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv(TracingEnvVar))
+	if enabled {
+		tracingSetup.Do(func() {
+			// SDK calls made without a segment in the context should log rather than panic.
+			xray.Configure(xray.Config{ContextMissingStrategy: ctxmissing.NewDefaultLogErrorStrategy()})
+		})
+	}
+	return enabled
+}
+
+// beginTrace opens a segment for the handler invocation and returns its context with a func to close it.
+func beginTrace(name string) (context.Context, func(error)) {
+	if !tracingEnabled() {
+		return context.Background(), func(error) {}
+	}
+	ctx, seg := xray.BeginSegment(context.Background(), name)
+	return ctx, seg.Close
+}
+
+// trace runs fn in a subsegment of the segment held by ctx.
+func trace(ctx context.Context, name string, fn func() error) error {
+	if !tracingEnabled() {
+		return fn()
+	}
+	return xray.Capture(ctx, name, func(context.Context) error {
+		return fn()
+	})
+}
+
+// traceSession instruments the AWS session when tracing is enabled.
+func traceSession(ses *session.Session) *session.Session {
+	if !tracingEnabled() {
+		return ses
+	}
+	return xray.AWSSession(ses)
+}
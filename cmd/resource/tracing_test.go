@@ -0,0 +1,29 @@
+package resource
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestTrace to test trace with tracing disabled
+func TestTrace(t *testing.T) {
+	tests := map[string]struct {
+		err error
+	}{
+		"Success": {},
+		"Error":   {err: assert.AnError},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			called := false
+			err := trace(context.Background(), name, func() error {
+				called = true
+				return d.err
+			})
+			assert.True(t, called)
+			assert.Equal(t, d.err, err)
+		})
+	}
+}
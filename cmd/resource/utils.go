@@ -2,7 +2,10 @@ package resource
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/gob"
 	"encoding/hex"
@@ -15,26 +18,48 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"reflect"
 	"regexp"
 	"runtime/debug"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
+	jsonpatch "github.com/evanphx/json-patch"
 	"helm.sh/helm/v3/pkg/action"
 	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/storage/driver"
 	"helm.sh/helm/v3/pkg/strvals"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/cli-runtime/pkg/resource"
 	"k8s.io/client-go/kubernetes"
 	"sigs.k8s.io/yaml"
 )
 
+// StrictRepositoryEnvVar set to true on the provider makes Repository required for remote charts.
+const StrictRepositoryEnvVar = "HELM_PROVIDER_STRICT_REPOSITORY"
+
 const (
-	valuesYamlFile = "/tmp/values.yaml"
 	defaultTimeOut = 60
+	// handlerTimeout is how long the CloudFormation plugin lets a handler invocation run.
+	handlerTimeout = 60 * time.Second
+	deadlineMargin = 5 * time.Second
+	// minOperationBudget is the least time an install, upgrade or uninstall is started with.
+	minOperationBudget = 30 * time.Second
+	// releaseNameMaxLen is the maximum length of a release name, as enforced by helm.
+	releaseNameMaxLen = 53
+)
+
+// Strategies for merging ValueYaml, Values and ValueOverrideURL.
+const (
+	mergeDeep        = "deep"
+	mergeReplace     = "replace"
+	mergeAppendLists = "append-lists"
 )
 
 // ID struct for CFN physical resource
@@ -44,7 +69,12 @@ type ID struct {
 	Region           *string           `json:",omitempty"`
 	Name             *string           `json:",omitempty"`
 	Namespace        *string           `json:",omitempty"`
+	StorageNamespace *string           `json:",omitempty"`
 	VPCConfiguration *VPCConfiguration `json:",omitempty"`
+	// VPCResolved marks VPCConfiguration as final, IDs created before it was recorded need detection.
+	VPCResolved bool `json:",omitempty"`
+	// VPCDetected marks VPCConfiguration as detected from the cluster rather than set on the model.
+	VPCDetected bool `json:",omitempty"`
 }
 
 type ClientsInterface interface{}
@@ -57,16 +87,56 @@ type Clients struct {
 	Settings        *cli.EnvSettings      `json:",omitempty"`
 	ResourceBuilder func() *resource.Builder
 	LambdaResource  *lambdaResource
+	ctx             context.Context
+	// region of the cluster, nil for the session's region.
+	region *string
+	// storageNamespace holds the release records when they aren't kept in the release namespace.
+	storageNamespace *string
 }
 
 // Config for processed inputs
 type Config struct {
-	Name, Namespace *string `json:",omitempty"`
+	Name, Namespace *string  `json:",omitempty"`
+	KubeVersion     *string  `json:",omitempty"`
+	APIVersions     []string `json:",omitempty"`
+	ValueFiles      []string `json:",omitempty"`
+	MaxHistory      *int     `json:",omitempty"`
+
+	DisableOpenAPIValidation bool    `json:",omitempty"`
+	DisableHooks             bool    `json:",omitempty"`
+	KeepHistory              bool    `json:",omitempty"`
+	UninstallTimeOut         *int    `json:",omitempty"`
+	UninstallWait            bool    `json:",omitempty"`
+	UninstallDescription     *string `json:",omitempty"`
+	TakeOwnership            bool    `json:",omitempty"`
+
+	DeleteNamespaceOnUninstall bool `json:",omitempty"`
+
+	ValueFromConfigMap, ValueFromSecret *ValueFrom `json:",omitempty"`
+
+	ReleaseLabels map[string]string `json:",omitempty"`
+
+	PullSecretName   *string `json:",omitempty"`
+	PullSecretConfig []byte  `json:",omitempty"`
+
+	PreInstallManifests       []string `json:",omitempty"`
+	DeletePreInstallManifests bool     `json:",omitempty"`
+
+	NamespaceManifests []string `json:",omitempty"`
+
+	Repositories []ChartRepository `json:",omitempty"`
+
+	CommonLabels, CommonAnnotations map[string]string `json:",omitempty"`
+
+	ChartCache    string `json:",omitempty"`
+	ChartCacheTTL int    `json:",omitempty"`
 }
 
 // Chart for chart data
 type Chart struct {
-	Chart, ChartName, ChartPath, ChartType, ChartRepo, ChartVersion, ChartRepoURL *string `json:",omitempty"`
+	Chart, ChartName, ChartPath, ChartType, ChartRepo, ChartVersion, ChartRepoURL *string    `json:",omitempty"`
+	ChartSha256                                                                   *string    `json:",omitempty"`
+	ChartConfigMap                                                                *ValueFrom `json:",omitempty"`
 }
 
 //Inputs for Config and Values for helm
@@ -77,7 +147,7 @@ type Inputs struct {
 }
 
 // NewClients is for generate clients for helm, kube and AWS
-var NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, role *string, customKubeconfig []byte, vpcConfig *VPCConfiguration) (*Clients, error) {
+var NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, region *string, role *string, customKubeconfig []byte, vpcConfig *VPCConfiguration, kubeContext *string, insecure bool) (*Clients, error) {
 	var err error
 	c := &Clients{}
 	if ses == nil {
@@ -86,14 +156,17 @@ var NewClients = func(cluster *string, kubeconfig *string, namespace *string, se
 			return nil, err
 		}
 	}
-	c.AWSClients = &AWSClients{AWSSession: ses}
-	if err := createKubeConfig(c.AWSClients.EKSClient(nil, nil), c.AWSClients.STSClient(nil, role), c.AWSClients.SecretsManagerClient(nil, nil), cluster, kubeconfig, customKubeconfig); err != nil {
+	c.AWSClients = &AWSClients{AWSSession: traceSession(ses)}
+	c.region = region
+	if err := createKubeConfig(c.AWSClients.EKSClient(region, nil), c.AWSClients.STSClient(region, role), c.AWSClients.SecretsManagerClient(nil, nil), cluster, kubeconfig, customKubeconfig, kubeContext, insecure); err != nil {
 		return nil, err
 	}
 	if namespace == nil {
 		namespace = aws.String("default")
 	}
+	os.Setenv("KUBECONFIG", kubeConfigPath(cluster, kubeconfig, customKubeconfig))
 	os.Setenv("HELM_NAMESPACE", aws.StringValue(namespace))
+	os.Setenv("HELM_KUBECONTEXT", aws.StringValue(kubeContext))
 	c.Settings = cli.New()
 	c.HelmClient, err = helmClientInvoke(namespace, c.Settings.RESTClientGetter())
 	if err != nil {
@@ -116,20 +189,54 @@ func (c *Clients) processValues(m *Model) (map[string]interface{}, error) {
 	values := map[string]interface{}{}
 	valueYaml := map[string]interface{}{}
 	currentMap := map[string]interface{}{}
+	strategy := aws.StringValue(m.MergeStrategy)
+	switch strategy {
+	case "", mergeDeep, mergeReplace, mergeAppendLists:
+	default:
+		return nil, withReason(InvalidValues, fmt.Errorf("unsupported merge strategy %s", strategy))
+	}
+	if m.ValueYamlGzipB64 != nil {
+		b, err := decodeGzipB64(*m.ValueYamlGzipB64)
+		if err != nil {
+			return nil, withReason(InvalidValues, genericError("Decoding ValueYamlGzipB64", err))
+		}
+		if err := yaml.Unmarshal(b, &valueYaml); err != nil {
+			return nil, withReason(InvalidValues, genericError("Parsing ValueYamlGzipB64", err))
+		}
+	}
 	if m.ValueYaml != nil {
-		err := yaml.Unmarshal([]byte(*m.ValueYaml), &valueYaml)
+		plain := map[string]interface{}{}
+		err := yaml.Unmarshal([]byte(*m.ValueYaml), &plain)
 		if err != nil {
 			return nil, err
 		}
+		valueYaml = mergeValues(valueYaml, plain, strategy)
 	}
 	if m.Values != nil {
+		var vars map[string]string
 		for k, v := range m.Values {
+			if builtinValueRegex.MatchString(v) {
+				if vars == nil {
+					var err error
+					if vars, err = c.builtinValues(m); err != nil {
+						return nil, err
+					}
+				}
+				for _, match := range builtinValueRegex.FindAllStringSubmatch(v, -1) {
+					if _, ok := vars[match[1]]; !ok {
+						return nil, fmt.Errorf("{{ %s }} in Values %s requires ClusterID", match[1], k)
+					}
+				}
+				v = builtinValueRegex.ReplaceAllStringFunc(v, func(s string) string {
+					return vars[builtinValueRegex.FindStringSubmatch(s)[1]]
+				})
+			}
 			if err := strvals.ParseInto(fmt.Sprintf("%s=%s", k, v), values); err != nil {
 				return nil, genericError("Processing values", err)
 			}
 		}
 	}
-	base := mergeMaps(valueYaml, values)
+	base := mergeValues(valueYaml, values, strategy)
 	if m.ValueOverrideURL != nil {
 		u, err := url.Parse(*m.ValueOverrideURL)
 		if err != nil {
@@ -141,28 +248,145 @@ func (c *Clients) processValues(m *Model) (map[string]interface{}, error) {
 		if err != nil {
 			return nil, err
 		}
-		err = downloadS3(c.AWSClients.S3Client(region, nil), bucket, key, valuesYamlFile)
+		valuesFile, err := tempFile("values-*.yaml")
+		if err != nil {
+			return nil, err
+		}
+		defer wipeFile(valuesFile)
+		err = downloadS3(c.AWSClients.S3Client(region, nil), bucket, key, valuesFile)
 		if err != nil {
 			return nil, err
 		}
-		byteKey, err := ioutil.ReadFile(valuesYamlFile)
+		byteKey, err := ioutil.ReadFile(valuesFile)
 		if err != nil {
 			return nil, genericError("Reading custom yaml", err)
 		}
 		if err := yaml.Unmarshal(byteKey, &currentMap); err != nil {
 			return nil, genericError("Parsing yaml", err)
 		}
+		if isSops(currentMap) {
+			if currentMap, err = c.decryptSops(byteKey, currentMap); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return applyValuePatches(mergeValues(base, currentMap, strategy), m.ValuePatches)
+}
+
+// applyValuePatches applies the patches in order. A JSON array is an RFC 6902 patch, an object an RFC 7386 merge patch.
+func applyValuePatches(values map[string]interface{}, patches []string) (map[string]interface{}, error) {
+	if len(patches) == 0 {
+		return values, nil
+	}
+	doc, err := json.Marshal(values)
+	if err != nil {
+		return nil, withReason(InvalidValues, genericError("Patching values", err))
+	}
+	for i, p := range patches {
+		p = strings.TrimSpace(p)
+		if strings.HasPrefix(p, "[") {
+			var patch jsonpatch.Patch
+			if patch, err = jsonpatch.DecodePatch([]byte(p)); err == nil {
+				doc, err = patch.Apply(doc)
+			}
+		} else {
+			doc, err = jsonpatch.MergePatch(doc, []byte(p))
+		}
+		if err != nil {
+			return nil, withReason(InvalidValues, genericError(fmt.Sprintf("Applying ValuePatches[%d]", i), err))
+		}
+	}
+	// Numbers are kept as written, so integers like account IDs aren't turned into floats.
+	out := map[string]interface{}{}
+	d := json.NewDecoder(bytes.NewReader(doc))
+	d.UseNumber()
+	if err := d.Decode(&out); err != nil {
+		return nil, withReason(InvalidValues, genericError("Patching values", err))
+	}
+	return out, nil
+}
+
+// decodeGzipB64 decodes a base64 encoded gzip blob.
+func decodeGzipB64(data string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64: %w", err)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("invalid gzip: %w", err)
+	}
+	defer r.Close()
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gzip: %w", err)
+	}
+	return out, nil
+}
+
+// builtinValueRegex matches the template variables resolved in Values.
+var builtinValueRegex = regexp.MustCompile(`{{\s*(AccountId|Region|ClusterName)\s*}}`)
+
+// builtinValues looks up the template variables from the session and model. Region is the cluster's, and ClusterName
+// is only set for models with a ClusterID.
+func (c *Clients) builtinValues(m *Model) (map[string]string, error) {
+	account, err := getAccountID(c.AWSClients.STSClient(nil, nil))
+	if err != nil {
+		return nil, err
+	}
+	region := clusterRegion(m)
+	if region == nil {
+		region = c.AWSClients.Session(nil, nil).Config.Region
+	}
+	vars := map[string]string{
+		"AccountId": aws.StringValue(account),
+		"Region":    aws.StringValue(region),
+	}
+	if m.ClusterID != nil {
+		vars["ClusterName"] = *m.ClusterID
+	}
+	return vars, nil
+}
+
+// strictRepository reports whether remote charts must name their Repository instead of defaulting to stable.
+func strictRepository() bool {
+	strict, _ := strconv.ParseBool(os.Getenv(StrictRepositoryEnvVar))
+	return strict
+}
+
+// localChart reports whether the chart is a file:// URL or an absolute path present on the local filesystem.
+func localChart(u *url.URL) bool {
+	switch strings.ToLower(u.Scheme) {
+	case "file":
+		return true
+	case "":
+		if !filepath.IsAbs(u.Path) {
+			return false
+		}
+		_, err := os.Stat(u.Path)
+		return err == nil
 	}
-	return mergeMaps(base, currentMap), nil
+	return false
 }
 
 // getChartDetails parse chart
 func getChartDetails(m *Model) (*Chart, error) {
-	cd := &Chart{}
+	cd := &Chart{ChartSha256: m.ChartSha256}
 	// Parse chart
-	switch m.Chart {
-	case nil:
-		return nil, errors.New("chart is required")
+	switch {
+	case m.ChartFromConfigMap != nil:
+		// Embedded in the cluster, so there's no repository or URL to resolve.
+		cd.ChartType = aws.String("ConfigMap")
+		cd.ChartConfigMap = m.ChartFromConfigMap
+		cd.Chart = m.ChartFromConfigMap.Key
+		cd.ChartName = m.ChartFromConfigMap.Name
+		if names := regexp.MustCompile(`[A-Za-z]+`).FindAllString(aws.StringValue(m.ChartFromConfigMap.Key), 1); len(names) > 0 {
+			cd.ChartName = aws.String(names[0])
+		}
+		cd.ChartVersion = m.Version
+		return cd, nil
+	case m.Chart == nil:
+		return nil, withReason(ChartNotFound, errors.New("chart is required"))
 	default:
 		// Check if chart is remote url
 		u, err := url.Parse(*m.Chart)
@@ -170,9 +394,18 @@ func getChartDetails(m *Model) (*Chart, error) {
 			return nil, genericError("Process chart", err)
 		}
 		switch {
+		case localChart(u):
+			// Bundled with the function or mounted, so it's loaded in place.
+			cd.ChartType = aws.String("Local")
+			cd.Chart = aws.String(u.Path)
+			cd.ChartPath = aws.String(u.Path)
+			names := regexp.MustCompile(`[A-Za-z]+`).FindAllString(filepath.Base(u.Path), 1)
+			if len(names) == 0 {
+				return nil, fmt.Errorf("cannot derive chart name from %s", u.Path)
+			}
+			cd.ChartName = aws.String(names[0])
 		case u.Host != "":
 			cd.ChartType = aws.String("Local")
-			cd.Chart = aws.String(chartLocalPath)
 			cd.ChartPath = m.Chart
 			var chart string
 			sa := strings.Split(u.Path, "/")
@@ -182,6 +415,7 @@ func getChartDetails(m *Model) (*Chart, error) {
 			default:
 				chart = strings.TrimLeft(u.RequestURI(), "/")
 			}
+			cd.Chart = aws.String(chart)
 			re := regexp.MustCompile(`[A-Za-z]+`)
 			cd.ChartName = aws.String(re.FindAllString(chart, 1)[0])
 		default:
@@ -204,6 +438,9 @@ func getChartDetails(m *Model) (*Chart, error) {
 	}
 	switch m.Repository {
 	case nil:
+		if aws.StringValue(cd.ChartType) == "Remote" && strictRepository() {
+			return nil, withReason(ChartNotFound, fmt.Errorf("Repository is required for bare chart name %s", *m.Chart))
+		}
 		cd.ChartRepoURL = aws.String(stableRepoURL)
 	default:
 		cd.ChartRepoURL = m.Repository
@@ -211,11 +448,13 @@ func getChartDetails(m *Model) (*Chart, error) {
 	return cd, nil
 }
 
-func getReleaseName(name *string, chartname *string) *string {
+// getReleaseName returns the name or one derived from the chart, stack ID and logical resource ID, so retries reuse it
+// and stacks created from the same template don't share a release.
+func getReleaseName(name *string, chartname *string, stackID string, logicalID string) *string {
 	switch name {
 	case nil:
 		if chartname != nil {
-			return aws.String(*chartname + "-" + fmt.Sprint(time.Now().Unix()))
+			return aws.String(*chartname + "-" + (*getHash(stackID + "/" + logicalID))[:8])
 		}
 		return nil
 	default:
@@ -223,6 +462,17 @@ func getReleaseName(name *string, chartname *string) *string {
 	}
 }
 
+// validateReleaseName checks the name against helm's release name rules.
+func validateReleaseName(name string) error {
+	if len(name) > releaseNameMaxLen {
+		return withReason(InvalidRequest, fmt.Errorf("release name %q is invalid: must be no more than %d characters", name, releaseNameMaxLen))
+	}
+	if !releaseNameRegex.MatchString(name) {
+		return withReason(InvalidRequest, fmt.Errorf("release name %q is invalid: must consist of lower case alphanumeric characters, '-' or '.', and must start and end with an alphanumeric character", name))
+	}
+	return nil
+}
+
 func getReleaseNameContext(context map[string]interface{}) *string {
 	if context == nil {
 		return nil
@@ -258,7 +508,11 @@ func AWSError(err error) error {
 		if origErr := awsErr.OrigErr(); origErr != nil {
 			// operate on original error.
 		}
-		return fmt.Errorf("AWS Error: %s - %s %v", awsErr.Code(), awsErr.Message(), awsErr.OrigErr())
+		flat := fmt.Errorf("AWS Error: %s - %s %v", awsErr.Code(), awsErr.Message(), awsErr.OrigErr())
+		if reason, ok := awsErrorReasons[awsErr.Code()]; ok {
+			return withReason(reason, flat)
+		}
+		return flat
 	}
 	return fmt.Errorf(err.Error())
 }
@@ -266,22 +520,132 @@ func AWSError(err error) error {
 //genericError takes  error, log it and return new err.
 func genericError(source string, err error) error {
 	log.Printf("Error: At %s - %s \n", source, err)
-	return fmt.Errorf("Error: At %s - %s ", source, err)
+	return fmt.Errorf("Error: At %s - %w ", source, err)
+}
+
+// applyError lists each resource failure behind a helm install or upgrade error, keeping the original in the chain.
+type applyError struct {
+	err      error
+	failures []string
+}
+
+func (e *applyError) Error() string {
+	return fmt.Sprintf("%s; %d resources failed: %s", e.err, len(e.failures), strings.Join(e.failures, "; "))
+}
+
+func (e *applyError) Unwrap() error {
+	return e.err
+}
+
+// describeApplyError enumerates the per-resource failures in an error from the kube client, when there's more than one.
+func describeApplyError(err error) error {
+	var failures []string
+	var agg utilerrors.Aggregate
+	root := err
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		root = e
+		if a, ok := e.(utilerrors.Aggregate); ok {
+			agg = a
+			break
+		}
+	}
+	switch {
+	case agg != nil:
+		for _, e := range agg.Errors() {
+			failures = append(failures, resourceFailure(e))
+		}
+	default:
+		// The kube client joins update failures into one message.
+		failures = strings.Split(root.Error(), " && ")
+	}
+	if len(failures) < 2 {
+		return err
+	}
+	return &applyError{err: err, failures: failures}
+}
+
+// resourceFailure describes an apply failure as kind/name: reason when the API server returned the details.
+func resourceFailure(err error) string {
+	var status kerrors.APIStatus
+	if errors.As(err, &status) {
+		s := status.Status()
+		if s.Details != nil && s.Details.Name != "" {
+			return fmt.Sprintf("%s/%s: %s: %s", s.Details.Kind, s.Details.Name, s.Reason, s.Message)
+		}
+	}
+	return err.Error()
+}
+
+// releaseNameRegex matches a valid release name, a RFC 1123 DNS subdomain as enforced by helm.
+var releaseNameRegex = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+
+// releaseNotFoundRegex matches helm's wording for a missing release, including errors relayed as text by the VPC connector.
+var releaseNotFoundRegex = regexp.MustCompile(`(?i)release:? not found|release not loaded|has no deployed releases`)
+
+// isReleaseNotFound checks whether the error reports a missing release.
+func isReleaseNotFound(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, driver.ErrReleaseNotFound) {
+		return true
+	}
+	var c *connectorError
+	if errors.As(err, &c) && c.reason == ReleaseNotFound {
+		return true
+	}
+	return releaseNotFoundRegex.MatchString(err.Error())
+}
+
+// releaseDeletedRegex matches helm's error on uninstalling a release already uninstalled with its history kept.
+var releaseDeletedRegex = regexp.MustCompile(`the release named .* is already deleted`)
+
+func isReleaseDeleted(err error) bool {
+	return err != nil && releaseDeletedRegex.MatchString(err.Error())
 }
 
 // Merge values maps
 func mergeMaps(a, b map[string]interface{}) map[string]interface{} {
+	return deepMerge(a, b, false)
+}
+
+// mergeValues merges b over a with the given strategy, defaulting to a deep merge.
+func mergeValues(a, b map[string]interface{}, strategy string) map[string]interface{} {
+	switch strategy {
+	case mergeReplace:
+		out := make(map[string]interface{}, len(a))
+		for k, v := range a {
+			out[k] = v
+		}
+		for k, v := range b {
+			out[k] = v
+		}
+		return out
+	case mergeAppendLists:
+		return deepMerge(a, b, true)
+	default:
+		return deepMerge(a, b, false)
+	}
+}
+
+// deepMerge merges maps recursively, slices are concatenated when appendLists is set and replaced otherwise.
+// A null in b is kept over a, so helm deletes the key, chart defaults included, as it does for `--set key=null`.
+func deepMerge(a, b map[string]interface{}, appendLists bool) map[string]interface{} {
 	out := make(map[string]interface{}, len(a))
 	for k, v := range a {
 		out[k] = v
 	}
 	for k, v := range b {
-		if v, ok := v.(map[string]interface{}); ok {
-			if bv, ok := out[k]; ok {
-				if bv, ok := bv.(map[string]interface{}); ok {
-					out[k] = mergeMaps(bv, v)
-					continue
-				}
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if bv, ok := out[k].(map[string]interface{}); ok {
+				out[k] = deepMerge(bv, v, appendLists)
+				continue
+			}
+		case []interface{}:
+			if bv, ok := out[k].([]interface{}); ok && appendLists {
+				out[k] = append(append([]interface{}{}, bv...), v...)
+				continue
 			}
 		}
 		out[k] = v
@@ -292,16 +656,19 @@ func mergeMaps(a, b map[string]interface{}) map[string]interface{} {
 // downloadHTTP downloads the file to specified path
 func downloadHTTP(url string, filepath string) error {
 	log.Printf("Getting file from URL...")
-	// Get the data
+	// Get the data, redirects are followed by the client. A redirect it can't follow, e.g. without a Location, is
+	// returned as the response.
 	resp, err := http.Get(url)
 	if err != nil {
-		return genericError("Downloading file", err)
-	}
-	if resp.StatusCode != 200 {
-		return genericError("Downloading file", fmt.Errorf("got response %v", resp.StatusCode))
+		return withReason(ChartNotFound, genericError("Downloading file", err))
 	}
-
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// Report where the redirects ended, without the query, a signed URL's query is a credential.
+		final := *resp.Request.URL
+		final.RawQuery = ""
+		return withReason(ChartNotFound, genericError("Downloading file", fmt.Errorf("got response %v from %s", resp.StatusCode, final.String())))
+	}
 
 	// Create the file
 	out, err := os.Create(filepath)
@@ -319,18 +686,31 @@ func downloadHTTP(url string, filepath string) error {
 	return nil
 }
 
+// clusterRegion returns the region of the cluster from the model or its ID, nil meaning the session's region.
+func clusterRegion(m *Model) *string {
+	if m.ClusterRegion != nil {
+		return m.ClusterRegion
+	}
+	if m.ID != nil {
+		if data, err := DecodeID(m.ID); err == nil && data.Region != nil {
+			return data.Region
+		}
+	}
+	return nil
+}
+
 //generateID is to generate physical id for CFN
-func generateID(m *Model, name string, region string, namespace string) (*string, error) {
+func generateID(m *Model, name string, region string, namespace string, vpcDetected bool) (*string, error) {
 	i := &ID{}
 	switch {
 	case m.ClusterID != nil && m.KubeConfig != nil:
-		return nil, fmt.Errorf("both ClusterID or KubeConfig can not be specified")
+		return nil, withReason(InvalidRequest, errors.New("both ClusterID or KubeConfig can not be specified"))
 	case m.ClusterID != nil:
 		i.ClusterID = m.ClusterID
 	case m.KubeConfig != nil:
 		i.KubeConfig = m.KubeConfig
 	default:
-		return nil, fmt.Errorf("either ClusterID or KubeConfig must be specified")
+		return nil, withReason(InvalidRequest, errors.New("either ClusterID or KubeConfig must be specified"))
 	}
 	if name == "" || namespace == "" || region == "" {
 		return nil, fmt.Errorf("incorrect values for variable name, namespace, region")
@@ -338,9 +718,12 @@ func generateID(m *Model, name string, region string, namespace string) (*string
 	i.Name = aws.String(name)
 	i.Namespace = aws.String(namespace)
 	i.Region = aws.String(region)
+	i.StorageNamespace = m.StorageNamespace
 	if !IsZero(m.VPCConfiguration) {
 		i.VPCConfiguration = m.VPCConfiguration
 	}
+	i.VPCResolved = true
+	i.VPCDetected = vpcDetected
 	out, err := json.Marshal(i)
 	if err != nil {
 		return nil, genericError("Json Marshal", err)
@@ -363,6 +746,90 @@ func DecodeID(id *string) (*ID, error) {
 	return i, nil
 }
 
+// tempFile creates an empty, uniquely named file in the temp dir so concurrent invocations in a warm
+// container don't share a path.
+func tempFile(pattern string) (string, error) {
+	f, err := ioutil.TempFile("", pattern)
+	if err != nil {
+		return "", genericError("Creating temp file", err)
+	}
+	defer f.Close()
+	return f.Name(), nil
+}
+
+// fetchChart returns the path to load a Local chart from, downloading it to a temp file unless it's already
+// on the filesystem. The download is wiped by the returned cleanup.
+func (c *Clients) fetchChart(chart *Chart) (string, func(), error) {
+	// Charts already on the local filesystem are loaded from ChartPath without a download.
+	if aws.StringValue(chart.ChartPath) == aws.StringValue(chart.Chart) {
+		return *chart.Chart, func() {}, nil
+	}
+	path, err := tempFile("chart-*.tgz")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { wipeFile(path) }
+	if err := c.downloadChart(*chart.ChartPath, path); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	if err := checkChartArchive(path); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return path, cleanup, nil
+}
+
+// verifyChartDigest checks the chart archive at path against the pinned SHA-256 digest, if any.
+func verifyChartDigest(path string, digest *string) error {
+	if digest == nil {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return withReason(InvalidChart, genericError("Verifying chart digest", err))
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err == nil && fi.IsDir() {
+		return withReason(InvalidChart, genericError("Verifying chart digest", fmt.Errorf("%s is a directory, ChartSha256 needs a chart archive", path)))
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return withReason(InvalidChart, genericError("Verifying chart digest", err))
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(sum, *digest) {
+		return withReason(InvalidChart, genericError("Verifying chart digest", fmt.Errorf("chart archive has SHA-256 %s, expected %s", sum, *digest)))
+	}
+	return nil
+}
+
+// gzipMagic starts every chart archive.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// checkChartArchive fails a download that isn't a gzip archive, such as an HTML error page served with a 200,
+// which loader.Load would only report as a gzip error.
+func checkChartArchive(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return withReason(InvalidChart, genericError("Reading chart", err))
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return withReason(InvalidChart, genericError("Reading chart", err))
+	}
+	head = head[:n]
+	if bytes.HasPrefix(head, gzipMagic) {
+		return nil
+	}
+	preview := head
+	if len(preview) > 32 {
+		preview = preview[:32]
+	}
+	return withReason(InvalidChart, genericError("Reading chart", fmt.Errorf("downloaded file is not a valid chart archive (got %s?), starts with %q", http.DetectContentType(head), preview)))
+}
+
 // downloadChart downloads the chart
 func (c *Clients) downloadChart(ur string, f string) error {
 	u, err := url.Parse(ur)
@@ -408,18 +875,142 @@ func checkTimeOut(startTime string, timeOut *int) bool {
 	return false
 }
 
+// operationBudget checks there's at least minOperationBudget left to run an install or upgrade, as one cut off
+// part way leaves a pending release. It fails once the resource's TimeOut leaves too little, and reports retry when
+// only this invocation is short, so the operation starts in a fresh one.
+func operationBudget(ctx context.Context, startTime string, timeOut *int) (retry bool, err error) {
+	if start, err := time.Parse(time.RFC3339, startTime); err == nil {
+		t := defaultTimeOut
+		if timeOut != nil {
+			t = *timeOut
+		}
+		if left := time.Until(start.Add(time.Duration(t) * time.Minute)); left < minOperationBudget {
+			return false, withReason(TimedOut, fmt.Errorf("insufficient time budget remaining: %v left of the %d minute TimeOut, an install or upgrade needs at least %v", left.Round(time.Second), t, minOperationBudget))
+		}
+	}
+	return invocationShort(ctx), nil
+}
+
+// invocationShort reports whether ctx leaves less than minOperationBudget, so an operation is started in a fresh
+// invocation instead.
+func invocationShort(ctx context.Context) bool {
+	deadline, ok := ctx.Deadline()
+	return ok && time.Until(deadline) < minOperationBudget
+}
+
+// withDeadline bounds ctx by the stack operation timeout and the time left in this invocation, less a margin to report the cancellation.
+func withDeadline(ctx context.Context, timeOut *int) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(handlerTimeout)
+	}
+	if start, err := time.Parse(time.RFC3339, os.Getenv("StartTime")); err == nil {
+		t := defaultTimeOut
+		if timeOut != nil {
+			t = *timeOut
+		}
+		if d := start.Add(time.Duration(t) * time.Minute); d.Before(deadline) {
+			deadline = d
+		}
+	}
+	return context.WithDeadline(ctx, deadline.Add(-deadlineMargin))
+}
+
+// WithInvocationDeadline bounds ctx by the invocation's deadline less a margin to report the cancellation, for the VPC
+// connector, which has no stack operation timeout to honour.
+func WithInvocationDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, deadline.Add(-deadlineMargin))
+}
+
+// inFlightGrace is how long runWithContext still waits for fn once ctx is done, out of the margin left to report.
+var inFlightGrace = deadlineMargin / 2
+
+// InFlightOperation names an operation left running when the invocation returned. It's recorded in the callback
+// context, as the next invocation may find the release still changing.
+var InFlightOperation string
+
+// inFlightError reports an operation still running when its context was done.
+type inFlightError struct {
+	op  string
+	err error
+}
+
+func (e *inFlightError) Error() string {
+	return fmt.Sprintf("operation cancelled near deadline during %s, it may still be in flight: %v", e.op, e.err)
+}
+
+func (e *inFlightError) Unwrap() error {
+	return e.err
+}
+
+// isInFlight reports whether err is from an operation left running by runWithContext.
+func isInFlight(err error) bool {
+	var e *inFlightError
+	return errors.As(err, &e)
+}
+
+// runWithContext runs fn until ctx is done. Helm actions and the resource builder take no context, and their own
+// timeouts are bounded by hookTimeout, so fn is then given inFlightGrace to finish rather than being abandoned at
+// once. If it's still running it's recorded in InFlightOperation.
+func runWithContext(ctx context.Context, op string, fn func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(inFlightGrace):
+		log.Printf("Warning: %s still running at the deadline", op)
+		InFlightOperation = op
+		return &inFlightError{op: op, err: ctx.Err()}
+	}
+}
+
+// opContext returns the context bounding the client's operations.
+func (c *Clients) opContext() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// WithContext sets the context bounding the client's operations.
+func (c *Clients) WithContext(ctx context.Context) *Clients {
+	c.ctx = ctx
+	return c
+}
+
+// getStage returns the stage to run and restores StartTime from the callback context.
+// Only the Init stage starts the clock, so a cold start mid-reconcile can't reset the timeout.
 func getStage(context map[string]interface{}) Stage {
-	if context == nil {
-		os.Setenv("StartTime", time.Now().Format(time.RFC3339))
-		return InitStage
+	stage := InitStage
+	if context["Stage"] != nil {
+		stage = Stage(fmt.Sprint(context["Stage"]))
 	}
-	if context["Stage"] == nil {
-		return InitStage
+	InFlightOperation = ""
+	if op, _ := context["InFlight"].(string); op != "" {
+		log.Printf("Warning: %s may still be in flight from the previous invocation", op)
 	}
-	if context["StartTime"] != nil {
-		os.Setenv("StartTime", context["StartTime"].(string))
+	start, _ := context["StartTime"].(string)
+	switch {
+	case start != "":
+		os.Setenv("StartTime", start)
+	case stage == InitStage:
+		os.Setenv("StartTime", time.Now().Format(time.RFC3339))
+	default:
+		log.Printf("Warning: no StartTime in callback context for %s, keeping %s", stage, os.Getenv("StartTime"))
 	}
-	return Stage(fmt.Sprint(context["Stage"]))
+	return stage
 }
 
 func getHash(data string) *string {
@@ -436,13 +1027,46 @@ func LogPanic() {
 }
 
 func getLocalKubeConfig() ([]byte, error) {
-	data, err := ioutil.ReadFile(KubeConfigLocalPath)
+	data, err := ioutil.ReadFile(os.Getenv("KUBECONFIG"))
 	if err != nil {
 		return nil, err
 	}
 	return data, nil
 }
 
+// wipeFile overwrites a file with zeros before removing it, so its contents don't outlive the invocation.
+func wipeFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(make([]byte, info.Size())); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// CleanupTempFiles wipes the kubeconfig written to /tmp during an invocation. Manifests, values and charts
+// go to per-invocation temp files wiped by their users.
+func CleanupTempFiles() {
+	for _, f := range []string{os.Getenv("KUBECONFIG")} {
+		if err := wipeFile(f); err != nil {
+			log.Printf("Warning: Got error cleaning up %s: %s", f, err.Error())
+		}
+	}
+}
+
 func isZero(v reflect.Value) bool {
 	if !v.IsValid() {
 		return true
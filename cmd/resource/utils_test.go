@@ -2,16 +2,32 @@ package resource
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/aws-cloudformation/cloudformation-cli-go-plugin/cfn/handler"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/stretchr/testify/assert"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/storage/driver"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 )
 
 type TestDetailParam struct {
@@ -51,6 +67,110 @@ func TestMergeMaps(t *testing.T) {
 	assert.EqualValues(t, expectedMap, result)
 }
 
+// TestMergeMapsNull is to test a null is kept over the base, for helm to delete the key
+func TestMergeMapsNull(t *testing.T) {
+	base := map[string]interface{}{
+		"a": map[string]interface{}{
+			"b": "a",
+			"c": map[string]interface{}{"d": "a"},
+		},
+		"e": map[string]interface{}{"f": "a"},
+	}
+	tests := map[string]struct {
+		override map[string]interface{}
+		eRes     map[string]interface{}
+	}{
+		"NestedKey": {
+			override: map[string]interface{}{"a": map[string]interface{}{"b": nil}},
+			eRes: map[string]interface{}{
+				"a": map[string]interface{}{"b": nil, "c": map[string]interface{}{"d": "a"}},
+				"e": map[string]interface{}{"f": "a"},
+			},
+		},
+		"Subtree": {
+			override: map[string]interface{}{"a": nil},
+			eRes: map[string]interface{}{
+				"a": nil,
+				"e": map[string]interface{}{"f": "a"},
+			},
+		},
+		"MissingKey": {
+			override: map[string]interface{}{"g": nil},
+			eRes: map[string]interface{}{
+				"a": base["a"],
+				"e": base["e"],
+				"g": nil,
+			},
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.EqualValues(t, d.eRes, mergeMaps(base, d.override))
+		})
+	}
+}
+
+// TestProcessValuesNullDefaults is to test a null in the values deletes the chart's default
+func TestProcessValuesNullDefaults(t *testing.T) {
+	ch := &chart.Chart{
+		Metadata: &chart.Metadata{Name: "test", Version: "0.1.0"},
+		Values: map[string]interface{}{
+			"resources": map[string]interface{}{"limits": map[string]interface{}{"cpu": "100m"}},
+			"image":     map[string]interface{}{"tag": "1.0", "pullPolicy": "Always"},
+		},
+	}
+	c := NewMockClient(t, nil)
+	values, err := c.processValues(&Model{ValueYaml: aws.String("resources: ~\nimage:\n  pullPolicy: ~\n")})
+	assert.Nil(t, err)
+	coalesced, err := chartutil.CoalesceValues(ch, values)
+	assert.Nil(t, err)
+	assert.NotContains(t, coalesced, "resources")
+	assert.EqualValues(t, map[string]interface{}{"tag": "1.0"}, coalesced["image"])
+}
+
+// TestMergeValues is to test mergeValues
+func TestMergeValues(t *testing.T) {
+	m1 := map[string]interface{}{
+		"a": map[string]interface{}{"b": "a", "c": "a"},
+		"l": []interface{}{"a"},
+	}
+	m2 := map[string]interface{}{
+		"a": map[string]interface{}{"b": "b"},
+		"l": []interface{}{"b"},
+	}
+	tests := map[string]struct {
+		strategy string
+		eRes     map[string]interface{}
+	}{
+		"Deep": {
+			strategy: mergeDeep,
+			eRes: map[string]interface{}{
+				"a": map[string]interface{}{"b": "b", "c": "a"},
+				"l": []interface{}{"b"},
+			},
+		},
+		"Replace": {
+			strategy: mergeReplace,
+			eRes: map[string]interface{}{
+				"a": map[string]interface{}{"b": "b"},
+				"l": []interface{}{"b"},
+			},
+		},
+		"AppendLists": {
+			strategy: mergeAppendLists,
+			eRes: map[string]interface{}{
+				"a": map[string]interface{}{"b": "b", "c": "a"},
+				"l": []interface{}{"a", "b"},
+			},
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.EqualValues(t, d.eRes, mergeValues(m1, m2, d.strategy))
+		})
+	}
+}
+
 func TestProcessValues(t *testing.T) {
 	stringYaml := `root:
   firstlevel: value
@@ -58,6 +178,11 @@ func TestProcessValues(t *testing.T) {
     - a1
     - a2
   string: true`
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte(stringYaml))
+	w.Close()
+	gzipYaml := base64.StdEncoding.EncodeToString(gz.Bytes())
 	tests := map[string]struct {
 		m    *Model
 		eRes map[string]interface{}
@@ -71,18 +196,80 @@ func TestProcessValues(t *testing.T) {
 			},
 			eRes: map[string]interface{}{"root": map[string]interface{}{"file": true, "firstlevel": "value", "secondlevel": []interface{}{"a1", "a2"}, "string": true}, "stack": map[string]interface{}{"nested": true}},
 		},
+		"BuiltinValues": {
+			m: &Model{
+				ClusterID: aws.String("eks"),
+				Values:    map[string]string{"account": "{{ AccountId }}", "image": "{{AccountId}}.dkr.ecr.{{ Region }}.amazonaws.com/app", "cluster": "{{ ClusterName }}", "other": "{{ Other }}"},
+			},
+			eRes: map[string]interface{}{"account": int64(1234567890), "image": "1234567890.dkr.ecr.us-east-1.amazonaws.com/app", "cluster": "eks", "other": "{{ Other }}"},
+		},
+		"BuiltinValuesClusterRegion": {
+			m: &Model{
+				ClusterID:     aws.String("eks"),
+				ClusterRegion: aws.String("eu-west-1"),
+				Values:        map[string]string{"image": "{{AccountId}}.dkr.ecr.{{ Region }}.amazonaws.com/app"},
+			},
+			eRes: map[string]interface{}{"image": "1234567890.dkr.ecr.eu-west-1.amazonaws.com/app"},
+		},
+		"BuiltinValuesNoCluster": {
+			m: &Model{
+				KubeConfig: aws.String("arn"),
+				Values:     map[string]string{"cluster": "{{ ClusterName }}"},
+			},
+			eErr: "{{ ClusterName }} in Values cluster requires ClusterID",
+		},
 		"WrongYaml": {
 			m: &Model{
 				ValueYaml: aws.String("stringYaml"),
 			},
 			eErr: "error unmarshaling JSON",
 		},
+		"GzipValues": {
+			m: &Model{
+				ValueYamlGzipB64: aws.String(gzipYaml),
+				ValueYaml:        aws.String("root:\n  firstlevel: override"),
+			},
+			eRes: map[string]interface{}{"root": map[string]interface{}{"firstlevel": "override", "secondlevel": []interface{}{"a1", "a2"}, "string": true}},
+		},
+		"WrongBase64": {
+			m: &Model{
+				ValueYamlGzipB64: aws.String("not base64!"),
+			},
+			eErr: "invalid base64",
+		},
+		"WrongGzip": {
+			m: &Model{
+				ValueYamlGzipB64: aws.String(base64.StdEncoding.EncodeToString([]byte(stringYaml))),
+			},
+			eErr: "invalid gzip",
+		},
 		"WrongPath": {
 			m: &Model{
 				ValueOverrideURL: aws.String("../test"),
 			},
 			eErr: "InvalidParameter",
 		},
+		"AppendLists": {
+			m: &Model{
+				Values:        map[string]string{"root.secondlevel[0]": "a3"},
+				ValueYaml:     aws.String(stringYaml),
+				MergeStrategy: aws.String("append-lists"),
+			},
+			eRes: map[string]interface{}{"root": map[string]interface{}{"firstlevel": "value", "secondlevel": []interface{}{"a1", "a2", "a3"}, "string": true}},
+		},
+		"ValuePatches": {
+			m: &Model{
+				ValueYaml:    aws.String(stringYaml),
+				ValuePatches: []string{`[{"op": "add", "path": "/root/secondlevel/1", "value": "a3"}]`, `{"root": {"string": null}}`},
+			},
+			eRes: map[string]interface{}{"root": map[string]interface{}{"firstlevel": "value", "secondlevel": []interface{}{"a1", "a3", "a2"}}},
+		},
+		"WrongMergeStrategy": {
+			m: &Model{
+				MergeStrategy: aws.String("shallow"),
+			},
+			eErr: "unsupported merge strategy shallow",
+		},
 	}
 	data, _ := ioutil.ReadFile(TestFolder + "/test.yaml")
 	_, _ = dlLoggingSvcNoChunk(data)
@@ -99,8 +286,54 @@ func TestProcessValues(t *testing.T) {
 	}
 }
 
+// TestApplyValuePatches to test applyValuePatches
+func TestApplyValuePatches(t *testing.T) {
+	values := map[string]interface{}{"image": map[string]interface{}{"tag": "1.0"}, "account": int64(1234567890), "sidecars": []interface{}{}}
+	tests := map[string]struct {
+		patches []string
+		eRes    map[string]interface{}
+		eErr    string
+	}{
+		"None": {
+			eRes: values,
+		},
+		"InOrder": {
+			patches: []string{
+				`[{"op": "add", "path": "/sidecars/-", "value": {"name": "proxy"}}]`,
+				`{"image": {"tag": "2.0"}}`,
+				`[{"op": "replace", "path": "/image/tag", "value": "3.0"}]`,
+			},
+			eRes: map[string]interface{}{"image": map[string]interface{}{"tag": "3.0"}, "account": json.Number("1234567890"), "sidecars": []interface{}{map[string]interface{}{"name": "proxy"}}},
+		},
+		"FailedTest": {
+			patches: []string{`[{"op": "test", "path": "/image/tag", "value": "2.0"}]`},
+			eErr:    "Applying ValuePatches[0]",
+		},
+		"MissingPath": {
+			patches: []string{`{"image": {"tag": "2.0"}}`, `[{"op": "remove", "path": "/missing"}]`},
+			eErr:    "Applying ValuePatches[1]",
+		},
+		"Invalid": {
+			patches: []string{`{"image": `},
+			eErr:    "Applying ValuePatches[0]",
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			result, err := applyValuePatches(values, d.patches)
+			if d.eErr != "" {
+				assert.Contains(t, err.Error(), d.eErr)
+				return
+			}
+			assert.Nil(t, err)
+			assert.EqualValues(t, d.eRes, result)
+		})
+	}
+}
+
 // TestGetChartDetails is to test getChartDetails
 func TestGetChartDetails(t *testing.T) {
+	bundled, _ := filepath.Abs("testdata/test.tgz")
 	tests := map[string]struct {
 		m             *Model
 		expectedChart *Chart
@@ -147,18 +380,67 @@ func TestGetChartDetails(t *testing.T) {
 				Chart: aws.String("s3://test/chart-1.0.1.tgz"),
 			},
 			expectedChart: &Chart{
-				Chart:        aws.String("/tmp/chart.tgz"),
+				Chart:        aws.String("chart-1.0.1.tgz"),
 				ChartName:    aws.String("chart"),
 				ChartType:    aws.String("Local"),
 				ChartPath:    aws.String("s3://test/chart-1.0.1.tgz"),
 				ChartRepoURL: aws.String("https://kubernetes-charts.storage.googleapis.com"),
 			},
 		},
+		"FileScheme": {
+			m: &Model{
+				Chart: aws.String("file:///opt/charts/mychart"),
+			},
+			expectedChart: &Chart{
+				Chart:        aws.String("/opt/charts/mychart"),
+				ChartName:    aws.String("mychart"),
+				ChartType:    aws.String("Local"),
+				ChartPath:    aws.String("/opt/charts/mychart"),
+				ChartRepoURL: aws.String("https://kubernetes-charts.storage.googleapis.com"),
+			},
+		},
+		"BundledPath": {
+			m: &Model{
+				Chart: aws.String(bundled),
+			},
+			expectedChart: &Chart{
+				Chart:        aws.String(bundled),
+				ChartName:    aws.String("test"),
+				ChartType:    aws.String("Local"),
+				ChartPath:    aws.String(bundled),
+				ChartRepoURL: aws.String("https://kubernetes-charts.storage.googleapis.com"),
+			},
+		},
+		"ConfigMap": {
+			m: &Model{
+				ChartFromConfigMap: &ValueFrom{Name: aws.String("charts"), Key: aws.String("nginx-1.0.0.tgz")},
+				Version:            aws.String("1.0.0"),
+			},
+			expectedChart: &Chart{
+				Chart:          aws.String("nginx-1.0.0.tgz"),
+				ChartName:      aws.String("nginx"),
+				ChartType:      aws.String("ConfigMap"),
+				ChartVersion:   aws.String("1.0.0"),
+				ChartConfigMap: &ValueFrom{Name: aws.String("charts"), Key: aws.String("nginx-1.0.0.tgz")},
+			},
+		},
+		"NoChartName": {
+			m: &Model{
+				Chart: aws.String("file:///mnt/charts/1.0.0"),
+			},
+			expectedError: aws.String("cannot derive chart name from /mnt/charts/1.0.0"),
+		},
+		"RootPath": {
+			m: &Model{
+				Chart: aws.String("file:///"),
+			},
+			expectedError: aws.String("cannot derive chart name from /"),
+		},
 	}
 	for name, d := range tests {
 		t.Run(name, func(t *testing.T) {
 			result, err := getChartDetails(d.m)
-			if err != nil {
+			if d.expectedError != nil || err != nil {
 				assert.EqualError(t, err, aws.StringValue(d.expectedError))
 			} else {
 				assert.EqualValues(t, d.expectedChart, result)
@@ -167,6 +449,74 @@ func TestGetChartDetails(t *testing.T) {
 	}
 }
 
+// TestGetChartDetailsStrict is to test getChartDetails with StrictRepositoryEnvVar set
+func TestGetChartDetailsStrict(t *testing.T) {
+	defer os.Unsetenv(StrictRepositoryEnvVar)
+	os.Setenv(StrictRepositoryEnvVar, "true")
+	tests := map[string]struct {
+		m             *Model
+		expectedError *string
+	}{
+		"BareName": {
+			m:             &Model{Chart: aws.String("test")},
+			expectedError: aws.String("Repository is required for bare chart name test"),
+		},
+		"StablePrefix": {
+			m:             &Model{Chart: aws.String("stable/test")},
+			expectedError: aws.String("Repository is required for bare chart name stable/test"),
+		},
+		"ExplicitRepo": {
+			m: &Model{Chart: aws.String("test"), Repository: aws.String("test.com")},
+		},
+		"Local": {
+			m: &Model{Chart: aws.String("s3://test/chart-1.0.1.tgz")},
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := getChartDetails(d.m)
+			if d.expectedError != nil {
+				assert.EqualError(t, err, aws.StringValue(d.expectedError))
+			} else {
+				assert.Nil(t, err)
+			}
+		})
+	}
+}
+
+// TestDescribeApplyError is to test describeApplyError
+func TestDescribeApplyError(t *testing.T) {
+	single := errors.New("release test failed: timed out")
+	agg := utilerrors.NewAggregate([]error{
+		kerrors.NewAlreadyExists(schema.GroupResource{Resource: "configmaps"}, "test-cm"),
+		kerrors.NewNotFound(schema.GroupResource{Group: "apps", Resource: "deployments"}, "test-dep"),
+	})
+	tests := map[string]struct {
+		err  error
+		eMsg string
+	}{
+		"Single": {
+			err:  single,
+			eMsg: "release test failed: timed out",
+		},
+		"Aggregate": {
+			err:  fmt.Errorf("release test failed: %w", agg),
+			eMsg: "release test failed: [configmaps \"test-cm\" already exists, deployments.apps \"test-dep\" not found]; 2 resources failed: configmaps/test-cm: AlreadyExists: configmaps \"test-cm\" already exists; deployments/test-dep: NotFound: deployments.apps \"test-dep\" not found",
+		},
+		"Joined": {
+			err:  errors.New("failed to create resource: quota exceeded && failed to replace object: immutable field"),
+			eMsg: "failed to create resource: quota exceeded && failed to replace object: immutable field; 2 resources failed: failed to create resource: quota exceeded; failed to replace object: immutable field",
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := genericError("Helm install", describeApplyError(d.err))
+			assert.EqualError(t, err, "Error: At Helm install - "+d.eMsg+" ")
+			assert.True(t, errors.Is(err, d.err))
+		})
+	}
+}
+
 // TestGetReleaseName is to test getReleaseName
 func TestGetReleaseName(t *testing.T) {
 	tests := map[string]struct {
@@ -187,7 +537,7 @@ func TestGetReleaseName(t *testing.T) {
 		"OnlyChart": {
 			name:         nil,
 			chartname:    aws.String("TestChart"),
-			expectedName: aws.String("TestChart-" + fmt.Sprint(time.Now().Unix())),
+			expectedName: aws.String("TestChart-" + (*getHash("stack-one/TestHelm"))[:8]),
 		},
 		"NoValues": {
 			name:         nil,
@@ -197,10 +547,52 @@ func TestGetReleaseName(t *testing.T) {
 	}
 	for name, d := range tests {
 		t.Run(name, func(t *testing.T) {
-			result := getReleaseName(d.name, d.chartname)
+			result := getReleaseName(d.name, d.chartname, "stack-one", "TestHelm")
 			assert.EqualValues(t, aws.StringValue(d.expectedName), aws.StringValue(result))
 		})
 	}
+	one := getReleaseName(nil, aws.String("TestChart"), "stack-one", "TestHelm")
+	two := getReleaseName(nil, aws.String("TestChart"), "stack-two", "TestHelm")
+	assert.NotEqual(t, aws.StringValue(one), aws.StringValue(two))
+}
+
+// TestValidateReleaseName is to test validateReleaseName
+func TestValidateReleaseName(t *testing.T) {
+	tests := map[string]struct {
+		name        string
+		expectedErr *string
+	}{
+		"Valid": {
+			name: "my-release.v1",
+		},
+		"UpperCase": {
+			name:        "MyRelease",
+			expectedErr: aws.String("must consist of lower case alphanumeric characters"),
+		},
+		"Underscore": {
+			name:        "my_release",
+			expectedErr: aws.String("must consist of lower case alphanumeric characters"),
+		},
+		"TrailingDash": {
+			name:        "my-release-",
+			expectedErr: aws.String("must start and end with an alphanumeric character"),
+		},
+		"TooLong": {
+			name:        strings.Repeat("a", 54),
+			expectedErr: aws.String("must be no more than 53 characters"),
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := validateReleaseName(d.name)
+			if d.expectedErr == nil {
+				assert.Nil(t, err)
+				return
+			}
+			assert.Contains(t, err.Error(), *d.expectedErr)
+			assert.Contains(t, err.Error(), d.name)
+		})
+	}
 }
 
 // TestGetReleaseNameContextis to test getReleaseNameContext
@@ -269,9 +661,74 @@ func TestHTTPDownload(t *testing.T) {
 	}
 }
 
+// TestHTTPDownloadRedirect to test downloadHTTP with redirecting servers
+func TestHTTPDownloadRedirect(t *testing.T) {
+	files := http.StripPrefix("/files/", http.FileServer(http.Dir(TestFolder)))
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/found":
+			http.Redirect(w, r, "/temporary", http.StatusFound)
+		case "/temporary":
+			http.Redirect(w, r, "/files/test.tgz?X-Amz-Signature=secret", http.StatusTemporaryRedirect)
+		case "/missing":
+			http.Redirect(w, r, "/files/nonExt?X-Amz-Signature=secret", http.StatusFound)
+		case "/nolocation":
+			w.WriteHeader(http.StatusFound)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		default:
+			files.ServeHTTP(w, r)
+		}
+	}))
+	defer testServer.Close()
+	tests := map[string]struct {
+		path        string
+		expectedErr string
+	}{
+		"Redirects":  {path: "/found"},
+		"Missing":    {path: "/missing", expectedErr: "got response 404 from " + testServer.URL + "/files/nonExt"},
+		"NoLocation": {path: "/nolocation", expectedErr: "got response 302 from " + testServer.URL + "/nolocation"},
+		"Loop":       {path: "/loop", expectedErr: "stopped after 10 redirects"},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			f, err := tempFile("chart-*.tgz")
+			assert.Nil(t, err)
+			defer wipeFile(f)
+			err = downloadHTTP(testServer.URL+d.path, f)
+			if d.expectedErr != "" {
+				assert.Contains(t, err.Error(), d.expectedErr)
+				assert.NotContains(t, err.Error(), "secret")
+			} else {
+				assert.Nil(t, err)
+				assert.Nil(t, checkChartArchive(f))
+			}
+		})
+	}
+}
+
+// TestClusterRegion to test clusterRegion
+func TestClusterRegion(t *testing.T) {
+	id, _ := generateID(&Model{ClusterID: aws.String("eks")}, "test", "eu-west-1", "default", false)
+	tests := map[string]struct {
+		m       *Model
+		eRegion *string
+	}{
+		"Model":     {m: &Model{ClusterRegion: aws.String("ap-south-1"), ID: id}, eRegion: aws.String("ap-south-1")},
+		"ID":        {m: &Model{ID: id}, eRegion: aws.String("eu-west-1")},
+		"Session":   {m: &Model{}},
+		"InvalidID": {m: &Model{ID: aws.String("invalid")}},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, d.eRegion, clusterRegion(d.m))
+		})
+	}
+}
+
 // TestGenerateID is to test generateID
 func TestGenerateID(t *testing.T) {
-	eID := aws.String("eyJDbHVzdGVySUQiOiJla3MiLCJSZWdpb24iOiJldS13ZXN0LTEiLCJOYW1lIjoiVGVzdCIsIk5hbWVzcGFjZSI6ImRlZmF1bHQifQ")
+	eID := aws.String("eyJDbHVzdGVySUQiOiJla3MiLCJSZWdpb24iOiJldS13ZXN0LTEiLCJOYW1lIjoiVGVzdCIsIk5hbWVzcGFjZSI6ImRlZmF1bHQiLCJWUENSZXNvbHZlZCI6dHJ1ZX0")
 	tests := map[string]struct {
 		m                                      Model
 		name, region, namespace, expectedError string
@@ -344,13 +801,13 @@ func TestGenerateID(t *testing.T) {
 			name:          "Test",
 			region:        "eu-west-1",
 			namespace:     "default",
-			expectedID:    aws.String("eyJDbHVzdGVySUQiOiJla3MiLCJSZWdpb24iOiJldS13ZXN0LTEiLCJOYW1lIjoiVGVzdCIsIk5hbWVzcGFjZSI6ImRlZmF1bHQiLCJWUENDb25maWd1cmF0aW9uIjp7IlNlY3VyaXR5R3JvdXBJZHMiOlsic2ctMDEiXSwiU3VibmV0SWRzIjpbInN1Ym5ldC0wMSJdfX0"),
+			expectedID:    aws.String("eyJDbHVzdGVySUQiOiJla3MiLCJSZWdpb24iOiJldS13ZXN0LTEiLCJOYW1lIjoiVGVzdCIsIk5hbWVzcGFjZSI6ImRlZmF1bHQiLCJWUENDb25maWd1cmF0aW9uIjp7IlNlY3VyaXR5R3JvdXBJZHMiOlsic2ctMDEiXSwiU3VibmV0SWRzIjpbInN1Ym5ldC0wMSJdfSwiVlBDUmVzb2x2ZWQiOnRydWV9"),
 			expectedError: "",
 		},
 	}
 	for name, d := range tests {
 		t.Run(name, func(t *testing.T) {
-			result, err := generateID(&d.m, d.name, d.region, d.namespace)
+			result, err := generateID(&d.m, d.name, d.region, d.namespace, false)
 			if err != nil {
 				assert.EqualError(t, err, d.expectedError)
 			} else {
@@ -397,6 +854,31 @@ func TestDownloadChart(t *testing.T) {
 	}
 }
 
+// TestFetchChart to test fetchChart
+func TestFetchChart(t *testing.T) {
+	testServer := httptest.NewServer(http.StripPrefix("/", http.FileServer(http.Dir(TestFolder))))
+	defer func() { testServer.Close() }()
+	c := NewMockClient(t, nil)
+
+	bundled := &Chart{Chart: aws.String("/opt/charts/test"), ChartPath: aws.String("/opt/charts/test")}
+	path, cleanup, err := c.fetchChart(bundled)
+	assert.Nil(t, err)
+	assert.Equal(t, "/opt/charts/test", path)
+	cleanup()
+
+	remote := &Chart{Chart: aws.String("test.tgz"), ChartPath: aws.String(testServer.URL + "/test.tgz")}
+	first, cleanupFirst, err := c.fetchChart(remote)
+	assert.Nil(t, err)
+	second, cleanupSecond, err := c.fetchChart(remote)
+	assert.Nil(t, err)
+	assert.NotEqual(t, first, second)
+	assert.FileExists(t, first)
+	cleanupFirst()
+	cleanupSecond()
+	assert.NoFileExists(t, first)
+	assert.NoFileExists(t, second)
+}
+
 // TestCheckTimeOut to test checkTimeOut
 func TestCheckTimeOut(t *testing.T) {
 	timeOut := aws.Int(90)
@@ -421,18 +903,177 @@ func TestCheckTimeOut(t *testing.T) {
 	}
 }
 
+// TestWithDeadline is to test withDeadline
+func TestWithDeadline(t *testing.T) {
+	defer os.Unsetenv("StartTime")
+	tests := map[string]struct {
+		start     time.Duration
+		eDeadline time.Duration
+	}{
+		"Invocation": {
+			start:     -time.Minute,
+			eDeadline: handlerTimeout - deadlineMargin,
+		},
+		"TimeOut": {
+			start:     -90*time.Minute + 30*time.Second,
+			eDeadline: 30*time.Second - deadlineMargin,
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			os.Setenv("StartTime", time.Now().Add(d.start).Format(time.RFC3339))
+			ctx, cancel := withDeadline(context.Background(), aws.Int(90))
+			defer cancel()
+			deadline, ok := ctx.Deadline()
+			assert.True(t, ok)
+			assert.WithinDuration(t, time.Now().Add(d.eDeadline), deadline, 2*time.Second)
+		})
+	}
+}
+
+// TestOperationBudget is to test operationBudget
+func TestOperationBudget(t *testing.T) {
+	tests := map[string]struct {
+		start    string
+		deadline time.Duration
+		eRetry   bool
+		eErr     string
+	}{
+		"NoDeadline": {},
+		"Plenty": {
+			start:    time.Now().Add(-time.Minute).Format(time.RFC3339),
+			deadline: time.Minute,
+		},
+		"InvocationShort": {
+			start:    time.Now().Add(-time.Minute).Format(time.RFC3339),
+			deadline: 20 * time.Second,
+			eRetry:   true,
+		},
+		"TimeOutShort": {
+			start:    time.Now().Add(-5*time.Minute + 20*time.Second).Format(time.RFC3339),
+			deadline: time.Minute,
+			eErr:     "insufficient time budget remaining",
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			if d.deadline != 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, d.deadline)
+				defer cancel()
+			}
+			retry, err := operationBudget(ctx, d.start, aws.Int(5))
+			if d.eErr != "" {
+				assert.Contains(t, err.Error(), d.eErr)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, d.eRetry, retry)
+		})
+	}
+}
+
+// TestRunWithContext is to test runWithContext
+func TestRunWithContext(t *testing.T) {
+	defer func(g time.Duration) { inFlightGrace = g }(inFlightGrace)
+	defer func() { InFlightOperation = "" }()
+	tests := map[string]struct {
+		fn          func() error
+		timeOut     time.Duration
+		grace       time.Duration
+		expectedErr string
+		inFlight    bool
+	}{
+		"Done": {
+			fn:      func() error { return nil },
+			timeOut: time.Second,
+		},
+		"Error": {
+			fn:          func() error { return assert.AnError },
+			timeOut:     time.Second,
+			expectedErr: assert.AnError.Error(),
+		},
+		"DoneInGrace": {
+			fn: func() error {
+				time.Sleep(50 * time.Millisecond)
+				return nil
+			},
+			timeOut: 10 * time.Millisecond,
+			grace:   time.Second,
+		},
+		"InFlight": {
+			fn: func() error {
+				time.Sleep(time.Second)
+				return nil
+			},
+			timeOut:     10 * time.Millisecond,
+			grace:       10 * time.Millisecond,
+			expectedErr: "operation cancelled near deadline during test, it may still be in flight",
+			inFlight:    true,
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			InFlightOperation = ""
+			inFlightGrace = d.grace
+			ctx, cancel := context.WithTimeout(context.Background(), d.timeOut)
+			defer cancel()
+			err := runWithContext(ctx, "test", d.fn)
+			if d.expectedErr != "" {
+				assert.Contains(t, err.Error(), d.expectedErr)
+			} else {
+				assert.Nil(t, err)
+			}
+			assert.Equal(t, d.inFlight, isInFlight(err))
+			if d.inFlight {
+				assert.True(t, errors.Is(err, context.DeadlineExceeded))
+				assert.Equal(t, "test", InFlightOperation)
+				assert.Equal(t, "test", inProgressEvent(&Model{}, ReleaseStabilize).CallbackContext["InFlight"])
+			}
+		})
+	}
+}
+
+// TestWipeFile is to test wipeFile
+func TestWipeFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "wipe")
+	assert.Nil(t, err)
+	_, _ = f.WriteString("secret")
+	f.Close()
+	tests := map[string]struct {
+		path string
+	}{
+		"Exists":    {path: f.Name()},
+		"NotExists": {path: "/nonExt"},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Nil(t, wipeFile(d.path))
+			_, err := os.Stat(d.path)
+			assert.True(t, os.IsNotExist(err))
+		})
+	}
+}
+
 // TestGetStage is to test getStage
 func TestGetStage(t *testing.T) {
 	st := time.Now().Format(time.RFC3339)
+	old := time.Now().Add(-30 * time.Minute).Format(time.RFC3339)
 	tests := map[string]struct {
 		context       map[string]interface{}
+		envTime       string
 		expectedStage Stage
 		expectedTime  string
 	}{
+		"Nil": {
+			envTime:       old,
+			expectedStage: InitStage,
+		},
 		"Init": {
 			context:       make(map[string]interface{}),
+			envTime:       old,
 			expectedStage: InitStage,
-			expectedTime:  st,
 		},
 		"Stage": {
 			context: map[string]interface{}{
@@ -456,17 +1097,57 @@ func TestGetStage(t *testing.T) {
 			expectedStage: InitStage,
 			expectedTime:  st,
 		},
+		"ColdStart": {
+			context: map[string]interface{}{
+				"Stage":     "ReleaseStabilize",
+				"StartTime": old,
+			},
+			envTime:       st,
+			expectedStage: ReleaseStabilize,
+			expectedTime:  old,
+		},
+		"ColdStartNoStage": {
+			context: map[string]interface{}{
+				"StartTime": old,
+			},
+			envTime:       st,
+			expectedStage: InitStage,
+			expectedTime:  old,
+		},
 	}
 	for name, d := range tests {
 		t.Run(name, func(t *testing.T) {
 			os.Setenv("StartTime", d.expectedTime)
+			if d.envTime != "" {
+				os.Setenv("StartTime", d.envTime)
+			}
 			result := getStage(d.context)
 			assert.EqualValues(t, d.expectedStage, result)
+			if d.expectedTime == "" {
+				start, err := time.Parse(time.RFC3339, os.Getenv("StartTime"))
+				assert.Nil(t, err)
+				assert.WithinDuration(t, time.Now(), start, 2*time.Second)
+				return
+			}
 			assert.EqualValues(t, d.expectedTime, os.Getenv("StartTime"))
 		})
 	}
 }
 
+// TestGetStageColdStart to test a reconcile resumed on a fresh container still times out
+func TestGetStageColdStart(t *testing.T) {
+	defer os.Unsetenv("StartTime")
+	m := &Model{Name: aws.String("test"), TimeOut: aws.Int(30)}
+	os.Setenv("StartTime", time.Now().Add(-50*time.Minute).Format(time.RFC3339))
+	e := inProgressEvent(m, ReleaseStabilize)
+	// A new container seeds StartTime at init.
+	os.Setenv("StartTime", time.Now().Format(time.RFC3339))
+	assert.EqualValues(t, ReleaseStabilize, getStage(e.CallbackContext))
+	res := makeEvent(m, ReleaseStabilize, nil)
+	assert.EqualValues(t, handler.Failed, res.OperationStatus)
+	assert.Contains(t, res.Message, "timed out")
+}
+
 // TestHash is to test getHash
 func TestHash(t *testing.T) {
 	str := "Test"
@@ -678,3 +1359,39 @@ func TestPopLastKnownError(t *testing.T) {
 		})
 	}
 }
+
+func TestIsReleaseNotFound(t *testing.T) {
+	tests := map[string]struct {
+		err      error
+		expected bool
+	}{
+		"Driver": {
+			err:      driver.ErrReleaseNotFound,
+			expected: true,
+		},
+		"Uninstall": {
+			err:      fmt.Errorf("uninstall: Release not loaded: test: release: not found"),
+			expected: true,
+		},
+		"Upgrade": {
+			err:      fmt.Errorf("\"test\" has no deployed releases"),
+			expected: true,
+		},
+		"Connector": {
+			err:      fmt.Errorf("Error: At Helm Status - Release: Not Found"),
+			expected: true,
+		},
+		"Other": {
+			err:      fmt.Errorf("namespaces \"test\" not found"),
+			expected: false,
+		},
+		"Nil": {
+			expected: false,
+		},
+	}
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, d.expected, isReleaseNotFound(d.err))
+		})
+	}
+}
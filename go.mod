@@ -4,9 +4,10 @@ go 1.13
 
 require (
 	github.com/aws-cloudformation/cloudformation-cli-go-plugin v1.0.1-0.20200827221319-c1261e85f57d
-	github.com/aws/aws-lambda-go v1.17.0
+	github.com/aws/aws-lambda-go v1.18.0
 	github.com/aws/aws-sdk-go v1.31.12
-	github.com/evanphx/json-patch v4.5.0+incompatible // indirect
+	github.com/aws/aws-xray-sdk-go v1.0.1
+	github.com/evanphx/json-patch v4.5.0+incompatible
 	github.com/gofrs/flock v0.7.1
 	github.com/golang/protobuf v1.3.5 // indirect
 	github.com/googleapis/gnostic v0.3.1 // indirect
@@ -17,6 +18,7 @@ require (
 	github.com/stretchr/testify v1.6.1
 	golang.org/x/net v0.0.0-20200324143707-d3edc9973b7e // indirect
 	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
+	gopkg.in/yaml.v2 v2.3.0
 	helm.sh/helm/v3 v3.3.1
 	k8s.io/api v0.18.8
 	k8s.io/apiextensions-apiserver v0.18.8
@@ -10,8 +10,9 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 )
 
-func HandleRequest(_ context.Context, e resource.Event) (*resource.LambdaResponse, error) {
+func HandleRequest(ctx context.Context, e resource.Event) (*resource.LambdaResponse, error) {
 	defer resource.LogPanic()
+	defer resource.CleanupTempFiles()
 
 	res := &resource.LambdaResponse{}
 	eJson, err := json.Marshal(e)
@@ -19,16 +20,29 @@ func HandleRequest(_ context.Context, e resource.Event) (*resource.LambdaRespons
 		fmt.Println(err)
 	}
 	fmt.Println(string(eJson))
+	// Answered before any setup so a ping only checks the connector is reachable.
+	if e.Action == resource.PingAction {
+		return res, nil
+	}
 	data, err := resource.DecodeID(e.Model.ID)
 	if err != nil {
 		return nil, err
 	}
 
 	fmt.Println("starting invocation...")
-	client, err := resource.NewClients(nil, nil, data.Namespace, nil, nil, e.Kubeconfig, nil)
+	client, err := resource.NewClients(nil, nil, data.Namespace, nil, nil, nil, e.Kubeconfig, nil, e.Model.KubeContext, false)
 	if err != nil {
 		return nil, err
 	}
+	if err := client.UseStorageNamespace(data.StorageNamespace); err != nil {
+		return nil, err
+	}
+	ctx, cancel := resource.WithInvocationDeadline(ctx)
+	defer cancel()
+	client.WithContext(ctx)
+	if err := client.CheckClusterAccess(); err != nil {
+		return nil, err
+	}
 
 	switch e.Action {
 	case resource.InstallReleaseAction:
@@ -52,16 +66,44 @@ func HandleRequest(_ context.Context, e resource.Event) (*resource.LambdaRespons
 		return nil, client.HelmUpgrade(aws.StringValue(data.Name), e.Inputs.Config, e.Inputs.ValueOpts, e.Inputs.ChartDetails)
 	case resource.UninstallReleaseAction:
 		fmt.Println("UninstallReleaseAction")
-		return nil, client.HelmUninstall(aws.StringValue(data.Name))
+		return nil, client.HelmUninstall(aws.StringValue(data.Name), e.Inputs.Config)
+	case resource.CheckDeletedAction:
+		fmt.Println("CheckDeletedAction")
+		res.PendingResources, err = client.CheckPendingDeletion(e.ReleaseData)
+		res.LastKnownErrors = resource.LastKnownErrors
+		return res, err
+	case resource.GetDiagnosticsAction:
+		fmt.Println("GetDiagnosticsAction")
+		res.Diagnostics, err = client.GetDiagnostics(e.ReleaseData)
+		return res, err
+	case resource.UnlockReleaseAction:
+		fmt.Println("UnlockReleaseAction")
+		return nil, client.HelmUnlock(aws.StringValue(data.Name))
 	case resource.ListReleaseAction:
 		fmt.Println("ListReleaseAction")
-		res.ListData, err = client.HelmList(e.Inputs.Config, e.Inputs.ChartDetails)
+		res.ListData, res.ListWarnings, err = client.HelmList(e.Inputs.Config, e.Inputs.ChartDetails)
 		return res, err
 	default:
 		return nil, fmt.Errorf("Unhandled stage %s", e.Action)
 	}
 }
 
+// handleChecked fails responses over the payload limit with a clear error instead of Lambda's own. Errors are
+// returned in the response with their failure reason for the provider to report.
+func handleChecked(ctx context.Context, e resource.Event) (*resource.LambdaResponse, error) {
+	res, err := HandleRequest(ctx, e)
+	if err != nil {
+		return resource.ErrorResponse(err), nil
+	}
+	if res == nil {
+		return res, nil
+	}
+	if err := resource.CheckPayloadSize(e.Action, res); err != nil {
+		return resource.ErrorResponse(err), nil
+	}
+	return res, nil
+}
+
 func main() {
-	lambda.Start(HandleRequest)
+	lambda.Start(handleChecked)
 }
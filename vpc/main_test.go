@@ -100,7 +100,7 @@ func TestHandler(t *testing.T) {
 			eError: aws.String("At Json Unmarshal"),
 		},
 	}
-	resource.NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, role *string, customKubeconfig []byte, vpcConfig *resource.VPCConfiguration) (*resource.Clients, error) {
+	resource.NewClients = func(cluster *string, kubeconfig *string, namespace *string, ses *session.Session, region *string, role *string, customKubeconfig []byte, vpcConfig *resource.VPCConfiguration, kubeContext *string, insecure bool) (*resource.Clients, error) {
 		return resource.NewMockClient(t, nil), nil
 	}
 	for name, d := range tests {
@@ -114,3 +114,18 @@ func TestHandler(t *testing.T) {
 		})
 	}
 }
+
+// TestHandleChecked to test errors are returned with their failure reason
+func TestHandleChecked(t *testing.T) {
+	res, err := handleChecked(context.Background(), resource.Event{
+		Action: resource.CheckReleaseAction,
+		Model:  &resource.Model{ID: aws.String("test")},
+	})
+	assert.Nil(t, err)
+	assert.Contains(t, res.Error, "At Json Unmarshal")
+	assert.Equal(t, resource.InternalFailure, res.FailureReason)
+
+	res, err = handleChecked(context.Background(), resource.Event{Action: resource.PingAction})
+	assert.Nil(t, err)
+	assert.Empty(t, res.Error)
+}